@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// accessControl restricts who may make requests by their IP address,
+// with -allow and -deny lists for the whole server and for paths. An
+// address must be in every allow list that applies, when there are any,
+// and in none of the deny lists.
+type accessControl struct {
+	allow []netip.Prefix
+	deny []netip.Prefix
+	rules []accessRule
+	status int
+}
+
+// accessRule is an allow or deny list for the paths matching pattern.
+type accessRule struct {
+	pattern string
+	allow bool
+	prefixes []netip.Prefix
+}
+
+// parseIPList parses comma-separated CIDRs or single addresses.
+func parseIPList(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		if addr, err := netip.ParseAddr(field); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR %q", field)
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+func ipListContains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remoteAddr returns the IP address of the client of request, which is
+// invalid if it can't be parsed.
+func remoteAddr(request *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
+
+// forwardedClient returns the address of the client a trusted proxy
+// passed request on for, from X-Forwarded-For or else X-Real-IP. The
+// addresses in X-Forwarded-For are added by each proxy in turn, so the
+// client is the last one not of a trusted proxy; those before it could
+// have been made up by the client. It returns false when request didn't
+// come from a trusted proxy, or the proxy didn't say.
+func forwardedClient(request *http.Request, trusted []netip.Prefix) (netip.Addr, bool) {
+	peer := remoteAddr(request)
+	if !ipListContains(trusted, peer) {
+		return netip.Addr{}, false
+	}
+
+	var hops []string
+	for _, header := range request.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	if len(hops) == 0 {
+		hops = request.Header.Values("X-Real-IP")
+	}
+
+	client := netip.Addr{}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+
+		client = addr.Unmap()
+		if !ipListContains(trusted, client) {
+			break
+		}
+	}
+
+	return client, client.IsValid()
+}
+
+// permits reports whether addr may request urlPath, and if not, which
+// list it was refused by.
+func (c *accessControl) permits(addr netip.Addr, urlPath string, opts *serverOptions) (bool, string) {
+	if !addr.IsValid() {
+		return false, "unknown client address"
+	}
+
+	if ipListContains(c.deny, addr) {
+		return false, "-deny"
+	}
+
+	if len(c.allow) > 0 && !ipListContains(c.allow, addr) {
+		return false, "-allow"
+	}
+
+	for _, rule := range c.rules {
+		if !pathMatchesAny([]string{rule.pattern}, urlPath, opts) {
+			continue
+		}
+
+		if rule.allow && !ipListContains(rule.prefixes, addr) {
+			return false, "-allow-path " + rule.pattern
+		}
+
+		if !rule.allow && ipListContains(rule.prefixes, addr) {
+			return false, "-deny-path " + rule.pattern
+		}
+	}
+
+	return true, ""
+}
+
+// check lets request through if its client is permitted, and otherwise
+// answers it with the configured 403 or 404.
+func (c *accessControl) check(writer http.ResponseWriter, request *http.Request, opts *serverOptions) bool {
+	ok, list := c.permits(remoteAddr(request), request.URL.Path, opts)
+	if ok {
+		return true
+	}
+
+	requestTraceFrom(request.Context()).note("access", "refused by %s, %d", list, c.status)
+
+	if c.status == 404 {
+		http.Error(writer, "File not found", 404)
+	} else {
+		http.Error(writer, "Forbidden", 403)
+	}
+
+	return false
+}
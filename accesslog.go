@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLog appends the access log to a file, moving it aside to a name
+// with the time appended once it grows past maxSize or every interval,
+// when those are set, so that e.g. -log-retention-files 'access.log.*'
+// can prune the old ones. It can also be reopened, for logrotate, which
+// moves the file aside itself and signals the server.
+type accessLog struct {
+	path string
+	maxSize int64
+	interval time.Duration
+
+	mu sync.Mutex
+	file *os.File
+	size int64
+	opened time.Time
+}
+
+func openAccessLog(path string, maxSize int64, interval time.Duration) (*accessLog, error) {
+	l := &accessLog{path: path, maxSize: maxSize, interval: interval}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *accessLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if l.file != nil {
+		l.file.Close()
+	}
+
+	l.file, l.size, l.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// reopen opens the file at the log's path again, after logrotate moved
+// the old one aside.
+func (l *accessLog) reopen() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.open(); err != nil {
+		fmt.Fprintln(os.Stderr, "unable to reopen access log: ", err)
+	}
+}
+
+// rotate moves the file aside, to a name that isn't taken yet, and starts
+// a new one.
+func (l *accessLog) rotate(now time.Time) error {
+	rotated := l.path + "." + now.Format("20060102-150405")
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(rotated); os.IsNotExist(err) {
+			break
+		}
+
+		rotated = fmt.Sprintf("%s.%s-%d", l.path, now.Format("20060102-150405"), i)
+	}
+
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+func (l *accessLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// the interval starts at midnight UTC for daily rotation, on the
+	// hour for hourly, and so on.
+	now := time.Now()
+	if l.maxSize > 0 && l.size > 0 && l.size + int64(len(p)) > l.maxSize ||
+	   l.interval > 0 && !now.Truncate(l.interval).Equal(l.opened.Truncate(l.interval)) {
+		if err := l.rotate(now); err != nil {
+			fmt.Fprintln(os.Stderr, "unable to rotate access log: ", err)
+
+			// tried again after the next interval or size.
+			l.size, l.opened = 0, now
+		}
+	}
+
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+type logFieldsKey struct{}
+
+// logFields collects what is found out about a request while serving it
+// that goes into its log line and metrics, such as the user it was
+// authenticated as.
+type logFields struct {
+	user string
+	requestID string
+
+	// whether the request came with valid credentials, and the paths a
+	// token with them was restricted to, if it was.
+	authenticated bool
+	scope []string
+
+	// the size of a compressed response's file, and whether it came from
+	// a cache: "hit", "miss" or "" where none was asked.
+	uncompressed int64
+	cache string
+}
+
+func withLogFields(ctx context.Context, fields *logFields) context.Context {
+	return context.WithValue(ctx, logFieldsKey{}, fields)
+}
+
+func logFieldsFrom(ctx context.Context) *logFields {
+	fields, _ := ctx.Value(logFieldsKey{}).(*logFields)
+	return fields
+}
+
+func (f *logFields) setUser(user string) {
+	if f != nil {
+		f.user = user
+	}
+}
+
+// setAuthenticated notes that the request's credentials were accepted,
+// for user and, unless scope is nil, only the paths in it.
+func (f *logFields) setAuthenticated(user string, scope []string) {
+	if f != nil {
+		f.user, f.authenticated, f.scope = user, true, scope
+	}
+}
+
+func (f *logFields) setUncompressed(n int64) {
+	if f != nil {
+		f.uncompressed = n
+	}
+}
+
+func (f *logFields) setCache(result string) {
+	if f != nil {
+		f.cache = result
+	}
+}
+
+// logEntry is what the access log says about a request.
+type logEntry struct {
+	time time.Time
+
+	// how long the request took in all, and until the response started.
+	duration time.Duration
+	ttfb time.Duration
+	client string
+	user string
+	method string
+	uri string
+	host string
+	proto string
+	status int
+	bytes int64
+	referer string
+	userAgent string
+	requestID string
+
+	// the size of a compressed response before compression, or 0.
+	uncompressed int64
+
+	// the bytes sent of an aborted transfer and the expected ones, or "-".
+	aborted bool
+	expected string
+}
+
+// the formats of the access log: the server's own, Apache's Common and
+// Combined Log Formats, which log analyzers such as GoAccess and AWStats
+// read as they are, and JSON lines for log stores like Loki or
+// Elasticsearch.
+var logFormats = []string {"default", "common", "combined", "json"}
+
+// jsonLogEntry is a line of the access log in JSON.
+type jsonLogEntry struct {
+	Time string `json:"time"`
+	Client string `json:"client"`
+	User string `json:"user,omitempty"`
+	Method string `json:"method"`
+	URI string `json:"uri"`
+	Host string `json:"host"`
+	Proto string `json:"proto"`
+	Status int `json:"status"`
+	Bytes int64 `json:"bytes"`
+	BytesUncompressed int64 `json:"bytes_uncompressed,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+	TTFBMs float64 `json:"ttfb_ms"`
+	Referer string `json:"referer,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	RequestID string `json:"request_id"`
+	Aborted bool `json:"aborted,omitempty"`
+}
+
+// milliseconds returns d in milliseconds, to the microsecond.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// format returns the log line of e in format.
+func (e *logEntry) format(format string) string {
+	if format == "json" {
+		line, _ := json.Marshal(jsonLogEntry{
+			Time: e.time.UTC().Format(time.RFC3339Nano),
+			Client: e.client,
+			User: e.user,
+			Method: e.method,
+			URI: e.uri,
+			Host: e.host,
+			Proto: e.proto,
+			Status: e.status,
+			Bytes: e.bytes,
+			BytesUncompressed: e.uncompressed,
+			DurationMs: milliseconds(e.duration),
+			TTFBMs: milliseconds(e.ttfb),
+			Referer: e.referer,
+			UserAgent: e.userAgent,
+			RequestID: e.requestID,
+			Aborted: e.aborted,
+		})
+
+		return string(line) + "\n"
+	}
+
+	if format == "default" {
+		notes := fmt.Sprintf(" time=%.3fms ttfb=%.3fms", milliseconds(e.duration), milliseconds(e.ttfb))
+		if e.uncompressed > 0 {
+			notes += fmt.Sprintf(" uncompressed=%d", e.uncompressed)
+		}
+
+		if e.aborted {
+			notes += fmt.Sprintf(" aborted %d/%s", e.bytes, e.expected)
+		}
+
+		return fmt.Sprintf(
+			"%v %#v %v %#v %v %v %#v %#v %v%s\n",
+			e.client,
+			e.time.Format(time.RFC822Z),
+			e.method,
+			e.uri,
+			e.status,
+			e.bytes,
+			e.referer,
+			e.userAgent,
+			e.requestID,
+			notes,
+		)
+	}
+
+	user, bytes := "-", "-"
+	if e.user != "" {
+		user = clfEscape(e.user)
+	}
+
+	if e.bytes > 0 {
+		bytes = fmt.Sprint(e.bytes)
+	}
+
+	line := fmt.Sprintf(
+		`%s - %s [%s] "%s %s %s" %d %s`,
+		e.client,
+		user,
+		e.time.Format("02/Jan/2006:15:04:05 -0700"),
+		clfEscape(e.method),
+		clfEscape(e.uri),
+		e.proto,
+		e.status,
+		bytes,
+	)
+
+	if format == "combined" {
+		referer, userAgent := "-", "-"
+		if e.referer != "" {
+			referer = clfEscape(e.referer)
+		}
+
+		if e.userAgent != "" {
+			userAgent = clfEscape(e.userAgent)
+		}
+
+		line += fmt.Sprintf(` "%s" "%s"`, referer, userAgent)
+	}
+
+	return line + "\n"
+}
+
+// clfEscape escapes quotes, backslashes and control characters the way
+// Apache does, so that a field can't break out of its quotes.
+func clfEscape(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// reopenOnSignal does nothing, as there is no SIGUSR1 to reopen on.
+func reopenOnSignal(log *accessLog) {}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reopenOnSignal reopens log whenever the process gets a SIGUSR1, as
+// logrotate's postrotate script sends.
+func reopenOnSignal(log *accessLog) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	go func() {
+		for range signals {
+			log.reopen()
+		}
+	}()
+}
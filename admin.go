@@ -0,0 +1,69 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+)
+
+// adminHandler serves the admin endpoints, which are only reachable on
+// the separate -admin-listen address, never next to the content. With
+// -admin-auth-file, all but the health checks ask for Basic credentials
+// from that file.
+func adminHandler(opts *serverOptions) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/_debug/trace", func(writer http.ResponseWriter, request *http.Request) {
+		serveTrace(writer, request, opts)
+	})
+
+	if opts.metrics != nil && opts.metricsPath != "" {
+		mux.HandleFunc(opts.metricsPath, opts.metrics.serveMetrics)
+	}
+
+	if opts.stats != nil {
+		mux.HandleFunc("/stats", func(writer http.ResponseWriter, request *http.Request) {
+			serveStatsPage(writer, request, opts.stats)
+		})
+	}
+
+	// CPU and heap profiles for go tool pprof, and the runtime's memory
+	// statistics with the state of background jobs as JSON.
+	if opts.adminDebug {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		expvar.Publish("subsystems", expvar.Func(func() any {
+			return subsystems.status()
+		}))
+
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
+
+	if opts.adminUsers == nil {
+		mux.HandleFunc("/healthz", opts.health.serveHealth)
+		mux.HandleFunc("/readyz", opts.health.serveReady)
+		return mux
+	}
+
+	// probes can't log in, so the health endpoints are left open.
+	outer := http.NewServeMux()
+	outer.HandleFunc("/healthz", opts.health.serveHealth)
+	outer.HandleFunc("/readyz", opts.health.serveReady)
+
+	outer.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
+		user, password, ok := request.BasicAuth()
+		if !ok || !opts.adminUsers.verify(user, password) {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+			http.Error(writer, "Unauthorized", 401)
+			return
+		}
+
+		mux.ServeHTTP(writer, request)
+	})
+
+	return outer
+}
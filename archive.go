@@ -0,0 +1,333 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// archiveFormats maps the ?archive= values to their content types.
+var archiveFormats = map[string]string {
+	"zip": "application/zip",
+	"tar.gz": "application/gzip",
+}
+
+// serveArchive streams the directory at path as a zip or gzipped tar
+// archive, one file at a time. Hidden files, directories that can't be
+// listed and what the client couldn't request by itself are left out,
+// and so are symlinks to directories, which could form loops.
+func serveArchive(
+	writer http.ResponseWriter,
+	request *http.Request,
+	path string,
+	format string,
+	opts *serverOptions,
+) {
+	ctx := request.Context()
+
+	name := filepath.Base(path)
+	if path == "." {
+		name = "site"
+	}
+
+	writer.Header().Set("Content-Type", archiveFormats[format])
+	writer.Header().Set("Content-Disposition", contentDisposition(name + "." + format))
+
+	dir := archiveDir{
+		ctx: ctx,
+		path: path,
+		urlPath: request.URL.Path,
+		opts: opts,
+		access: newArchiveAccess(request, opts),
+	}
+
+	var err error
+	if format == "zip" {
+		err = writeZipArchive(writer, dir, name)
+	} else {
+		err = writeTarArchive(writer, dir, name)
+	}
+
+	// the response has started, so the archive is left without its
+	// trailer, which clients detect as a truncated download.
+	if err != nil && ctx.Err() == nil {
+		errorLog.print(request, "unable to write archive of %s: %v", path, err)
+	}
+}
+
+// archiveDir is a directory being archived.
+type archiveDir struct {
+	ctx context.Context
+	path string
+	urlPath string
+	opts *serverOptions
+	access *archiveAccess
+}
+
+// archiveAccess decides which of the files and directories under the one
+// requested go into its archive or tree: only those the client could have
+// requested one at a time. The request itself has been let in, and with
+// it whatever credentials it had; paths that need credentials it didn't
+// give are left out rather than asked for. A signature covers exactly
+// the directory's URL, which lets the request in but vouches for nothing
+// in it, so paths that need one or credentials are left out of signed
+// archives too.
+type archiveAccess struct {
+	request *http.Request
+	opts *serverOptions
+	addr netip.Addr
+	country string
+}
+
+func newArchiveAccess(request *http.Request, opts *serverOptions) *archiveAccess {
+	a := &archiveAccess{
+		request: request,
+		opts: opts,
+		addr: remoteAddr(request),
+	}
+
+	// the lookup worked when the request was let in, so a failure now
+	// leaves out whatever the country lists cover.
+	if opts.geoAccess != nil {
+		country, err := opts.geoAccess.db.country(a.addr)
+		if err == nil && country == "" {
+			country = "--"
+		}
+
+		a.country = country
+	}
+
+	return a
+}
+
+// permits reports whether the file or directory at urlPath may be
+// included.
+func (a *archiveAccess) permits(urlPath string) bool {
+	opts := a.opts
+
+	if opts.access != nil {
+		if ok, _ := opts.access.permits(a.addr, urlPath, opts); !ok {
+			return false
+		}
+	}
+
+	if opts.geoAccess != nil {
+		if ok, _ := opts.geoAccess.permits(a.country, urlPath, opts); a.country == "" || !ok {
+			return false
+		}
+	}
+
+	if opts.signedURLs != nil && pathMatchesAny(opts.signedURLs.paths, urlPath, opts) {
+		return false
+	}
+
+	if opts.auth != nil && opts.auth.protects(urlPath, opts) && !a.authenticated(urlPath) {
+		return false
+	}
+
+	return true
+}
+
+// permitsDir reports whether the directory at path, with urlPath, may be
+// included, which its .gohttpd file has a say in as well: not when it
+// refuses the client, needs credentials the request didn't give or turns
+// listings off.
+func (a *archiveAccess) permitsDir(ctx context.Context, path string, urlPath string) (bool, error) {
+	if !a.permits(urlPath) {
+		return false, nil
+	}
+
+	if a.opts.dirRules == nil {
+		return true, nil
+	}
+
+	rules, err := a.opts.dirRules.get(ctx, path)
+	if err != nil || rules == nil {
+		return err == nil, err
+	}
+
+	if !rules.permits(a.addr) || rules.listDir != nil && !*rules.listDir {
+		return false, nil
+	}
+
+	return rules.requireAuth == nil || !*rules.requireAuth || a.authenticated(urlPath), nil
+}
+
+// authenticated reports whether the request came with credentials that
+// are valid for urlPath.
+func (a *archiveAccess) authenticated(urlPath string) bool {
+	fields := logFieldsFrom(a.request.Context())
+	return fields != nil && fields.authenticated &&
+		(fields.scope == nil || pathMatchesAny(fields.scope, urlPath, a.opts))
+}
+
+// walkArchive calls fn for every file and directory under dir, with its
+// name in the archive; fn returns fs.SkipDir to leave out a directory's
+// contents.
+func walkArchive(
+	dir archiveDir,
+	name string,
+	fn func(path string, name string, info os.FileInfo) error,
+) error {
+	ctx := dir.ctx
+
+	entries, err := dir.opts.storage.ReadDirEntries(ctx, dir.path)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if isHiddenPath(entry.Name()) {
+			continue
+		}
+
+		path := filepath.Join(dir.path, entry.Name())
+		info, err := dir.opts.storage.Stat(ctx, path)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		entryName := name + "/" + entry.Name()
+		entryURLPath := strings.TrimSuffix(dir.urlPath, "/") + "/" + entry.Name()
+
+		if info.IsDir() {
+			subdir := dir
+			subdir.path = path
+			subdir.urlPath = entryURLPath + "/"
+
+			if entry.Type() & os.ModeSymlink != 0 ||
+			   !listingAllowed(ctx, subdir.path, subdir.urlPath, dir.opts) {
+				continue
+			}
+
+			permitted, err := dir.access.permitsDir(ctx, subdir.path, subdir.urlPath)
+			if err != nil {
+				return err
+			}
+
+			if !permitted {
+				continue
+			}
+
+			err = fn(path, entryName, info)
+			if err == fs.SkipDir {
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if err := walkArchive(subdir, entryName, fn); err != nil {
+				return err
+			}
+		} else if info.Mode().IsRegular() && dir.access.permits(entryURLPath) {
+			if err := fn(path, entryName, info); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func writeZipArchive(w io.Writer, dir archiveDir, name string) error {
+	zw := zip.NewWriter(w)
+
+	err := walkArchive(dir, name, func(path string, name string, info os.FileInfo) error {
+		header := &zip.FileHeader{Name: name, Modified: info.ModTime()}
+		header.SetMode(info.Mode())
+
+		if info.IsDir() {
+			header.Name += "/"
+			_, err := zw.CreateHeader(header)
+			return err
+		}
+
+		// like responses, only text formats are worth compressing.
+		if stringInSlice(strings.TrimPrefix(filepath.Ext(name), "."), compressExts) {
+			header.Method = zip.Deflate
+		}
+
+		entryWriter, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		file, err := dir.opts.storage.Open(dir.ctx, path)
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		_, err = io.Copy(entryWriter, file)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+func writeTarArchive(w io.Writer, dir archiveDir, name string) error {
+	gw, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	tw := tar.NewWriter(gw)
+
+	err := walkArchive(dir, name, func(path string, name string, info os.FileInfo) error {
+		header := &tar.Header{
+			Name: name,
+			Mode: int64(info.Mode().Perm()),
+			ModTime: info.ModTime(),
+			Typeflag: tar.TypeReg,
+			Size: info.Size(),
+		}
+
+		if info.IsDir() {
+			header.Name += "/"
+			header.Typeflag = tar.TypeDir
+			header.Size = 0
+			return tw.WriteHeader(header)
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		file, err := dir.opts.storage.Open(dir.ctx, path)
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		// the size is in the header already, so a file that changed
+		// since can't be archived.
+		_, err = io.CopyN(tw, file, info.Size())
+		return err
+	})
+
+	if err == nil {
+		err = tw.Close()
+	}
+
+	if err == nil {
+		err = gw.Close()
+	}
+
+	return err
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newArchiveTestServer serves a directory with a public file and a
+// private one under /private, which needs the password of bob.
+func newArchiveTestServer(t *testing.T) (*httptest.Server, *serverOptions) {
+	home := t.TempDir()
+
+	files := map[string]string {
+		"public.txt": "public",
+		"private/s.txt": "secret",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(home, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// bob:secret
+	passwords := filepath.Join(t.TempDir(), "htpasswd")
+	err := os.WriteFile(passwords, []byte("bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := loadHtpasswd(passwords)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := newFileStore(home, "off")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limits, err := newBodyLimits("1M", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &serverOptions{
+		storage: storage,
+		listDir: true,
+		archives: true,
+		treeDepth: 8,
+		quiet: true,
+		bodyLimits: limits,
+		auth: &auth{realm: "test", paths: []string{"/private"}, users: users},
+	}
+
+	server := httptest.NewServer(handlerWrap(requestHandler, opts))
+	t.Cleanup(server.Close)
+
+	return server, opts
+}
+
+// archiveNames requests the tar.gz archive of the root with the Basic
+// credentials of user, if given, and returns the names in it.
+func archiveNames(t *testing.T, server *httptest.Server, user string, password string) []string {
+	request, err := http.NewRequest("GET", server.URL + "/?archive=tar.gz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user != "" {
+		request.SetBasicAuth(user, password)
+	}
+
+	return archiveNamesFor(t, server, request)
+}
+
+func archiveNamesFor(t *testing.T, server *httptest.Server, request *http.Request) []string {
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		t.Fatalf("got status %d, expected 200", response.StatusCode)
+	}
+
+	gr, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	tr := tar.NewReader(gr)
+
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+
+		names = append(names, header.Name)
+	}
+
+	return names
+}
+
+func TestArchiveLeavesOutProtectedPaths(t *testing.T) {
+	server, _ := newArchiveTestServer(t)
+
+	names := archiveNames(t, server, "", "")
+	if !slices.Contains(names, "site/public.txt") {
+		t.Errorf("archive %v is missing site/public.txt", names)
+	}
+
+	for _, name := range names {
+		if name == "site/private/" || name == "site/private/s.txt" {
+			t.Errorf("archive without credentials has %s", name)
+		}
+	}
+}
+
+func TestArchiveIncludesPathsAuthenticatedFor(t *testing.T) {
+	server, opts := newArchiveTestServer(t)
+
+	// the whole server is protected, so the archive's request has
+	// to authenticate, which then covers the private directory.
+	opts.auth.paths = nil
+
+	names := archiveNames(t, server, "bob", "secret")
+	if !slices.Contains(names, "site/private/s.txt") {
+		t.Errorf("archive %v is missing site/private/s.txt", names)
+	}
+}
+
+func TestTreeLeavesOutProtectedPaths(t *testing.T) {
+	server, _ := newArchiveTestServer(t)
+
+	for _, url := range []string{"/..tree", "/?recursive=1&format=json"} {
+		response, err := server.Client().Get(server.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response.StatusCode != 200 {
+			t.Fatalf("%s: got status %d, expected 200", url, response.StatusCode)
+		}
+
+		if strings.Contains(string(body), "s.txt") {
+			t.Errorf("%s lists the private file: %s", url, body)
+		}
+	}
+}
+
+func TestArchiveLeavesOutDeniedPaths(t *testing.T) {
+	server, opts := newArchiveTestServer(t)
+	opts.auth = nil
+
+	loopback, err := parseIPList("127.0.0.0/8,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.access = &accessControl{
+		rules: []accessRule{{pattern: "/private", prefixes: loopback}},
+		status: 403,
+	}
+
+	for _, name := range archiveNames(t, server, "", "") {
+		if name == "site/private/" || name == "site/private/s.txt" {
+			t.Errorf("archive for a denied client has %s", name)
+		}
+	}
+}
+
+func TestArchiveLeavesOutDirectoriesRefusedByRules(t *testing.T) {
+	server, opts := newArchiveTestServer(t)
+	opts.auth = nil
+	opts.dirRules = newDirRulesCache(opts.storage)
+
+	rules := filepath.Join(opts.storage.home, "private", dirRulesFile)
+	if err := os.WriteFile(rules, []byte("deny all\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range archiveNames(t, server, "", "") {
+		if name == "site/private/" || name == "site/private/s.txt" {
+			t.Errorf("archive with private/ denied by its rules has %s", name)
+		}
+	}
+}
+
+func TestArchiveLeavesOutUnsignedPaths(t *testing.T) {
+	server, opts := newArchiveTestServer(t)
+	opts.auth = nil
+	opts.signedURLs = &signedURLs{key: make([]byte, 32), paths: []string{"/private"}}
+
+	for _, name := range archiveNames(t, server, "", "") {
+		if name == "site/private/" || name == "site/private/s.txt" {
+			t.Errorf("unsigned archive has %s", name)
+		}
+	}
+}
+
+func TestArchiveIncludesPathsWithSession(t *testing.T) {
+	server, opts := newArchiveTestServer(t)
+
+	client := &oidcClient{callbackPath: "/.oidc/callback", key: make([]byte, 32)}
+	opts.auth = &auth{paths: []string{"/private"}, oidc: client}
+
+	names := archiveNames(t, server, "", "")
+	if slices.Contains(names, "site/private/s.txt") {
+		t.Errorf("archive without a session has site/private/s.txt")
+	}
+
+	// logged in, with the whole server protected.
+	opts.auth.paths = nil
+
+	request, err := http.NewRequest("GET", server.URL + "/?archive=tar.gz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := oidcSession{User: "bob", Expires: time.Now().Add(time.Hour).Unix()}
+	request.AddCookie(&http.Cookie{
+		Name: oidcSessionCookie,
+		Value: client.signCookie("session", session),
+	})
+
+	names = archiveNamesFor(t, server, request)
+	if !slices.Contains(names, "site/private/s.txt") {
+		t.Errorf("archive %v with a session is missing site/private/s.txt", names)
+	}
+}
+
+func TestSignedArchiveLeavesOutWhatTheSignatureDoesNotCover(t *testing.T) {
+	server, opts := newArchiveTestServer(t)
+	key := make([]byte, 32)
+
+	for _, paths := range [][]string{nil, {"/private"}} {
+		opts.signedURLs = &signedURLs{key: key, paths: paths}
+
+		query := signURL(key, "/", time.Now().Add(time.Hour))
+		request, err := http.NewRequest("GET", server.URL + "/?archive=tar.gz&" + query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := archiveNamesFor(t, server, request)
+		if !slices.Contains(names, "site/public.txt") {
+			t.Errorf("signed archive %v is missing site/public.txt", names)
+		}
+
+		if slices.Contains(names, "site/private/s.txt") {
+			t.Errorf("archive signed for / has site/private/s.txt with signed paths %v", paths)
+		}
+	}
+}
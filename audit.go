@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// auditLog writes a JSON line for every request that was refused, kept
+// apart from the access log so that security monitoring doesn't have to
+// pick them out from among ordinary 404s.
+type auditLog struct {
+	mu sync.Mutex
+	out io.Writer
+}
+
+// auditRecord is a line of the audit log. Stage and Rule are the last
+// decision noted while serving the request, which is what refused it.
+type auditRecord struct {
+	Time string `json:"time"`
+	Client string `json:"client"`
+	Method string `json:"method"`
+	URI string `json:"uri"`
+	Host string `json:"host"`
+	Status int `json:"status"`
+	Stage string `json:"stage"`
+	Rule string `json:"rule"`
+	UserAgent string `json:"user_agent,omitempty"`
+	RequestID string `json:"request_id"`
+}
+
+// openAuditLog appends to the file at path, or writes to the standard
+// error for "-".
+func openAuditLog(path string) (*auditLog, error) {
+	if path == "-" {
+		return &auditLog{out: os.Stderr}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditLog{out: file}, nil
+}
+
+// audited reports whether responses of status are refusals that go into
+// the audit log: missing or rejected credentials, refused clients and
+// methods, oversized requests and rate limits.
+func audited(status int) bool {
+	switch status {
+	case 401, 403, 405, 413, 429:
+		return true
+	}
+
+	return false
+}
+
+func (a *auditLog) record(record auditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.out.Write(append(line, '\n'))
+}
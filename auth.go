@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// auth asks for the credentials of a user in an htpasswd file before
+// serving the paths it protects: everything, or only what matches one of
+// its path prefixes or globs. The credentials are sent with the Basic
+// scheme, or with Digest when nonces is set; with tokens set, requests
+// carry a bearer token instead, and with oidc set, a session cookie from
+// logging in with an OpenID Connect provider.
+type auth struct {
+	realm string
+	paths []string
+	users *htpasswdFile
+	nonces *digestNonces
+	tokens *jwtVerifier
+	oidc *oidcClient
+}
+
+// protects reports whether urlPath needs credentials. Paths are compared
+// the way they are resolved to files, so that e.g. a differently
+// normalized or, with -case-insensitive, differently cased URL can't get
+// around the check.
+func (a *auth) protects(urlPath string, opts *serverOptions) bool {
+	return len(a.paths) == 0 || pathMatchesAny(a.paths, urlPath, opts)
+}
+
+// pathMatchesAny reports whether urlPath matches one of patterns, as
+// prefixes or globs, compared the way protects describes.
+func pathMatchesAny(patterns []string, urlPath string, opts *serverOptions) bool {
+	urlPath = normalizeName(path.Clean("/" + urlPath), opts.normalize)
+	if strings.HasSuffix(urlPath, treeSuffix) {
+		urlPath = strings.TrimSuffix(urlPath, treeSuffix)
+	}
+
+	for _, pattern := range patterns {
+		pattern = normalizeName(pattern, opts.normalize)
+
+		if pathMatches(pattern, urlPath) || pathMatches(pattern, urlPath + "/") ||
+		   opts.caseInsensitive && pathMatches(strings.ToLower(pattern), strings.ToLower(urlPath)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check lets request through if it doesn't need credentials or has valid
+// ones, and otherwise answers it with a 401.
+func (a *auth) check(writer http.ResponseWriter, request *http.Request, opts *serverOptions) bool {
+	// the identity provider sends users back to the callback, protected
+	// or not, to finish logging in.
+	if a.oidc != nil && request.URL.Path == a.oidc.callbackPath {
+		a.oidc.callback(writer, request, opts)
+		return false
+	}
+
+	if !a.protects(request.URL.Path, opts) {
+		requestTraceFrom(request.Context()).note("auth", "not protected")
+		return true
+	}
+
+	return a.authenticate(writer, request, opts)
+}
+
+// authenticate lets request through if it has valid credentials, and
+// otherwise answers it with a 401.
+func (a *auth) authenticate(writer http.ResponseWriter, request *http.Request, opts *serverOptions) bool {
+	trace := requestTraceFrom(request.Context())
+
+	if a.tokens != nil {
+		return a.checkBearer(writer, request, opts)
+	}
+
+	if a.oidc != nil {
+		return a.oidc.checkSession(writer, request, opts)
+	}
+
+	if a.nonces != nil {
+		valid, stale := a.verifyDigest(request)
+		if valid {
+			params, _ := parseDigestAuthorization(request.Header.Get("Authorization"))
+			logFieldsFrom(request.Context()).setAuthenticated(params["username"], nil)
+			trace.note("auth", "valid Digest credentials")
+			return true
+		}
+
+		a.digestChallenge(writer.Header(), stale)
+	} else {
+		if user, password, ok := request.BasicAuth(); ok && a.users.verify(user, password) {
+			logFieldsFrom(request.Context()).setAuthenticated(user, nil)
+			trace.note("auth", "valid Basic credentials for %s", user)
+			return true
+		}
+
+		writer.Header().Set(
+			"WWW-Authenticate",
+			`Basic realm="` + strings.ReplaceAll(a.realm, `"`, `'`) + `", charset="UTF-8"`,
+		)
+	}
+
+	trace.note("auth", "credentials required, 401")
+	http.Error(writer, "Unauthorized", 401)
+	return false
+}
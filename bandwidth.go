@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responses are throttled in chunks of this size.
+const bandwidthChunk = 16 << 10
+
+var weekdayNames = []string {"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseRate parses a rate in bytes per second, with an optional K, M or
+// G suffix for multiples of 1024; 0 means unlimited.
+func parseRate(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	multiplier := int64(1)
+
+	if n := len(s); n > 0 {
+		switch s[n - 1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+
+		if multiplier > 1 {
+			s = s[:n - 1]
+		}
+	}
+
+	rate, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+
+	return rate * multiplier, nil
+}
+
+// bandwidthWindow is a time of day, on some days of the week, with its
+// own rate.
+type bandwidthWindow struct {
+	days [7]bool
+	start int
+	end int
+	rate int64
+}
+
+func (w bandwidthWindow) contains(t time.Time) bool {
+	minute := t.Hour() * 60 + t.Minute()
+	day := int(t.Weekday())
+
+	if w.start <= w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+
+	// the window runs past midnight, into the next day.
+	if minute >= w.start {
+		return w.days[day]
+	}
+
+	return minute < w.end && w.days[(day + 6) % 7]
+}
+
+// bandwidthSchedule is a repeatable "[days ]HH:MM-HH:MM=rate" flag, such
+// as "mon-fri 09:00-18:00=2M"; the first window containing the current
+// local time sets the rate.
+type bandwidthSchedule []bandwidthWindow
+
+func (s *bandwidthSchedule) String() string {
+	return ""
+}
+
+func (s *bandwidthSchedule) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 0 {
+		return fmt.Errorf("expected [days ]HH:MM-HH:MM=rate, got %q", value)
+	}
+
+	rate, err := parseRate(value[i + 1:])
+	if err != nil {
+		return err
+	}
+
+	window := bandwidthWindow{rate: rate}
+	fields := strings.Fields(value[:i])
+
+	switch len(fields) {
+	case 1:
+		window.days = [7]bool{true, true, true, true, true, true, true}
+	case 2:
+		if window.days, err = parseWeekdays(fields[0]); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("expected [days ]HH:MM-HH:MM=rate, got %q", value)
+	}
+
+	times := strings.Split(fields[len(fields) - 1], "-")
+	if len(times) != 2 {
+		return fmt.Errorf("invalid time range %q", fields[len(fields) - 1])
+	}
+
+	if window.start, err = parseTimeOfDay(times[0]); err != nil {
+		return err
+	}
+
+	if window.end, err = parseTimeOfDay(times[1]); err != nil {
+		return err
+	}
+
+	*s = append(*s, window)
+	return nil
+}
+
+func (s *bandwidthSchedule) repeatable() {}
+
+// parseWeekdays parses comma-separated days and ranges of days, such as
+// "mon-fri" or "sat,sun".
+func parseWeekdays(s string) ([7]bool, error) {
+	var days [7]bool
+
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		first, last, _ := strings.Cut(part, "-")
+		if last == "" {
+			last = first
+		}
+
+		from, to := stringIndex(first, weekdayNames), stringIndex(last, weekdayNames)
+		if from < 0 || to < 0 {
+			return days, fmt.Errorf("invalid days %q", s)
+		}
+
+		for day := from; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		if s == "24:00" {
+			return 24 * 60, nil
+		}
+
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+
+	return t.Hour() * 60 + t.Minute(), nil
+}
+
+func stringIndex(s string, list []string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// bandwidthLimiter is a token bucket shared by all responses, holding up
+// to a second's worth of bytes at the current rate.
+type bandwidthLimiter struct {
+	rate int64
+	schedule bandwidthSchedule
+
+	mu sync.Mutex
+	tokens float64
+	last time.Time
+}
+
+func newBandwidthLimiter(rate int64, schedule bandwidthSchedule) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: rate, schedule: schedule}
+}
+
+// currentRate returns the rate at t, 0 for unlimited.
+func (l *bandwidthLimiter) currentRate(t time.Time) int64 {
+	for _, window := range l.schedule {
+		if window.contains(t) {
+			return window.rate
+		}
+	}
+
+	return l.rate
+}
+
+// wait blocks until n bytes may be sent, or ctx is done. Callers take
+// their bytes up front, so those arriving later queue behind them.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+
+	now := time.Now()
+	rate := l.currentRate(now)
+	if rate == 0 {
+		l.tokens = 0
+		l.last = now
+		l.mu.Unlock()
+		return nil
+	}
+
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	}
+
+	l.tokens = min(l.tokens, float64(rate)) - float64(n)
+	l.last = now
+
+	delay := time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledWriter sends a response through a bandwidthLimiter.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+	limiter *bandwidthLimiter
+}
+
+func (w throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		chunk := p[:min(len(p), bandwidthChunk)]
+		if err := w.limiter.wait(w.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// banList bans clients, keyed by clientKey, for duration once they have
+// been answered with a 401, 403 or 404 failures times within window, the
+// way fail2ban would, so that scanners probing for e.g. /wp-admin or
+// /.env don't get to try everything. Clients in exempt are never banned.
+type banList struct {
+	failures int
+	window time.Duration
+	duration time.Duration
+	exempt []netip.Prefix
+
+	mu sync.Mutex
+	clients map[netip.Addr]*banEntry
+	swept time.Time
+}
+
+type banEntry struct {
+	// times of the failures within the window, oldest first.
+	failures []time.Time
+	bannedUntil time.Time
+}
+
+func newBanList(
+	failures int,
+	window time.Duration,
+	duration time.Duration,
+	exempt []netip.Prefix,
+) *banList {
+	return &banList{
+		failures: failures,
+		window: window,
+		duration: duration,
+		exempt: exempt,
+		clients: map[netip.Addr]*banEntry{},
+		swept: time.Now(),
+	}
+}
+
+// bannedFor returns how much longer addr is banned, or 0 if it isn't.
+func (b *banList) bannedFor(addr netip.Addr) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if entry, ok := b.clients[clientKey(addr)]; ok {
+		return max(time.Until(entry.bannedUntil), 0)
+	}
+
+	return 0
+}
+
+// record counts a response of status to addr as a failure if it is one,
+// banning addr when it has had too many.
+func (b *banList) record(addr netip.Addr, status int) {
+	if status != 401 && status != 403 && status != 404 || ipListContains(b.exempt, addr) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(b.swept) >= time.Minute {
+		b.sweep(now)
+	}
+
+	key := clientKey(addr)
+	entry, ok := b.clients[key]
+	if !ok {
+		for k := range b.clients {
+			if len(b.clients) < rateLimitMaxClients {
+				break
+			}
+
+			delete(b.clients, k)
+		}
+
+		entry = &banEntry{}
+		b.clients[key] = entry
+	}
+
+	// the refusals of a ban don't extend it.
+	if now.Before(entry.bannedUntil) {
+		return
+	}
+
+	entry.failures = append(entry.failures, now)
+	for len(entry.failures) > 0 && now.Sub(entry.failures[0]) > b.window {
+		entry.failures = entry.failures[1:]
+	}
+
+	if len(entry.failures) >= b.failures {
+		entry.failures = nil
+		entry.bannedUntil = now.Add(b.duration)
+		fmt.Printf("banned %v for %v after %d failures\n", key, b.duration, b.failures)
+	}
+}
+
+func (b *banList) sweep(now time.Time) {
+	b.swept = now
+
+	for key, entry := range b.clients {
+		if now.After(entry.bannedUntil) &&
+		   (len(entry.failures) == 0 || now.Sub(entry.failures[len(entry.failures) - 1]) > b.window) {
+			delete(b.clients, key)
+		}
+	}
+}
+
+// check lets request through unless its client is banned, and otherwise
+// answers it with a 403.
+func (b *banList) check(writer http.ResponseWriter, request *http.Request) bool {
+	wait := b.bannedFor(remoteAddr(request))
+	if wait == 0 {
+		return true
+	}
+
+	retry := int(math.Ceil(wait.Seconds()))
+	requestTraceFrom(request.Context()).note("bans", "client banned for another %ds, 403", retry)
+
+	writer.Header().Set("Retry-After", strconv.Itoa(retry))
+	http.Error(writer, "Forbidden", 403)
+	return false
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// bcrypt's base64 alphabet, which differs from the standard one.
+var bcryptEncoding = base64.NewEncoding(
+	"./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789",
+).WithPadding(base64.NoPadding)
+
+// the text bcrypt encrypts with the password-derived key.
+const bcryptMagic = "OrpheanBeholderScryDoubt"
+
+var errInvalidBcrypt = errors.New("invalid bcrypt hash")
+
+type blowfishState struct {
+	p [18]uint32
+	s [4][256]uint32
+}
+
+func (b *blowfishState) f(x uint32) uint32 {
+	return (b.s[0][x >> 24] + b.s[1][x >> 16 & 0xff]) ^ b.s[2][x >> 8 & 0xff] + b.s[3][x & 0xff]
+}
+
+func (b *blowfishState) encrypt(l uint32, r uint32) (uint32, uint32) {
+	l ^= b.p[0]
+	for i := 1; i <= 16; i += 2 {
+		r ^= b.f(l) ^ b.p[i]
+		l ^= b.f(r) ^ b.p[i + 1]
+	}
+
+	return r ^ b.p[17], l
+}
+
+// streamWord returns the next 4 bytes of data, cycling through it, as a
+// big-endian word.
+func streamWord(data []byte, pos *int) uint32 {
+	var w uint32
+	for i := 0; i < 4; i++ {
+		w = w << 8 | uint32(data[*pos])
+		*pos = (*pos + 1) % len(data)
+	}
+
+	return w
+}
+
+// expand mixes key into the subkeys and, as the tables are regenerated,
+// salt into the blocks being encrypted; a nil salt leaves them alone.
+func (b *blowfishState) expand(key []byte, salt []byte) {
+	pos := 0
+	for i := range b.p {
+		b.p[i] ^= streamWord(key, &pos)
+	}
+
+	var l, r uint32
+	pos = 0
+
+	next := func() {
+		if salt != nil {
+			l ^= streamWord(salt, &pos)
+			r ^= streamWord(salt, &pos)
+		}
+
+		l, r = b.encrypt(l, r)
+	}
+
+	for i := 0; i < len(b.p); i += 2 {
+		next()
+		b.p[i], b.p[i + 1] = l, r
+	}
+
+	for i := range b.s {
+		for j := 0; j < 256; j += 2 {
+			next()
+			b.s[i][j], b.s[i][j + 1] = l, r
+		}
+	}
+}
+
+// bcryptHash computes the 23-byte bcrypt hash of password with the given
+// cost and 16-byte salt.
+func bcryptHash(password []byte, cost int, salt []byte) []byte {
+	// the key includes the terminating NUL and is cut at 72 bytes.
+	key := append(append([]byte{}, password...), 0)
+	if len(key) > 72 {
+		key = key[:72]
+	}
+
+	b := &blowfishState{p: blowfishP, s: blowfishS}
+	b.expand(key, salt)
+
+	for i := 0; i < 1 << cost; i++ {
+		b.expand(key, nil)
+		b.expand(salt, nil)
+	}
+
+	ctext := []byte(bcryptMagic)
+	for i := 0; i < len(ctext); i += 8 {
+		l, r := binary.BigEndian.Uint32(ctext[i:]), binary.BigEndian.Uint32(ctext[i + 4:])
+		for j := 0; j < 64; j++ {
+			l, r = b.encrypt(l, r)
+		}
+
+		binary.BigEndian.PutUint32(ctext[i:], l)
+		binary.BigEndian.PutUint32(ctext[i + 4:], r)
+	}
+
+	return ctext[:23]
+}
+
+// bcryptVerify checks password against a bcrypt hash as written by
+// htpasswd -B, like "$2y$10$" followed by the salt and hash.
+func bcryptVerify(hash string, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "" || len(parts[3]) != 53 {
+		return false, errInvalidBcrypt
+	}
+
+	switch parts[1] {
+	case "2a", "2b", "2y":
+	default:
+		return false, errInvalidBcrypt
+	}
+
+	// the cost is always written with two digits.
+	cost, err := strconv.Atoi(parts[2])
+	if err != nil || len(parts[2]) != 2 || cost < 4 || cost > 31 {
+		return false, errInvalidBcrypt
+	}
+
+	salt, err := bcryptEncoding.DecodeString(parts[3][:22])
+	if err != nil {
+		return false, errInvalidBcrypt
+	}
+
+	sum := bcryptEncoding.EncodeToString(bcryptHash([]byte(password), cost, salt))
+	return subtle.ConstantTimeCompare([]byte(sum), []byte(parts[3][22:])) == 1, nil
+}
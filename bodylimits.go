@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// bodyLimits caps the size of request bodies, at limit bytes or, for the
+// methods in methods, at the size given for them. Bodies over it are
+// refused with a 413 before any of them is read, rather than net/http
+// reading and throwing away whatever a client streams at it.
+type bodyLimits struct {
+	limit int64
+	methods map[string]int64
+}
+
+// newBodyLimits returns the limits given with -max-body-size and
+// -max-method-body, which take sizes with an optional K, M or G suffix.
+// GET and HEAD requests have no use for a body, and are allowed none
+// unless they are given a size.
+func newBodyLimits(limit string, methodLimits []string) (*bodyLimits, error) {
+	size, err := parseRate(limit)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bodyLimits{
+		limit: size,
+		methods: map[string]int64{"GET": 0, "HEAD": 0},
+	}
+
+	for _, methodLimit := range methodLimits {
+		method, value, ok := strings.Cut(methodLimit, "=")
+		size, err := parseRate(value)
+		if !ok || method == "" || err != nil {
+			return nil, fmt.Errorf("expected METHOD=size, got %q", methodLimit)
+		}
+
+		b.methods[strings.ToUpper(method)] = size
+	}
+
+	return b, nil
+}
+
+func (b *bodyLimits) limitFor(method string) int64 {
+	if size, ok := b.methods[method]; ok {
+		return size
+	}
+
+	return b.limit
+}
+
+// check answers request with a 413 if its Content-Length is over the
+// limit for its method, or it has a chunked body where none is allowed,
+// and otherwise makes reading more than the limit from its body fail.
+func (b *bodyLimits) check(writer http.ResponseWriter, request *http.Request) bool {
+	limit := b.limitFor(request.Method)
+
+	// the length of chunked bodies is -1.
+	if request.ContentLength > limit || limit == 0 && request.ContentLength != 0 {
+		trace := requestTraceFrom(request.Context())
+		if request.ContentLength < 0 {
+			trace.note("body limits", "chunked body where %s allows none, 413", request.Method)
+		} else {
+			trace.note("body limits", "body of %d bytes over the %d allowed for %s, 413",
+				request.ContentLength, limit, request.Method)
+		}
+
+		// the connection is closed rather than the rest of the body read.
+		writer.Header().Set("Connection", "close")
+		http.Error(writer, "Request body too large", 413)
+		return false
+	}
+
+	if request.Body != nil && request.Body != http.NoBody {
+		request.Body = http.MaxBytesReader(writer, request.Body, limit)
+	}
+
+	return true
+}
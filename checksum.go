@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// files up to this size are verified in full before anything is sent, so
+// that corruption can be answered with a 502; larger ones are verified
+// while streaming and the transfer is cut short instead.
+const checksumBufferSize = 1 << 20
+
+type fileChecksum struct {
+	sum []byte
+	newHash func() hash.Hash
+}
+
+// loadChecksums reads a checksum index in the format written by
+// sha256sum or sha512sum, with paths relative to the home directory.
+func loadChecksums(path string) (map[string]fileChecksum, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	checksums := map[string]fileChecksum{}
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected checksum and path", path, lineNum)
+		}
+
+		sum, err := hex.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid checksum", path, lineNum)
+		}
+
+		checksum := fileChecksum{sum: sum}
+
+		switch len(sum) {
+		case sha256.Size:
+			checksum.newHash = sha256.New
+		case sha512.Size:
+			checksum.newHash = sha512.New
+		default:
+			return nil, fmt.Errorf("%s:%d: expected a SHA-256 or SHA-512 checksum", path, lineNum)
+		}
+
+		// a '*' marks binary mode, which makes no difference here.
+		name := strings.TrimPrefix(strings.TrimLeft(fields[1], " "), "*")
+		name = filepath.Clean(filepath.FromSlash(strings.TrimPrefix(name, "./")))
+		checksums[name] = checksum
+	}
+
+	return checksums, scanner.Err()
+}
+
+// verifyFile checks the file at path, which has been opened as body,
+// against its checksum. It returns a reader for the verified contents or
+// one that verifies them while they are read.
+func verifyFile(
+	path string,
+	body io.ReadCloser,
+	size int64,
+	checksum fileChecksum,
+) (io.ReadCloser, error) {
+	h := checksum.newHash()
+
+	if size > checksumBufferSize {
+		return &verifyingReader{
+			ReadCloser: body,
+			path: path,
+			hash: h,
+			checksum: checksum,
+		}, nil
+	}
+
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, checksumBufferSize + 1))
+	if err != nil {
+		return nil, err
+	}
+
+	h.Write(data)
+	if !bytes.Equal(h.Sum(nil), checksum.sum) {
+		return nil, checksumMismatch(path, checksum.sum, h.Sum(nil))
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func checksumMismatch(path string, want []byte, got []byte) error {
+	fmt.Printf("ALERT: checksum mismatch for %s: expected %x, got %x\n", path, want, got)
+	return fmt.Errorf("%w: %s", errChecksumMismatch, path)
+}
+
+// verifyingReader hashes a file while it is read. It holds back the last
+// byte until the whole file has been verified, so that a corrupt file is
+// never delivered in full.
+type verifyingReader struct {
+	io.ReadCloser
+	path string
+	hash hash.Hash
+	checksum fileChecksum
+
+	held byte
+	hasHeld bool
+	eof bool
+	err error
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if r.eof {
+		sum := r.hash.Sum(nil)
+		if !bytes.Equal(sum, r.checksum.sum) {
+			r.err = checksumMismatch(r.path, r.checksum.sum, sum)
+			return 0, r.err
+		}
+
+		r.err = io.EOF
+		if !r.hasHeld {
+			return 0, io.EOF
+		}
+
+		p[0] = r.held
+		return 1, io.EOF
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+
+	if err == io.EOF {
+		r.eof = true
+	} else if err != nil {
+		r.err = err
+	}
+
+	if n == 0 {
+		return 0, r.err
+	}
+
+	// shift the held byte in front and hold back the new last one
+	last := p[n - 1]
+	if r.hasHeld {
+		copy(p[1:n], p[:n - 1])
+		p[0] = r.held
+	} else {
+		n--
+	}
+
+	r.held, r.hasHeld = last, true
+	return n, r.err
+}
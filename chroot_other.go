@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func enterChroot(dir string) error {
+	return errors.New("chroot is only supported on Unix systems")
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package main
+
+import (
+	"crypto/x509"
+	"os"
+	"syscall"
+	"time"
+)
+
+// enterChroot makes dir the root directory of the process. What is
+// loaded lazily from outside of it, the local time zone and the system
+// certificates, is loaded beforehand.
+func enterChroot(dir string) error {
+	time.Now().Zone()
+	x509.SystemCertPool()
+
+	if err := syscall.Chroot(dir); err != nil {
+		return err
+	}
+
+	return os.Chdir("/")
+}
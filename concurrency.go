@@ -0,0 +1,211 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// clientCounts counts what each client, by clientKey, has open.
+type clientCounts struct {
+	limit int
+
+	mu sync.Mutex
+	open map[netip.Addr]int
+}
+
+func newClientCounts(limit int) *clientCounts {
+	return &clientCounts{limit: limit, open: map[netip.Addr]int{}}
+}
+
+// acquire counts one more for addr, unless it is at the limit; a zero
+// limit allows any number.
+func (c *clientCounts) acquire(addr netip.Addr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := clientKey(addr)
+	if c.limit > 0 && c.open[key] >= c.limit {
+		return false
+	}
+
+	c.open[key]++
+	return true
+}
+
+func (c *clientCounts) release(addr netip.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := clientKey(addr)
+	if c.open[key]--; c.open[key] <= 0 {
+		delete(c.open, key)
+	}
+}
+
+// requestLimit bounds the requests being handled at once, in all and for
+// each client. Requests over the total wait up to queueTimeout for
+// another to finish; requests over a client's share are refused.
+type requestLimit struct {
+	slots chan struct{}
+	clients *clientCounts
+	queueTimeout time.Duration
+}
+
+func newRequestLimit(total int, perClient int, queueTimeout time.Duration) *requestLimit {
+	l := &requestLimit{clients: newClientCounts(perClient), queueTimeout: queueTimeout}
+	if total > 0 {
+		l.slots = make(chan struct{}, total)
+	}
+
+	return l
+}
+
+// acquire waits for request to be allowed to run, returning the function
+// that ends it, or answers it with a 429 or 503 and returns false. A nil
+// limit lets everything run.
+func (l *requestLimit) acquire(writer http.ResponseWriter, request *http.Request) (func(), bool) {
+	if l == nil {
+		return func() {}, true
+	}
+
+	trace := requestTraceFrom(request.Context())
+	addr := remoteAddr(request)
+
+	if !l.clients.acquire(addr) {
+		trace.note("concurrency", "too many requests from this client at once, 429")
+		writer.Header().Set("Retry-After", "1")
+		http.Error(writer, "Too many requests", 429)
+		return nil, false
+	}
+
+	busy := func() (func(), bool) {
+		l.clients.release(addr)
+		trace.note("concurrency", "server busy, 503")
+		writer.Header().Set("Retry-After", "5")
+		http.Error(writer, "Server busy", 503)
+		return nil, false
+	}
+
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if l.queueTimeout <= 0 {
+				return busy()
+			}
+
+			timer := time.NewTimer(l.queueTimeout)
+			defer timer.Stop()
+
+			select {
+			case l.slots <- struct{}{}:
+			case <-timer.C:
+				return busy()
+			case <-request.Context().Done():
+				l.clients.release(addr)
+				return nil, false
+			}
+		}
+	}
+
+	return func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+
+		l.clients.release(addr)
+	}, true
+}
+
+// limitListener bounds the connections open at once, in all and for each
+// client. Over the total, it stops accepting until one closes, leaving new
+// ones waiting in the kernel's queue; connections over a client's share
+// are closed as soon as they are accepted.
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+	clients *clientCounts
+	closed chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(listener net.Listener, total int, perClient int) *limitListener {
+	l := &limitListener{
+		Listener: listener,
+		clients: newClientCounts(perClient),
+		closed: make(chan struct{}),
+	}
+
+	if total > 0 {
+		l.slots = make(chan struct{}, total)
+	}
+
+	return l
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		if l.slots != nil {
+			select {
+			case l.slots <- struct{}{}:
+			case <-l.closed:
+				return nil, net.ErrClosed
+			}
+		}
+
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.release()
+			return nil, err
+		}
+
+		addr := netip.Addr{}
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			addr = tcpAddr.AddrPort().Addr().Unmap()
+		}
+
+		if !l.clients.acquire(addr) {
+			conn.Close()
+			l.release()
+			continue
+		}
+
+		return &limitConn{Conn: conn, release: func() {
+			l.clients.release(addr)
+			l.release()
+		}}, nil
+	}
+}
+
+func (l *limitListener) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// limitConn gives its slot back when it is closed.
+type limitConn struct {
+	net.Conn
+	once sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// ReadFrom lets files go out with sendfile, as they would without the
+// limit.
+func (c *limitConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// matches the durations accepted by time.ParseDuration.
+const durationPattern = `^(0|[-+]?([0-9]*(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+)$`
+
+// repeatableFlag is implemented by flag values that may be given more
+// than once; config files set them with an array of strings.
+type repeatableFlag interface {
+	repeatable()
+}
+
+// set by "httpd config schema", which prints the schema of the server's
+// flags instead of starting it.
+var printConfigSchema = false
+
+// configEntry is one "name = value" line of a config file. Values are
+// kept as the strings that would be passed to the flag; arrays, used for
+// repeatable flags, hold one string per occurrence.
+type configEntry struct {
+	line int
+	name string
+	values []string
+	kind string
+}
+
+// parseConfig reads a config file, which is a small subset of TOML:
+// top-level "name = value" pairs named after the command line flags,
+// where a value is a string, boolean, integer, float or array of strings.
+func parseConfig(path string) ([]configEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	return readConfig(file, path)
+}
+
+// readConfig parses a config file from r; path is used in errors.
+func readConfig(r io.Reader, path string) ([]configEntry, error) {
+	var err error
+	var entries []configEntry
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		startLine := lineNum
+
+		index := strings.Index(line, "=")
+		if index < 0 {
+			return nil, fmt.Errorf("%s:%d: expected name = value", path, startLine)
+		}
+
+		// arrays may be split over several lines.
+		isArray := strings.HasPrefix(strings.TrimSpace(line[index + 1:]), "[")
+		for isArray && !strings.HasSuffix(line, "]") {
+			if !scanner.Scan() {
+				return nil, fmt.Errorf("%s:%d: unterminated array", path, startLine)
+			}
+
+			lineNum++
+			line += " " + strings.TrimSpace(stripConfigComment(scanner.Text()))
+		}
+
+		name := strings.TrimSpace(line[:index])
+		if strings.HasPrefix(name, "\"") {
+			name, err = strconv.Unquote(name)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid name", path, startLine)
+			}
+		}
+
+		if name == "" {
+			return nil, fmt.Errorf("%s:%d: missing name", path, startLine)
+		}
+
+		values, kind, err := parseConfigValue(strings.TrimSpace(line[index + 1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %v", path, startLine, name, err)
+		}
+
+		entries = append(entries, configEntry{
+			line: startLine,
+			name: name,
+			values: values,
+			kind: kind,
+		})
+	}
+
+	return entries, scanner.Err()
+}
+
+// stripConfigComment removes a trailing '#' comment that is not inside
+// a string.
+func stripConfigComment(line string) string {
+	var quote byte
+
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+func parseConfigValue(value string) ([]string, string, error) {
+	switch {
+	case value == "":
+		return nil, "", fmt.Errorf("missing value")
+	case value == "true" || value == "false":
+		return []string{value}, "boolean", nil
+	case value[0] == '"' || value[0] == '\'':
+		s, err := parseConfigString(value)
+		return []string{s}, "string", err
+	case value[0] == '[':
+		if !strings.HasSuffix(value, "]") {
+			return nil, "", fmt.Errorf("unterminated array")
+		}
+
+		var values []string
+		rest := strings.TrimSpace(value[1:len(value) - 1])
+
+		for rest != "" {
+			end := configStringEnd(rest)
+			if end < 0 {
+				return nil, "", fmt.Errorf("arrays may only hold strings")
+			}
+
+			s, err := parseConfigString(rest[:end])
+			if err != nil {
+				return nil, "", err
+			}
+
+			values = append(values, s)
+			rest = strings.TrimSpace(rest[end:])
+
+			if rest != "" {
+				if rest[0] != ',' {
+					return nil, "", fmt.Errorf("expected , between array items")
+				}
+
+				rest = strings.TrimSpace(rest[1:])
+			}
+		}
+
+		return values, "array", nil
+	}
+
+	number := strings.Replace(value, "_", "", -1)
+	if n, err := strconv.ParseInt(number, 10, 64); err == nil {
+		return []string{strconv.FormatInt(n, 10)}, "integer", nil
+	}
+
+	// floats have a fraction or an exponent, which ParseFloat takes
+	// along with forms TOML doesn't, such as hex.
+	if strings.ContainsAny(number, ".eE") && !strings.ContainsAny(number, "xXpP") {
+		if f, err := strconv.ParseFloat(number, 64); err == nil {
+			return []string{strconv.FormatFloat(f, 'g', -1, 64)}, "float", nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("invalid value %s", value)
+}
+
+// configStringEnd returns the length of the quoted string at the start
+// of s, or -1 if s does not start with one.
+func configStringEnd(s string) int {
+	if s == "" || (s[0] != '"' && s[0] != '\'') {
+		return -1
+	}
+
+	for i := 1; i < len(s); i++ {
+		if s[0] == '"' && s[i] == '\\' {
+			i++
+		} else if s[i] == s[0] {
+			return i + 1
+		}
+	}
+
+	return -1
+}
+
+func parseConfigString(value string) (string, error) {
+	if configStringEnd(value) != len(value) {
+		return "", fmt.Errorf("invalid string %s", value)
+	}
+
+	// literal strings have no escapes
+	if value[0] == '\'' {
+		return value[1:len(value) - 1], nil
+	}
+
+	s, err := strconv.Unquote(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid string %s", value)
+	}
+
+	return s, nil
+}
+
+// loadConfig applies a config file to the flags; flags given on the
+// command line take precedence over the file.
+func loadConfig(path string, flags *flag.FlagSet) error {
+	entries, err := parseConfig(path)
+	if err != nil {
+		return err
+	}
+
+	return applyConfig(entries, path, flags)
+}
+
+// applyConfig sets flags from parsed config entries, except those that
+// were already set on the command line.
+func applyConfig(entries []configEntry, path string, flags *flag.FlagSet) error {
+	setOnCommandLine := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	for _, entry := range entries {
+		f := flags.Lookup(entry.name)
+		if f == nil || entry.name == "config" {
+			if suggestion := similarFlag(flags, entry.name); suggestion != "" {
+				return fmt.Errorf(
+					"%s:%d: unknown option %s, did you mean %s?",
+					path, entry.line, entry.name, suggestion,
+				)
+			}
+
+			return fmt.Errorf("%s:%d: unknown option %s", path, entry.line, entry.name)
+		}
+
+		expected := configType(f)
+		if expected == "duration" {
+			expected = "string"
+		}
+
+		// numbers may be written as integers or floats.
+		if entry.kind != expected &&
+		   !(expected == "number" && (entry.kind == "integer" || entry.kind == "float")) &&
+		   !(expected == "string or integer" && (entry.kind == "string" || entry.kind == "integer")) {
+			return fmt.Errorf(
+				"%s:%d: %s: expected %s, got %s",
+				path, entry.line, entry.name, expected, entry.kind,
+			)
+		}
+
+		if setOnCommandLine[entry.name] {
+			continue
+		}
+
+		for _, value := range entry.values {
+			if err := flags.Set(entry.name, value); err != nil {
+				return fmt.Errorf("%s:%d: %s: %v", path, entry.line, entry.name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// stringOrIntegerFlags are string flags that usually hold a number, such
+// as a status that may also be "off" or a size that may have a suffix, so
+// that config files may give them as either.
+var stringOrIntegerFlags = map[string]bool {
+	"dir-redirect": true,
+	"max-body-size": true,
+	"access-log-max-size": true,
+	"min-send-rate": true,
+	"bandwidth": true,
+}
+
+// configType returns the type a flag takes in config files: "boolean",
+// "integer", "number", "duration", "string", "string or integer" or
+// "array".
+func configType(f *flag.Flag) string {
+	if stringOrIntegerFlags[f.Name] {
+		return "string or integer"
+	}
+
+	if _, ok := f.Value.(repeatableFlag); ok {
+		return "array"
+	}
+
+	if v, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && v.IsBoolFlag() {
+		return "boolean"
+	}
+
+	if v, ok := f.Value.(flag.Getter); ok {
+		switch v.Get().(type) {
+		case int, int64, uint, uint64:
+			return "integer"
+		case float64:
+			return "number"
+		case time.Duration:
+			return "duration"
+		}
+	}
+
+	return "string"
+}
+
+// configSchema describes the config file as a JSON Schema, which editors
+// can use for completion and validation.
+func configSchema(flags *flag.FlagSet) map[string]interface{} {
+	properties := map[string]interface{}{}
+
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+
+		property := map[string]interface{}{"description": f.Usage}
+
+		switch configType(f) {
+		case "array":
+			property["type"] = "array"
+			property["items"] = map[string]string{"type": "string"}
+		case "boolean":
+			property["type"] = "boolean"
+			property["default"] = f.DefValue == "true"
+		case "integer":
+			property["type"] = "integer"
+			property["default"], _ = strconv.ParseInt(f.DefValue, 10, 64)
+		case "number":
+			property["type"] = "number"
+			property["default"], _ = strconv.ParseFloat(f.DefValue, 64)
+		case "duration":
+			property["type"] = "string"
+			property["pattern"] = durationPattern
+			property["default"] = f.DefValue
+		case "string or integer":
+			property["type"] = []string{"string", "integer"}
+			property["default"] = f.DefValue
+		default:
+			property["type"] = "string"
+			property["default"] = f.DefValue
+		}
+
+		properties[f.Name] = property
+	})
+
+	return map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title": "gohttpd configuration",
+		"type": "object",
+		"properties": properties,
+		"additionalProperties": false,
+	}
+}
+
+func writeConfigSchema(w io.Writer, flags *flag.FlagSet) int {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(configSchema(flags)); err != nil {
+		fmt.Println("unable to write schema: ", err)
+		return 1
+	}
+
+	return 0
+}
+
+// similarFlag returns the name of a flag that is at most two edits away
+// from name, to point out typos.
+func similarFlag(flags *flag.FlagSet, name string) string {
+	best, bestDistance := "", 3
+
+	flags.VisitAll(func(f *flag.Flag) {
+		if d := editDistance(name, f.Name); d < bestDistance && f.Name != "config" {
+			best, bestDistance = f.Name, d
+		}
+	})
+
+	return best
+}
+
+// editDistance computes the Levenshtein distance between a and b.
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b) + 1)
+	cur := make([]int, len(b) + 1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i - 1] == b[j - 1] {
+				cost = 0
+			}
+
+			cur[j] = min(prev[j] + 1, cur[j - 1] + 1, prev[j - 1] + cost)
+		}
+
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+// configCommand implements "httpd config".
+func configCommand(args []string) int {
+	if len(args) != 1 || args[0] != "schema" {
+		fmt.Println("usage: httpd config schema")
+		return 1
+	}
+
+	printConfigSchema = true
+	return serveWithExitCode(nil)
+}
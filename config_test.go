@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newConfigTestFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Int("port", 8080, "")
+	flags.Bool("listdir", false, "")
+	flags.String("home", ".", "")
+	flags.Float64("rate-limit", 0, "")
+	flags.Float64("otlp-sample-ratio", 1, "")
+	flags.Duration("nfs-timeout", 5 * time.Second, "")
+	flags.String("dir-redirect", "301", "")
+	flags.String("max-body-size", "1M", "")
+
+	var noList stringList
+	flags.Var(&noList, "no-list", "")
+
+	return flags
+}
+
+func TestConfigTypedValues(t *testing.T) {
+	config := `
+port = 8_081
+listdir = true
+home = '/srv/www'
+rate-limit = 10
+otlp-sample-ratio = 0.1
+nfs-timeout = "2s"
+no-list = ["/assets", "/private"]
+`
+
+	entries, err := readConfig(strings.NewReader(config), "test.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags := newConfigTestFlags()
+	if err := applyConfig(entries, "test.toml", flags); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string {
+		"port": "8081",
+		"listdir": "true",
+		"home": "/srv/www",
+		"rate-limit": "10",
+		"otlp-sample-ratio": "0.1",
+		"nfs-timeout": "2s",
+		"no-list": "/assets,/private",
+	}
+
+	for name, value := range want {
+		if got := flags.Lookup(name).Value.String(); got != value {
+			t.Errorf("%s = %s, expected %s", name, got, value)
+		}
+	}
+}
+
+func TestConfigStringsOrIntegers(t *testing.T) {
+	tests := []struct {
+		config string
+		name string
+		value string
+	}{
+		{`dir-redirect = 308`, "dir-redirect", "308"},
+		{`dir-redirect = "308"`, "dir-redirect", "308"},
+		{`max-body-size = 1048576`, "max-body-size", "1048576"},
+		{`max-body-size = 1_048_576`, "max-body-size", "1048576"},
+		{`max-body-size = "10M"`, "max-body-size", "10M"},
+	}
+
+	for _, test := range tests {
+		entries, err := readConfig(strings.NewReader(test.config), "test.toml")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		flags := newConfigTestFlags()
+		if err := applyConfig(entries, "test.toml", flags); err != nil {
+			t.Errorf("%s: %v", test.config, err)
+		} else if got := flags.Lookup(test.name).Value.String(); got != test.value {
+			t.Errorf("%s: %s = %s, expected %s", test.config, test.name, got, test.value)
+		}
+	}
+}
+
+func TestConfigRejectsWrongTypes(t *testing.T) {
+	configs := []string{
+		`port = 1.5`,
+		`port = "8080"`,
+		`listdir = 1`,
+		`rate-limit = "10"`,
+		`home = 1`,
+		`no-list = "/assets"`,
+		`otlp-sample-ratio = 0x1p-2`,
+		`dir-redirect = 30.8`,
+		`dir-redirect = ["308"]`,
+		`max-body-size = 1.5`,
+	}
+
+	for _, config := range configs {
+		entries, err := readConfig(strings.NewReader(config), "test.toml")
+		if err == nil {
+			err = applyConfig(entries, "test.toml", newConfigTestFlags())
+		}
+
+		if err == nil {
+			t.Errorf("%s was accepted", config)
+		}
+	}
+}
+
+func TestConfigSchemaTypes(t *testing.T) {
+	properties := configSchema(newConfigTestFlags())["properties"].(map[string]interface{})
+
+	want := map[string]string {
+		"port": "integer",
+		"listdir": "boolean",
+		"home": "string",
+		"rate-limit": "number",
+		"otlp-sample-ratio": "number",
+		"nfs-timeout": "string",
+		"no-list": "array",
+	}
+
+	for name, kind := range want {
+		property := properties[name].(map[string]interface{})
+		if property["type"] != kind {
+			t.Errorf("%s has type %v, expected %s", name, property["type"], kind)
+		}
+	}
+
+	kinds, _ := properties["dir-redirect"].(map[string]interface{})["type"].([]string)
+	if !slices.Equal(kinds, []string{"string", "integer"}) {
+		t.Errorf("dir-redirect has type %v, expected string or integer", kinds)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a Digest nonce may be used before the client is asked, with
+// stale=true, to retry with a new one.
+const digestNonceLifetime = 5 * time.Minute
+
+// the Digest algorithms offered, in order of preference.
+var digestAlgorithms = []string {"SHA-256", "MD5"}
+
+// digestAlgorithmForHash returns the algorithm of a hex-encoded hash from
+// an htdigest line, or "" if it is neither MD5 nor SHA-256.
+func digestAlgorithmForHash(ha1 string) string {
+	if _, err := hex.DecodeString(ha1); err != nil {
+		return ""
+	}
+
+	switch len(ha1) {
+	case md5.Size * 2:
+		return "MD5"
+	case sha256.Size * 2:
+		return "SHA-256"
+	}
+
+	return ""
+}
+
+func digestKey(user string, realm string, algorithm string) string {
+	return user + "\x00" + realm + "\x00" + algorithm
+}
+
+func digestHash(algorithm string, data string) string {
+	var h hash.Hash
+	if algorithm == "SHA-256" {
+		h = sha256.New()
+	} else {
+		h = md5.New()
+	}
+
+	h.Write([]byte(data))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// digestNonces issues nonces that carry their own time and signature, so
+// that they need no state until they are used. The highest nonce count
+// seen for each nonce is kept for its lifetime, to refuse replays.
+type digestNonces struct {
+	key []byte
+
+	mu sync.Mutex
+	counts map[string]uint64
+	expires map[string]time.Time
+}
+
+func newDigestNonces() *digestNonces {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &digestNonces{key: key, counts: map[string]uint64{}, expires: map[string]time.Time{}}
+}
+
+func (n *digestNonces) sign(issued []byte) []byte {
+	mac := hmac.New(sha256.New, n.key)
+	mac.Write(issued)
+	return mac.Sum(nil)[:16]
+}
+
+func (n *digestNonces) issue() string {
+	issued := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix()))
+	return base64.RawURLEncoding.EncodeToString(append(issued, n.sign(issued)...))
+}
+
+// check reports whether nonce was issued by the server, and whether it is
+// still fresh and count hasn't been seen with it before.
+func (n *digestNonces) check(nonce string, count uint64) (bool, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(data) != 24 || !hmac.Equal(data[8:], n.sign(data[:8])) {
+		return false, false
+	}
+
+	issued := time.Unix(int64(binary.BigEndian.Uint64(data[:8])), 0)
+	if time.Since(issued) > digestNonceLifetime {
+		return true, false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	for k, expires := range n.expires {
+		if now.After(expires) {
+			delete(n.expires, k)
+			delete(n.counts, k)
+		}
+	}
+
+	if count <= n.counts[nonce] {
+		return true, false
+	}
+
+	n.counts[nonce] = count
+	n.expires[nonce] = issued.Add(digestNonceLifetime)
+	return true, true
+}
+
+// parseDigestAuthorization parses the parameters of a Digest Authorization
+// header, which may be quoted strings or tokens.
+func parseDigestAuthorization(header string) (map[string]string, bool) {
+	rest, ok := strings.CutPrefix(header, "Digest ")
+	if !ok {
+		return nil, false
+	}
+
+	params := map[string]string{}
+
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		if rest == "" {
+			return params, true
+		}
+
+		name, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			return nil, false
+		}
+
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimLeft(value, " \t")
+
+		if strings.HasPrefix(value, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i + 1 < len(value) {
+					i++
+				}
+
+				b.WriteByte(value[i])
+			}
+
+			if i >= len(value) {
+				return nil, false
+			}
+
+			params[name], rest = b.String(), value[i + 1:]
+		} else {
+			end := strings.IndexByte(value, ',')
+			if end < 0 {
+				end = len(value)
+			}
+
+			params[name], rest = strings.TrimSpace(value[:end]), value[end:]
+		}
+	}
+}
+
+// verifyDigest checks the Digest credentials of request, reporting whether
+// they are valid and, if not, whether only their nonce has expired.
+func (a *auth) verifyDigest(request *http.Request) (bool, bool) {
+	params, ok := parseDigestAuthorization(request.Header.Get("Authorization"))
+	if !ok || params["realm"] != a.realm || params["qop"] != "auth" ||
+	   params["uri"] != request.RequestURI {
+		return false, false
+	}
+
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+
+	if !stringInSlice(algorithm, digestAlgorithms) {
+		return false, false
+	}
+
+	count, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil || params["cnonce"] == "" {
+		return false, false
+	}
+
+	ha1, ok := a.users.digestHA1(params["username"], a.realm, algorithm)
+	if !ok {
+		return false, false
+	}
+
+	ha2 := digestHash(algorithm, request.Method + ":" + params["uri"])
+	expected := digestHash(algorithm, fmt.Sprintf(
+		"%s:%s:%s:%s:auth:%s", ha1, params["nonce"], params["nc"], params["cnonce"], ha2,
+	))
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+		return false, false
+	}
+
+	// the nonce is checked last, so that guesses don't use up counts.
+	issued, fresh := a.nonces.check(params["nonce"], count)
+	return issued && fresh, issued && !fresh
+}
+
+// digestChallenge sets a Digest WWW-Authenticate header for each algorithm
+// there are users for. Clients answer the first one they support, so a
+// user needs lines for both if the file has both.
+func (a *auth) digestChallenge(header http.Header, stale bool) {
+	nonce := a.nonces.issue()
+	realm := strings.ReplaceAll(a.realm, `"`, `'`)
+
+	for i, algorithm := range digestAlgorithms {
+		// with no users at all, still ask for credentials.
+		last := i == len(digestAlgorithms) - 1 && len(header.Values("WWW-Authenticate")) == 0
+		if !last && !a.users.hasDigests(a.realm, algorithm) {
+			continue
+		}
+
+		challenge := `Digest realm="` + realm + `", qop="auth", algorithm=` + algorithm +
+			`, nonce="` + nonce + `", charset=UTF-8`
+		if stale {
+			challenge += ", stale=true"
+		}
+
+		header.Add("WWW-Authenticate", challenge)
+	}
+}
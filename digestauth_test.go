@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// the examples of RFC 7616 section 3.9.1.
+const (
+	rfcDigestUser = "Mufasa"
+	rfcDigestPassword = "Circle of Life"
+	rfcDigestRealm = "http-auth@example.org"
+	rfcDigestURI = "/dir/index.html"
+	rfcDigestNonce = "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"
+	rfcDigestCnonce = "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+)
+
+// digestResponse computes the response of a client for a GET of uri, with
+// qop=auth.
+func digestResponse(
+	algorithm string,
+	password string,
+	uri string,
+	nonce string,
+	nc string,
+) string {
+	ha1 := digestHash(algorithm, rfcDigestUser + ":" + rfcDigestRealm + ":" + password)
+	ha2 := digestHash(algorithm, "GET:" + uri)
+	return digestHash(algorithm, ha1 + ":" + nonce + ":" + nc + ":" + rfcDigestCnonce + ":auth:" + ha2)
+}
+
+func TestDigestRFC7616Examples(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		response string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+
+	for _, test := range tests {
+		got := digestResponse(test.algorithm, rfcDigestPassword, rfcDigestURI, rfcDigestNonce, "00000001")
+		if got != test.response {
+			t.Errorf("%s: got response %s, expected %s", test.algorithm, got, test.response)
+		}
+	}
+}
+
+// newDigestTestAuth returns Digest authentication for the user of the RFC
+// examples, with hashes for both algorithms.
+func newDigestTestAuth(t *testing.T) *auth {
+	var lines []string
+	for _, algorithm := range digestAlgorithms {
+		ha1 := digestHash(algorithm, rfcDigestUser + ":" + rfcDigestRealm + ":" + rfcDigestPassword)
+		lines = append(lines, rfcDigestUser + ":" + rfcDigestRealm + ":" + ha1)
+	}
+
+	return &auth{realm: rfcDigestRealm, users: newTestHtpasswd(t, lines...), nonces: newDigestNonces()}
+}
+
+// verifyDigestRequest verifies a GET of requestURI with the credentials a
+// client would send for uri.
+func verifyDigestRequest(
+	a *auth,
+	algorithm string,
+	requestURI string,
+	uri string,
+	nonce string,
+	nc string,
+) (bool, bool) {
+	request := httptest.NewRequest("GET", requestURI, nil)
+	request.Header.Set("Authorization", fmt.Sprintf(
+		`Digest username="%s", realm="%s", uri="%s", algorithm=%s, nonce="%s", ` +
+			`nc=%s, cnonce="%s", qop=auth, response="%s"`,
+		rfcDigestUser, rfcDigestRealm, uri, algorithm, nonce, nc, rfcDigestCnonce,
+		digestResponse(algorithm, rfcDigestPassword, uri, nonce, nc),
+	))
+
+	return a.verifyDigest(request)
+}
+
+func TestDigestVerify(t *testing.T) {
+	for _, algorithm := range digestAlgorithms {
+		a := newDigestTestAuth(t)
+		nonce := a.nonces.issue()
+
+		valid, stale := verifyDigestRequest(a, algorithm, rfcDigestURI, rfcDigestURI, nonce, "00000001")
+		if !valid || stale {
+			t.Errorf("%s: got (%v, %v) for valid credentials", algorithm, valid, stale)
+		}
+
+		valid, _ = verifyDigestRequest(a, algorithm, rfcDigestURI, rfcDigestURI, nonce, "00000002")
+		if !valid {
+			t.Errorf("%s: the next nonce count is refused", algorithm)
+		}
+	}
+}
+
+func TestDigestRefusesReplays(t *testing.T) {
+	for _, algorithm := range digestAlgorithms {
+		a := newDigestTestAuth(t)
+		nonce := a.nonces.issue()
+
+		valid, _ := verifyDigestRequest(a, algorithm, rfcDigestURI, rfcDigestURI, nonce, "00000002")
+		if !valid {
+			t.Fatalf("%s: valid credentials are refused", algorithm)
+		}
+
+		// the same count again, or a lower one.
+		for _, nc := range []string{"00000002", "00000001"} {
+			valid, _ = verifyDigestRequest(a, algorithm, rfcDigestURI, rfcDigestURI, nonce, nc)
+			if valid {
+				t.Errorf("%s: nc=%s is accepted after nc=00000002", algorithm, nc)
+			}
+		}
+	}
+}
+
+func TestDigestRefusesStaleNonces(t *testing.T) {
+	a := newDigestTestAuth(t)
+
+	issued := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Add(-2 * digestNonceLifetime).Unix()))
+	nonce := base64.RawURLEncoding.EncodeToString(append(issued, a.nonces.sign(issued)...))
+
+	valid, stale := verifyDigestRequest(a, "SHA-256", rfcDigestURI, rfcDigestURI, nonce, "00000001")
+	if valid || !stale {
+		t.Errorf("got (%v, %v) for a stale nonce, expected (false, true)", valid, stale)
+	}
+}
+
+func TestDigestRefusesForeignNonces(t *testing.T) {
+	a := newDigestTestAuth(t)
+
+	// the nonce of the RFC examples, which the server didn't issue.
+	for _, algorithm := range digestAlgorithms {
+		valid, stale := verifyDigestRequest(a, algorithm, rfcDigestURI, rfcDigestURI, rfcDigestNonce, "00000001")
+		if valid || stale {
+			t.Errorf("%s: got (%v, %v) for a foreign nonce, expected (false, false)", algorithm, valid, stale)
+		}
+	}
+
+	nonce := newDigestNonces().issue()
+	valid, stale := verifyDigestRequest(a, "SHA-256", rfcDigestURI, rfcDigestURI, nonce, "00000001")
+	if valid || stale {
+		t.Errorf("got (%v, %v) for a nonce signed with another key", valid, stale)
+	}
+}
+
+func TestDigestRefusesMismatchedURIs(t *testing.T) {
+	a := newDigestTestAuth(t)
+	nonce := a.nonces.issue()
+
+	valid, stale := verifyDigestRequest(a, "SHA-256", "/dir/secret.html", rfcDigestURI, nonce, "00000001")
+	if valid || stale {
+		t.Errorf("got (%v, %v) for credentials for another uri", valid, stale)
+	}
+
+	// the same credentials are still good for the uri they are for.
+	valid, _ = verifyDigestRequest(a, "SHA-256", rfcDigestURI, rfcDigestURI, nonce, "00000001")
+	if !valid {
+		t.Errorf("credentials are refused after a mismatched uri")
+	}
+}
+
+func TestDigestRefusesWrongPasswords(t *testing.T) {
+	a := newDigestTestAuth(t)
+	nonce := a.nonces.issue()
+
+	request := httptest.NewRequest("GET", rfcDigestURI, nil)
+	request.Header.Set("Authorization", fmt.Sprintf(
+		`Digest username="%s", realm="%s", uri="%s", algorithm=MD5, nonce="%s", ` +
+			`nc=00000001, cnonce="%s", qop=auth, response="%s"`,
+		rfcDigestUser, rfcDigestRealm, rfcDigestURI, nonce, rfcDigestCnonce,
+		digestResponse("MD5", "circle of life", rfcDigestURI, nonce, "00000001"),
+	))
+
+	if valid, stale := a.verifyDigest(request); valid || stale {
+		t.Errorf("got (%v, %v) for a wrong password", valid, stale)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the name of per-directory rule files, and how often a cached one is
+// checked for changes.
+const (
+	dirRulesFile = ".gohttpd"
+	dirRulesCheckInterval = 2 * time.Second
+)
+
+// dirRules are the rules of one .gohttpd file:
+//
+//	# only the office, with a password
+//	deny all
+//	allow 10.0.0.0/8, 192.168.1.0/24
+//	require auth
+//	listdir off
+//
+// Address rules of every directory along a request's path must let the
+// client in; for require and listdir, the deepest directory that sets
+// them decides.
+type dirRules struct {
+	denyAll bool
+	allow [][]netip.Prefix
+	deny [][]netip.Prefix
+	requireAuth *bool
+	listDir *bool
+}
+
+func parseDirRules(r io.Reader, path string) (*dirRules, error) {
+	rules := &dirRules{}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		directive, value, _ := strings.Cut(line, " ")
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch directive {
+		case "allow", "deny":
+			if value == "all" {
+				rules.denyAll = directive == "deny"
+				break
+			}
+
+			var prefixes []netip.Prefix
+			if prefixes, err = parseIPList(value); err == nil && len(prefixes) == 0 {
+				err = fmt.Errorf("expected all or addresses")
+			}
+
+			if directive == "allow" {
+				rules.allow = append(rules.allow, prefixes)
+			} else {
+				rules.deny = append(rules.deny, prefixes)
+			}
+
+		case "require":
+			if value != "auth" && value != "none" {
+				err = fmt.Errorf("expected require auth or require none")
+			}
+
+			required := value == "auth"
+			rules.requireAuth = &required
+
+		case "listdir":
+			if value != "on" && value != "off" {
+				err = fmt.Errorf("expected listdir on or listdir off")
+			}
+
+			on := value == "on"
+			rules.listDir = &on
+
+		default:
+			err = fmt.Errorf("unknown directive %q", directive)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+	}
+
+	return rules, scanner.Err()
+}
+
+// permits reports whether the rules let addr in: not when it is denied,
+// or when all are denied or some are allowed and it isn't one of them.
+func (r *dirRules) permits(addr netip.Addr) bool {
+	for _, prefixes := range r.deny {
+		if ipListContains(prefixes, addr) {
+			return false
+		}
+	}
+
+	if !r.denyAll && len(r.allow) == 0 {
+		return true
+	}
+
+	for _, prefixes := range r.allow {
+		if ipListContains(prefixes, addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dirRulesCache keeps the rules of each directory, including that it has
+// none, checking the files again when they may have changed.
+type dirRulesCache struct {
+	storage *fileStore
+	mu sync.Mutex
+	entries map[string]dirRulesEntry
+}
+
+type dirRulesEntry struct {
+	rules *dirRules
+	err error
+	modTime time.Time
+	checked time.Time
+}
+
+func newDirRulesCache(storage *fileStore) *dirRulesCache {
+	return &dirRulesCache{storage: storage, entries: map[string]dirRulesEntry{}}
+}
+
+// get returns the rules of the directory at dir, or nil if it has none.
+func (c *dirRulesCache) get(ctx context.Context, dir string) (*dirRules, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[dir]
+	c.mu.Unlock()
+
+	if ok && time.Since(entry.checked) < dirRulesCheckInterval {
+		return entry.rules, entry.err
+	}
+
+	path := filepath.Join(dir, dirRulesFile)
+	stat, err := c.storage.Stat(ctx, path)
+
+	switch {
+	case os.IsNotExist(err):
+		entry = dirRulesEntry{}
+	case err != nil:
+		return nil, err
+	case ok && stat.ModTime().Equal(entry.modTime):
+	default:
+		entry = dirRulesEntry{modTime: stat.ModTime()}
+
+		var file io.ReadCloser
+		if file, entry.err = c.storage.Open(ctx, path); entry.err == nil {
+			entry.rules, entry.err = parseDirRules(io.LimitReader(file, 64 << 10), path)
+			file.Close()
+		}
+
+		if entry.err != nil {
+			fmt.Println("invalid directory rules: ", entry.err)
+		}
+	}
+
+	entry.checked = time.Now()
+
+	c.mu.Lock()
+	c.entries[dir] = entry
+	c.mu.Unlock()
+
+	return entry.rules, entry.err
+}
+
+// applyDirRules checks the rule files of the directories from the root
+// down to the one holding path, which has been resolved to a file or, if
+// isDir, a directory. It returns the options to serve the request with,
+// or answers it and returns nil when the rules refuse it or can't be read.
+func applyDirRules(
+	writer http.ResponseWriter,
+	request *http.Request,
+	path string,
+	isDir bool,
+	opts *serverOptions,
+) *serverOptions {
+	ctx := request.Context()
+	trace := requestTraceFrom(ctx)
+
+	dir := path
+	if !isDir {
+		dir = filepath.Dir(path)
+	}
+
+	var dirs []string
+	for d := dir; ; d = filepath.Dir(d) {
+		dirs = append(dirs, d)
+		if d == "." || d == "/" || d == filepath.Dir(d) {
+			break
+		}
+	}
+
+	addr := remoteAddr(request)
+	requireAuth := false
+	var listDir *bool
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rules, err := opts.dirRules.get(ctx, dirs[i])
+		if err != nil {
+			trace.note("directory rules", "%s can't be used, 500", filepath.Join(dirs[i], dirRulesFile))
+			errorLog.print(request, "unable to read %s: %v", filepath.Join(dirs[i], dirRulesFile), err)
+			http.Error(writer, "Internal server error", 500)
+			return nil
+		}
+
+		if rules == nil {
+			continue
+		}
+
+		if !rules.permits(addr) {
+			trace.note("directory rules", "refused by %s, 403", filepath.Join(dirs[i], dirRulesFile))
+			http.Error(writer, "Forbidden", 403)
+			return nil
+		}
+
+		if rules.requireAuth != nil {
+			requireAuth = *rules.requireAuth
+		}
+
+		if rules.listDir != nil {
+			listDir = rules.listDir
+		}
+	}
+
+	// a signed URL takes the place of credentials, and without either,
+	// nobody can be let in.
+	if requireAuth && opts.signedURLs.valid(request) {
+		trace.note("directory rules", "credentials required, signed URL instead")
+		requireAuth = false
+	}
+
+	if requireAuth && opts.auth == nil {
+		trace.note("directory rules", "credentials required but none configured, 403")
+		http.Error(writer, "Forbidden", 403)
+		return nil
+	}
+
+	if requireAuth && !opts.auth.protects(request.URL.Path, opts) &&
+	   !opts.auth.authenticate(writer, request, opts) {
+		return nil
+	}
+
+	if listDir != nil && *listDir != opts.listDir {
+		trace.note("directory rules", "listdir %v", *listDir)
+		dirOpts := *opts
+		dirOpts.listDir = *listDir
+		opts = &dirOpts
+	}
+
+	return opts
+}
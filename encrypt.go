@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Encrypted files start with a magic string and a random salt, from which
+// and the master key the file's AES-256-GCM key is derived. The contents
+// follow in chunks of up to encChunkSize bytes, each sealed with a nonce
+// made of the chunk's number and a flag marking the last chunk, so that
+// chunks can't be reordered or the file truncated without detection.
+const (
+	encMagic = "ghtpenc1"
+	encSaltSize = 16
+	encHeaderSize = len(encMagic) + encSaltSize
+	encChunkSize = 64 << 10
+	encTagSize = 16
+)
+
+var errNotEncrypted = errors.New("file is not encrypted")
+
+// loadEncryptionKey reads the 32-byte master key, hex or base64 encoded,
+// from the named environment variable or from a file.
+func loadEncryptionKey(envName string, keyFile string) ([]byte, error) {
+	var encoded string
+
+	if envName != "" {
+		encoded = os.Getenv(envName)
+		if encoded == "" {
+			return nil, fmt.Errorf("%s is not set", envName)
+		}
+	} else {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded = string(data)
+	}
+
+	encoded = strings.TrimSpace(encoded)
+
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+	}
+
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("the key must be 32 bytes, hex or base64 encoded")
+	}
+
+	return key, nil
+}
+
+func fileCipher(key []byte, salt []byte) (cipher.AEAD, error) {
+	fileKey, err := hkdf.Key(sha256.New, key, salt, "gohttpd file encryption", 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+// plaintextSize returns the size of the contents of an encrypted file of
+// the given size.
+func plaintextSize(size int64) int64 {
+	size -= int64(encHeaderSize)
+	if size <= encTagSize {
+		return 0
+	}
+
+	chunks := (size + encChunkSize + encTagSize - 1) / (encChunkSize + encTagSize)
+	return size - chunks * encTagSize
+}
+
+// encryptedFileInfo reports the size of an encrypted file's contents.
+type encryptedFileInfo struct {
+	os.FileInfo
+}
+
+func (fi encryptedFileInfo) Size() int64 {
+	return plaintextSize(fi.FileInfo.Size())
+}
+
+func decryptedFileInfo(stat os.FileInfo) os.FileInfo {
+	if !stat.Mode().IsRegular() {
+		return stat
+	}
+
+	return encryptedFileInfo{stat}
+}
+
+// decryptingReader decrypts an encrypted file as it is read.
+type decryptingReader struct {
+	io.Closer
+	r *bufio.Reader
+	aead cipher.AEAD
+	counter uint64
+	chunk []byte
+	plain []byte
+	err error
+}
+
+func newDecryptingReader(body io.ReadCloser, key []byte) (io.ReadCloser, error) {
+	r := bufio.NewReaderSize(body, encChunkSize + encTagSize)
+
+	header := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(encMagic)]) != encMagic {
+		body.Close()
+		return nil, errNotEncrypted
+	}
+
+	aead, err := fileCipher(key, header[len(encMagic):])
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	return &decryptingReader{
+		Closer: body,
+		r: r,
+		aead: aead,
+		chunk: make([]byte, encChunkSize + encTagSize),
+	}, nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+
+		d.err = d.nextChunk()
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptingReader) nextChunk() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	if err == io.EOF {
+		return errors.New("encrypted file is truncated")
+	}
+
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	// a full chunk is the last one when nothing follows it.
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	d.plain, err = d.aead.Open(d.chunk[:0], chunkNonce(d.counter, last), d.chunk[:n], nil)
+	if err != nil {
+		return errors.New("encrypted file is corrupt or was encrypted with another key")
+	}
+
+	d.counter++
+	if last {
+		return io.EOF
+	}
+
+	return nil
+}
+
+// encryptFile writes the encrypted contents of src to w.
+func encryptFile(w io.Writer, src io.Reader, key []byte) error {
+	header := make([]byte, encHeaderSize)
+	copy(header, encMagic)
+	if _, err := rand.Read(header[len(encMagic):]); err != nil {
+		return err
+	}
+
+	aead, err := fileCipher(key, header[len(encMagic):])
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	r := bufio.NewReaderSize(src, encChunkSize)
+	chunk := make([]byte, encChunkSize, encChunkSize + encTagSize)
+
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(r, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		last := err != nil
+		if !last {
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+
+		sealed := aead.Seal(chunk[:0], chunkNonce(counter, last), chunk[:n], nil)
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+
+		chunk = chunk[:encChunkSize]
+	}
+}
+
+// encryptCommand implements "httpd encrypt", which writes an encrypted
+// copy of a tree for serving with -encryption-key-env or
+// -encryption-key-file, or generates a new key.
+func encryptCommand(args []string) int {
+	flags := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	keyEnv := flags.String("key-env", "", "environment variable holding the key")
+	keyFile := flags.String("key-file", "", "file holding the key")
+	generate := flags.Bool("generate-key", false, "print a new random key and exit")
+	flags.Usage = func() {
+		fmt.Println("usage: httpd encrypt -generate-key")
+		fmt.Println("       httpd encrypt -key-env name|-key-file file source destination")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if *generate {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			fmt.Println("unable to generate key: ", err)
+			return 1
+		}
+
+		fmt.Println(hex.EncodeToString(key))
+		return 0
+	}
+
+	if flags.NArg() != 2 || (*keyEnv == "") == (*keyFile == "") {
+		flags.Usage()
+		return 1
+	}
+
+	key, err := loadEncryptionKey(*keyEnv, *keyFile)
+	if err != nil {
+		fmt.Println("unable to load key: ", err)
+		return 1
+	}
+
+	src, dest := flags.Arg(0), flags.Arg(1)
+	encrypted := 0
+
+	err = filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		if isHiddenPath(filepath.ToSlash(rel)) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		target := filepath.Join(dest, rel)
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		stat, err := os.Stat(path)
+		if err != nil || !stat.Mode().IsRegular() {
+			return err
+		}
+
+		if err := encryptPath(path, target, key); err != nil {
+			return err
+		}
+
+		encrypted++
+		return os.Chtimes(target, time.Now(), stat.ModTime())
+	})
+
+	if err != nil {
+		fmt.Println("unable to encrypt: ", err)
+		return 1
+	}
+
+	fmt.Println("* Encrypted", encrypted, "files to", dest)
+	return 0
+}
+
+func encryptPath(src string, dest string, key []byte) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	if err := encryptFile(out, in, key); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
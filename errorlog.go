@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errorLog is where internal errors go: storage failures, listings that
+// fail to render, transfers the server's side cut short, and panics with
+// their stack, each with the request it happened in, so that they can be
+// told apart from the 404s and aborted downloads of the access log. It
+// is the standard error, or the file named by -error-log.
+var errorLog = &serverErrorLog{}
+
+type serverErrorLog struct {
+	mu sync.Mutex
+	out io.Writer
+}
+
+// print logs an error that happened while serving request, which may be
+// nil for errors outside of requests.
+func (l *serverErrorLog) print(request *http.Request, format string, args ...any) {
+	var b strings.Builder
+	b.WriteString(time.Now().Format(time.RFC3339))
+	b.WriteString(" [error] ")
+
+	if request != nil {
+		id := ""
+		if fields := logFieldsFrom(request.Context()); fields != nil {
+			id = fields.requestID
+		}
+
+		fmt.Fprintf(&b, "%s %s %q %s: ", remoteAddr(request), request.Method, request.RequestURI, id)
+	}
+
+	fmt.Fprintf(&b, format, args...)
+	b.WriteString("\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// the standard error is looked up each time, since -syslog swaps it
+	// for a pipe once the server starts.
+	out := l.out
+	if out == nil {
+		out = os.Stderr
+	}
+
+	io.WriteString(out, b.String())
+}
+
+// recoverPanic is deferred around serving a request, and logs a panic with
+// its stack instead of leaving it to net/http, which only writes it to the
+// standard error and drops the connection. Before the response started,
+// the client gets a 500; after, the response can only be cut short, which
+// the caller is told to do once the request is logged.
+func recoverPanic(writer http.ResponseWriter, request *http.Request, recorder *responseRecorder, abort *bool) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	if r == http.ErrAbortHandler {
+		*abort = true
+		return
+	}
+
+	errorLog.print(request, "panic: %v\n%s", r, debug.Stack())
+
+	if recorder.status == 0 {
+		http.Error(writer, "Internal server error", 500)
+	} else {
+		*abort = true
+	}
+}
+
+// clientGone reports whether err, from sending a response, came from the
+// client going away or being cut off for being too slow, rather than
+// from the server's side.
+func clientGone(ctx context.Context, err error) bool {
+	return ctx.Err() != nil ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// exportWriter is the http.ResponseWriter for "httpd export", which
+// streams a successful response body to a file and discards the rest.
+type exportWriter struct {
+	header http.Header
+	status int
+	path string
+	file *os.File
+	err error
+}
+
+func (w *exportWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *exportWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *exportWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(200)
+
+	if w.status != 200 {
+		return len(p), nil
+	}
+
+	if w.file == nil && w.err == nil {
+		w.file, w.err = createExportFile(w.path)
+	}
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	return w.file.Write(p)
+}
+
+func createExportFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	return os.Create(path)
+}
+
+// exportURL requests urlPath from the handler and writes the response to
+// dest if it succeeds, giving the file the response's modification time.
+// It returns whether a file was written.
+func exportURL(urlPath string, dest string, opts *serverOptions) (bool, error) {
+	u := &url.URL{Path: urlPath}
+	request, err := http.NewRequest("GET", u.RequestURI(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	writer := &exportWriter{header: http.Header{}, path: dest}
+	requestHandler(writer, request, opts)
+
+	if writer.status != 0 && writer.status != 200 {
+		return false, nil
+	}
+
+	if writer.file == nil && writer.err == nil {
+		writer.file, writer.err = createExportFile(dest)
+	}
+
+	if writer.err != nil {
+		return false, writer.err
+	}
+
+	if err := writer.file.Close(); err != nil {
+		return false, err
+	}
+
+	lastModified, err := http.ParseTime(writer.header.Get("Last-Modified"))
+	if err == nil {
+		os.Chtimes(dest, time.Now(), lastModified)
+	}
+
+	return true, nil
+}
+
+// exportCommand implements "httpd export", which writes what the server
+// would serve for a tree, such as directory listings, the default
+// language variant of index pages and clean URL aliases, to a plain
+// static tree that can be published to a CDN or object storage.
+func exportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	listDir := flags.Bool(
+		"listdir",
+		false,
+		"write listings for directories without an index page",
+	)
+	cleanURLs := flags.Bool(
+		"clean-urls",
+		false,
+		"also write name.html as name/index.html, for serving at /name",
+	)
+	defaultLang := flags.String(
+		"default-lang",
+		"en",
+		"language of the variant written for index pages",
+	)
+	humanSizes := flags.Bool(
+		"human-sizes",
+		false,
+		"show file sizes in listings as KB, MB or GB instead of bytes",
+	)
+	noIcons := flags.Bool(
+		"no-icons",
+		false,
+		"leave out the file type icons in listings",
+	)
+	listTheme := flags.String(
+		"list-theme",
+		"auto",
+		"color scheme of listings: auto (following the browser), light or dark",
+	)
+	listStylesheet := flags.String(
+		"list-stylesheet",
+		"",
+		"URL of a stylesheet loaded by listings after the built-in styles",
+	)
+	listTemplatePath := flags.String(
+		"list-template",
+		"",
+		"html/template file used for directory listings instead of the built-in one",
+	)
+	flags.Usage = func() {
+		fmt.Println("usage: httpd export [flags] source destination")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if !stringInSlice(*listTheme, listThemes) {
+		fmt.Println("invalid listing theme: ", *listTheme)
+		return 1
+	}
+
+	if *listTemplatePath != "" {
+		if err := loadListTemplate(*listTemplatePath); err != nil {
+			fmt.Println("unable to load listing template: ", err)
+			return 1
+		}
+	}
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 1
+	}
+
+	storage, err := newFileStore(flags.Arg(0), "all")
+	if err != nil {
+		fmt.Println("unable to use source: ", err)
+		return 1
+	}
+
+	src := storage.home
+
+	dest, err := filepath.Abs(flags.Arg(1))
+	if err != nil {
+		fmt.Println("unable to use destination: ", err)
+		return 1
+	}
+
+	if rel, err := filepath.Rel(src, dest); err == nil && !strings.HasPrefix(rel, "..") {
+		fmt.Println("the destination must be outside the source")
+		return 1
+	}
+
+	opts := &serverOptions{
+		storage: storage,
+		listDir: *listDir,
+		defaultLang: *defaultLang,
+		cleanURLs: *cleanURLs,
+		dirRedirect: 301,
+		staticListings: true,
+		humanSizes: *humanSizes,
+		noIcons: *noIcons,
+		listTheme: *listTheme,
+		listStylesheet: *listStylesheet,
+	}
+
+	// a directory's index page is exported for both the directory and
+	// the file itself.
+	exported := map[string]bool{}
+	written := 0
+
+	err = fs.WalkDir(os.DirFS(src), ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		slashPath := filepath.ToSlash(path)
+		if isHiddenPath(slashPath) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		var exports [][2]string
+
+		if entry.IsDir() {
+			urlPath := strings.TrimSuffix("/" + slashPath + "/", "./")
+			exports = append(exports, [2]string{urlPath, filepath.Join(path, "index.html")})
+		} else {
+			exports = append(exports, [2]string{"/" + slashPath, path})
+
+			name := entry.Name()
+			if opts.cleanURLs && strings.HasSuffix(name, ".html") &&
+			   !stringInSlice(name, indexFiles) {
+				alias := strings.TrimSuffix(path, ".html")
+				if _, err := storage.Stat(context.Background(), alias); os.IsNotExist(err) {
+					exports = append(exports, [2]string{
+						"/" + filepath.ToSlash(alias),
+						filepath.Join(alias, "index.html"),
+					})
+				}
+			}
+		}
+
+		for _, export := range exports {
+			if exported[export[1]] {
+				continue
+			}
+
+			ok, err := exportURL(export[0], filepath.Join(dest, export[1]), opts)
+			if err != nil {
+				return err
+			}
+
+			exported[export[1]] = true
+			if ok {
+				written++
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		fmt.Println("unable to export: ", err)
+		return 1
+	}
+
+	fmt.Println("* Exported", written, "files to", dest)
+	return 0
+}
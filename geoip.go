@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+)
+
+// the marker the metadata of a MaxMind database follows.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// geoIPDatabase looks up the countries of addresses in a MaxMind DB file,
+// such as GeoLite2-Country.mmdb or GeoIP2-City.mmdb, which is read into
+// memory whole. The format is a binary search tree on the bits of the
+// address whose leaves point into a data section of typed values.
+type geoIPDatabase struct {
+	tree []byte
+	data []byte
+	nodeCount uint
+	recordSize uint
+	ipVersion uint
+
+	// the node IPv4 addresses start from in an IPv6 tree.
+	ipv4Start uint
+
+	// countries by the offset of their record, which many networks share.
+	mu sync.Mutex
+	countries map[uint]string
+}
+
+// openGeoIPDatabase reads the database at path.
+func openGeoIPDatabase(path string) (*geoIPDatabase, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.LastIndex(file, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+
+	metadata, _, err := decodeMMDB(file[i + len(mmdbMetadataMarker):], 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+
+	fields, _ := metadata.(map[string]any)
+	nodeCount, _ := fields["node_count"].(uint64)
+	recordSize, _ := fields["record_size"].(uint64)
+	ipVersion, _ := fields["ip_version"].(uint64)
+
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 ||
+	   ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported record size %d or IP version %d", recordSize, ipVersion)
+	}
+
+	// the data section follows the tree and 16 zero bytes.
+	treeSize := nodeCount * recordSize / 4
+	if treeSize + 16 > uint64(i) {
+		return nil, errors.New("search tree is larger than the file")
+	}
+
+	db := &geoIPDatabase{
+		tree: file[:treeSize],
+		data: file[treeSize + 16:i],
+		nodeCount: uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion: uint(ipVersion),
+		countries: map[uint]string{},
+	}
+
+	if db.ipVersion == 6 {
+		for n := 0; n < 96 && db.ipv4Start < db.nodeCount; n++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *geoIPDatabase) record(node uint, bit byte) uint {
+	b := db.tree[node * db.recordSize / 4:]
+
+	switch db.recordSize {
+	case 24:
+		b = b[bit * 3:]
+		return uint(b[0]) << 16 | uint(b[1]) << 8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3] & 0xf0) << 20 | uint(b[0]) << 16 | uint(b[1]) << 8 | uint(b[2])
+		}
+
+		return uint(b[3] & 0x0f) << 24 | uint(b[4]) << 16 | uint(b[5]) << 8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit * 4:]))
+	}
+}
+
+// country returns the ISO 3166 code of the country of addr, or "" if the
+// database doesn't have it, as for private addresses.
+func (db *geoIPDatabase) country(addr netip.Addr) (string, error) {
+	addr = addr.Unmap()
+
+	node, bits := uint(0), addr.AsSlice()
+	if addr.Is4() && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if !addr.Is4() && db.ipVersion == 4 {
+		return "", nil
+	}
+
+	for i := 0; i < len(bits) * 8 && node < db.nodeCount; i++ {
+		node = db.record(node, bits[i / 8] >> (7 - i % 8) & 1)
+	}
+
+	if node <= db.nodeCount {
+		return "", nil
+	}
+
+	offset := node - db.nodeCount - 16
+
+	db.mu.Lock()
+	code, ok := db.countries[offset]
+	db.mu.Unlock()
+
+	if ok {
+		return code, nil
+	}
+
+	if offset >= uint(len(db.data)) {
+		return "", errors.New("invalid data pointer in search tree")
+	}
+
+	value, _, err := decodeMMDB(db.data, offset)
+	if err != nil {
+		return "", err
+	}
+
+	// the country the address is in, or else the one its network is
+	// registered in, as for some anycast and satellite networks.
+	fields, _ := value.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := fields[key].(map[string]any)
+		if code, _ = country["iso_code"].(string); code != "" {
+			break
+		}
+	}
+
+	db.mu.Lock()
+	db.countries[offset] = code
+	db.mu.Unlock()
+
+	return code, nil
+}
+
+// decodeMMDB decodes the value at offset in a MaxMind DB data section,
+// returning it and the offset following it. Maps become map[string]any,
+// arrays []any, and integers uint64 or int64.
+func decodeMMDB(data []byte, offset uint) (any, uint, error) {
+	errTruncated := errors.New("truncated data section")
+
+	next := func(n uint) ([]byte, error) {
+		if offset + n > uint(len(data)) {
+			return nil, errTruncated
+		}
+
+		b := data[offset:offset + n]
+		offset += n
+		return b, nil
+	}
+
+	b, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	kind, size := uint(b[0] >> 5), uint(b[0] & 0x1f)
+
+	// pointers are to a value elsewhere in the section, which is decoded
+	// in their place.
+	if kind == 1 {
+		n := (size >> 3) + 1
+		p, err := next(n)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		target := uint(0)
+		if n < 4 {
+			target = size & 0x7
+		}
+
+		for _, c := range p {
+			target = target << 8 | uint(c)
+		}
+
+		target += []uint{0, 2048, 526336, 0}[n - 1]
+
+		value, _, err := decodeMMDB(data, target)
+		return value, offset, err
+	}
+
+	if kind == 0 {
+		if b, err = next(1); err != nil {
+			return nil, 0, err
+		}
+
+		kind = 7 + uint(b[0])
+	}
+
+	if size >= 29 {
+		n := size - 28
+		if b, err = next(n); err != nil {
+			return nil, 0, err
+		}
+
+		size = []uint{29, 285, 65821}[n - 1]
+		extra := uint(0)
+		for _, c := range b {
+			extra = extra << 8 | uint(c)
+		}
+
+		size += extra
+	}
+
+	switch kind {
+	case 2, 4:
+		if b, err = next(size); err != nil {
+			return nil, 0, err
+		}
+
+		if kind == 2 {
+			return string(b), offset, nil
+		}
+
+		return bytes.Clone(b), offset, nil
+	case 3, 15:
+		if b, err = next(size); err != nil || size != 8 && size != 4 {
+			return nil, 0, errTruncated
+		}
+
+		if size == 4 {
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 5, 6, 8, 9, 10:
+		if b, err = next(size); err != nil {
+			return nil, 0, err
+		}
+
+		// 128-bit integers don't fit, and only their low bits are kept.
+		value := uint64(0)
+		for _, c := range b {
+			value = value << 8 | uint64(c)
+		}
+
+		if kind == 8 {
+			return int64(int32(value)), offset, nil
+		}
+
+		return value, offset, nil
+	case 7:
+		fields := make(map[string]any, min(size, 64))
+		for range size {
+			var key, value any
+			if key, offset, err = decodeMMDB(data, offset); err != nil {
+				return nil, 0, err
+			}
+
+			if value, offset, err = decodeMMDB(data, offset); err != nil {
+				return nil, 0, err
+			}
+
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+
+			fields[name] = value
+		}
+
+		return fields, offset, nil
+	case 11:
+		values := make([]any, 0, min(size, 64))
+		for range size {
+			var value any
+			if value, offset, err = decodeMMDB(data, offset); err != nil {
+				return nil, 0, err
+			}
+
+			values = append(values, value)
+		}
+
+		return values, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	}
+
+	return nil, 0, fmt.Errorf("unknown data type %d", kind)
+}
+
+// geoAccess restricts who may make requests by the country of their IP
+// address, with -allow-country and -deny-country lists for the whole
+// server and for paths, which work like those of accessControl. Addresses
+// the database doesn't have, such as private ones, are in the country
+// "--".
+type geoAccess struct {
+	db *geoIPDatabase
+	allow []string
+	deny []string
+	rules []geoAccessRule
+	status int
+}
+
+// geoAccessRule is an allow or deny list of countries for the paths
+// matching pattern.
+type geoAccessRule struct {
+	pattern string
+	allow bool
+	countries []string
+}
+
+// parseCountryList parses comma-separated ISO 3166 country codes.
+func parseCountryList(s string) ([]string, error) {
+	var countries []string
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.ToUpper(strings.TrimSpace(field))
+		if field == "" {
+			continue
+		}
+
+		if len(field) != 2 || field != "--" && strings.Trim(field, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return nil, fmt.Errorf("invalid country code %q", field)
+		}
+
+		countries = append(countries, field)
+	}
+
+	return countries, nil
+}
+
+// permits reports whether clients in country may request urlPath, and if
+// not, which list they were refused by.
+func (g *geoAccess) permits(country string, urlPath string, opts *serverOptions) (bool, string) {
+	if stringInSlice(country, g.deny) {
+		return false, "-deny-country"
+	}
+
+	if len(g.allow) > 0 && !stringInSlice(country, g.allow) {
+		return false, "-allow-country"
+	}
+
+	for _, rule := range g.rules {
+		if !pathMatchesAny([]string{rule.pattern}, urlPath, opts) {
+			continue
+		}
+
+		if rule.allow && !stringInSlice(country, rule.countries) {
+			return false, "-allow-country-path " + rule.pattern
+		}
+
+		if !rule.allow && stringInSlice(country, rule.countries) {
+			return false, "-deny-country-path " + rule.pattern
+		}
+	}
+
+	return true, ""
+}
+
+// check lets request through if its client's country is permitted, and
+// otherwise answers it with the configured 403 or 404.
+func (g *geoAccess) check(writer http.ResponseWriter, request *http.Request, opts *serverOptions) bool {
+	trace := requestTraceFrom(request.Context())
+
+	country, err := g.db.country(remoteAddr(request))
+	if err != nil {
+		trace.note("geoip", "lookup failed: %v, 500", err)
+		errorLog.print(request, "GeoIP lookup failed: %v", err)
+		http.Error(writer, "Internal server error", 500)
+		return false
+	}
+
+	if country == "" {
+		country = "--"
+	}
+
+	ok, list := g.permits(country, request.URL.Path, opts)
+	if ok {
+		return true
+	}
+
+	trace.note("geoip", "country %s refused by %s, %d", country, list, g.status)
+
+	if g.status == 404 {
+		http.Error(writer, "File not found", 404)
+	} else {
+		http.Error(writer, "Forbidden", 403)
+	}
+
+	return false
+}
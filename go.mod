@@ -0,0 +1,3 @@
+module github.com/supriyo-biswas/gohttpd
+
+go 1.24
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// how long the home directory may take to answer a readiness check.
+const readinessTimeout = 2 * time.Second
+
+// healthState is what the health endpoints report on, for load balancers
+// and orchestrators to probe without touching any content.
+type healthState struct {
+	storage *fileStore
+
+	// set once the listener accepts connections, and cleared again when
+	// the server starts shutting down.
+	serving atomic.Bool
+}
+
+// serveHealth answers /healthz, which says the process is up and handling
+// requests.
+func (h *healthState) serveHealth(writer http.ResponseWriter, request *http.Request) {
+	writeHealth(writer, true, nil)
+}
+
+// serveReady answers /readyz, which says whether the server should be sent
+// traffic: the listener is serving and the home directory can be read.
+// Only the last can take long, on a hung network filesystem.
+func (h *healthState) serveReady(writer http.ResponseWriter, request *http.Request) {
+	checks := map[string]string{"listener": "ok", "docroot": "ok"}
+	ready := true
+
+	if !h.serving.Load() {
+		checks["listener"] = "not serving"
+		ready = false
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), readinessTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.checkDocroot(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			checks["docroot"] = err.Error()
+			ready = false
+		}
+	case <-ctx.Done():
+		checks["docroot"] = "timed out after " + readinessTimeout.String()
+		ready = false
+	}
+
+	writeHealth(writer, ready, checks)
+}
+
+// checkDocroot reads the home directory, and checks that it is still the
+// one at its path, which it isn't once it was deleted or unmounted, even
+// though the directory opened at startup can still be read.
+func (h *healthState) checkDocroot(ctx context.Context) error {
+	if _, err := h.storage.Stat(ctx, "."); err != nil {
+		return err
+	}
+
+	if h.storage.root == nil {
+		return nil
+	}
+
+	served, err := h.storage.root.Stat(".")
+	if err != nil {
+		return err
+	}
+
+	current, err := os.Stat(h.storage.home)
+	if err != nil {
+		return err
+	}
+
+	if !os.SameFile(served, current) {
+		return errors.New("directory was replaced or unmounted")
+	}
+
+	return nil
+}
+
+func writeHealth(writer http.ResponseWriter, ok bool, checks map[string]string) {
+	status, code := "ok", 200
+	if !ok {
+		status, code = "unavailable", 503
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(code)
+
+	json.NewEncoder(writer).Encode(struct {
+		Status string `json:"status"`
+		Checks map[string]string `json:"checks,omitempty"`
+	}{status, checks})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// the extensions -hotlink-domains protects by default: images, audio and
+// video, which is what other sites embed.
+const defaultHotlinkExts = "avif,bmp,flac,gif,ico,jpeg,jpg,m4a,m4v,mkv,mov,mp3,mp4,oga,ogg,ogv,opus,png,svg,wav,webm,webp"
+
+// hotlinkProtection refuses requests for media files made from pages of
+// other sites, which browsers tell by the Referer header. Requests
+// without one, such as those of people opening a file directly or of
+// browsers that hide it, are always served.
+type hotlinkProtection struct {
+	domains []string
+	exts []string
+	redirect string
+}
+
+// protects reports whether the file at urlPath is protected.
+func (h *hotlinkProtection) protects(urlPath string) bool {
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(urlPath)), ".")
+	return ext != "" && stringInSlice(ext, h.exts)
+}
+
+// allowed reports whether a request for a protected file may be served:
+// when it comes from this site or an allowed one.
+func (h *hotlinkProtection) allowed(request *http.Request) bool {
+	referer := request.Header.Get("Referer")
+	if referer == "" {
+		return true
+	}
+
+	// the replacement image is embedded by the same pages.
+	if h.redirect != "" && request.URL.Path == h.redirect {
+		return true
+	}
+
+	refererURL, err := url.Parse(referer)
+	if err != nil || refererURL.Host == "" {
+		return false
+	}
+
+	if hostAllowed(refererURL.Host, []string{hostOnly(request.Host)}) {
+		return true
+	}
+
+	return len(h.domains) > 0 && hostAllowed(refererURL.Host, h.domains)
+}
+
+// hostOnly returns host without its port, in lower case.
+func hostOnly(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// check lets request through if it isn't hotlinked, and otherwise answers
+// it with a 403 or a redirect to the replacement.
+func (h *hotlinkProtection) check(writer http.ResponseWriter, request *http.Request) bool {
+	if !h.protects(request.URL.Path) {
+		return true
+	}
+
+	// caches must not hand a response for one page to another.
+	addVary(writer.Header(), "Referer")
+
+	if h.allowed(request) {
+		return true
+	}
+
+	trace := requestTraceFrom(request.Context())
+
+	if h.redirect != "" {
+		trace.note("hotlink", "from %s, redirected", request.Header.Get("Referer"))
+		writer.Header().Set("Location", h.redirect)
+		writer.WriteHeader(302)
+		return false
+	}
+
+	trace.note("hotlink", "from %s, 403", request.Header.Get("Referer"))
+	http.Error(writer, "Forbidden", 403)
+	return false
+}
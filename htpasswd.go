@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the credentials file is checked for changes.
+const htpasswdCheckInterval = 2 * time.Second
+
+// htpasswdFile holds the users of an Apache htpasswd file, which is read
+// again whenever it changes. bcrypt ("$2y$"), MD5 ("$apr1$") and SHA-1
+// ("{SHA}") hashes are supported. For Digest authentication, the file
+// also takes htdigest lines, "user:realm:hash", with the MD5 or SHA-256
+// hash of "user:realm:password".
+type htpasswdFile struct {
+	path string
+
+	mu sync.Mutex
+	users map[string]string
+	digests map[string]string
+	modTime time.Time
+	checked time.Time
+
+	// bcrypt is slow by design, so passwords that were accepted are
+	// remembered, by a hash of the password and the user's hash.
+	verified map[string]bool
+}
+
+func loadHtpasswd(path string) (*htpasswdFile, error) {
+	f := &htpasswdFile{path: path}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.load(stat.ModTime()); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *htpasswdFile) load(modTime time.Time) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	users, digests, err := parseHtpasswd(file, f.path)
+	if err != nil {
+		return err
+	}
+
+	f.users, f.digests, f.modTime, f.checked = users, digests, modTime, time.Now()
+	f.verified = map[string]bool{}
+	return nil
+}
+
+// parseHtpasswd reads "user:hash" lines, and "user:realm:hash" lines
+// into digests, keyed by digestKey, skipping blank lines and comments.
+func parseHtpasswd(r io.Reader, path string) (map[string]string, map[string]string, error) {
+	users := map[string]string{}
+	digests := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, nil, fmt.Errorf("%s:%d: expected user:hash", path, lineNum)
+		}
+
+		if realm, ha1, ok := strings.Cut(hash, ":"); ok {
+			algorithm := digestAlgorithmForHash(ha1)
+			if algorithm == "" {
+				return nil, nil, fmt.Errorf("%s:%d: expected an MD5 or SHA-256 hash for %s", path, lineNum, user)
+			}
+
+			digests[digestKey(user, realm, algorithm)] = strings.ToLower(ha1)
+			continue
+		}
+
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "$apr1$") &&
+		   !strings.HasPrefix(hash, "{SHA}") {
+			return nil, nil, fmt.Errorf("%s:%d: unsupported hash for %s, use bcrypt (htpasswd -B)", path, lineNum, user)
+		}
+
+		users[user] = hash
+	}
+
+	return users, digests, scanner.Err()
+}
+
+// digestHA1 returns the stored hash of "user:realm:password" for Digest
+// authentication with algorithm.
+func (f *htpasswdFile) digestHA1(user string, realm string, algorithm string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.reload()
+	ha1, ok := f.digests[digestKey(user, realm, algorithm)]
+	return ha1, ok
+}
+
+// hasDigests reports whether any user has a hash for realm and algorithm.
+func (f *htpasswdFile) hasDigests(realm string, algorithm string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.reload()
+	for key := range f.digests {
+		_, rest, _ := strings.Cut(key, "\x00")
+		if rest == realm + "\x00" + algorithm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reload reads the file again if it changed, keeping the current users if
+// it can't be read.
+func (f *htpasswdFile) reload() {
+	if time.Since(f.checked) < htpasswdCheckInterval {
+		return
+	}
+
+	f.checked = time.Now()
+
+	stat, err := os.Stat(f.path)
+	if err != nil || stat.ModTime().Equal(f.modTime) {
+		return
+	}
+
+	if err := f.load(stat.ModTime()); err != nil {
+		fmt.Println("unable to reload credentials: ", err)
+	}
+}
+
+// verify reports whether password is user's password.
+func (f *htpasswdFile) verify(user string, password string) bool {
+	f.mu.Lock()
+	f.reload()
+	hash, ok := f.users[user]
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(hash + "\x00" + password)))
+	cached := f.verified[key]
+	f.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	if cached {
+		return true
+	}
+
+	var valid bool
+
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		var err error
+		if valid, err = bcryptVerify(hash, password); err != nil {
+			fmt.Println("invalid bcrypt hash for", user)
+		}
+
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.TrimPrefix(hash, "$apr1$")
+		if i := strings.Index(salt, "$"); i >= 0 {
+			salt = salt[:i]
+		}
+
+		valid = subtle.ConstantTimeCompare([]byte(apr1Hash(password, salt)), []byte(hash)) == 1
+
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		encoded := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		valid = subtle.ConstantTimeCompare([]byte(encoded), []byte(hash)) == 1
+	}
+
+	if valid {
+		f.mu.Lock()
+		if len(f.verified) < 1024 {
+			f.verified[key] = true
+		}
+
+		f.mu.Unlock()
+	}
+
+	return valid
+}
+
+// the alphabet of crypt(3) style hashes.
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1Hash computes Apache's variant of the MD5-based crypt(3) hash, as
+// written by htpasswd -m.
+func apr1Hash(password string, salt string) string {
+	const magic = "$apr1$"
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.Sum([]byte(password + salt + password))
+
+	h := md5.New()
+	io.WriteString(h, password + magic + salt)
+	for n := len(password); n > 0; n -= 16 {
+		h.Write(alt[:min(n, 16)])
+	}
+
+	for n := len(password); n != 0; n >>= 1 {
+		if n & 1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write([]byte{password[0]})
+		}
+	}
+
+	sum := h.Sum(nil)
+
+	// a thousand rounds, to slow down guessing.
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i & 1 != 0 {
+			io.WriteString(h, password)
+		} else {
+			h.Write(sum)
+		}
+
+		if i % 3 != 0 {
+			io.WriteString(h, salt)
+		}
+
+		if i % 7 != 0 {
+			io.WriteString(h, password)
+		}
+
+		if i & 1 != 0 {
+			h.Write(sum)
+		} else {
+			io.WriteString(h, password)
+		}
+
+		sum = h.Sum(nil)
+	}
+
+	var b strings.Builder
+	b.WriteString(magic + salt + "$")
+
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(cryptAlphabet[v & 0x3f])
+			v >>= 6
+		}
+	}
+
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(sum[g[0]]) << 16 | uint32(sum[g[1]]) << 8 | uint32(sum[g[2]]), 4)
+	}
+
+	encode(uint32(sum[11]), 2)
+	return b.String()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// known answers from the OpenBSD and jBCrypt test suites, checked against
+// crypt(3); 2b and 2y hash like 2a for passwords like these.
+var bcryptTests = []struct {
+	password string
+	hash string
+}{
+	{"U*U", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+	{"U*U*", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.VGOzA784oUp/Z0DY336zx7pLYAy0lwK"},
+	{"", "$2a$06$DCq7YPn5Rq63x1Lad4cll.TV4S6ytwfsfvkgY8jIucDrjc8deX1s."},
+	{"U*U", "$2b$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+	{"U*U", "$2y$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+	{
+		"0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789chars after 72 are ignored",
+		"$2a$05$abcdefghijklmnopqrstuu5s2v8.iXieOjg/.AySBTTZIIVFJeBui",
+	},
+}
+
+func TestBcryptKnownAnswers(t *testing.T) {
+	for _, test := range bcryptTests {
+		valid, err := bcryptVerify(test.hash, test.password)
+		if err != nil || !valid {
+			t.Errorf("%q against %s: got %v, %v, expected a match", test.password, test.hash, valid, err)
+		}
+
+		valid, err = bcryptVerify(test.hash, "x" + test.password)
+		if err != nil || valid {
+			t.Errorf("%q against %s: got %v, %v, expected no match", "x" + test.password, test.hash, valid, err)
+		}
+	}
+}
+
+func TestBcryptRejectsInvalidHashes(t *testing.T) {
+	hashes := []string{
+		"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOe",
+		"$2a$05$CCCCCCCCCCCCCCCCCCCCC.",
+		"$2x$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$2a$03$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$2a$5$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"",
+	}
+
+	for _, hash := range hashes {
+		if valid, err := bcryptVerify(hash, "U*U"); valid || err == nil {
+			t.Errorf("%q: got %v, %v, expected an invalid hash", hash, valid, err)
+		}
+	}
+}
+
+// hashes written by openssl passwd -apr1 -salt r31.Xw2x.
+var apr1Tests = []struct {
+	password string
+	hash string
+}{
+	{"secret", "$apr1$r31.Xw2x$lmvzwL/aJg3Jlc7O0TVjj/"},
+	{"", "$apr1$r31.Xw2x$KEJ8L8DVsyP7LFMtqYsi41"},
+	{"p@ss w0rd", "$apr1$r31.Xw2x$QWNDDXUokzUUk0yKprwIR0"},
+}
+
+func TestApr1KnownAnswers(t *testing.T) {
+	for _, test := range apr1Tests {
+		if got := apr1Hash(test.password, "r31.Xw2x"); got != test.hash {
+			t.Errorf("apr1Hash(%q) = %s, expected %s", test.password, got, test.hash)
+		}
+	}
+}
+
+// newTestHtpasswd returns an htpasswd file of the given lines, which is
+// not read again from disk.
+func newTestHtpasswd(t *testing.T, lines ...string) *htpasswdFile {
+	users, digests, err := parseHtpasswd(strings.NewReader(strings.Join(lines, "\n")), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &htpasswdFile{
+		users: users,
+		digests: digests,
+		checked: time.Now(),
+		verified: map[string]bool{},
+	}
+}
+
+func TestHtpasswdVerify(t *testing.T) {
+	f := newTestHtpasswd(t,
+		"bcrypt:" + bcryptTests[0].hash,
+		"apr1:" + apr1Tests[0].hash,
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"short-bcrypt:" + bcryptTests[0].hash[:40],
+		"short-apr1:" + apr1Tests[0].hash[:20],
+		"short-sha:{SHA}5en6G6MezRroT3XKqkdPOm",
+	)
+
+	tests := []struct {
+		user string
+		password string
+		want bool
+	}{
+		{"bcrypt", "U*U", true},
+		{"bcrypt", "U*U*", false},
+		{"apr1", "secret", true},
+		{"apr1", "Secret", false},
+		{"sha", "secret", true},
+		{"sha", "secret ", false},
+		{"short-bcrypt", "U*U", false},
+		{"short-apr1", "secret", false},
+		{"short-sha", "secret", false},
+		{"nobody", "secret", false},
+	}
+
+	// twice, the second time from what was remembered of the first.
+	for round := 0; round < 2; round++ {
+		for _, test := range tests {
+			if got := f.verify(test.user, test.password); got != test.want {
+				t.Errorf("verify(%q, %q) = %v, expected %v", test.user, test.password, got, test.want)
+			}
+		}
+	}
+}
+
+func TestParseHtpasswdRejectsUnsupportedHashes(t *testing.T) {
+	for _, line := range []string{"bob:plaintext", "bob:$1$salt$hash", ":{SHA}x"} {
+		if _, _, err := parseHtpasswd(strings.NewReader(line), "test"); err == nil {
+			t.Errorf("%q was accepted", line)
+		}
+	}
+}
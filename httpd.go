@@ -1,18 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"html"
 	"html/template"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
-	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -20,11 +36,13 @@ var mimes = map[string]string {
 	// common web types
 	"html" : "text/html",
 	"js"   : "application/javascript",
+	"mjs"  : "application/javascript",
 	"css"  : "text/css",
 	"xml"  : "text/xml",
 	"xhtml": "application/xhtml+xml",
 	"txt"  : "text/plain",
 	"json" : "application/json",
+	"wasm" : "application/wasm",
 
 	// images
 	"png"  : "image/png",
@@ -33,6 +51,7 @@ var mimes = map[string]string {
 	"gif"  : "image/gif",
 	"svg"  : "image/svg+xml",
 	"webp" : "image/webp",
+	"avif" : "image/avif",
 	"ico"  : "image/x-icon",
 
 	// media
@@ -46,6 +65,10 @@ var mimes = map[string]string {
 	"webm" : "video/webm",
 	"m3u8" : "application/vnd.apple.mpegurl",
 
+	// 3d models
+	"gltf" : "model/gltf+json",
+	"glb"  : "model/gltf-binary",
+
 	// fonts
 	"eot"  : "application/vnd.ms-fontobject",
 	"ttf"  : "font/ttf",
@@ -83,21 +106,275 @@ var indexFiles = []string {
 	"index.xhtml",
 }
 
+type serverOptions struct {
+	storage *fileStore
+	listDir bool
+	defaultLang string
+	peerCache *peerCache
+	charset string
+	charsetPaths prefixList
+	headers pathHeaders
+	dirRedirect int
+	cleanURLs bool
+	cleanURLsRedirect bool
+	serverHeader string
+	deadlines prefixList
+	allowedHosts []string
+
+	// proxies in front whose X-Forwarded-For and X-Request-ID are
+	// believed, and whether the ID is sent back in the response.
+	trustedProxies []netip.Prefix
+	echoRequestID bool
+	humanSizes bool
+	noIcons bool
+	listTheme string
+	listStylesheet string
+	listPageSize int
+	userDirs *userDirs
+	caseInsensitive bool
+	normalize string
+	archives bool
+	methodHint string
+	logIP string
+	logFormat string
+	logNoAgent bool
+	strictPrivacy bool
+	noList stringList
+	listCache *listingCache
+	robots prefixList
+	noAI stringList
+	crawlDelay int
+	bandwidth *bandwidthLimiter
+	treeDepth int
+	fileConnections *fileConnections
+	auth *auth
+	signedURLs *signedURLs
+	secretPrefix string
+	access *accessControl
+	geoAccess *geoAccess
+	userAgents *userAgentFilter
+	rateLimit *rateLimiter
+	bans *banList
+	audit *auditLog
+	requestLimit *requestLimit
+	maxURLLength int
+	bodyLimits *bodyLimits
+	securityHeaders *securityHeaders
+	hotlink *hotlinkProtection
+	dirRules *dirRulesCache
+	maxQueryLength int
+	suggestedConnections int
+	digests *digestCache
+
+	// set for listings that are saved as static files, which can't be
+	// re-sorted through query parameters.
+	staticListings bool
+	stats *requestStats
+	quiet bool
+
+	// where the access log goes, a file or syslog, or nil for the
+	// standard output.
+	accessLog io.Writer
+
+	// counted for the admin listener, where they are served at
+	// metricsPath to whoever is in adminUsers, if set.
+	metrics *serverMetrics
+	metricsPath string
+	adminUsers *htpasswdFile
+
+	health *healthState
+	adminDebug bool
+
+	// where a span per request is sent, if anywhere.
+	tracer *otlpExporter
+}
+
+type prefixValue struct {
+	prefix string
+	value string
+}
+
+// prefixList is a repeatable "prefix=value" flag that associates values
+// with URL path prefixes.
+type prefixList []prefixValue
+
+func (l *prefixList) String() string {
+	var values []string
+	for _, v := range *l {
+		values = append(values, v.prefix + "=" + v.value)
+	}
+
+	return strings.Join(values, ",")
+}
+
+func (l *prefixList) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 1 || !strings.HasPrefix(s, "/") {
+		return fmt.Errorf("expected /prefix=value, got %q", s)
+	}
+
+	*l = append(*l, prefixValue{prefix: s[:i], value: s[i + 1:]})
+	return nil
+}
+
+func (l *prefixList) repeatable() {}
+
+// lookup returns the value for the longest prefix matching path, which
+// like other path patterns matches whole segments, so that /api doesn't
+// cover /apiary.
+func (l prefixList) lookup(path string) (string, bool) {
+	match := -1
+
+	for i, v := range l {
+		if pathMatches(v.prefix, path) &&
+		   (match == -1 || len(v.prefix) > len(l[match].prefix)) {
+			match = i
+		}
+	}
+
+	if match == -1 {
+		return "", false
+	}
+
+	return l[match].value, true
+}
+
+type listBreadcrumb struct {
+	Name string
+	URL string
+}
+
+// stringList is a repeatable flag collecting its values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func (l *stringList) repeatable() {}
+
+// listTemplateInfo is the data passed to the listing template, including
+// one given with -list-template.
 type listTemplateInfo struct {
 	Path string
+	BaseHref string
 	Files []os.FileInfo
+
+	// relative URL of the parent directory, empty at the root, and the
+	// path from the root to this directory with relative URLs; both
+	// are filled in by renderListing.
+	Parent string
+	Breadcrumbs []listBreadcrumb
+
+	// page of the listing, counting from 1, the number of pages, entries
+	// per page (0 when not paged), the total number of entries and the
+	// relative URLs of the previous and next pages, if any.
+	Page int
+	Pages int
+	PerPage int
+	Total int
+	PrevURL string
+	NextURL string
+
+	// whether sizes are shown as e.g. "1.5 MB" instead of bytes, and
+	// whether entries get file type icons
+	HumanSizes bool
+	Icons bool
+
+	// Server header value, or "gohttpd" if there is none, and the Host
+	// the listing was requested for, which is empty in static listings.
+	Server string
+	Host string
+
+	// sort key (name, size or mtime) and order (asc or desc) of Files;
+	// Sortable is false when the listing can't be re-sorted by links,
+	// as in the static indexes from index-gen.
+	Sort string
+	Order string
+	Sortable bool
+
+	// the ?q= filter the entries were narrowed down with, if any.
+	Query string
+
+	// whether the directory can be downloaded with ?archive=.
+	Archives bool
+
+	// color scheme of the listing: auto (following the browser's
+	// preference), light or dark, and the URL of a stylesheet loaded
+	// after the built-in styles, if any.
+	Theme string
+	Stylesheet string
+
+	// contents of the directory's HEADER.html, shown above the files,
+	// and of its README.md, rendered, or README.txt, shown below them.
+	Header template.HTML
+	Readme template.HTML
 }
 
 var listTemplate = `
 <!DOCTYPE html>
-<html>
+<html{{ if ne .Theme "auto" }} data-theme="{{ .Theme }}"{{ end }}>
 <head>
   <title>Index of {{ .Path }}</title>
+  {{ if .BaseHref }}<base href="{{ .BaseHref }}">{{ end }}
   <meta name="viewport" content="width=device-width, initial-scale=1.0">
+  <meta name="color-scheme" content="{{ if eq .Theme "auto" }}light dark{{ else }}{{ .Theme }}{{ end }}">
   <style>
+    :root {
+      --background: #fff;
+      --text: #222;
+      --link: #0645ad;
+      --visited: #6b4ba1;
+      --muted: #666;
+      --border: #ccc;
+      --hover: #f2f2f2;
+    }
+    @media (prefers-color-scheme: dark) {
+      :root:not([data-theme="light"]) {
+        --background: #1b1c1e;
+        --text: #ddd;
+        --link: #8ab4f8;
+        --visited: #c58af9;
+        --muted: #999;
+        --border: #444;
+        --hover: #2a2b2e;
+      }
+    }
+    :root[data-theme="dark"] {
+      --background: #1b1c1e;
+      --text: #ddd;
+      --link: #8ab4f8;
+      --visited: #c58af9;
+      --muted: #999;
+      --border: #444;
+      --hover: #2a2b2e;
+    }
     html, body, table, tr {
       width: 100%;
     }
+    body {
+      background: var(--background);
+      color: var(--text);
+    }
+    a {
+      color: var(--link);
+    }
+    a:visited {
+      color: var(--visited);
+    }
+    tr.entry:hover {
+      background: var(--hover);
+    }
+    input {
+      background: var(--background);
+      color: var(--text);
+      border: 1px solid var(--border);
+    }
     .main {
       max-width: 992px;
       margin: 0 auto;
@@ -121,29 +398,66 @@ var listTemplate = `
     td.size, td.last-modified {
       width: 20%;
     }
+    .icon {
+      vertical-align: -2px;
+      margin-right: 4px;
+    }
+    td.size {
+      text-align: right;
+      padding-right: 2em;
+    }
+    .filter {
+      margin: 5px 0;
+    }
+    .readme {
+      margin-top: 2em;
+      border-top: 1px solid var(--border);
+    }
+    .readme pre {
+      white-space: pre-wrap;
+    }
   </style>
+  {{ if .Stylesheet }}<link rel="stylesheet" href="{{ .Stylesheet }}">{{ end }}
 </head>
 <body>
   <div class="main">
-    <h2>Index of {{ .Path }}</h2>
+    <h2>Index of {{ range $i, $crumb := .Breadcrumbs }}{{ if eq (len $.Breadcrumbs) (inc $i) }}{{ .Name }}/{{ else }}<a href="{{ .URL }}">{{ .Name }}/</a>{{ end }}{{ end }}</h2>
+    {{ if .Header }}<div class="header">{{ .Header }}</div>{{ end }}
+    <form class="filter">
+      <input type="search" id="filter" placeholder="Filter"{{ if .Sortable }} name="q" value="{{ .Query }}"{{ end }}>
+    </form>
     <table>
       <tr>
+        {{ if .Sortable }}
+        <td class="name"><b><a href="?sort=name{{ if and (eq .Sort "name") (eq .Order "asc") }}&amp;order=desc{{ end }}{{ if .Query }}&amp;q={{ .Query }}{{ end }}">Name</a></b></td>
+        <td class="size"><b><a href="?sort=size{{ if and (eq .Sort "size") (eq .Order "asc") }}&amp;order=desc{{ end }}{{ if .Query }}&amp;q={{ .Query }}{{ end }}">Size{{ if not .HumanSizes }} (bytes){{ end }}</a></b></td>
+        <td class="last-modified"><b><a href="?sort=mtime{{ if not (and (eq .Sort "mtime") (eq .Order "desc")) }}&amp;order=desc{{ end }}{{ if .Query }}&amp;q={{ .Query }}{{ end }}">Last Modified</a></b></td>
+        {{ else }}
         <td class="name"><b>Name</b></td>
-        <td class="size"><b>Size (bytes)</b></td>
+        <td class="size"><b>Size{{ if not .HumanSizes }} (bytes){{ end }}</b></td>
         <td class="last-modified"><b>Last Modified</b></td>
+        {{ end }}
       </tr>
+      {{ if .Parent }}
       <tr>
+        <td class="name">{{ if .Icons }}{{ icon "folder" }}{{ end }}<a href="{{ .Parent }}">../</a></td>
+        <td class="size">-</td>
+        <td class="last-modified">-</td>
+      </tr>
+      {{ end }}
       {{ range .Files }}
-        {{ if (ne (index .Name 0) 46) }}
-        <tr>
+        <tr class="entry" data-name="{{ .Name }}">
          <td class="name">
-           <a href="{{ .Name }}{{ if .IsDir }}/{{ end }}">
+           {{ if $.Icons }}{{ icon (iconKind .) }}{{ end }}
+           <a href="./{{ pathEscape .Name }}{{ if .IsDir }}/{{ end }}">
              {{ .Name }}{{ if .IsDir }}/{{ end }}
            </a>
          </td>
          <td class="size">
            {{ if .IsDir }}
              -
+           {{ else if $.HumanSizes }}
+             <span title="{{ .Size }} bytes">{{ formatBytes .Size }}</span>
            {{ else }}
              {{ .Size }}
            {{ end }}
@@ -156,10 +470,28 @@ var listTemplate = `
            {{ end }}
          </td>
         </tr>
-        {{ end }}
       {{ end }}
     </table>
+    {{ if .Archives }}
+    <p class="archives">Download as <a href="?archive=zip">zip</a> or <a href="?archive=tar.gz">tar.gz</a></p>
+    {{ end }}
+    {{ if gt .Pages 1 }}
+    <p class="pages">
+      {{ if .PrevURL }}<a href="{{ .PrevURL }}">&laquo; previous</a>{{ end }}
+      page {{ .Page }} of {{ .Pages }}
+      {{ if .NextURL }}<a href="{{ .NextURL }}">next &raquo;</a>{{ end }}
+    </p>
+    {{ end }}
+    {{ if .Readme }}<div class="readme">{{ .Readme }}</div>{{ end }}
   </div>
+  <script>
+    document.getElementById("filter").addEventListener("input", function () {
+      var filter = this.value.trim().toLowerCase();
+      document.querySelectorAll("tr.entry").forEach(function (row) {
+        row.hidden = row.dataset.name.toLowerCase().indexOf(filter) < 0;
+      });
+    });
+  </script>
 </body>
 </html>`
 
@@ -183,215 +515,4509 @@ func (w *gzipResponseWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
-func stringInSlice(a string, list []string) bool {
-	for _, b := range list {
-		if b == a {
-			return true
-		}
-	}
+// consecutive storage failures after which the circuit breaker opens.
+const storageBreakerThreshold = 5
 
-	return false
-}
+var errStorageUnavailable = errors.New("storage unavailable")
 
-func isHiddenPath(path string) bool {
-	return len(path) > 1 && path[0] == '.' || strings.Index(path, "/.") != -1
+// fileStore performs all filesystem access for request handling. Paths are
+// relative to the home directory, which is opened as root so that nothing
+// can be reached outside of it, even through symlinks or a path that
+// wasn't cleaned properly; only with -follow-symlinks all is root nil, and
+// paths are joined to home instead. By default operations are passed
+// straight through; in network filesystem mode each operation runs with a
+// timeout, transient ESTALE/EIO errors are retried, and repeated failures
+// open a circuit breaker that fails requests fast until the cooldown has
+// passed, so a hung mount can't tie up a goroutine per request.
+type fileStore struct {
+	root *os.Root
+	noFollow bool
+
+	// the real path of the home directory, and the -follow-symlinks
+	// policy.
+	home string
+	symlinks string
+
+	// identical copies of the home directory on other disks, across
+	// which opens of large files are spread.
+	mirrors []*os.Root
+	nextMirror uint64
+
+	checksums map[string]fileChecksum
+
+	// master key for a home directory written by "httpd encrypt"
+	encryptionKey []byte
+
+	// per-user directories served at "~name/...", which are used as is,
+	// without mirrors, checksums or decryption.
+	userDirs *userDirs
+
+	timeout time.Duration
+	retries int
+	cooldown time.Duration
+
+	mu sync.Mutex
+	failures int
+	openUntil time.Time
+	lastErr error
 }
 
-func showListing(writer http.ResponseWriter, path string) {
-	files, err := ioutil.ReadDir(path)
-	if err != nil {
-		http.Error(writer, "File not found", 404)
-		return
+// newFileStore returns a store serving the directory at home, following
+// symlinks as the given -follow-symlinks policy says.
+func newFileStore(home string, symlinks string) (*fileStore, error) {
+	if !stringInSlice(symlinks, symlinkPolicies) {
+		return nil, fmt.Errorf("invalid symlink policy %q", symlinks)
+	}
+
+	home, err := filepath.Abs(home)
+	if err == nil {
+		home, err = filepath.EvalSymlinks(home)
 	}
 
-	t, err := template.New("listTemplate").Parse(listTemplate)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	err = t.Execute(writer, listTemplateInfo{
-		Path: path,
-		Files: files,
-	})
+	s := &fileStore{home: home, symlinks: symlinks}
 
-	if err != nil {
-		panic(err)
+	if symlinks != "all" {
+		if s.root, err = os.OpenRoot(home); err != nil {
+			return nil, err
+		}
 	}
+
+	return s, nil
 }
 
-func requestHandler(
-	writer http.ResponseWriter,
-	request *http.Request,
-	listDir bool,
-) {
-	if request.Method != "GET" && request.Method != "HEAD" {
-		http.Error(writer, "Method not allowed", 405)
-		return
+func isTransientStorageError(err error) bool {
+	return errors.Is(err, syscall.ESTALE) || errors.Is(err, syscall.EIO)
+}
+
+func (s *fileStore) do(
+	ctx context.Context,
+	op string,
+	path string,
+	fn func() error,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	path := filepath.Clean(request.URL.Path[1:])
-	if isHiddenPath(path) {
-		http.Error(writer, "File not found", 404)
-		return
+	if s.timeout == 0 {
+		return fn()
 	}
 
-	stat, err := os.Stat(path)
-	if err != nil {
-		http.Error(writer, "File not found", 404)
-		return
+	s.mu.Lock()
+	if time.Now().Before(s.openUntil) {
+		lastErr := s.lastErr
+		s.mu.Unlock()
+		return fmt.Errorf("%w: circuit open after %v", errStorageUnavailable, lastErr)
 	}
+	s.mu.Unlock()
 
-	if stat.IsDir() {
-		lastChar := request.URL.Path[len(request.URL.Path) - 1]
+	var err error
 
-		// redirect to the directory URL with '/' at end.
-		if path != "." && lastChar != '/' {
-			writer.Header().Set("Location", fmt.Sprintf("/%s/", path))
-			writer.WriteHeader(301)
-			return
+	for attempt := 0; attempt <= s.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
 
-		found := false
+		done := make(chan error, 1)
+		go func() {
+			done <- fn()
+		}()
 
-		for _, i := range indexFiles {
-			indexPath := fmt.Sprintf("%s/%s", path, i)
-			stat, err = os.Stat(indexPath)
+		timer := time.NewTimer(s.timeout)
 
-			if err == nil && !stat.IsDir() {
-				found = true
-				path = indexPath
-				break
-			}
+		select {
+		case err = <-done:
+			timer.Stop()
+		case <-ctx.Done():
+			// the request was canceled or ran out of time, which says
+			// nothing about the health of the storage.
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+			// the goroutine stays blocked in the kernel until the mount
+			// recovers; don't retry, that would only pile up more of them.
+			err = fmt.Errorf(
+				"%w: %s %s timed out after %v",
+				errStorageUnavailable, op, path, s.timeout,
+			)
+
+			s.recordFailure(err)
+			return err
 		}
 
-		if !found {
-			if listDir {
-				showListing(writer, path)
-			} else {
-				http.Error(writer, "File not found", 404)
-			}
+		if !isTransientStorageError(err) {
+			break
+		}
+	}
 
-			return
+	if isTransientStorageError(err) {
+		err = fmt.Errorf("%w: %s %s: %v", errStorageUnavailable, op, path, err)
+		s.recordFailure(err)
+		return err
+	}
+
+	s.mu.Lock()
+	s.failures = 0
+	s.mu.Unlock()
+
+	return err
+}
+
+func (s *fileStore) recordFailure(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures++
+	s.lastErr = err
+
+	if s.failures >= storageBreakerThreshold {
+		s.openUntil = time.Now().Add(s.cooldown)
+		s.failures = 0
+		errorLog.print(nil, "storage circuit open for %v after: %v", s.cooldown, err)
+	}
+}
+
+// inUserDir reports whether path is in a user directory.
+func (s *fileStore) inUserDir(path string) bool {
+	return s.userDirs != nil && strings.HasPrefix(path, "~")
+}
+
+// locate returns the root that path is to be opened in and path relative
+// to it, or a nil root and the full path when there is none.
+func (s *fileStore) locate(path string) (*os.Root, string, error) {
+	if !s.inUserDir(path) {
+		if s.root == nil {
+			return nil, filepath.Join(s.home, path), nil
 		}
+
+		return s.root, path, nil
 	}
 
-	file, err := os.Open(path)
-	defer file.Close()
+	name, rest, _ := strings.Cut(path, string(filepath.Separator))
+	root, err := s.userDirs.root(name[1:])
+	if err != nil {
+		return nil, "", err
+	}
 
+	if rest == "" {
+		rest = "."
+	}
+
+	return root, rest, nil
+}
+
+func (s *fileStore) Stat(ctx context.Context, path string) (os.FileInfo, error) {
+	var stat os.FileInfo
+
+	root, rel, err := s.locate(path)
 	if err != nil {
-		http.Error(writer, "File not found", 404)
-		return
+		return nil, err
 	}
 
-	extension := filepath.Ext(path)
-	if extension != "" {
-		extension = extension[1:]
+	err = s.do(ctx, "stat", path, func() (err error) {
+		if err := s.checkSymlinks(root, rel); err != nil {
+			return err
+		}
+
+		if root != nil {
+			stat, err = root.Stat(rel)
+		} else {
+			stat, err = os.Stat(rel)
+		}
+
+		return refuseEscapes(err)
+	})
+
+	if err == nil && s.encryptionKey != nil && !s.inUserDir(path) {
+		stat = decryptedFileInfo(stat)
 	}
 
-	mimeType, ok := mimes[extension]
-	if !ok {
-		mimeType = "application/octet-stream"
+	return stat, err
+}
+
+func (s *fileStore) ReadDir(ctx context.Context, path string) ([]os.FileInfo, error) {
+	var files []os.FileInfo
+
+	root, rel, err := s.locate(path)
+	if err != nil {
+		return nil, err
 	}
 
-	// truncate time to seconds to prevent caching issues
-	// because the resolution of the If-Modified-Since header
-	// is only precise upto a second.
-	lastModified := stat.ModTime().UTC().Truncate(time.Second)
-	lastModifiedStr := lastModified.Format(http.TimeFormat)
+	err = s.do(ctx, "readdir", path, func() (err error) {
+		if err := s.checkSymlinks(root, rel); err != nil {
+			return err
+		}
 
-	writer.Header().Set("Last-Modified", lastModifiedStr)
-	writer.Header().Set("Content-Type", mimeType)
+		if root == nil {
+			files, err = ioutil.ReadDir(rel)
+			return err
+		}
 
-	ifModifiedSince := request.Header.Get("If-Modified-Since")
-	since, err := time.Parse(http.TimeFormat, ifModifiedSince)
+		dir, err := root.Open(rel)
+		if err != nil {
+			return refuseEscapes(err)
+		}
 
-	if err == nil {
-		if lastModified.Before(since) || lastModified.Equal(since) {
-			writer.WriteHeader(304)
-			return
+		defer dir.Close()
+
+		files, err = dir.Readdir(-1)
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].Name() < files[j].Name()
+		})
+
+		return err
+	})
+
+	if s.encryptionKey != nil && !s.inUserDir(path) {
+		for i, file := range files {
+			files[i] = decryptedFileInfo(file)
 		}
 	}
 
-	if request.Method == "HEAD" {
-		return
+	return files, err
+}
+
+// ReadDirEntries lists the directory at path, sorted by name, without
+// stat'ing the entries.
+func (s *fileStore) ReadDirEntries(ctx context.Context, path string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+
+	root, rel, err := s.locate(path)
+	if err != nil {
+		return nil, err
 	}
 
-	acceptEnc := request.Header.Get("Accept-Encoding")
+	err = s.do(ctx, "readdir", path, func() (err error) {
+		if err := s.checkSymlinks(root, rel); err != nil {
+			return err
+		}
 
-	if stat.Size() > 1024 && strings.Contains(acceptEnc, "gzip") &&
-	   extension != "" && stringInSlice(extension, compressExts) {
-		writer.Header().Set("Content-Encoding", "gzip")
+		if root == nil {
+			entries, err = os.ReadDir(rel)
+			return err
+		}
 
-		gz := gzPool.Get().(*gzip.Writer)
-		gz.Reset(writer)
+		dir, err := root.Open(rel)
+		if err != nil {
+			return refuseEscapes(err)
+		}
 
-		defer gzPool.Put(gz)
-		defer gz.Close()
+		defer dir.Close()
 
-		io.Copy(&gzipResponseWriter{ResponseWriter: writer, Writer: gz}, file)
-	} else {
-		io.Copy(writer, file)
+		entries, err = dir.ReadDir(-1)
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name() < entries[j].Name()
+		})
+
+		return err
+	})
+
+	return entries, err
+}
+
+// EntryInfos stats entries of the directory at path, leaving out those
+// that have disappeared since it was listed. Symlinks are described by
+// what they point to, and left out if that isn't served.
+func (s *fileStore) EntryInfos(
+	ctx context.Context,
+	path string,
+	entries []fs.DirEntry,
+) ([]os.FileInfo, error) {
+	files := make([]os.FileInfo, 0, len(entries))
+
+	for _, entry := range entries {
+		var info os.FileInfo
+		var err error
+
+		if entry.Type() & fs.ModeSymlink != 0 {
+			// Stat has decrypted the size already.
+			info, err = s.Stat(ctx, filepath.Join(path, entry.Name()))
+		} else {
+			err = s.do(ctx, "stat", filepath.Join(path, entry.Name()), func() (err error) {
+				info, err = entry.Info()
+				return err
+			})
+
+			if err == nil && s.encryptionKey != nil && !s.inUserDir(path) {
+				info = decryptedFileInfo(info)
+			}
+		}
+
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, info)
 	}
+
+	return files, nil
 }
 
-func handlerWrap(
-	handler func(http.ResponseWriter, *http.Request, bool),
-	context bool,
-) http.HandlerFunc {
-	return (func(writer http.ResponseWriter, request *http.Request) {
-		requestTime := time.Now()
-		handler(writer, request, context)
+// Open opens path for reading. Reads fail once ctx is done, and in network
+// filesystem mode the returned reader applies the same timeouts and
+// retries to every read. Files in the checksum index are verified.
+func (s *fileStore) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	var file *os.File
 
-		portIndex := strings.LastIndex(request.RemoteAddr, ":")
-		clientIP := request.RemoteAddr[:portIndex]
-
-		reflectWriter := reflect.ValueOf(writer)
-		statusCode := reflectWriter.Elem().FieldByName("status")
-
-		fmt.Printf(
-			"%v %#v %v %#v %v %#v %#v\n",
-			clientIP,
-			requestTime.Format(time.RFC822Z),
-			request.Method,
-			request.RequestURI,
-			statusCode,
-			request.Header.Get("Referer"),
-			request.Header.Get("User-Agent"),
-		)
+	flags := os.O_RDONLY
+	if s.noFollow {
+		flags |= openNoFollow
+	}
+
+	root, rel, err := s.locate(path)
+	if err != nil {
+		return nil, err
+	}
+
+	inUserDir := s.inUserDir(path)
+
+	err = s.do(ctx, "open", path, func() (err error) {
+		if err := s.checkSymlinks(root, rel); err != nil {
+			return err
+		}
+
+		if !inUserDir {
+			if file = s.openMirror(root, rel, path, flags); file != nil {
+				return nil
+			}
+		}
+
+		if root != nil {
+			file, err = root.OpenFile(rel, flags, 0)
+		} else {
+			file, err = os.OpenFile(rel, flags, 0)
+		}
+
+		return refuseEscapes(err)
 	})
-}
 
-func mainWithExitCode() int {
-	port := flag.Int("port", 8080, "port number to bind")
-	home := flag.String("home", ".", "web server home directory")
-	listDir := flag.Bool("listdir", false, "enable directory listing")
+	if err != nil {
+		return nil, err
+	}
 
-	flag.Parse()
+	var body io.ReadCloser
 
-	if *port < 1 || *port > 65535 {
-		fmt.Println("invalid port number: ", port)
-		flag.PrintDefaults()
-		return 1
+	if s.timeout != 0 {
+		body = &storeFile{ctx: ctx, file: file, store: s}
+	} else {
+		// closing the file aborts a pending read, including one done by
+		// sendfile, which is kept by returning the *os.File itself.
+		stop := context.AfterFunc(ctx, func() {
+			file.Close()
+		})
+
+		body = &ctxFile{File: file, stop: stop}
 	}
 
-	if err := os.Chdir(*home); err != nil {
-		fmt.Println("unable to chdir: ", err)
-		flag.PrintDefaults()
-		return 1
+	if inUserDir {
+		return body, nil
+	}
+
+	if s.encryptionKey != nil {
+		if body, err = newDecryptingReader(body, s.encryptionKey); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
 	}
 
-	fmt.Println("* Serving on port", *port, "from", *home)
-	http.Handle("/", handlerWrap(requestHandler, *listDir))
+	if checksum, ok := s.checksums[filepath.Clean(path)]; ok {
+		stat, err := file.Stat()
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
 
-	bindPort := fmt.Sprintf(":%d", *port)
-	err := http.ListenAndServe(bindPort, nil)
+		size := stat.Size()
+		if s.encryptionKey != nil {
+			size = plaintextSize(size)
+		}
 
-	if err != nil && err != http.ErrServerClosed {
-		fmt.Println("unable to start server", err)
-		return 1
+		return verifyFile(path, body, size, checksum)
 	}
 
-	return 0
+	return body, nil
+}
+
+// files from this size up are opened from the mirrors in turn; smaller
+// ones are likely cached anyway.
+const mirrorMinSize = 1 << 20
+
+// openMirror opens path, found at rel in root, from the next of the home
+// directory and its mirrors in round-robin order. It returns nil when
+// it's the home directory's turn, the file is small, or the mirror's copy
+// is missing or doesn't have the same size and modification time.
+func (s *fileStore) openMirror(
+	root *os.Root,
+	rel string,
+	path string,
+	flags int,
+) *os.File {
+	if len(s.mirrors) == 0 {
+		return nil
+	}
+
+	n := atomic.AddUint64(&s.nextMirror, 1) % uint64(len(s.mirrors) + 1)
+	if n == 0 {
+		return nil
+	}
+
+	var stat os.FileInfo
+	var err error
+
+	if root != nil {
+		stat, err = root.Stat(rel)
+	} else {
+		stat, err = os.Stat(rel)
+	}
+
+	if err != nil || stat.IsDir() || stat.Size() < mirrorMinSize {
+		return nil
+	}
+
+	file, err := s.mirrors[n - 1].OpenFile(path, flags, 0)
+	if err != nil {
+		return nil
+	}
+
+	mirrorStat, err := file.Stat()
+	if err != nil || mirrorStat.Size() != stat.Size() ||
+	   !mirrorStat.ModTime().Equal(stat.ModTime()) {
+		file.Close()
+		return nil
+	}
+
+	return file
+}
+
+type ctxFile struct {
+	*os.File
+	stop func() bool
+}
+
+func (f *ctxFile) Close() error {
+	f.stop()
+	return f.File.Close()
+}
+
+type storeFile struct {
+	ctx context.Context
+	file *os.File
+	store *fileStore
+}
+
+func (f *storeFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *storeFile) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+
+	err := f.store.do(f.ctx, "seek", f.file.Name(), func() (err error) {
+		pos, err = f.file.Seek(offset, whence)
+		return err
+	})
+
+	return pos, err
+}
+
+func (f *storeFile) Read(p []byte) (int, error) {
+	// read into a private buffer so that a read which outlives its
+	// timeout can't scribble over p after we've returned.
+	buf := make([]byte, len(p))
+	var n int
+
+	err := f.store.do(f.ctx, "read", f.file.Name(), func() (err error) {
+		n, err = f.file.Read(buf)
+		return err
+	})
+
+	copy(p, buf[:n])
+	return n, err
+}
+
+// fileError responds to a failed storage operation, with a 503 and the
+// diagnostic when the storage itself is failing and a 404 otherwise.
+func fileError(writer http.ResponseWriter, request *http.Request, err error) {
+	// nobody is left to read a response to a canceled request.
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if errors.Is(err, errNotEncrypted) {
+		errorLog.print(request, "storage error: %v", err)
+		http.Error(writer, "Internal server error", 500)
+		return
+	}
+
+	if errors.Is(err, errChecksumMismatch) {
+		http.Error(writer, "Bad gateway: file failed verification", 502)
+		return
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(writer, "Service unavailable: request deadline exceeded", 503)
+		return
+	}
+
+	if errors.Is(err, errStorageUnavailable) {
+		errorLog.print(request, "storage error: %v", err)
+		writer.Header().Set("Retry-After", "30")
+		http.Error(writer, "Service unavailable: " + err.Error(), 503)
+		return
+	}
+
+	http.Error(writer, "File not found", 404)
+}
+
+// how often -assert-readonly re-verifies that the root is read-only.
+const readOnlyCheckInterval = time.Minute
+
+// watchReadOnly exits the process if dir stops being on a read-only
+// filesystem, e.g. because it was remounted read-write.
+func watchReadOnly(dir *os.File) {
+	for range time.Tick(readOnlyCheckInterval) {
+		if err := checkReadOnly(dir); err != nil {
+			fmt.Println("read-only assertion failed, exiting: ", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// peerCachePrefix is the URL prefix under which peers fetch compressed
+// objects from their owner.
+const peerCachePrefix = "/.gohttpd-peer/"
+
+// number of points each peer gets on the hash ring.
+const peerRingReplicas = 100
+
+// peerCache shards gzip-compressed copies of files among a fixed set of
+// peers serving identical trees. Each path is owned by one peer chosen by
+// consistent hashing; the owner keeps the compressed body in an LRU cache
+// and the other peers fetch it from the owner instead of reading and
+// compressing the file themselves.
+type peerCache struct {
+	storage *fileStore
+	self string
+	ring []uint32
+	owners map[uint32]string
+	peerIPs map[string]bool
+	client *http.Client
+
+	mu sync.Mutex
+	maxBytes int64
+	curBytes int64
+	entries map[string]*list.Element
+	lru *list.List
+}
+
+type peerCacheEntry struct {
+	path string
+	lastModified time.Time
+	body []byte
+}
+
+func newPeerCache(
+	storage *fileStore,
+	self string,
+	peers []string,
+	maxBytes int64,
+) (*peerCache, error) {
+	c := &peerCache{
+		storage: storage,
+		self: strings.TrimSuffix(self, "/"),
+		owners: map[uint32]string{},
+		peerIPs: map[string]bool{},
+		client: &http.Client{Timeout: 5 * time.Second},
+		maxBytes: maxBytes,
+		entries: map[string]*list.Element{},
+		lru: list.New(),
+	}
+
+	isPeer := false
+
+	for _, peer := range peers {
+		peer = strings.TrimSuffix(strings.TrimSpace(peer), "/")
+		isPeer = isPeer || peer == c.self
+
+		u, err := url.Parse(peer)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid peer URL %q", peer)
+		}
+
+		addrs, err := net.LookupHost(u.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve peer %q: %v", peer, err)
+		}
+
+		for _, addr := range addrs {
+			c.peerIPs[addr] = true
+		}
+
+		for i := 0; i < peerRingReplicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%d:%s", i, peer)))
+			c.owners[point] = peer
+			c.ring = append(c.ring, point)
+		}
+	}
+
+	if !isPeer {
+		return nil, fmt.Errorf("%q is not in the peer list", self)
+	}
+
+	sort.Slice(c.ring, func(i, j int) bool { return c.ring[i] < c.ring[j] })
+	return c, nil
+}
+
+// maxObjectSize is the largest file the cache will compress into memory.
+func (c *peerCache) maxObjectSize() int64 {
+	return c.maxBytes / 16
+}
+
+func (c *peerCache) owner(path string) string {
+	point := crc32.ChecksumIEEE([]byte(path))
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i] >= point })
+	if i == len(c.ring) {
+		i = 0
+	}
+
+	return c.owners[c.ring[i]]
+}
+
+// get returns the gzip-compressed contents of path, which must have been
+// last modified at lastModified. The owning peer is asked first; if it is
+// unreachable or has a different version, the file is compressed locally.
+func (c *peerCache) get(
+	ctx context.Context,
+	path string,
+	lastModified time.Time,
+) ([]byte, error) {
+	if owner := c.owner(path); owner != c.self {
+		body, err := c.fetch(ctx, owner, path, lastModified)
+		if err == nil {
+			return body, nil
+		}
+	}
+
+	return c.load(ctx, path, lastModified)
+}
+
+func (c *peerCache) fetch(
+	ctx context.Context,
+	owner string,
+	path string,
+	lastModified time.Time,
+) ([]byte, error) {
+	u := url.URL{Path: peerCachePrefix + filepath.ToSlash(path)}
+	request, err := http.NewRequestWithContext(ctx, "GET", owner + u.EscapedPath(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("peer %s returned %d", owner, resp.StatusCode)
+	}
+
+	// the peers are expected to serve identical trees, but during a sync
+	// one of them may briefly have an older or newer copy.
+	if resp.Header.Get("Last-Modified") != lastModified.Format(http.TimeFormat) {
+		return nil, errors.New("peer has a different version")
+	}
+
+	// the body is compressed from a file of at most maxObjectSize, which
+	// gzip's framing can make slightly larger when it doesn't compress.
+	limit := c.maxObjectSize() + c.maxObjectSize() / 1000 + 64
+	if resp.ContentLength < 0 || resp.ContentLength > limit {
+		return nil, fmt.Errorf("peer %s sent a body of unexpected length %d", owner, resp.ContentLength)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit + 1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) != resp.ContentLength {
+		return nil, fmt.Errorf("peer %s sent %d bytes, expected %d", owner, len(body), resp.ContentLength)
+	}
+
+	return body, nil
+}
+
+// load returns the compressed body from the local cache, compressing the
+// file and caching the result on a miss.
+func (c *peerCache) load(
+	ctx context.Context,
+	path string,
+	lastModified time.Time,
+) ([]byte, error) {
+	c.mu.Lock()
+	if elem, ok := c.entries[path]; ok {
+		entry := elem.Value.(*peerCacheEntry)
+		if entry.lastModified.Equal(lastModified) {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			return entry.body, nil
+		}
+
+		c.remove(elem)
+	}
+	c.mu.Unlock()
+
+	file, err := c.storage.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var buf bytes.Buffer
+	gz := gzPool.Get().(*gzip.Writer)
+	gz.Reset(&buf)
+	defer gzPool.Put(gz)
+
+	n, err := io.Copy(gz, io.LimitReader(file, c.maxObjectSize() + 1))
+	if err == nil && n > c.maxObjectSize() {
+		err = errors.New("file grew beyond the cache object size")
+	}
+
+	if err == nil {
+		err = gz.Close()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	body := buf.Bytes()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[path]; ok {
+		c.remove(elem)
+	}
+
+	c.entries[path] = c.lru.PushFront(&peerCacheEntry{
+		path: path,
+		lastModified: lastModified,
+		body: body,
+	})
+	c.curBytes += int64(len(body))
+
+	for c.curBytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+
+	return body, nil
+}
+
+// remove drops elem from the cache; c.mu must be held.
+func (c *peerCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*peerCacheEntry)
+	delete(c.entries, entry.path)
+	c.curBytes -= int64(len(entry.body))
+}
+
+// fromPeer reports whether request is a cache fetch from another peer.
+func (c *peerCache) fromPeer(request *http.Request) bool {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	return err == nil && c.peerIPs[host] && strings.HasPrefix(request.URL.Path, peerCachePrefix)
+}
+
+// serve answers cache fetches from other peers.
+func (c *peerCache) serve(writer http.ResponseWriter, request *http.Request) {
+	trace := requestTraceFrom(request.Context())
+	if !c.fromPeer(request) {
+		trace.note("peer cache", "not a peer, 404")
+		http.Error(writer, "File not found", 404)
+		return
+	}
+
+	path := filepath.Clean(strings.TrimPrefix(request.URL.Path, peerCachePrefix))
+	if isHiddenPath(path) {
+		http.Error(writer, "File not found", 404)
+		return
+	}
+
+	stat, err := c.storage.Stat(request.Context(), path)
+	if err != nil || stat.IsDir() || stat.Size() > c.maxObjectSize() {
+		http.Error(writer, "File not found", 404)
+		return
+	}
+
+	lastModified := stat.ModTime().UTC().Truncate(time.Second)
+	body, err := c.load(request.Context(), path, lastModified)
+	if err != nil {
+		http.Error(writer, "File not found", 404)
+		return
+	}
+
+	writer.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.Write(body)
+}
+
+// loadMimeTypes merges the MIME mappings in the given file into mimes,
+// overriding the built-in entries. The file may use nginx's mime.types
+// syntax ("type ext1 ext2;" optionally inside a "types { }" block), or
+// simple "ext = type" lines; '#' starts a comment in both.
+func loadMimeTypes(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	nginxTypes := ""
+
+	for lineNo, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if i := strings.Index(line, "="); i != -1 {
+			ext := strings.TrimPrefix(strings.TrimSpace(line[:i]), ".")
+			mimeType := strings.TrimSpace(line[i + 1:])
+
+			if ext == "" || mimeType == "" {
+				return fmt.Errorf("%s:%d: invalid mapping", path, lineNo + 1)
+			}
+
+			mimes[strings.ToLower(ext)] = mimeType
+			continue
+		}
+
+		nginxTypes += " " + line
+	}
+
+	nginxTypes = strings.NewReplacer("{", ";", "}", ";").Replace(nginxTypes)
+
+	for _, statement := range strings.Split(nginxTypes, ";") {
+		fields := strings.Fields(statement)
+		if len(fields) == 0 || len(fields) == 1 && fields[0] == "types" {
+			continue
+		}
+
+		if len(fields) < 2 {
+			return fmt.Errorf("%s: no extensions for %q", path, fields[0])
+		}
+
+		for _, ext := range fields[1:] {
+			mimes[strings.ToLower(strings.TrimPrefix(ext, "."))] = fields[0]
+		}
+	}
+
+	return nil
+}
+
+// pathMatches reports whether a URL path matches pattern. Patterns without
+// glob characters match the path itself and everything under it, so that
+// "/builds/foo" covers /builds/foo/a but not /builds/foobar; glob patterns
+// (see path.Match) match if they match the path itself or one of its
+// parent directories, so that "/app/*" covers everything under /app/.
+func pathMatches(pattern, urlPath string) bool {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return urlPath == pattern || strings.HasPrefix(urlPath, strings.TrimSuffix(pattern, "/") + "/")
+	}
+
+	for p := urlPath; ; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+
+		if p == "/" || p == "." {
+			return false
+		}
+	}
+}
+
+type pathHeader struct {
+	pattern string
+	name string
+	value string
+}
+
+// pathHeaders is a repeatable "pattern=Name: value" flag for headers added
+// to responses whose path matches the pattern.
+type pathHeaders []pathHeader
+
+func (h *pathHeaders) String() string {
+	var values []string
+	for _, v := range *h {
+		values = append(values, v.pattern + "=" + v.name + ": " + v.value)
+	}
+
+	return strings.Join(values, ",")
+}
+
+func (h *pathHeaders) Set(s string) error {
+	i := strings.Index(s, "=")
+	j := strings.Index(s, ":")
+	if i < 1 || j < i + 2 || !strings.HasPrefix(s, "/") {
+		return fmt.Errorf("expected /pattern=Name: value, got %q", s)
+	}
+
+	*h = append(*h, pathHeader{
+		pattern: s[:i],
+		name: strings.TrimSpace(s[i + 1:j]),
+		value: strings.TrimSpace(s[j + 1:]),
+	})
+
+	return nil
+}
+
+func (h *pathHeaders) repeatable() {}
+
+func (h pathHeaders) apply(header http.Header, urlPath string) {
+	for _, v := range h {
+		if pathMatches(v.pattern, urlPath) {
+			header.Add(v.name, v.value)
+		}
+	}
+}
+
+// hasCharset reports whether responses of the given type are text that
+// should be labelled with a charset.
+func hasCharset(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "text/") ||
+		mimeType == "application/json" ||
+		mimeType == "application/javascript" ||
+		strings.HasSuffix(mimeType, "+xml")
+}
+
+// sanitizeFilename makes name safe to use as a download filename by
+// dropping any directory part and characters that are unsafe in headers
+// or on common filesystems.
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`"/\:*?<>|`, r) {
+			return -1
+		}
+
+		return r
+	}, name)
+
+	name = strings.TrimSpace(name)
+	if name == "." || name == ".." {
+		return ""
+	}
+
+	return name
+}
+
+// contentDisposition returns an attachment Content-Disposition value for
+// name, with an ASCII fallback and the exact UTF-8 name per RFC 6266.
+func contentDisposition(name string) string {
+	ascii := strings.Map(func(r rune) rune {
+		if r > 0x7e {
+			return '_'
+		}
+
+		return r
+	}, name)
+
+	value := fmt.Sprintf("attachment; filename=\"%s\"", ascii)
+	if ascii != name {
+		value += "; filename*=UTF-8''" + url.PathEscape(name)
+	}
+
+	return value
+}
+
+func stringInSlice(a string, list []string) bool {
+	for _, b := range list {
+		if b == a {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addVary adds field to the Vary header unless it is already listed.
+func addVary(header http.Header, field string) {
+	for _, value := range header.Values("Vary") {
+		for _, f := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+
+	header.Add("Vary", field)
+}
+
+type languageRange struct {
+	tag string
+	q float64
+}
+
+// parseAcceptLanguage returns the ranges listed in an Accept-Language
+// header, most preferred first. Ranges with q=0 are dropped.
+func parseAcceptLanguage(header string) []languageRange {
+	var ranges []languageRange
+
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		if q > 0 {
+			ranges = append(ranges, languageRange{tag: tag, q: q})
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+
+	return ranges
+}
+
+func isLanguageTag(tag string) bool {
+	if tag == "" || len(tag) > 35 {
+		return false
+	}
+
+	for _, subtag := range strings.Split(tag, "-") {
+		if subtag == "" || len(subtag) > 8 {
+			return false
+		}
+
+		for _, c := range subtag {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// languageMatches reports whether a language range from Accept-Language
+// covers the given tag, either exactly or as a prefix ("en" matching
+// "en-gb", and "en-gb" falling back to a plain "en" variant).
+func languageMatches(rangeTag, tag string) bool {
+	return rangeTag == "*" || rangeTag == tag ||
+		strings.HasPrefix(tag, rangeTag + "-") ||
+		strings.HasPrefix(rangeTag, tag + "-")
+}
+
+// findLanguageVariant looks for language-tagged variants of path, such as
+// index.en.html and index.de.html for index.html, and picks the one best
+// matching the Accept-Language header, falling back to defaultLang and
+// then to the first variant by name. It returns the variant's path and
+// language, or empty strings if path has no variants.
+func findLanguageVariant(
+	ctx context.Context,
+	storage *fileStore,
+	path string,
+	acceptLang string,
+	defaultLang string,
+) (string, string) {
+	dir, name := filepath.Split(path)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	files, err := storage.ReadDir(ctx, filepath.Clean(dir))
+	if err != nil {
+		return "", ""
+	}
+
+	variants := map[string]string{}
+	var tags []string
+
+	for _, file := range files {
+		fileName := file.Name()
+		if file.IsDir() || !strings.HasPrefix(fileName, base + ".") ||
+		   !strings.HasSuffix(fileName, ext) ||
+		   len(fileName) <= len(base) + len(ext) + 1 {
+			continue
+		}
+
+		tag := fileName[len(base) + 1:len(fileName) - len(ext)]
+		tag = strings.ToLower(tag)
+
+		if isLanguageTag(tag) {
+			variants[tag] = filepath.Join(dir, fileName)
+			tags = append(tags, tag)
+		}
+	}
+
+	if len(tags) == 0 {
+		return "", ""
+	}
+
+	sort.Strings(tags)
+
+	for _, r := range parseAcceptLanguage(acceptLang) {
+		// prefer an exact match for this range over a prefix match.
+		if variant, ok := variants[r.tag]; ok {
+			return variant, r.tag
+		}
+
+		for _, tag := range tags {
+			if languageMatches(r.tag, tag) {
+				return variants[tag], tag
+			}
+		}
+	}
+
+	if variant, ok := variants[strings.ToLower(defaultLang)]; ok {
+		return variant, strings.ToLower(defaultLang)
+	}
+
+	return variants[tags[0]], tags[0]
+}
+
+// findPathVariant looks for a file whose path matches path one element
+// at a time, where match compares a directory entry's name with the
+// element. It returns "" if there is none, or if an element matches more
+// than one name, as README and readme do when ignoring case.
+func findPathVariant(
+	ctx context.Context,
+	storage *fileStore,
+	path string,
+	match func(name string, element string) bool,
+) string {
+	elements := strings.Split(path, string(filepath.Separator))
+	found := "."
+
+	// user directory names are taken as they are.
+	if storage.inUserDir(path) {
+		found, elements = elements[0], elements[1:]
+	}
+
+	for _, element := range elements {
+		entries, err := storage.ReadDirEntries(ctx, found)
+		if err != nil {
+			return ""
+		}
+
+		matched := ""
+		for _, entry := range entries {
+			if !match(entry.Name(), element) {
+				continue
+			}
+
+			if matched != "" {
+				return ""
+			}
+
+			matched = entry.Name()
+		}
+
+		if matched == "" {
+			return ""
+		}
+
+		found = filepath.Join(found, matched)
+	}
+
+	return found
+}
+
+// fileETag returns a strong validator for a file based on its size and
+// modification time.
+func fileETag(stat os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size())
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header value
+// lists etag. Weak comparison ignores the W/ prefix; strong comparison
+// never matches weak validators.
+func etagMatches(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+
+			candidate = candidate[2:]
+		}
+
+		if candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPreconditions evaluates the RFC 7232 conditional request headers
+// in the order given in section 6 and returns 304 or 412 if the request
+// should be answered with that status instead, or 0 to proceed.
+func checkPreconditions(
+	request *http.Request,
+	etag string,
+	lastModified time.Time,
+) int {
+	isGet := request.Method == "GET" || request.Method == "HEAD"
+
+	if ifMatch := request.Header.Get("If-Match"); ifMatch != "" {
+		if !etagMatches(ifMatch, etag, false) {
+			return 412
+		}
+	} else if v := request.Header.Get("If-Unmodified-Since"); v != "" {
+		since, err := time.Parse(http.TimeFormat, v)
+		if err == nil && lastModified.After(since) {
+			return 412
+		}
+	}
+
+	if ifNoneMatch := request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagMatches(ifNoneMatch, etag, true) {
+			if isGet {
+				return 304
+			}
+
+			return 412
+		}
+	} else if v := request.Header.Get("If-Modified-Since"); v != "" && isGet {
+		since, err := time.Parse(http.TimeFormat, v)
+		if err == nil && !lastModified.After(since) {
+			return 304
+		}
+	}
+
+	return 0
+}
+
+// dotfiles and directories are hidden, except those named in
+// hiddenAllowed, unless -show-hidden is given.
+var showHidden = false
+
+var hiddenAllowed = []string {
+	".well-known",
+}
+
+// the server's own files in served directories, which configure it and
+// may say more than their owners want shown, so they stay hidden even
+// with -show-hidden, in any case, as file systems may ignore it.
+var hiddenAlways = []string {
+	dirRulesFile,
+	userDirSettings,
+}
+
+// isHiddenPath reports whether any element of path, which may also be a
+// single name, is hidden.
+func isHiddenPath(path string) bool {
+	elements := strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == '\\'
+	})
+
+	for _, element := range elements {
+		for _, name := range hiddenAlways {
+			if strings.EqualFold(element, name) {
+				return true
+			}
+		}
+
+		if !showHidden && strings.HasPrefix(element, ".") && element != "." &&
+		   !stringInSlice(element, hiddenAllowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// a directory holding this file is never listed.
+const noListMarker = ".nolist"
+
+// listingAllowed reports whether the directory at path may be listed or
+// downloaded as an archive, which isn't the case if it has a .nolist file
+// or its URL matches a -no-list pattern.
+func listingAllowed(
+	ctx context.Context,
+	path string,
+	urlPath string,
+	opts *serverOptions,
+) bool {
+	for _, pattern := range opts.noList {
+		if pathMatches(pattern, urlPath) {
+			return false
+		}
+	}
+
+	_, err := opts.storage.Stat(ctx, filepath.Join(path, noListMarker))
+	return err != nil
+}
+
+// showListing renders the listing for the directory at path. baseHref is
+// set when the directory was requested without a trailing slash, so that
+// the relative links in the listing still resolve inside it.
+func showListing(
+	writer http.ResponseWriter,
+	request *http.Request,
+	path string,
+	baseHref string,
+	opts *serverOptions,
+) {
+	ctx := request.Context()
+	asJSON := wantsJSON(request)
+
+	addVary(writer.Header(), "Accept")
+
+	if asJSON {
+		writer.Header().Set("Content-Type", "application/json")
+	} else {
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if opts.strictPrivacy {
+			writer.Header().Set("Content-Security-Policy", strictContentSecurityPolicy)
+		}
+
+		opts.securityHeaders.applyHTML(writer.Header())
+	}
+
+	// the directory's modification time changes when entries are added,
+	// removed or renamed, which the cache and Last-Modified go by.
+	var modTime time.Time
+	if stat, err := opts.storage.Stat(ctx, path); err == nil {
+		modTime = stat.ModTime()
+	}
+
+	variant := listingCacheKey(request, path, baseHref, asJSON)
+	cacheKey := ""
+
+	if opts.listCache != nil && !modTime.IsZero() {
+		cacheKey = variant
+
+		if entry, ok := opts.listCache.get(cacheKey, modTime); ok {
+			requestTraceFrom(ctx).note("listing cache", "hit")
+			logFieldsFrom(ctx).setCache("hit")
+			if setListingValidators(writer, request, entry.etag, entry.lastModified) {
+				return
+			}
+
+			writer.Header().Set("Content-Length", strconv.Itoa(len(entry.body)))
+			writer.Write(entry.body)
+			return
+		}
+	}
+
+	if cacheKey != "" {
+		requestTraceFrom(ctx).note("listing cache", "miss")
+		logFieldsFrom(ctx).setCache("miss")
+	}
+
+	entries, err := opts.storage.ReadDirEntries(ctx, path)
+	if err != nil {
+		fileError(writer, request, err)
+		return
+	}
+
+	query := request.URL.Query()
+
+	// ?q= narrows the listing to names containing it, ignoring case.
+	filter := ""
+	if !opts.staticListings {
+		filter = strings.TrimSpace(query.Get("q"))
+	}
+
+	// hidden files are never served, so they aren't listed either.
+	visible := entries[:0]
+	for _, entry := range entries {
+		if !isHiddenPath(entry.Name()) &&
+		   strings.Contains(
+			   strings.ToLower(normalizeName(entry.Name(), opts.normalize)),
+			   strings.ToLower(normalizeName(filter, opts.normalize)),
+		   ) {
+			visible = append(visible, entry)
+		}
+	}
+
+	entries = visible
+
+	perPage := opts.listPageSize
+	if n, err := strconv.Atoi(query.Get("per_page")); err == nil && n > 0 {
+		perPage = min(n, maxListPageSize)
+	}
+
+	if opts.staticListings {
+		perPage = 0
+	}
+
+	page := 1
+	if n, err := strconv.Atoi(query.Get("page")); err == nil && n > 1 {
+		page = n
+	}
+
+	total := len(entries)
+	start, end := 0, total
+	if perPage > 0 {
+		start = min((page - 1) * perPage, total)
+		end = min(start + perPage, total)
+	}
+
+	// entries come sorted by name, so only those on the page need to be
+	// stat'ed; any other order needs them all.
+	var files []os.FileInfo
+	sortKey, order := query.Get("sort"), query.Get("order")
+	byName := sortKey != "size" && sortKey != "mtime"
+
+	if byName {
+		if order == "desc" {
+			start, end = total - end, total - start
+		}
+
+		files, err = opts.storage.EntryInfos(
+			ctx, path, entries[min(start, len(entries)):min(end, len(entries))],
+		)
+	} else {
+		files, err = opts.storage.EntryInfos(ctx, path, entries)
+	}
+
+	if err != nil {
+		fileError(writer, request, err)
+		return
+	}
+
+	normalizeListing(files, opts.normalize)
+	sortKey, order = sortListing(files, sortKey, order)
+
+	// entries that vanished since the directory was read leave fewer
+	// files than entries, so the page may start past the end.
+	if !byName {
+		files = files[min(start, len(files)):min(end, len(files))]
+	}
+
+	info := listTemplateInfo{
+		Path: path,
+		BaseHref: baseHref,
+		Files: files,
+		Server: "gohttpd",
+		Host: request.Host,
+		Sort: sortKey,
+		Order: order,
+		Sortable: !opts.staticListings,
+		Query: filter,
+		Archives: opts.archives && !opts.staticListings,
+		HumanSizes: opts.humanSizes,
+		Icons: !opts.noIcons,
+		Theme: opts.listTheme,
+		Stylesheet: opts.listStylesheet,
+		Page: page,
+		Pages: 1,
+		PerPage: perPage,
+		Total: total,
+	}
+
+	if perPage > 0 {
+		info.Pages = max(1, (total + perPage - 1) / perPage)
+
+		if page > 1 {
+			info.PrevURL = listingPageURL(query, min(page - 1, info.Pages))
+		}
+
+		if page < info.Pages {
+			info.NextURL = listingPageURL(query, page + 1)
+		}
+	}
+
+	if opts.serverHeader != "" {
+		info.Server = opts.serverHeader
+	}
+
+	info.Header, info.Readme = listingReadme(ctx, opts.storage, path)
+
+	etag, lastModified := listingValidators(variant, modTime, info, opts)
+	if setListingValidators(writer, request, etag, lastModified) {
+		return
+	}
+
+	out := &listingWriter{ResponseWriter: writer}
+	if cacheKey != "" {
+		out.capture = &bytes.Buffer{}
+	}
+
+	if asJSON {
+		err = renderJSONListing(out, path, info)
+	} else {
+		err = renderListing(out, info)
+	}
+
+	if err == nil {
+		err = out.flush()
+	}
+
+	if err == nil && out.capture != nil {
+		opts.listCache.put(cacheKey, modTime, listingCacheEntry{
+			body: out.capture.Bytes(),
+			etag: etag,
+			lastModified: lastModified,
+		})
+	}
+
+	if err != nil {
+		errorLog.print(request, "unable to render listing: %v", err)
+		if !out.streaming {
+			writer.Header().Del("ETag")
+			writer.Header().Del("Last-Modified")
+			http.Error(writer, "Internal server error", 500)
+		}
+	}
+}
+
+// listingValidators returns the ETag of a listing, a hash of everything
+// shown in it, and its Last-Modified time, the latest modification of the
+// directory and the entries shown.
+func listingValidators(
+	variant string,
+	modTime time.Time,
+	info listTemplateInfo,
+	opts *serverOptions,
+) (string, time.Time) {
+	h := sha256.New()
+
+	fmt.Fprintf(
+		h, "%s\x00%s\x00%v %v %d %d %s %s %s\x00",
+		variant, listingTemplateSource, info.HumanSizes, info.Icons,
+		info.Pages, info.Total, info.Theme, info.Stylesheet, info.Server,
+	)
+
+	lastModified := modTime
+	for _, file := range info.Files {
+		fmt.Fprintf(h, "%s\x00%d %d %v\x00", file.Name(), file.Size(), file.ModTime().UnixNano(), file.IsDir())
+		if file.ModTime().After(lastModified) {
+			lastModified = file.ModTime()
+		}
+	}
+
+	fmt.Fprintf(h, "%s\x00%s", info.Header, info.Readme)
+
+	return fmt.Sprintf(`W/"%x"`, h.Sum(nil)[:12]), lastModified.UTC().Truncate(time.Second)
+}
+
+// setListingValidators adds a listing's ETag and Last-Modified headers
+// and answers a conditional request it satisfies, reporting whether it
+// did.
+func setListingValidators(
+	writer http.ResponseWriter,
+	request *http.Request,
+	etag string,
+	lastModified time.Time,
+) bool {
+	writer.Header().Set("ETag", etag)
+	if !lastModified.IsZero() && lastModified.Unix() > 0 {
+		writer.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	}
+
+	if status := checkPreconditions(request, etag, lastModified); status != 0 {
+		requestTraceFrom(request.Context()).note("preconditions", "%d", status)
+		writer.WriteHeader(status)
+		return true
+	}
+
+	return false
+}
+
+// READMEs larger than this aren't shown in listings.
+const maxReadmeSize = 256 << 10
+
+// listingReadme returns the header and README shown with the listing of
+// the directory at path, as Apache's fancy indexing does.
+func listingReadme(
+	ctx context.Context,
+	storage *fileStore,
+	path string,
+) (template.HTML, template.HTML) {
+	read := func(name string) (string, bool) {
+		file, err := storage.Open(ctx, filepath.Join(path, name))
+		if err != nil {
+			return "", false
+		}
+
+		defer file.Close()
+
+		data, err := io.ReadAll(io.LimitReader(file, maxReadmeSize + 1))
+		if err != nil || len(data) > maxReadmeSize {
+			return "", false
+		}
+
+		return string(data), true
+	}
+
+	var header, readme template.HTML
+
+	if data, ok := read("HEADER.html"); ok {
+		header = template.HTML(data)
+	}
+
+	if data, ok := read("README.md"); ok {
+		readme = renderMarkdown(data)
+	} else if data, ok := read("README.txt"); ok {
+		readme = template.HTML("<pre>" + html.EscapeString(data) + "</pre>")
+	}
+
+	return header, readme
+}
+
+// normalizedFileInfo is a listing entry whose name is normalized, so that
+// links to it are in the same form as every other URL.
+type normalizedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi normalizedFileInfo) Name() string {
+	return fi.name
+}
+
+func normalizeListing(files []os.FileInfo, form string) {
+	for i, file := range files {
+		if name := normalizeName(file.Name(), form); name != file.Name() {
+			files[i] = normalizedFileInfo{file, name}
+		}
+	}
+}
+
+// largest page size that can be asked for with ?per_page=
+const maxListPageSize = 10000
+
+// listingPageURL returns the relative URL of another page of a listing,
+// keeping its sort order and page size.
+func listingPageURL(query url.Values, page int) string {
+	values := url.Values{}
+	for _, key := range []string{"sort", "order", "per_page", "q", "format"} {
+		if value := query.Get(key); value != "" {
+			values.Set(key, value)
+		}
+	}
+
+	values.Set("page", strconv.Itoa(page))
+	return "?" + values.Encode()
+}
+
+// the start of a listing is buffered so that an error early on, as from
+// a broken custom template, can still be answered with a 500.
+const listingBufferSize = 64 << 10
+
+// listingWriter buffers the start of a listing and streams the rest. It
+// also keeps a copy for the listing cache in capture, unless the listing
+// turns out too large to be cached.
+type listingWriter struct {
+	http.ResponseWriter
+	buf bytes.Buffer
+	streaming bool
+	capture *bytes.Buffer
+}
+
+func (w *listingWriter) Write(p []byte) (int, error) {
+	if w.capture != nil {
+		if w.capture.Len() + len(p) > listingCacheMaxSize {
+			w.capture = nil
+		} else {
+			w.capture.Write(p)
+		}
+	}
+
+	if w.streaming {
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.buf.Write(p)
+	if w.buf.Len() < listingBufferSize {
+		return len(p), nil
+	}
+
+	if err := w.flush(); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (w *listingWriter) flush() error {
+	if w.streaming {
+		return nil
+	}
+
+	w.streaming = true
+	_, err := w.ResponseWriter.Write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+// sortListing sorts files by name, size or mtime, ascending or descending,
+// and returns the key and order used; names break ties and unknown keys
+// sort by name, ascending unless asked otherwise.
+func sortListing(
+	files []os.FileInfo,
+	sortKey string,
+	order string,
+) (string, string) {
+	if sortKey != "size" && sortKey != "mtime" {
+		sortKey = "name"
+	}
+
+	if order != "desc" {
+		order = "asc"
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if order == "desc" {
+			a, b = b, a
+		}
+
+		switch {
+		case sortKey == "size" && listingSize(a) != listingSize(b):
+			return listingSize(a) < listingSize(b)
+		case sortKey == "mtime" && !a.ModTime().Equal(b.ModTime()):
+			return a.ModTime().Before(b.ModTime())
+		}
+
+		return a.Name() < b.Name()
+	})
+
+	return sortKey, order
+}
+
+type jsonListing struct {
+	Path string `json:"path"`
+	Total int `json:"total"`
+	Page int `json:"page,omitempty"`
+	PerPage int `json:"per_page,omitempty"`
+	Entries []jsonListingEntry `json:"entries"`
+}
+
+type jsonListingEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64 `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// the methods the server answers; others get a 405.
+var allowedMethods = []string {
+	"GET",
+	"HEAD",
+}
+
+// methodNotAllowed answers a request with an unsupported method, listing
+// the allowed ones and adding hint, which explains e.g. that uploads are
+// disabled, as text or, for API clients, as JSON.
+func methodNotAllowed(writer http.ResponseWriter, request *http.Request, hint string) {
+	writer.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+
+	if !wantsJSON(request) {
+		message := "Method not allowed"
+		if hint != "" {
+			message += "\n" + hint
+		}
+
+		http.Error(writer, message, 405)
+		return
+	}
+
+	body, _ := json.Marshal(struct {
+		Error string `json:"error"`
+		Method string `json:"method"`
+		Allow []string `json:"allow"`
+		Hint string `json:"hint,omitempty"`
+	}{"method not allowed", request.Method, allowedMethods, hint})
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.WriteHeader(405)
+	writer.Write(append(body, '\n'))
+}
+
+// wantsJSON reports whether a listing or error was asked for as JSON,
+// with ?format=json or an Accept header preferring it over HTML.
+func wantsJSON(request *http.Request) bool {
+	if format := request.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+
+	accept := request.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") &&
+		!strings.Contains(accept, "text/html")
+}
+
+// renderJSONListing writes the listing of a directory as JSON, leaving out
+// hidden files like the HTML listing does.
+func renderJSONListing(w io.Writer, path string, info listTemplateInfo) error {
+	listing := jsonListing{
+		Path: "/" + strings.TrimPrefix(filepath.ToSlash(path) + "/", "./"),
+		Total: info.Total,
+		Entries: []jsonListingEntry{},
+	}
+
+	if info.PerPage > 0 {
+		listing.Page, listing.PerPage = info.Page, info.PerPage
+	}
+
+	for _, file := range info.Files {
+		if isHiddenPath(file.Name()) {
+			continue
+		}
+
+		entry := jsonListingEntry{
+			Name: file.Name(),
+			Type: "file",
+			Size: listingSize(file),
+			ModTime: file.ModTime().UTC().Truncate(time.Second),
+		}
+
+		if file.IsDir() {
+			entry.Type = "directory"
+		}
+
+		listing.Entries = append(listing.Entries, entry)
+	}
+
+	return json.NewEncoder(w).Encode(listing)
+}
+
+// listingSize is the size shown for a listing entry, where directories
+// count as empty.
+func listingSize(file os.FileInfo) int64 {
+	if file.IsDir() {
+		return 0
+	}
+
+	return file.Size()
+}
+
+// listingTemplate renders directory listings; it is the built-in
+// template unless replaced with loadListTemplate.
+var listingTemplate = template.Must(
+	template.New("listTemplate").Funcs(listTemplateFuncs).Parse(listTemplate),
+)
+
+// color schemes of the built-in listing template.
+var listThemes = []string {"auto", "light", "dark"}
+
+// the source of listingTemplate, for checking what it refers to.
+var listingTemplateSource = listTemplate
+
+// functions available to listing templates.
+var listTemplateFuncs = template.FuncMap {
+	"formatBytes": formatBytes,
+	"pathEscape": url.PathEscape,
+	"inc": func(i int) int { return i + 1 },
+	"icon": icon,
+	"iconKind": iconKind,
+}
+
+// loadListTemplate replaces the listing template with the html/template
+// in the given file.
+func loadListTemplate(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	t, err := template.New(filepath.Base(path)).
+		Funcs(listTemplateFuncs).
+		Parse(string(data))
+	if err != nil {
+		return err
+	}
+
+	listingTemplate, listingTemplateSource = t, string(data)
+	return nil
+}
+
+// renderListing writes a directory listing with the listing template.
+func renderListing(w io.Writer, info listTemplateInfo) error {
+	info.Parent = ""
+	info.Breadcrumbs = []listBreadcrumb{{Name: "", URL: "./"}}
+
+	if info.Theme == "" {
+		info.Theme = "auto"
+	}
+
+	if info.Path != "." {
+		info.Parent = "../"
+
+		segments := strings.Split(filepath.ToSlash(info.Path), "/")
+		info.Breadcrumbs[0].URL = strings.Repeat("../", len(segments))
+
+		for i, segment := range segments {
+			crumb := listBreadcrumb{Name: segment, URL: "./"}
+			if i < len(segments) - 1 {
+				crumb.URL = strings.Repeat("../", len(segments) - i - 1)
+			}
+
+			info.Breadcrumbs = append(info.Breadcrumbs, crumb)
+		}
+	}
+
+	return listingTemplate.Execute(w, info)
+}
+
+func requestHandler(
+	writer http.ResponseWriter,
+	request *http.Request,
+	opts *serverOptions,
+) {
+	if opts.peerCache != nil && strings.HasPrefix(request.URL.Path, peerCachePrefix) {
+		opts.peerCache.serve(writer, request)
+		return
+	}
+
+	opts.headers.apply(writer.Header(), request.URL.Path)
+	applyRobots(writer.Header(), request.URL.Path, opts)
+
+	trace := requestTraceFrom(request.Context())
+
+	if value, ok := opts.deadlines.lookup(request.URL.Path); ok {
+		trace.note("deadline", "%s", value)
+		timeout, _ := time.ParseDuration(value)
+		ctx, cancel := context.WithTimeout(request.Context(), timeout)
+		defer cancel()
+
+		request = request.WithContext(ctx)
+	}
+
+	ctx := request.Context()
+
+	if !stringInSlice(request.Method, allowedMethods) {
+		trace.note("method", "%s is not allowed, 405", request.Method)
+		methodNotAllowed(writer, request, opts.methodHint)
+		return
+	}
+
+	// /dir/..tree is the plain-text tree of /dir/.
+	treeText := false
+	if opts.treeDepth > 0 && strings.HasSuffix(request.URL.Path, treeSuffix) {
+		request.URL.Path = strings.TrimSuffix(request.URL.Path, treeSuffix) + "/"
+		treeText = true
+	}
+
+	path := filepath.Clean(request.URL.Path[1:])
+	if isHiddenPath(path) {
+		trace.note("hidden", "%s is hidden, 404", path)
+		http.Error(writer, "File not found", 404)
+		return
+	}
+
+	if name := userDirName(request.URL.Path); name != "" && opts.userDirs != nil {
+		if over, renewal := opts.userDirs.overQuota(name); over {
+			trace.note("user directory", "%s is over its transfer quota, 429", name)
+			writer.Header().Set("Retry-After", strconv.Itoa(int(renewal.Seconds()) + 1))
+			http.Error(writer, "Transfer quota exceeded", 429)
+			return
+		}
+
+		userOpts, err := opts.userDirs.options(name, opts)
+		if err != nil {
+			errorLog.print(request, "unable to load user directory settings: %v", err)
+			http.Error(writer, "Internal server error", 500)
+			return
+		}
+
+		trace.note("user directory", "%s, with its settings", name)
+		opts = userOpts
+	}
+
+	acceptLang := request.Header.Get("Accept-Language")
+	lang := ""
+
+	// names on disk may be in either normalization form, so they are
+	// compared in the configured one.
+	path = normalizeName(path, opts.normalize)
+	stat, err := opts.storage.Stat(ctx, path)
+
+	if os.IsNotExist(err) && opts.normalize != "" && path != "." {
+		variant := findPathVariant(ctx, opts.storage, path, func(name string, element string) bool {
+			return normalizeName(name, opts.normalize) == element
+		})
+
+		if variant != "" {
+			stat, err = opts.storage.Stat(ctx, variant)
+			path = variant
+		}
+	}
+
+	// in clean URLs mode, /about is served from about.html.
+	variantPath := path
+	renamed := false
+	if err != nil && !errors.Is(err, errStorageUnavailable) &&
+	   opts.cleanURLs && path != "." {
+		variantPath = path + ".html"
+		if htmlStat, htmlErr := opts.storage.Stat(ctx, variantPath); !os.IsNotExist(htmlErr) {
+			stat, err, path = htmlStat, htmlErr, variantPath
+			renamed = true
+		}
+	}
+
+	if err != nil && !errors.Is(err, errStorageUnavailable) {
+		variant, variantLang := findLanguageVariant(
+			ctx, opts.storage, variantPath, acceptLang, opts.defaultLang,
+		)
+
+		if variant != "" {
+			stat, err = opts.storage.Stat(ctx, variant)
+			path, lang = variant, variantLang
+			renamed = true
+		}
+	}
+
+	if err == nil {
+		trace.note("resolve", "%s", path)
+	}
+
+	// access was checked for the URL as requested, so a file served under
+	// another name is checked again under its own.
+	if err == nil && renamed &&
+	   !admitResolved(writer, request, resolvedURLPath(request.URL.Path, path), opts) {
+		return
+	}
+
+	if os.IsNotExist(err) && path == "robots.txt" &&
+	   (len(opts.robots) > 0 || len(opts.noAI) > 0 || opts.crawlDelay > 0) {
+		trace.note("resolve", "robots.txt generated from -robots, -no-ai and -crawl-delay")
+		serveRobotsTxt(writer, opts)
+		return
+	}
+
+	// redirect to the canonical case of the path, or of the .html file
+	// for its clean URL.
+	if os.IsNotExist(err) && opts.caseInsensitive && path != "." {
+		location := url.URL{RawQuery: request.URL.RawQuery}
+		caseMatch := func(name string, element string) bool {
+			return strings.EqualFold(normalizeName(name, opts.normalize), element)
+		}
+
+		if variant := findPathVariant(ctx, opts.storage, path, caseMatch); variant != "" {
+			location.Path = "/" + filepath.ToSlash(variant)
+		} else if opts.cleanURLs {
+			if variant := findPathVariant(ctx, opts.storage, path + ".html", caseMatch); variant != "" {
+				location.Path = "/" + filepath.ToSlash(strings.TrimSuffix(variant, ".html"))
+			}
+		}
+
+		if location.Path != "" {
+			location.Path = opts.secretPrefix + normalizeName(location.Path, opts.normalize)
+			if strings.HasSuffix(request.URL.Path, "/") {
+				location.Path += "/"
+			}
+
+			trace.note("redirect", "to the canonical case, %s", location.String())
+			writer.Header().Set("Location", location.String())
+			writer.WriteHeader(301)
+			return
+		}
+	}
+
+	if err != nil {
+		trace.note("resolve", "%s: %v", path, err)
+		fileError(writer, request, err)
+		return
+	}
+
+	// rules are looked up by where the request resolved to, so that no
+	// other spelling of the path gets around them.
+	if opts.dirRules != nil {
+		if opts = applyDirRules(writer, request, path, stat.IsDir(), opts); opts == nil {
+			return
+		}
+	}
+
+	// send requests for the .html form to the extensionless URL, as
+	// long as that URL would not serve something else.
+	if opts.cleanURLsRedirect && !stat.IsDir() &&
+	   strings.HasSuffix(request.URL.Path, ".html") &&
+	   path == filepath.Clean(request.URL.Path[1:]) {
+		cleanPath := strings.TrimSuffix(path, ".html")
+		location := url.URL{RawQuery: request.URL.RawQuery}
+
+		if stringInSlice(filepath.Base(path), indexFiles) {
+			location.Path = "/" + filepath.ToSlash(filepath.Dir(path)) + "/"
+			location.Path = strings.Replace(location.Path, "/./", "/", 1)
+		} else if _, err := opts.storage.Stat(ctx, cleanPath); os.IsNotExist(err) {
+			location.Path = "/" + filepath.ToSlash(cleanPath)
+		}
+
+		if location.Path != "" {
+			location.Path = opts.secretPrefix + location.Path
+			trace.note("redirect", "to the clean URL, %s", location.String())
+			writer.Header().Set("Location", location.String())
+			writer.WriteHeader(301)
+			return
+		}
+	}
+
+	if stat.IsDir() {
+		lastChar := request.URL.Path[len(request.URL.Path) - 1]
+
+		// redirect to the directory URL with '/' at end, unless
+		// configured to serve directories at either URL.
+		baseHref := ""
+		if path != "." && lastChar != '/' {
+			location := url.URL{
+				Path: opts.secretPrefix + "/" + filepath.ToSlash(path) + "/",
+				RawQuery: request.URL.RawQuery,
+			}
+
+			if opts.dirRedirect != 0 {
+				trace.note("redirect", "to the directory URL, %s", location.String())
+				writer.Header().Set("Location", location.String())
+				writer.WriteHeader(opts.dirRedirect)
+				return
+			}
+
+			baseHref = location.EscapedPath()
+		}
+
+		format := request.URL.Query().Get("archive")
+		if format != "" && opts.archives && listingAllowed(ctx, path, request.URL.Path, opts) {
+			if _, ok := archiveFormats[format]; !ok {
+				http.Error(writer, "Unsupported archive format", 400)
+				return
+			}
+
+			trace.note("directory", "%s archive", format)
+			serveArchive(writer, request, path, format, opts)
+			return
+		}
+
+		tree := treeText || request.URL.Query().Get("recursive") == "1"
+		if tree && opts.treeDepth > 0 && opts.listDir &&
+		   listingAllowed(ctx, path, request.URL.Path, opts) {
+			trace.note("directory", "tree")
+			showTree(writer, request, path, baseHref, treeText, opts)
+			return
+		}
+
+		// API clients asking for ?format=json, such as httpd sync, get
+		// the listing even of directories with an index page.
+		if request.URL.Query().Get("format") == "json" && opts.listDir &&
+		   listingAllowed(ctx, path, request.URL.Path, opts) {
+			trace.note("directory", "JSON listing")
+			showListing(writer, request, path, baseHref, opts)
+			return
+		}
+
+		found := false
+
+		for _, i := range indexFiles {
+			indexPath := fmt.Sprintf("%s/%s", path, i)
+			stat, err = opts.storage.Stat(ctx, indexPath)
+			if errors.Is(err, errStorageUnavailable) {
+				fileError(writer, request, err)
+				return
+			}
+
+			if err == nil && !stat.IsDir() {
+				found = true
+				path = indexPath
+				break
+			}
+
+			variant, variantLang := findLanguageVariant(
+				ctx, opts.storage, indexPath, acceptLang, opts.defaultLang,
+			)
+
+			if variant != "" {
+				stat, err = opts.storage.Stat(ctx, variant)
+				if err == nil && !stat.IsDir() {
+					found = true
+					path, lang = variant, variantLang
+					break
+				}
+			}
+		}
+
+		if !found {
+			if opts.listDir && listingAllowed(ctx, path, request.URL.Path, opts) {
+				trace.note("directory", "listing")
+				showListing(writer, request, path, baseHref, opts)
+			} else {
+				trace.note("directory", "no index page and no listing, 404")
+				http.Error(writer, "File not found", 404)
+			}
+
+			return
+		}
+
+		trace.note("directory", "index page %s", path)
+	}
+
+	// download accelerators fetch large files in many ranges at once,
+	// which are limited for each client.
+	if opts.fileConnections != nil && request.Method == "GET" {
+		key := fileConnectionKey(request, path)
+		if !opts.fileConnections.acquire(key) {
+			trace.note("connections", "too many open for this file, 429")
+			writer.Header().Set("Retry-After", "1")
+			http.Error(writer, "Too many connections for this file", 429)
+			return
+		}
+
+		defer opts.fileConnections.release(key)
+	}
+
+	file, err := opts.storage.Open(ctx, path)
+	if err != nil {
+		fileError(writer, request, err)
+		return
+	}
+
+	defer file.Close()
+
+	// ranges can only be served from files that can seek, which files
+	// that are decrypted or verified while being read can't.
+	seeker, seekable := file.(io.Seeker)
+	rangeHeader := ""
+	if seekable {
+		rangeHeader = request.Header.Get("Range")
+	}
+
+	extension := filepath.Ext(path)
+	if extension != "" {
+		extension = extension[1:]
+	}
+
+	mimeType, knownType := mimes[extension]
+
+	// truncate time to seconds to prevent caching issues
+	// because the resolution of the If-Modified-Since header
+	// is only precise upto a second.
+	lastModified := stat.ModTime().UTC().Truncate(time.Second)
+	lastModifiedStr := lastModified.Format(http.TimeFormat)
+
+	compressible := stat.Size() > 1024 && extension != "" &&
+		stringInSlice(extension, compressExts)
+
+	// the body depends on Accept-Encoding whenever the file could be
+	// compressed, so caches must key on it even for identity responses.
+	// Vary is set before the 304 check since it must be present there too.
+	if compressible {
+		addVary(writer.Header(), "Accept-Encoding")
+	}
+
+	if lang != "" {
+		addVary(writer.Header(), "Accept-Language")
+		writer.Header().Set("Content-Language", lang)
+	}
+
+	acceptEnc := request.Header.Get("Accept-Encoding")
+	useGzip := compressible && rangeHeader == "" && strings.Contains(acceptEnc, "gzip")
+
+	// the gzip body is a different representation, so it needs its own
+	// strong validator.
+	etag := fileETag(stat)
+	if useGzip {
+		etag = strings.TrimSuffix(etag, `"`) + `-gzip"`
+	}
+
+	writer.Header().Set("Last-Modified", lastModifiedStr)
+	writer.Header().Set("ETag", etag)
+
+	if status := checkPreconditions(request, etag, lastModified); status != 0 {
+		trace.note("preconditions", "%d", status)
+		writer.WriteHeader(status)
+		return
+	}
+
+	if seekable {
+		writer.Header().Set("Accept-Ranges", "bytes")
+	} else {
+		writer.Header().Set("Accept-Ranges", "none")
+	}
+
+	if opts.suggestedConnections > 0 && seekable && stat.Size() >= mirrorMinSize {
+		writer.Header().Set("X-Suggested-Connections", strconv.Itoa(opts.suggestedConnections))
+	}
+
+	// a range of a changed file would mix old and new contents, so If-Range
+	// asks for the whole file then.
+	start, length := int64(0), stat.Size()
+	partial := false
+
+	if rangeHeader != "" && ifRangeMatches(request.Header.Get("If-Range"), etag, lastModified) {
+		rangeStart, rangeLength, err := parseRange(rangeHeader, stat.Size())
+		if err == errRangeUnsatisfiable {
+			trace.note("range", "%s is not satisfiable, 416", rangeHeader)
+			writer.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", stat.Size()))
+			http.Error(writer, "Range not satisfiable", 416)
+			return
+		}
+
+		if err == nil {
+			trace.note("range", "%d bytes from %d", rangeLength, rangeStart)
+			start, length, partial = rangeStart, rangeLength, true
+		} else {
+			trace.note("range", "%s ignored, whole file", rangeHeader)
+		}
+	} else if rangeHeader != "" {
+		trace.note("range", "If-Range doesn't match, whole file")
+	}
+
+	var body io.Reader = file
+
+	// guess the type of unknown and extensionless files (LICENSE, etc.)
+	// from their contents, like browsers do, rather than forcing a
+	// download of everything that isn't in the table.
+	if !knownType {
+		sniffBuf := make([]byte, 512)
+		n, err := io.ReadFull(file, sniffBuf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			fileError(writer, request, err)
+			return
+		}
+
+		mimeType = http.DetectContentType(sniffBuf[:n])
+
+		// the sniffer labels anything without a BOM as UTF-8; leave it to
+		// the configured charset instead.
+		mimeType = strings.TrimSuffix(mimeType, "; charset=utf-8")
+		body = io.MultiReader(bytes.NewReader(sniffBuf[:n]), file)
+	}
+
+	if hasCharset(mimeType) && !strings.Contains(mimeType, "charset=") {
+		charset := opts.charset
+		if v, ok := opts.charsetPaths.lookup(request.URL.Path); ok {
+			charset = v
+		}
+
+		if charset != "" {
+			mimeType += "; charset=" + charset
+		}
+	}
+
+	writer.Header().Set("Content-Type", mimeType)
+	if strings.HasPrefix(mimeType, "text/html") {
+		opts.securityHeaders.applyHTML(writer.Header())
+	}
+
+	if partial {
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			fileError(writer, request, err)
+			return
+		}
+
+		body = io.LimitReader(file, length)
+		writer.Header().Set(
+			"Content-Range",
+			fmt.Sprintf("bytes %d-%d/%d", start, start + length - 1, stat.Size()),
+		)
+	}
+
+	// ?download or ?dl=name asks for a save dialog instead of rendering
+	// the file inline, optionally under a different name.
+	query := request.URL.Query()
+	if _, ok := query["download"]; ok || query.Get("dl") != "" {
+		name := sanitizeFilename(query.Get("dl"))
+		if name == "" {
+			name = sanitizeFilename(filepath.Base(path))
+		}
+
+		writer.Header().Set("Content-Disposition", contentDisposition(name))
+	}
+
+	// with the length declared, a short transfer shows up as aborted in
+	// the log instead of passing for a complete one.
+	if useGzip {
+		trace.note("encoding", "gzip")
+		writer.Header().Set("Content-Encoding", "gzip")
+	} else {
+		writer.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+
+	// Repr-Digest covers the whole file, so that a file downloaded in
+	// ranges can be verified; Content-Digest covers this response's body.
+	if opts.digests != nil && !useGzip {
+		if digest, ok := opts.digests.lookup(path, stat); ok {
+			writer.Header().Set("Repr-Digest", digest)
+			if !partial {
+				writer.Header().Set("Content-Digest", digest)
+			}
+		}
+	}
+
+	if partial {
+		writer.WriteHeader(206)
+	}
+
+	if request.Method == "HEAD" {
+		return
+	}
+
+	if useGzip {
+		if opts.peerCache != nil &&
+		   stat.Size() <= opts.peerCache.maxObjectSize() {
+			body, err := opts.peerCache.get(ctx, path, lastModified)
+			if err == nil {
+				writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				writer.Write(body)
+				logFieldsFrom(ctx).setUncompressed(stat.Size())
+				logFieldsFrom(ctx).setCache("hit")
+				return
+			}
+
+			logFieldsFrom(ctx).setCache("miss")
+		}
+
+		gz := gzPool.Get().(*gzip.Writer)
+		gz.Reset(writer)
+
+		defer gzPool.Put(gz)
+		defer gz.Close()
+
+		n, err := io.Copy(&gzipResponseWriter{ResponseWriter: writer, Writer: gz}, body)
+		logFieldsFrom(ctx).setUncompressed(n)
+		copyError(request, path, err)
+	} else {
+		_, err := io.Copy(writer, body)
+		copyError(request, path, err)
+	}
+}
+
+// copyError logs a transfer of the file at path that failed for reasons
+// other than the client, such as a failing disk.
+func copyError(request *http.Request, path string, err error) {
+	if err != nil && !clientGone(request.Context(), err) {
+		errorLog.print(request, "unable to send %s: %v", path, err)
+	}
+}
+
+func handlerWrap(
+	handler func(http.ResponseWriter, *http.Request, *serverOptions),
+	opts *serverOptions,
+) http.HandlerFunc {
+	return (func(writer http.ResponseWriter, request *http.Request) {
+		requestTime := time.Now()
+
+		recorder := &responseRecorder{ResponseWriter: writer, head: request.Method == "HEAD"}
+		writer = recorder
+
+		// a panic after the response started can only be answered by
+		// cutting it short, which is done once it is logged.
+		abort := false
+		defer func() {
+			if abort {
+				panic(http.ErrAbortHandler)
+			}
+		}()
+
+		var span, parentSpan spanContext
+		if opts.tracer != nil {
+			span, parentSpan = opts.tracer.start(request)
+		}
+
+		fields := &logFields{requestID: requestID(request, opts)}
+		request = request.WithContext(withLogFields(request.Context(), fields))
+
+		// behind a trusted proxy, the client is the one it forwarded the
+		// request for, to log, limit and allow or deny.
+		if client, ok := forwardedClient(request, opts.trustedProxies); ok {
+			request.RemoteAddr = net.JoinHostPort(client.String(), "0")
+		}
+
+		if opts.echoRequestID {
+			writer.Header().Set("X-Request-ID", fields.requestID)
+		}
+
+		if opts.serverHeader != "" {
+			writer.Header().Set("Server", opts.serverHeader)
+		}
+
+		opts.securityHeaders.apply(writer.Header())
+
+		opts.metrics.started()
+		defer opts.metrics.finished()
+
+		// refusals are logged with the decision that led to them, which
+		// is the last one traced.
+		var trace *requestTrace
+		if opts.audit != nil {
+			trace = &requestTrace{}
+			request = request.WithContext(withRequestTrace(request.Context(), trace))
+		}
+
+		if opts.strictPrivacy {
+			writer.Header().Set("Permissions-Policy", strictPermissionsPolicy)
+			writer.Header().Set("Referrer-Policy", "no-referrer")
+		}
+
+		// everything outside the secret prefix is hidden, and what is
+		// inside of it is served as if it was at the root.
+		inPrefix := true
+		if opts.secretPrefix != "" {
+			request, inPrefix = stripSecretPrefix(writer, request, opts.secretPrefix)
+		}
+
+		if inPrefix && urlWithinLimits(writer, request, opts) &&
+		   opts.bodyLimits.check(writer, request) {
+			release, ok := opts.requestLimit.acquire(writer, request)
+			if ok {
+				func() {
+					defer recoverPanic(writer, request, recorder, &abort)
+
+					if admitRequest(writer, request, opts) {
+						var w http.ResponseWriter = writer
+						if opts.bandwidth != nil {
+							w = throttledWriter{writer, request.Context(), opts.bandwidth}
+						}
+
+						handler(w, request, opts)
+					}
+				}()
+			}
+
+			if ok {
+				release()
+			}
+		}
+
+		portIndex := strings.LastIndex(request.RemoteAddr, ":")
+		clientIP := anonymizeIP(request.RemoteAddr[:portIndex], opts.logIP)
+
+		status, written := recorder.result()
+
+		if opts.bans != nil {
+			opts.bans.record(remoteAddr(request), status)
+		}
+
+		if opts.audit != nil && audited(status) {
+			step := trace.last()
+			userAgent := request.Header.Get("User-Agent")
+			if opts.logNoAgent {
+				userAgent = ""
+			}
+
+			opts.audit.record(auditRecord{
+				Time: requestTime.UTC().Format(time.RFC3339),
+				Client: clientIP,
+				Method: request.Method,
+				URI: request.RequestURI,
+				Host: request.Host,
+				Status: status,
+				Stage: step.Stage,
+				Rule: step.Decision,
+				UserAgent: userAgent,
+				RequestID: fields.requestID,
+			})
+		}
+
+		if name := userDirName(request.URL.Path); name != "" && opts.userDirs != nil {
+			opts.userDirs.account(name, written)
+		}
+
+		// a transfer is aborted when less than the declared length was
+		// sent, or, for compressed responses whose length isn't known up
+		// front, when the client went away before the handler finished.
+		expected := int64(-1)
+		if n, err := strconv.ParseInt(writer.Header().Get("Content-Length"), 10, 64); err == nil {
+			expected = n
+		}
+
+		aborted := request.Method != "HEAD" &&
+			(expected >= 0 && written < expected ||
+			 expected < 0 && request.Context().Err() != nil)
+
+		duration := time.Since(requestTime)
+
+		// the response of a handler that wrote nothing goes out once it
+		// returns.
+		ttfb := duration
+		if !recorder.firstByte.IsZero() {
+			ttfb = recorder.firstByte.Sub(requestTime)
+		}
+		opts.metrics.record(status, written, duration, aborted)
+		if fields.uncompressed > 0 {
+			opts.metrics.compressed(fields.uncompressed, written)
+		}
+
+		if span.sampled {
+			opts.tracer.record(spanRecord{
+				sc: span,
+				parent: parentSpan,
+				start: requestTime,
+				end: requestTime.Add(duration),
+				method: request.Method,
+				path: request.URL.Path,
+				host: request.Host,
+				client: clientIP,
+				userAgent: request.Header.Get("User-Agent"),
+				status: status,
+				bytes: written,
+				uncompressed: fields.uncompressed,
+				encoding: writer.Header().Get("Content-Encoding"),
+				cache: fields.cache,
+				requestID: fields.requestID,
+			})
+		}
+
+		if opts.stats != nil {
+			opts.stats.record(requestRecord{
+				time: requestTime,
+				client: clientIP,
+				method: request.Method,
+				path: request.URL.Path,
+				status: status,
+				bytes: written,
+				aborted: aborted,
+			})
+		}
+
+		// the status screen takes the place of the log on stdout, but not
+		// of one written to a file.
+		if opts.quiet && opts.accessLog == nil {
+			return
+		}
+
+		entry := logEntry{
+			time: requestTime,
+			duration: duration,
+			ttfb: ttfb,
+			client: clientIP,
+			user: fields.user,
+			method: request.Method,
+			uri: request.RequestURI,
+			host: request.Host,
+			proto: request.Proto,
+			status: status,
+			bytes: written,
+			referer: request.Header.Get("Referer"),
+			userAgent: request.Header.Get("User-Agent"),
+			requestID: fields.requestID,
+			uncompressed: fields.uncompressed,
+			aborted: aborted,
+			expected: "-",
+		}
+
+		if expected >= 0 {
+			entry.expected = strconv.FormatInt(expected, 10)
+		}
+
+		if opts.logNoAgent {
+			entry.referer, entry.userAgent = "", ""
+		}
+
+		out := opts.accessLog
+		if out == nil {
+			out = os.Stdout
+		}
+
+		io.WriteString(out, entry.format(opts.logFormat))
+	})
+}
+
+// urlWithinLimits answers requests whose URL or query string is longer
+// than allowed with a 414.
+func urlWithinLimits(writer http.ResponseWriter, request *http.Request, opts *serverOptions) bool {
+	if opts.maxURLLength > 0 && len(request.RequestURI) > opts.maxURLLength ||
+	   opts.maxQueryLength > 0 && len(request.URL.RawQuery) > opts.maxQueryLength {
+		requestTraceFrom(request.Context()).note("limits", "URL too long, 414")
+		http.Error(writer, "URI too long", 414)
+		return false
+	}
+
+	return true
+}
+
+// admitRequest checks the Host, the client's address and credentials of
+// request before it is served, answering it with an error if one of them
+// isn't allowed.
+func admitRequest(writer http.ResponseWriter, request *http.Request, opts *serverOptions) bool {
+	// peers fetching from the cache are known by their address and have
+	// no credentials or browser to check, but the rules for addresses
+	// still hold for them.
+	if opts.peerCache != nil && opts.peerCache.fromPeer(request) {
+		requestTraceFrom(request.Context()).note("peer cache", "fetch from a peer")
+		return (opts.bans == nil || opts.bans.check(writer, request)) &&
+			(opts.access == nil || opts.access.check(writer, request, opts)) &&
+			(opts.geoAccess == nil || opts.geoAccess.check(writer, request, opts))
+	}
+
+	// a Host outside the list points to DNS rebinding or a poisoned
+	// Host header, so such requests are not served at all.
+	if !hostAllowed(request.Host, opts.allowedHosts) {
+		requestTraceFrom(request.Context()).note("host", "%s is not an allowed host, 421", request.Host)
+		http.Error(writer, "Misdirected request", 421)
+		return false
+	}
+
+	// clients are rate limited before their credentials are checked, to
+	// slow down guessing. A signed URL takes the place of credentials.
+	return (opts.bans == nil || opts.bans.check(writer, request)) &&
+		(opts.access == nil || opts.access.check(writer, request, opts)) &&
+		(opts.geoAccess == nil || opts.geoAccess.check(writer, request, opts)) &&
+		(opts.userAgents == nil || opts.userAgents.check(writer, request)) &&
+		(opts.hotlink == nil || opts.hotlink.check(writer, request)) &&
+		(opts.rateLimit == nil || opts.rateLimit.check(writer, request)) &&
+		(opts.signedURLs == nil || opts.signedURLs.check(writer, request, opts)) &&
+		(opts.auth == nil || opts.signedURLs.valid(request) || opts.auth.check(writer, request, opts))
+}
+
+// admitResolved repeats the checks of admitRequest that go by the path
+// for urlPath, the URL of the file that request is answered from under
+// another name, such as about.html for /about in clean URLs mode or
+// doc.fr.html for /doc.html in French, so that protecting a file by its
+// own name is enough. A signature made for the URL as requested still
+// stands in for credentials.
+func admitResolved(
+	writer http.ResponseWriter,
+	request *http.Request,
+	urlPath string,
+	opts *serverOptions,
+) bool {
+	trace := requestTraceFrom(request.Context())
+	trace.note("resolve", "checking access to %s as well", urlPath)
+
+	resolvedURL := *request.URL
+	resolvedURL.Path = urlPath
+	resolved := request.WithContext(request.Context())
+	resolved.URL = &resolvedURL
+
+	if opts.access != nil && !opts.access.check(writer, resolved, opts) ||
+	   opts.geoAccess != nil && !opts.geoAccess.check(writer, resolved, opts) {
+		return false
+	}
+
+	signed := opts.signedURLs.valid(request)
+	if opts.signedURLs != nil && !signed && pathMatchesAny(opts.signedURLs.paths, urlPath, opts) {
+		trace.note("signed URL", "signature required, 403")
+		http.Error(writer, "Forbidden", 403)
+		return false
+	}
+
+	if opts.auth == nil || signed || !opts.auth.protects(urlPath, opts) {
+		return true
+	}
+
+	// credentials that were accepted already can't always be checked
+	// again, as Digest nonces are only good once, so only their scope is.
+	if fields := logFieldsFrom(request.Context()); fields != nil && fields.authenticated {
+		if fields.scope == nil || pathMatchesAny(fields.scope, urlPath, opts) {
+			return true
+		}
+
+		trace.note("auth", "credentials not valid for %s, 403", urlPath)
+		http.Error(writer, "Forbidden", 403)
+		return false
+	}
+
+	return opts.auth.authenticate(writer, resolved, opts)
+}
+
+// resolvedURLPath returns the URL path of the file at resolved, a name in
+// the directory of urlPath that the request was answered from.
+func resolvedURLPath(urlPath string, resolved string) string {
+	return path.Join(path.Dir(strings.TrimSuffix(urlPath, "/")), filepath.Base(resolved))
+}
+
+// hostAllowed checks the Host header, without any port, against the
+// allowed host names; "*.example.com" allows any subdomain of example.com.
+// Every host is allowed if the list is empty.
+func hostAllowed(host string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	for _, pattern := range allowed {
+		if pattern == host ||
+		   strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stopServer is closed to shut the server down gracefully, e.g. when the
+// Windows service manager asks the service to stop.
+var stopServer = make(chan struct{})
+
+// how long a graceful shutdown waits for in-flight requests.
+const shutdownTimeout = 10 * time.Second
+
+func serveWithExitCode(args []string) int {
+	port := flag.Int("port", 8080, "port number to bind")
+	home := flag.String("home", ".", "web server home directory")
+	listDir := flag.Bool("listdir", false, "enable directory listing")
+	defaultLang := flag.String(
+		"default-lang",
+		"en",
+		"language served when no variant matches Accept-Language",
+	)
+	peers := flag.String(
+		"peers",
+		"",
+		"comma-separated base URLs of all peers sharing the compressed cache, with any -secret-prefix",
+	)
+	peerSelf := flag.String("peer-self", "", "base URL of this node in -peers")
+	peerCacheMB := flag.Int("peer-cache-mb", 64, "peer cache size in MiB")
+	nfs := flag.Bool(
+		"nfs",
+		false,
+		"network filesystem mode: time out, retry and circuit-break file access",
+	)
+	nfsTimeout := flag.Duration(
+		"nfs-timeout",
+		5 * time.Second,
+		"timeout for each file operation in -nfs mode",
+	)
+	nfsRetries := flag.Int(
+		"nfs-retries",
+		2,
+		"retries for ESTALE/EIO errors in -nfs mode",
+	)
+	nfsCooldown := flag.Duration(
+		"nfs-cooldown",
+		30 * time.Second,
+		"how long to fail fast with 503 after repeated storage failures",
+	)
+	assertReadOnly := flag.Bool(
+		"assert-readonly",
+		false,
+		"require a read-only home directory and never follow final symlinks",
+	)
+	chroot := flag.Bool(
+		"chroot",
+		false,
+		"chroot into the home directory once the ports are bound, when started as root (Unix)",
+	)
+	runAsUser := flag.String(
+		"user",
+		"",
+		"user to switch to once the ports are bound, when started as root (Unix)",
+	)
+	runAsGroup := flag.String(
+		"group",
+		"",
+		"group to switch to once the ports are bound; the user's group by default (Unix)",
+	)
+	sandbox := flag.Bool(
+		"sandbox",
+		false,
+		"restrict file access to the home directory and block unneeded syscalls (Linux, OpenBSD, FreeBSD)",
+	)
+	charset := flag.String(
+		"charset",
+		"utf-8",
+		"charset added to text content types, empty to omit",
+	)
+	var charsetPaths prefixList
+	flag.Var(
+		&charsetPaths,
+		"charset-path",
+		"charset for a URL prefix, as /prefix=charset (repeatable)",
+	)
+	dirRedirect := flag.String(
+		"dir-redirect",
+		"301",
+		"status for redirecting directories to their URL with a trailing slash (301, 302, 307, 308 or off)",
+	)
+	var headers pathHeaders
+	flag.Var(
+		&headers,
+		"header",
+		"response header for paths matching a prefix or glob, as /pattern=Name: value (repeatable)",
+	)
+	mimeTypes := flag.String(
+		"mime-types",
+		"",
+		"file with extra MIME mappings (nginx mime.types or ext = type)",
+	)
+	cleanURLs := flag.Bool(
+		"clean-urls",
+		false,
+		"serve /name from name.html when /name does not exist",
+	)
+	cleanURLsRedirect := flag.Bool(
+		"clean-urls-redirect",
+		false,
+		"redirect requests for .html files to their extensionless URL (implies -clean-urls)",
+	)
+	var deadlines prefixList
+	flag.Var(
+		&deadlines,
+		"deadline",
+		"time limit for requests under a URL prefix, including the transfer, as /prefix=duration (repeatable)",
+	)
+	allowedHosts := flag.String(
+		"allowed-hosts",
+		"",
+		"comma-separated host names accepted in the Host header (*.domain for subdomains), empty for any",
+	)
+	serverHeader := flag.String(
+		"server-header",
+		"",
+		"value of the Server response header, which is omitted when empty",
+	)
+	var mirrors stringList
+	flag.Var(
+		&mirrors,
+		"mirror",
+		"identical copy of the home directory on another disk to spread large file reads over (repeatable)",
+	)
+	checksums := flag.String(
+		"checksums",
+		"",
+		"sha256sum or sha512sum style index of files to verify while reading, relative to the home directory",
+	)
+	encryptionKeyEnv := flag.String(
+		"encryption-key-env",
+		"",
+		"environment variable with the key to decrypt a home directory written by httpd encrypt",
+	)
+	encryptionKeyFile := flag.String(
+		"encryption-key-file",
+		"",
+		"file with the key to decrypt a home directory written by httpd encrypt",
+	)
+	humanSizes := flag.Bool(
+		"human-sizes",
+		false,
+		"show file sizes in listings as KB, MB or GB instead of bytes",
+	)
+	listPageSize := flag.Int(
+		"list-page-size",
+		1000,
+		"entries per page of a directory listing, 0 for no paging",
+	)
+	noIcons := flag.Bool(
+		"no-icons",
+		false,
+		"leave out the file type icons in listings",
+	)
+	listTheme := flag.String(
+		"list-theme",
+		"auto",
+		"color scheme of listings: auto (following the browser), light or dark",
+	)
+	listStylesheet := flag.String(
+		"list-stylesheet",
+		"",
+		"URL of a stylesheet loaded by listings after the built-in styles",
+	)
+	listTemplatePath := flag.String(
+		"list-template",
+		"",
+		"html/template file used for directory listings instead of the built-in one",
+	)
+	index := flag.String(
+		"index",
+		strings.Join(indexFiles, ","),
+		"comma-separated index files tried for directories, empty to disable",
+	)
+	userDir := flag.String(
+		"userdir",
+		"",
+		"serve /~name/ from each user's directory, e.g. public_html in their home or /srv/www/*",
+	)
+	userDirQuotaMB := flag.Int(
+		"userdir-quota-mb",
+		0,
+		"daily transfer quota of each user directory in MiB, 0 for none",
+	)
+	var userDirQuotas stringList
+	flag.Var(
+		&userDirQuotas,
+		"userdir-quota",
+		"daily transfer quota of one user in MiB, as name=MiB (repeatable)",
+	)
+	caseInsensitive := flag.Bool(
+		"case-insensitive",
+		false,
+		"redirect paths that only match a file with different case to that file",
+	)
+	normalize := flag.String(
+		"normalize",
+		"",
+		"Unicode normalization form (nfc or nfd) that paths are matched and listing links written in",
+	)
+	archives := flag.Bool(
+		"archives",
+		false,
+		"allow downloading directories as zip or tar.gz archives with ?archive=zip or ?archive=tar.gz",
+	)
+	methodHint := flag.String(
+		"method-hint",
+		"",
+		"explanation added to 405 responses, e.g. \"uploads are disabled on this server\"",
+	)
+	logIP := flag.String(
+		"log-ip",
+		"full",
+		"how client addresses are logged: full, truncate (to /24 or /48) or hash (with a key changed daily)",
+	)
+	logFormat := flag.String(
+		"log-format",
+		"default",
+		"format of the access log: default, Apache's common or combined for log analyzers, or json",
+	)
+	logNoAgent := flag.Bool(
+		"log-no-agent",
+		false,
+		"leave the User-Agent and Referer out of the log",
+	)
+	accessLogPath := flag.String(
+		"access-log",
+		"",
+		"file to append the access log to instead of printing it, which is reopened on SIGUSR1 (Unix)",
+	)
+	errorLogPath := flag.String(
+		"error-log",
+		"",
+		"file to append internal errors and panics to instead of the standard error, which is reopened on SIGUSR1 (Unix)",
+	)
+	accessLogMaxSize := flag.String(
+		"access-log-max-size",
+		"0",
+		"size past which -access-log is moved aside to a name with the time appended, with a K, M or G suffix, 0 for no limit",
+	)
+	accessLogRotate := flag.Duration(
+		"access-log-rotate",
+		0,
+		"how often -access-log is moved aside to a name with the time appended, e.g. 24h for daily at midnight UTC, 0 for never",
+	)
+	syslogAddress := flag.String(
+		"syslog",
+		"",
+		"send the access log and the server's messages to syslog: local, udp://host:port, tcp://host:port or unix:///path (Unix)",
+	)
+	syslogFacility := flag.String(
+		"syslog-facility",
+		"daemon",
+		"syslog facility, such as daemon or local0 to local7",
+	)
+	syslogTag := flag.String(
+		"syslog-tag",
+		"httpd",
+		"tag syslog messages are sent with",
+	)
+	otlpEndpoint := flag.String(
+		"otlp-endpoint",
+		"",
+		"OpenTelemetry collector to send a span per request to with OTLP/HTTP, e.g. http://localhost:4318",
+	)
+	var otlpHeaders stringList
+	flag.Var(
+		&otlpHeaders,
+		"otlp-header",
+		"header sent to the collector, as Name: value (repeatable)",
+	)
+	otlpServiceName := flag.String(
+		"otlp-service-name",
+		"gohttpd",
+		"service name spans are sent under",
+	)
+	otlpSampleRatio := flag.Float64(
+		"otlp-sample-ratio",
+		1,
+		"fraction of requests without a traceparent header whose spans are sent",
+	)
+	auditLogPath := flag.String(
+		"audit-log",
+		"",
+		"file to log refused requests (401, 403, 405, 413, 429) to as JSON lines, - for standard error",
+	)
+	logRetention := flag.Duration(
+		"log-retention",
+		0,
+		"delete files matching -log-retention-files older than this, 0 to keep them",
+	)
+	logRetentionFiles := flag.String(
+		"log-retention-files",
+		"",
+		"glob of rotated log files pruned after -log-retention, e.g. /var/log/httpd/access.log.*",
+	)
+	showHiddenFlag := flag.Bool(
+		"show-hidden",
+		false,
+		"serve and list all files and directories whose names start with a dot, except .gohttpd rule and settings files",
+	)
+	hiddenAllow := flag.String(
+		"hidden-allow",
+		strings.Join(hiddenAllowed, ","),
+		"comma-separated names starting with a dot that are served and listed anyway",
+	)
+	strictPrivacy := flag.Bool(
+		"strict-privacy",
+		false,
+		"never set cookies or refer to other sites, and lock down browser features with Permissions-Policy",
+	)
+	var noList stringList
+	flag.Var(
+		&noList,
+		"no-list",
+		"URL prefix or glob of directories that are never listed, like those with a .nolist file (repeatable)",
+	)
+	listCacheTTL := flag.Duration(
+		"list-cache-ttl",
+		0,
+		"how long rendered directory listings are cached while the directory is unchanged, 0 to disable",
+	)
+	var robots prefixList
+	flag.Var(
+		&robots,
+		"robots",
+		"X-Robots-Tag directives for a URL prefix or glob, as /pattern=noindex,nofollow (repeatable)",
+	)
+	var noAI stringList
+	flag.Var(
+		&noAI,
+		"no-ai",
+		"URL prefix or glob opted out of AI crawling and training (repeatable)",
+	)
+	crawlDelay := flag.Int(
+		"crawl-delay",
+		0,
+		"seconds crawlers are asked to wait between requests in the generated robots.txt, 0 for none",
+	)
+	treeDepth := flag.Int(
+		"tree-depth",
+		0,
+		"levels of subdirectories shown by ?recursive=1 and /dir/..tree views of listed directories, 0 to disable them",
+	)
+	authFile := flag.String(
+		"auth-file",
+		"",
+		"htpasswd file with the users allowed in, with bcrypt, apr1 or SHA hashes, or htdigest lines for -auth-scheme digest",
+	)
+	authRealm := flag.String(
+		"auth-realm",
+		"Restricted",
+		"realm shown by browsers when asking for credentials",
+	)
+	adminListen := flag.String(
+		"admin-listen",
+		"",
+		"address for admin endpoints such as /_debug/trace, e.g. 127.0.0.1:9090; keep it private",
+	)
+	adminDebug := flag.Bool(
+		"admin-debug",
+		false,
+		"also serve pprof profiles at /debug/pprof/ and expvar at /debug/vars on the -admin-listen address",
+	)
+	adminAuthFile := flag.String(
+		"admin-auth-file",
+		"",
+		"htpasswd file with the users that may use the admin endpoints",
+	)
+	healthChecks := flag.Bool(
+		"health-checks",
+		false,
+		"also answer /healthz and /readyz on the main port, in place of any files by those names",
+	)
+	metricsPath := flag.String(
+		"metrics-path",
+		"/metrics",
+		"path of the Prometheus metrics on the -admin-listen address, or empty to not collect them",
+	)
+	allowIPs := flag.String(
+		"allow",
+		"",
+		"comma-separated CIDRs or addresses of the only clients served",
+	)
+	denyIPs := flag.String(
+		"deny",
+		"",
+		"comma-separated CIDRs or addresses of clients refused",
+	)
+	trustedProxies := flag.String(
+		"trusted-proxies",
+		"",
+		"comma-separated CIDRs or addresses of proxies in front, whose X-Forwarded-For, X-Real-IP and X-Request-ID are believed",
+	)
+	echoRequestID := flag.Bool(
+		"echo-request-id",
+		false,
+		"send each request's ID back in an X-Request-ID header",
+	)
+	var allowPaths prefixList
+	flag.Var(
+		&allowPaths,
+		"allow-path",
+		"only clients allowed for a URL prefix or glob, as /pattern=CIDR,CIDR (repeatable)",
+	)
+	var denyPaths prefixList
+	flag.Var(
+		&denyPaths,
+		"deny-path",
+		"clients refused for a URL prefix or glob, as /pattern=CIDR,CIDR (repeatable)",
+	)
+	denyStatus := flag.Int(
+		"deny-status",
+		403,
+		"status sent to refused clients, 403, or 404 to hide what exists",
+	)
+	geoIPDB := flag.String(
+		"geoip-db",
+		"",
+		"MaxMind DB file, such as GeoLite2-Country.mmdb, to look up the countries of clients in",
+	)
+	allowCountries := flag.String(
+		"allow-country",
+		"",
+		"comma-separated country codes of the only clients served, -- for addresses not in -geoip-db",
+	)
+	denyCountries := flag.String(
+		"deny-country",
+		"",
+		"comma-separated country codes of clients refused",
+	)
+	var allowCountryPaths prefixList
+	flag.Var(
+		&allowCountryPaths,
+		"allow-country-path",
+		"only countries allowed for a URL prefix or glob, as /pattern=US,CA (repeatable)",
+	)
+	var denyCountryPaths prefixList
+	flag.Var(
+		&denyCountryPaths,
+		"deny-country-path",
+		"countries refused for a URL prefix or glob, as /pattern=US,CA (repeatable)",
+	)
+	var denyUserAgents stringList
+	flag.Var(
+		&denyUserAgents,
+		"deny-user-agent",
+		"case-insensitive regular expression of User-Agents refused, e.g. AhrefsBot|MJ12bot (repeatable)",
+	)
+	denyEmptyUserAgent := flag.Bool(
+		"deny-empty-user-agent",
+		false,
+		"refuse requests without a User-Agent",
+	)
+	rateLimit := flag.Float64(
+		"rate-limit",
+		0,
+		"requests per second allowed from each client address, 0 for no limit",
+	)
+	rateBurst := flag.Int(
+		"rate-burst",
+		20,
+		"requests a client may make at once before -rate-limit applies",
+	)
+	banAfter := flag.Int(
+		"ban-after",
+		0,
+		"401, 403 and 404 responses within -ban-window after which a client is banned, 0 for no bans",
+	)
+	banWindow := flag.Duration(
+		"ban-window",
+		time.Minute,
+		"time within which -ban-after failures get a client banned",
+	)
+	banTime := flag.Duration(
+		"ban-time",
+		10 * time.Minute,
+		"how long a client stays banned",
+	)
+	banExempt := flag.String(
+		"ban-exempt",
+		"",
+		"comma-separated addresses or CIDRs that are never banned",
+	)
+	followSymlinks := flag.String(
+		"follow-symlinks",
+		"safe",
+		"which symlinks are followed: all, safe (those that stay inside the home directory) or off",
+	)
+	dirRules := flag.Bool(
+		"dir-rules",
+		false,
+		"apply the rules of " + dirRulesFile + " files in served directories (allow, deny, require auth, listdir)",
+	)
+	hotlinkProtect := flag.Bool(
+		"hotlink-protection",
+		false,
+		"refuse requests for images, audio and video embedded in pages of other sites",
+	)
+	hotlinkDomains := flag.String(
+		"hotlink-domains",
+		"",
+		"comma-separated other sites allowed to embed files, like example.com or *.example.com",
+	)
+	hotlinkExts := flag.String(
+		"hotlink-exts",
+		defaultHotlinkExts,
+		"comma-separated extensions of the files -hotlink-protection applies to",
+	)
+	hotlinkRedirect := flag.String(
+		"hotlink-redirect",
+		"",
+		"URL to redirect hotlinked requests to, such as a placeholder image, instead of a 403",
+	)
+	securityHeadersPreset := flag.Bool(
+		"security-headers",
+		false,
+		"send X-Content-Type-Options, X-Frame-Options, Referrer-Policy and, on HTML, Content-Security-Policy headers",
+	)
+	frameOptions := flag.String(
+		"frame-options",
+		"",
+		"X-Frame-Options header: DENY, SAMEORIGIN, or off (SAMEORIGIN with -security-headers)",
+	)
+	referrerPolicy := flag.String(
+		"referrer-policy",
+		"",
+		"Referrer-Policy header, or off (strict-origin-when-cross-origin with -security-headers)",
+	)
+	contentSecurityPolicy := flag.String(
+		"content-security-policy",
+		"",
+		"Content-Security-Policy header of HTML responses, or off (same-site only with -security-headers)",
+	)
+	headerTimeout := flag.Duration(
+		"header-timeout",
+		10 * time.Second,
+		"time a client has to send the request headers, 0 for no limit",
+	)
+	idleTimeout := flag.Duration(
+		"idle-timeout",
+		2 * time.Minute,
+		"time an idle keep-alive connection is kept open, 0 for no limit",
+	)
+	minSendRate := flag.String(
+		"min-send-rate",
+		"0",
+		"bytes per second a client must read responses at, with a K, M or G suffix, 0 for any rate",
+	)
+	maxHeaderBytes := flag.Int(
+		"max-header-bytes",
+		64 << 10,
+		"bytes of request line and headers read per request, past which it gets a 431",
+	)
+	maxURLLength := flag.Int(
+		"max-url-length",
+		8192,
+		"bytes allowed in a request URL, past which it gets a 414, 0 for no limit",
+	)
+	maxQueryLength := flag.Int(
+		"max-query-length",
+		4096,
+		"bytes allowed in a query string, past which the request gets a 414, 0 for no limit",
+	)
+	maxBodySize := flag.String(
+		"max-body-size",
+		"1M",
+		"bytes allowed in a request body, with a K, M or G suffix, past which it gets a 413",
+	)
+	var maxMethodBodies stringList
+	flag.Var(
+		&maxMethodBodies,
+		"max-method-body",
+		"bytes allowed in the body of one method's requests, as METHOD=size (repeatable), GET and HEAD allow none by default",
+	)
+	maxConnections := flag.Int(
+		"max-connections",
+		0,
+		"connections open at once, past which new ones wait to be accepted, 0 for no limit",
+	)
+	maxClientConnections := flag.Int(
+		"max-client-connections",
+		0,
+		"connections a client address may have open at once, 0 for no limit",
+	)
+	maxRequests := flag.Int(
+		"max-requests",
+		0,
+		"requests handled at once, past which they wait for -request-queue-timeout, 0 for no limit",
+	)
+	maxClientRequests := flag.Int(
+		"max-client-requests",
+		0,
+		"requests a client address may have handled at once, 0 for no limit",
+	)
+	requestQueueTimeout := flag.Duration(
+		"request-queue-timeout",
+		0,
+		"how long requests over -max-requests wait before getting a 503, 0 to refuse them at once",
+	)
+	authScheme := flag.String(
+		"auth-scheme",
+		"basic",
+		"how credentials are sent: basic, digest with htdigest lines in -auth-file, bearer for JSON Web Tokens, or oidc to log in with an OpenID Connect provider",
+	)
+	oidcIssuer := flag.String(
+		"oidc-issuer",
+		"",
+		"URL of the OpenID Connect provider of -auth-scheme oidc, e.g. https://accounts.google.com",
+	)
+	oidcClientID := flag.String(
+		"oidc-client-id",
+		"",
+		"client ID this server is registered with at the OpenID Connect provider",
+	)
+	oidcClientSecretFile := flag.String(
+		"oidc-client-secret-file",
+		"",
+		"file with the client secret this server is registered with at the OpenID Connect provider",
+	)
+	oidcRedirectURL := flag.String(
+		"oidc-redirect-url",
+		"",
+		"URL on this server the OpenID Connect provider sends users back to, e.g. https://docs.example.com/.oidc/callback",
+	)
+	oidcScopes := flag.String(
+		"oidc-scopes",
+		"openid email profile",
+		"space-separated scopes asked from the OpenID Connect provider",
+	)
+	var oidcClaims stringList
+	flag.Var(
+		&oidcClaims,
+		"oidc-claim",
+		"claim users must have, as name=value, e.g. groups=docs; any value of a name will do (repeatable)",
+	)
+	oidcSessionTTL := flag.Duration(
+		"oidc-session-ttl",
+		8 * time.Hour,
+		"how long users stay logged in",
+	)
+	secretPrefix := flag.String(
+		"secret-prefix",
+		"",
+		"only serve under this path prefix of 16 or more letters and digits, or a new random one with \"random\"",
+	)
+	signingKeyFile := flag.String(
+		"url-signing-key-file",
+		"",
+		"file with the key of URLs signed with \"httpd sign\", which are served without credentials until they expire",
+	)
+	var signedPaths stringList
+	flag.Var(
+		&signedPaths,
+		"signed-path",
+		"URL prefix or glob only served with a signed URL (repeatable)",
+	)
+	jwtSecretFile := flag.String(
+		"jwt-secret-file",
+		"",
+		"file with the HMAC secret bearer tokens are signed with (HS256, HS384, HS512)",
+	)
+	jwksURL := flag.String(
+		"jwks-url",
+		"",
+		"URL of the JWKS with the public keys bearer tokens are signed with (RS*, PS*, ES*)",
+	)
+	jwtIssuer := flag.String(
+		"jwt-issuer",
+		"",
+		"iss claim bearer tokens must have",
+	)
+	jwtAudience := flag.String(
+		"jwt-audience",
+		"",
+		"aud claim bearer tokens must include",
+	)
+	var authPaths stringList
+	flag.Var(
+		&authPaths,
+		"auth-path",
+		"URL prefix or glob that needs credentials, instead of the whole server (repeatable)",
+	)
+	maxFileConnections := flag.Int(
+		"max-file-connections",
+		0,
+		"requests a client may have open for the same file at once, e.g. in ranges, 0 for no limit",
+	)
+	suggestedConnections := flag.Int(
+		"suggested-connections",
+		0,
+		"connections suggested to download accelerators for large files in X-Suggested-Connections, 0 to omit it",
+	)
+	digests := flag.Bool(
+		"digests",
+		false,
+		"send SHA-256 digests of files in Repr-Digest and Content-Digest, from -checksums or computed in the background",
+	)
+	bandwidth := flag.String(
+		"bandwidth",
+		"0",
+		"bytes per second sent to all clients together, with a K, M or G suffix, 0 for unlimited",
+	)
+	var bandwidthSchedule bandwidthSchedule
+	flag.Var(
+		&bandwidthSchedule,
+		"bandwidth-schedule",
+		"bandwidth at other times, as \"[days ]HH:MM-HH:MM=rate\" like \"mon-fri 09:00-18:00=2M\" (repeatable)",
+	)
+	configFile := flag.String(
+		"config",
+		"",
+		"config file with option values (see httpd init)",
+	)
+	tui := flag.Bool(
+		"tui",
+		false,
+		"show a live status screen on the terminal instead of the access log",
+	)
+
+	if printConfigSchema {
+		return writeConfigSchema(os.Stdout, flag.CommandLine)
+	}
+
+	flag.CommandLine.Parse(args)
+
+	if *configFile != "" {
+		if err := loadConfig(*configFile, flag.CommandLine); err != nil {
+			fmt.Println("unable to load config: ", err)
+			return 1
+		}
+	}
+
+	if *port < 1 || *port > 65535 {
+		fmt.Println("invalid port number: ", port)
+		flag.PrintDefaults()
+		return 1
+	}
+
+	dirRedirectStatus := 0
+	if *dirRedirect != "off" {
+		dirRedirectStatus, _ = strconv.Atoi(*dirRedirect)
+
+		switch dirRedirectStatus {
+		case 301, 302, 307, 308:
+		default:
+			fmt.Println("invalid directory redirect status: ", *dirRedirect)
+			flag.PrintDefaults()
+			return 1
+		}
+	}
+
+	if *mimeTypes != "" {
+		if err := loadMimeTypes(*mimeTypes); err != nil {
+			fmt.Println("unable to load MIME types: ", err)
+			return 1
+		}
+	}
+
+	storage, err := newFileStore(*home, *followSymlinks)
+	if err != nil {
+		fmt.Println("unable to open home directory: ", err)
+		flag.PrintDefaults()
+		return 1
+	}
+
+	if *nfs {
+		if *nfsTimeout <= 0 {
+			fmt.Println("invalid NFS timeout: ", *nfsTimeout)
+			flag.PrintDefaults()
+			return 1
+		}
+
+		storage.timeout = *nfsTimeout
+		storage.retries = *nfsRetries
+		storage.cooldown = *nfsCooldown
+	}
+
+	if !stringInSlice(*listTheme, listThemes) {
+		fmt.Println("invalid listing theme: ", *listTheme)
+		flag.PrintDefaults()
+		return 1
+	}
+
+	if *listTemplatePath != "" {
+		if err := loadListTemplate(*listTemplatePath); err != nil {
+			fmt.Println("unable to load listing template: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+	}
+
+	for _, deadline := range deadlines {
+		if timeout, err := time.ParseDuration(deadline.value); err != nil || timeout <= 0 {
+			fmt.Println("invalid deadline: ", deadline.value)
+			flag.PrintDefaults()
+			return 1
+		}
+	}
+
+	bodyLimitsConfig, err := newBodyLimits(*maxBodySize, maxMethodBodies)
+	if err != nil {
+		fmt.Println("invalid body size limit: ", err)
+		flag.PrintDefaults()
+		return 1
+	}
+
+	minSendRateValue, err := parseRate(*minSendRate)
+	if err != nil {
+		fmt.Println("invalid minimum send rate: ", err)
+		flag.PrintDefaults()
+		return 1
+	}
+
+	bandwidthRate, err := parseRate(*bandwidth)
+	if err != nil {
+		fmt.Println("invalid bandwidth: ", err)
+		flag.PrintDefaults()
+		return 1
+	}
+
+	indexFiles = nil
+	for _, name := range strings.Split(*index, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		if strings.ContainsAny(name, "/\\") || isHiddenPath(name) {
+			fmt.Println("invalid index file name: ", name)
+			flag.PrintDefaults()
+			return 1
+		}
+
+		indexFiles = append(indexFiles, name)
+	}
+
+	showHidden = *showHiddenFlag
+	hiddenAllowed = nil
+	for _, name := range strings.Split(*hiddenAllow, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			hiddenAllowed = append(hiddenAllowed, name)
+		}
+	}
+
+	sandboxPaths := []string{storage.home}
+	for _, mirror := range mirrors {
+		root, err := os.OpenRoot(mirror)
+		if err == nil {
+			mirror, err = filepath.Abs(mirror)
+		}
+
+		if err != nil {
+			fmt.Println("unable to open mirror: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+
+		storage.mirrors = append(storage.mirrors, root)
+		sandboxPaths = append(sandboxPaths, mirror)
+	}
+
+	// neither is reachable from inside the home directory.
+	if *chroot && (len(mirrors) > 0 || *userDir != "") {
+		fmt.Println("-chroot can't be used with -mirror or -userdir")
+		flag.PrintDefaults()
+		return 1
+	}
+
+	if *encryptionKeyEnv != "" || *encryptionKeyFile != "" {
+		var err error
+		storage.encryptionKey, err = loadEncryptionKey(*encryptionKeyEnv, *encryptionKeyFile)
+		if err != nil {
+			fmt.Println("unable to load encryption key: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+	}
+
+	if *checksums != "" {
+		var err error
+		storage.checksums, err = loadChecksums(*checksums)
+		if err != nil {
+			fmt.Println("unable to load checksums: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+	}
+
+	var userDirs *userDirs
+	if *userDir != "" {
+		var err error
+		userDirs, err = newUserDirs(*userDir, *userDirQuotaMB, userDirQuotas)
+		if err != nil {
+			fmt.Println("unable to set up user directories: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+
+		// users' homes can't all be allowed up front.
+		if *sandbox && userDirs.baseDir() == "" {
+			fmt.Println("-sandbox needs -userdir to be an absolute path")
+			flag.PrintDefaults()
+			return 1
+		}
+
+		if userDirs.baseDir() != "" {
+			sandboxPaths = append(sandboxPaths, userDirs.baseDir())
+		}
+
+		storage.userDirs = userDirs
+	}
+
+	var accessConfig *accessControl
+	if *allowIPs != "" || *denyIPs != "" || len(allowPaths) > 0 || len(denyPaths) > 0 {
+		accessConfig = &accessControl{status: *denyStatus}
+
+		var err error
+		if accessConfig.allow, err = parseIPList(*allowIPs); err == nil {
+			accessConfig.deny, err = parseIPList(*denyIPs)
+		}
+
+		addRules := func(list prefixList, allow bool) {
+			for _, v := range list {
+				if err != nil {
+					return
+				}
+
+				rule := accessRule{pattern: v.prefix, allow: allow}
+				rule.prefixes, err = parseIPList(v.value)
+				accessConfig.rules = append(accessConfig.rules, rule)
+			}
+		}
+
+		addRules(allowPaths, true)
+		addRules(denyPaths, false)
+
+		if err == nil && *denyStatus != 403 && *denyStatus != 404 {
+			err = fmt.Errorf("invalid status %d, expected 403 or 404", *denyStatus)
+		}
+
+		if err != nil {
+			fmt.Println("unable to set up access lists: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+	}
+
+	var geoAccessConfig *geoAccess
+	if *allowCountries != "" || *denyCountries != "" || len(allowCountryPaths) > 0 || len(denyCountryPaths) > 0 {
+		geoAccessConfig = &geoAccess{status: *denyStatus}
+
+		if *geoIPDB == "" {
+			err = errors.New("country lists need a database given with -geoip-db")
+		} else if geoAccessConfig.db, err = openGeoIPDatabase(*geoIPDB); err == nil {
+			if geoAccessConfig.allow, err = parseCountryList(*allowCountries); err == nil {
+				geoAccessConfig.deny, err = parseCountryList(*denyCountries)
+			}
+		}
+
+		addRules := func(list prefixList, allow bool) {
+			for _, v := range list {
+				if err != nil {
+					return
+				}
+
+				rule := geoAccessRule{pattern: v.prefix, allow: allow}
+				rule.countries, err = parseCountryList(v.value)
+				geoAccessConfig.rules = append(geoAccessConfig.rules, rule)
+			}
+		}
+
+		addRules(allowCountryPaths, true)
+		addRules(denyCountryPaths, false)
+
+		if err == nil && *denyStatus != 403 && *denyStatus != 404 {
+			err = fmt.Errorf("invalid status %d, expected 403 or 404", *denyStatus)
+		}
+
+		if err != nil {
+			fmt.Println("unable to set up country lists: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+	}
+
+	var userAgentsConfig *userAgentFilter
+	if len(denyUserAgents) > 0 || *denyEmptyUserAgent {
+		userAgentsConfig, err = newUserAgentFilter(denyUserAgents, *denyEmptyUserAgent)
+		if err != nil {
+			fmt.Println("invalid User-Agent pattern: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+	}
+
+	securityHeadersConfig, err := newSecurityHeaders(
+		*securityHeadersPreset, *frameOptions, *referrerPolicy, *contentSecurityPolicy,
+	)
+
+	if err != nil {
+		fmt.Println("unable to set up security headers: ", err)
+		flag.PrintDefaults()
+		return 1
+	}
+
+	var hotlinkConfig *hotlinkProtection
+	if *hotlinkProtect {
+		hotlinkConfig = &hotlinkProtection{redirect: *hotlinkRedirect}
+
+		for _, domain := range strings.Split(*hotlinkDomains, ",") {
+			if domain = hostOnly(strings.TrimSpace(domain)); domain != "" {
+				hotlinkConfig.domains = append(hotlinkConfig.domains, domain)
+			}
+		}
+
+		for _, ext := range strings.Split(*hotlinkExts, ",") {
+			ext = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ext)), ".")
+			if ext != "" {
+				hotlinkConfig.exts = append(hotlinkConfig.exts, ext)
+			}
+		}
+	}
+
+	var requestLimitConfig *requestLimit
+	if *maxRequests > 0 || *maxClientRequests > 0 {
+		requestLimitConfig = newRequestLimit(*maxRequests, *maxClientRequests, *requestQueueTimeout)
+	}
+
+	var rateLimiterConfig *rateLimiter
+	if *rateLimit > 0 {
+		rateLimiterConfig = newRateLimiter(*rateLimit, *rateBurst)
+	}
+
+	var banConfig *banList
+	if *banAfter > 0 {
+		exempt, err := parseIPList(*banExempt)
+		if err != nil {
+			fmt.Println("invalid ban exemptions: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+
+		if *banWindow <= 0 || *banTime <= 0 {
+			fmt.Println("invalid ban window or time: ", *banWindow, *banTime)
+			flag.PrintDefaults()
+			return 1
+		}
+
+		banConfig = newBanList(*banAfter, *banWindow, *banTime, exempt)
+	}
+
+	var accessLogConfig *accessLog
+	if *accessLogPath != "" {
+		maxSize, err := parseRate(*accessLogMaxSize)
+		if err == nil && *accessLogRotate < 0 {
+			err = errors.New("the rotation interval can't be negative")
+		}
+
+		// moving the file aside and creating a new one needs access to
+		// its directory.
+		if err == nil && (maxSize > 0 || *accessLogRotate > 0) && (*sandbox || *chroot) {
+			err = errors.New("rotation can't be used with -sandbox or -chroot, rotate with logrotate's copytruncate instead")
+		}
+
+		if err == nil {
+			accessLogConfig, err = openAccessLog(*accessLogPath, maxSize, *accessLogRotate)
+		}
+
+		if err != nil {
+			fmt.Println("unable to open access log: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+
+		reopenOnSignal(accessLogConfig)
+	} else if *accessLogMaxSize != "0" || *accessLogRotate != 0 {
+		fmt.Println("-access-log-max-size and -access-log-rotate need -access-log")
+		flag.PrintDefaults()
+		return 1
+	}
+
+	if *errorLogPath != "" {
+		file, err := openAccessLog(*errorLogPath, 0, 0)
+		if err != nil {
+			fmt.Println("unable to open error log: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+
+		errorLog.out = file
+		reopenOnSignal(file)
+	}
+
+	var auditConfig *auditLog
+	if *auditLogPath != "" {
+		var err error
+		if auditConfig, err = openAuditLog(*auditLogPath); err != nil {
+			fmt.Println("unable to open audit log: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+	}
+
+	var signedURLsConfig *signedURLs
+	if *signingKeyFile != "" {
+		key, err := loadSigningKey(*signingKeyFile)
+		if err != nil {
+			fmt.Println("unable to load URL signing key: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+
+		signedURLsConfig = &signedURLs{key: key, paths: signedPaths}
+	} else if len(signedPaths) > 0 {
+		fmt.Println("-signed-path needs -url-signing-key-file")
+		flag.PrintDefaults()
+		return 1
+	}
+
+	var secretPrefixConfig string
+	if *secretPrefix != "" {
+		var err error
+		if secretPrefixConfig, err = newSecretPrefix(*secretPrefix); err != nil {
+			fmt.Println("invalid secret prefix: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+	}
+
+	var authConfig *auth
+	if *authScheme == "bearer" {
+		var secret []byte
+		var err error
+
+		switch {
+		case (*jwtSecretFile == "") == (*jwksURL == ""):
+			err = errors.New("-auth-scheme bearer needs one of -jwt-secret-file and -jwks-url")
+		case *jwtSecretFile != "":
+			secret, err = os.ReadFile(*jwtSecretFile)
+			secret = bytes.TrimSpace(secret)
+			if err == nil && len(secret) < 32 {
+				err = errors.New("the JWT secret must be at least 32 bytes")
+			}
+		}
+
+		var tokens *jwtVerifier
+		if err == nil {
+			tokens, err = newJWTVerifier(secret, *jwksURL, *jwtIssuer, *jwtAudience)
+		}
+
+		if err != nil {
+			fmt.Println("unable to set up bearer tokens: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+
+		authConfig = &auth{realm: *authRealm, paths: authPaths, tokens: tokens}
+	} else if *authScheme == "oidc" {
+		var oidc *oidcClient
+		var secret []byte
+		var err error
+
+		// providers that allow it let clients without a secret in with
+		// PKCE alone.
+		if *oidcClientSecretFile != "" {
+			secret, err = os.ReadFile(*oidcClientSecretFile)
+		}
+
+		switch {
+		case err != nil:
+		case *oidcIssuer == "" || *oidcClientID == "" || *oidcRedirectURL == "":
+			err = errors.New("-auth-scheme oidc needs -oidc-issuer, -oidc-client-id and -oidc-redirect-url")
+		case *strictPrivacy:
+			err = errors.New("logins need cookies, which -strict-privacy rules out")
+		default:
+			oidc, err = newOIDCClient(
+				*oidcIssuer, *oidcClientID, string(bytes.TrimSpace(secret)), *oidcRedirectURL,
+				*oidcScopes, oidcClaims, *oidcSessionTTL, secretPrefixConfig,
+			)
+		}
+
+		if err != nil {
+			fmt.Println("unable to set up OpenID Connect: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+
+		authConfig = &auth{realm: *authRealm, paths: authPaths, oidc: oidc}
+	} else if *jwtSecretFile != "" || *jwksURL != "" {
+		fmt.Println("-jwt-secret-file and -jwks-url need -auth-scheme bearer")
+		flag.PrintDefaults()
+		return 1
+	} else if *oidcIssuer != "" {
+		fmt.Println("-oidc-issuer needs -auth-scheme oidc")
+		flag.PrintDefaults()
+		return 1
+	} else if *authFile != "" {
+		path, err := filepath.Abs(*authFile)
+		var users *htpasswdFile
+		if err == nil {
+			users, err = loadHtpasswd(path)
+		}
+
+		if err != nil {
+			fmt.Println("unable to load credentials: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+
+		authConfig = &auth{realm: *authRealm, paths: authPaths, users: users}
+
+		switch *authScheme {
+		case "basic":
+		case "digest":
+			authConfig.nonces = newDigestNonces()
+		default:
+			fmt.Println("invalid auth scheme: ", *authScheme)
+			flag.PrintDefaults()
+			return 1
+		}
+	} else if len(authPaths) > 0 {
+		fmt.Println("-auth-path needs -auth-file")
+		flag.PrintDefaults()
+		return 1
+	}
+
+	opts := &serverOptions{
+		storage: storage,
+		listDir: *listDir,
+		defaultLang: *defaultLang,
+		charset: *charset,
+		charsetPaths: charsetPaths,
+		headers: headers,
+		dirRedirect: dirRedirectStatus,
+		cleanURLs: *cleanURLs || *cleanURLsRedirect,
+		cleanURLsRedirect: *cleanURLsRedirect,
+		serverHeader: *serverHeader,
+		deadlines: deadlines,
+		humanSizes: *humanSizes,
+		noIcons: *noIcons,
+		listTheme: *listTheme,
+		listStylesheet: *listStylesheet,
+		listPageSize: max(*listPageSize, 0),
+		userDirs: userDirs,
+		caseInsensitive: *caseInsensitive,
+		normalize: strings.ToLower(*normalize),
+		archives: *archives,
+		methodHint: *methodHint,
+		logIP: *logIP,
+		logFormat: *logFormat,
+		logNoAgent: *logNoAgent,
+		strictPrivacy: *strictPrivacy,
+		noList: noList,
+		robots: robots,
+		noAI: noAI,
+		crawlDelay: *crawlDelay,
+		treeDepth: max(*treeDepth, 0),
+		suggestedConnections: max(*suggestedConnections, 0),
+		auth: authConfig,
+		access: accessConfig,
+		geoAccess: geoAccessConfig,
+		userAgents: userAgentsConfig,
+		rateLimit: rateLimiterConfig,
+		bans: banConfig,
+		audit: auditConfig,
+		signedURLs: signedURLsConfig,
+		secretPrefix: secretPrefixConfig,
+		requestLimit: requestLimitConfig,
+		maxURLLength: *maxURLLength,
+		bodyLimits: bodyLimitsConfig,
+		securityHeaders: securityHeadersConfig,
+		hotlink: hotlinkConfig,
+		maxQueryLength: *maxQueryLength,
+	}
+
+	if *maxFileConnections > 0 {
+		opts.fileConnections = newFileConnections(*maxFileConnections)
+		if opts.suggestedConnections > 0 {
+			opts.suggestedConnections = min(opts.suggestedConnections, *maxFileConnections)
+		}
+	}
+
+	if *digests {
+		opts.digests = newDigestCache(storage)
+	}
+
+	if bandwidthRate > 0 || len(bandwidthSchedule) > 0 {
+		opts.bandwidth = newBandwidthLimiter(bandwidthRate, bandwidthSchedule)
+	}
+
+	if *dirRules {
+		opts.dirRules = newDirRulesCache(storage)
+	}
+
+	if *listCacheTTL > 0 {
+		opts.listCache = newListingCache(*listCacheTTL)
+	}
+
+	if opts.strictPrivacy {
+		if err := checkStrictPrivacy(headers, opts.listStylesheet); err != nil {
+			fmt.Println("strict privacy check failed: ", err)
+			return 1
+		}
+	}
+
+	switch opts.logIP {
+	case "full", "truncate", "hash":
+	default:
+		fmt.Println("invalid client address logging: ", *logIP)
+		flag.PrintDefaults()
+		return 1
+	}
+
+	if !stringInSlice(opts.logFormat, logFormats) {
+		fmt.Println("invalid log format: ", *logFormat)
+		flag.PrintDefaults()
+		return 1
+	}
+
+	if (*logRetention > 0) != (*logRetentionFiles != "") {
+		fmt.Println("-log-retention and -log-retention-files must be given together")
+		flag.PrintDefaults()
+		return 1
+	}
+
+	// pruning deletes files outside the home directory.
+	if *logRetention > 0 && *sandbox {
+		fmt.Println("-log-retention can't be used with -sandbox")
+		flag.PrintDefaults()
+		return 1
+	}
+
+	if opts.normalize != "" && opts.normalize != "nfc" && opts.normalize != "nfd" {
+		fmt.Println("invalid normalization form: ", *normalize)
+		flag.PrintDefaults()
+		return 1
+	}
+
+	for _, host := range strings.Split(*allowedHosts, ",") {
+		host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+		if host != "" {
+			opts.allowedHosts = append(opts.allowedHosts, host)
+		}
+	}
+
+	if *tui {
+		opts.stats = newRequestStats()
+		opts.quiet = true
+	}
+
+	// the admin listener has the status screen's counters as a page.
+	if *adminListen != "" && opts.stats == nil {
+		opts.stats = newRequestStats()
+	}
+
+	opts.trustedProxies, err = parseIPList(*trustedProxies)
+	if err != nil {
+		fmt.Println("invalid trusted proxies: ", err)
+		flag.PrintDefaults()
+		return 1
+	}
+
+	opts.echoRequestID = *echoRequestID
+	opts.adminDebug = *adminDebug
+
+	if *metricsPath != "" && !strings.HasPrefix(*metricsPath, "/") {
+		fmt.Println("invalid metrics path: ", *metricsPath)
+		flag.PrintDefaults()
+		return 1
+	}
+
+	if *adminListen != "" && *metricsPath != "" {
+		opts.metrics = newServerMetrics()
+		opts.metricsPath = *metricsPath
+	}
+
+	if *adminAuthFile != "" {
+		path, err := filepath.Abs(*adminAuthFile)
+		if err == nil {
+			opts.adminUsers, err = loadHtpasswd(path)
+		}
+
+		if err != nil {
+			fmt.Println("unable to load admin credentials: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+	}
+
+	if accessLogConfig != nil {
+		opts.accessLog = accessLogConfig
+	}
+
+	var syslogConfig *syslogLog
+	if *syslogAddress != "" {
+		var err error
+		if *tui {
+			err = errors.New("the status screen needs the standard output, which -syslog takes")
+		} else {
+			syslogConfig, err = openSyslog(*syslogAddress, *syslogFacility, *syslogTag)
+		}
+
+		if err != nil {
+			fmt.Println("unable to set up syslog: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+
+		if opts.accessLog == nil {
+			opts.accessLog = syslogConfig.info()
+		}
+	}
+
+	if *otlpEndpoint != "" {
+		tracer, err := newOTLPExporter(*otlpEndpoint, otlpHeaders, *otlpServiceName, *otlpSampleRatio)
+		if err != nil {
+			fmt.Println("unable to set up tracing: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+
+		opts.tracer = tracer
+		subsystems.start("trace export", tracer.run)
+	}
+
+	// the content has a mux of its own, so that nothing registered on the
+	// default one, like the profiles of net/http/pprof, is served next to
+	// it.
+	mux := http.NewServeMux()
+
+	if *peers != "" {
+		cache, err := newPeerCache(
+			storage,
+			*peerSelf,
+			strings.Split(*peers, ","),
+			int64(*peerCacheMB) << 20,
+		)
+
+		if err != nil {
+			fmt.Println("unable to set up peer cache: ", err)
+			flag.PrintDefaults()
+			return 1
+		}
+
+		opts.peerCache = cache
+	}
+
+	opts.health = &healthState{storage: storage}
+	if *healthChecks {
+		mux.HandleFunc("/healthz", opts.health.serveHealth)
+		mux.HandleFunc("/readyz", opts.health.serveReady)
+	}
+
+	mux.Handle("/", handlerWrap(requestHandler, opts))
+
+	bindPort := fmt.Sprintf(":%d", *port)
+	listener, err := net.Listen("tcp", bindPort)
+	if err != nil {
+		fmt.Println("unable to start server", err)
+		return 1
+	}
+
+	if *maxConnections > 0 || *maxClientConnections > 0 {
+		listener = newLimitListener(listener, *maxConnections, *maxClientConnections)
+	}
+
+	if minSendRateValue > 0 {
+		listener = &minRateListener{Listener: listener, rate: minSendRateValue}
+	}
+
+	// admin endpoints get their own listener, so that they can be kept
+	// off the network the content is served to.
+	var adminListener net.Listener
+	if *adminListen != "" {
+		adminListener, err = net.Listen("tcp", *adminListen)
+		if err != nil {
+			fmt.Println("unable to start admin server", err)
+			return 1
+		}
+	}
+
+	// accounts are looked up while /etc is still there.
+	uid, gid := -1, -1
+	if *runAsUser != "" || *runAsGroup != "" {
+		uid, gid, err = lookupCredentials(*runAsUser, *runAsGroup)
+		if err != nil {
+			fmt.Println("unable to drop privileges: ", err)
+			return 1
+		}
+	}
+
+	if *chroot {
+		if err := enterChroot(storage.home); err != nil {
+			fmt.Println("unable to chroot: ", err)
+			return 1
+		}
+
+		storage.home = "/"
+		sandboxPaths = []string{"/"}
+	}
+
+	// binding ports below 1024 is the only thing that needs root, so it is
+	// given up before any request is served.
+	if *runAsUser != "" || *runAsGroup != "" {
+		if err := dropPrivileges(uid, gid); err != nil {
+			fmt.Println("unable to drop privileges: ", err)
+			return 1
+		}
+	}
+
+	var adminServer *http.Server
+	if adminListener != nil {
+		adminServer = &http.Server{Handler: adminHandler(opts)}
+		go func() {
+			err := adminServer.Serve(adminListener)
+			if err != nil && err != http.ErrServerClosed {
+				fmt.Println("admin server failed: ", err)
+			}
+		}()
+	}
+
+	// nothing in the server writes to the home directory, so asserting
+	// read-only only needs the mount check and O_NOFOLLOW opens.
+	if *assertReadOnly {
+		rootDir, err := os.Open(storage.home)
+		if err == nil {
+			err = checkReadOnly(rootDir)
+		}
+
+		if err != nil {
+			fmt.Println("read-only assertion failed: ", err)
+			return 1
+		}
+
+		storage.noFollow = true
+		subsystems.start("read-only watcher", func() error {
+			watchReadOnly(rootDir)
+			return nil
+		})
+	}
+
+	// this has to come last, once the socket is bound and everything
+	// else that needs to read outside the home directory is done.
+	if *sandbox {
+		if err := applySandbox(storage, sandboxPaths); err != nil {
+			fmt.Println("unable to sandbox: ", err)
+			return 1
+		}
+	}
+
+	// slow clients are cut off: those that trickle in their headers,
+	// keep idle connections open or read responses slower than
+	// -min-send-rate.
+	server := &http.Server{
+		Handler: mux,
+		MaxHeaderBytes: *maxHeaderBytes,
+		ReadHeaderTimeout: *headerTimeout,
+		IdleTimeout: *idleTimeout,
+	}
+
+	go func() {
+		<-stopServer
+		opts.health.serving.Store(false)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if adminServer != nil {
+			adminServer.Close()
+		}
+
+		if server.Shutdown(ctx) != nil {
+			server.Close()
+		}
+	}()
+
+	if *logRetention > 0 {
+		subsystems.start("log pruning", func() error {
+			pruneLogs(*logRetentionFiles, *logRetention)
+			return nil
+		})
+	}
+
+	// from here on, what the server prints goes to syslog, errors with
+	// their own severity.
+	if syslogConfig != nil {
+		if err := redirectOutput(&os.Stdout, syslogConfig.notice()); err != nil {
+			fmt.Println("unable to redirect output to syslog: ", err)
+			return 1
+		}
+
+		redirectOutput(&os.Stderr, syslogConfig.err())
+	}
+
+	served := fmt.Sprintf("port %d from %s", *port, *home)
+	if opts.secretPrefix != "" {
+		served += fmt.Sprintf(", only under %s/", opts.secretPrefix)
+	}
+
+	if *tui {
+		go runStatusScreen(opts.stats, served)
+	} else {
+		fmt.Println("* Serving on", served)
+	}
+
+	opts.health.serving.Store(true)
+	err = server.Serve(listener)
+
+	if opts.tracer != nil {
+		if err := opts.tracer.flush(); err != nil {
+			fmt.Println("unable to export spans: ", err)
+		}
+	}
+
+	if err != nil && err != http.ErrServerClosed {
+		fmt.Println("unable to start server", err)
+		return 1
+	}
+
+	return 0
+}
+
+func mainWithExitCode() int {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "service":
+			return serviceCommand(os.Args[2:])
+		case "init":
+			return initCommand(os.Args[2:])
+		case "config":
+			return configCommand(os.Args[2:])
+		case "index-gen":
+			return indexGenCommand(os.Args[2:])
+		case "export":
+			return exportCommand(os.Args[2:])
+		case "encrypt":
+			return encryptCommand(os.Args[2:])
+		case "sync":
+			return syncCommand(os.Args[2:])
+		case "sign":
+			return signCommand(os.Args[2:])
+		}
+	}
+
+	return serveWithExitCode(os.Args[1:])
 }
 
 func main() {
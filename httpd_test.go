@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPathMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		urlPath string
+		want bool
+	}{
+		{"/builds/foo", "/builds/foo", true},
+		{"/builds/foo", "/builds/foo/", true},
+		{"/builds/foo", "/builds/foo/b", true},
+		{"/builds/foo", "/builds/foobar/b", false},
+		{"/builds/foo/", "/builds/foo/b", true},
+		{"/builds/foo/", "/builds/foobar", false},
+		{"/api", "/apiary", false},
+		{"/api", "/api/v1", true},
+		{"/", "/anything", true},
+		{"/app/*", "/app/x/y", true},
+		{"/app/*", "/apps/x", false},
+	}
+
+	for _, test := range tests {
+		if got := pathMatches(test.pattern, test.urlPath); got != test.want {
+			t.Errorf("pathMatches(%q, %q) = %v, expected %v", test.pattern, test.urlPath, got, test.want)
+		}
+	}
+}
+
+func TestPrefixListLookup(t *testing.T) {
+	var deadlines prefixList
+	for _, s := range []string{"/=1m", "/api=5s", "/api/slow=30s"} {
+		if err := deadlines.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]string {
+		"/api": "5s",
+		"/api/v1": "5s",
+		"/api/slow/x": "30s",
+		"/api/slower": "5s",
+		"/apiary": "1m",
+		"/": "1m",
+	}
+
+	for urlPath, want := range tests {
+		if got, _ := deadlines.lookup(urlPath); got != want {
+			t.Errorf("lookup(%q) = %q, expected %q", urlPath, got, want)
+		}
+	}
+}
+
+func TestServerFilesStayHidden(t *testing.T) {
+	defer func(saved bool) { showHidden = saved }(showHidden)
+	showHidden = true
+
+	for _, path := range []string{".gohttpd", "docs/.gohttpd", "~bob/.gohttpd.toml", ".GOHTTPD", "~bob/.Gohttpd.toml"} {
+		if !isHiddenPath(path) {
+			t.Errorf("%s is served with -show-hidden", path)
+		}
+	}
+
+	if isHiddenPath("docs/.env") {
+		t.Errorf("docs/.env is hidden with -show-hidden")
+	}
+}
+
+// getStatus requests urlPath from server, with the Basic credentials of
+// user if given, and returns the status.
+func getStatus(t *testing.T, server *httptest.Server, urlPath string, user string, password string) int {
+	request, err := http.NewRequest("GET", server.URL + urlPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user != "" {
+		request.SetBasicAuth(user, password)
+	}
+
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func TestCleanURLsKeepFilesProtected(t *testing.T) {
+	server, opts := newArchiveTestServer(t)
+	opts.cleanURLs = true
+	opts.auth.paths = []string{"/secret.html"}
+
+	page := filepath.Join(opts.storage.home, "secret.html")
+	if err := os.WriteFile(page, []byte("<p>secret</p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := getStatus(t, server, "/secret", "", ""); status != 401 {
+		t.Errorf("/secret without credentials got status %d, expected 401", status)
+	}
+
+	if status := getStatus(t, server, "/secret", "bob", "secret"); status != 200 {
+		t.Errorf("/secret with credentials got status %d, expected 200", status)
+	}
+
+	opts.auth = nil
+	opts.signedURLs = &signedURLs{key: make([]byte, 32), paths: []string{"/secret.html"}}
+
+	if status := getStatus(t, server, "/secret", "", ""); status != 403 {
+		t.Errorf("unsigned /secret got status %d, expected 403", status)
+	}
+}
+
+func TestLanguageVariantsKeepFilesProtected(t *testing.T) {
+	server, opts := newArchiveTestServer(t)
+	opts.defaultLang = "en"
+	opts.auth.paths = []string{"/doc.fr.html"}
+
+	page := filepath.Join(opts.storage.home, "doc.fr.html")
+	if err := os.WriteFile(page, []byte("<p>secret</p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest("GET", server.URL + "/doc.html", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request.Header.Set("Accept-Language", "fr")
+
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+	if response.StatusCode != 401 {
+		t.Errorf("/doc.html in French got status %d, expected 401", response.StatusCode)
+	}
+}
+
+func TestPeerCacheFetch(t *testing.T) {
+	lastModified := time.Now().UTC().Truncate(time.Second)
+	cache := &peerCache{client: http.DefaultClient, maxBytes: 16 << 10}
+	limit := int(cache.maxObjectSize())
+
+	tests := []struct {
+		name string
+		serve func(writer http.ResponseWriter)
+		valid bool
+	}{
+		{"complete", func(writer http.ResponseWriter) {
+			writer.Header().Set("Content-Length", "5")
+			writer.Write([]byte("hello"))
+		}, true},
+		{"slightly larger than a file at the limit", func(writer http.ResponseWriter) {
+			writer.Header().Set("Content-Length", strconv.Itoa(limit + 20))
+			writer.Write([]byte(strings.Repeat("x", limit + 20)))
+		}, true},
+		{"without a length", func(writer http.ResponseWriter) {
+			writer.Write([]byte("hello"))
+			writer.(http.Flusher).Flush()
+		}, false},
+		{"too large", func(writer http.ResponseWriter) {
+			writer.Header().Set("Content-Length", strconv.Itoa(2 * limit))
+			writer.Write([]byte(strings.Repeat("x", 2 * limit)))
+		}, false},
+		{"too large without a length", func(writer http.ResponseWriter) {
+			writer.Write([]byte(strings.Repeat("x", 2 * limit)))
+			writer.(http.Flusher).Flush()
+		}, false},
+		{"cut short", func(writer http.ResponseWriter) {
+			writer.Header().Set("Content-Length", "100")
+			writer.Write([]byte("hello"))
+		}, false},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+			test.serve(writer)
+		}))
+
+		_, err := cache.fetch(context.Background(), server.URL, "file.txt", lastModified)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got error %v, expected valid %v", test.name, err, test.valid)
+		}
+
+		if test.valid {
+			_, err := cache.fetch(context.Background(), server.URL, "file.txt", lastModified.Add(time.Second))
+			if err == nil {
+				t.Errorf("%s: body of another version accepted", test.name)
+			}
+		}
+
+		server.Close()
+	}
+}
+
+func TestPeerFetchesAreAdmitted(t *testing.T) {
+	server, opts := newArchiveTestServer(t)
+	opts.auth.paths = nil
+
+	var log bytes.Buffer
+	opts.accessLog = &log
+
+	opts.peerCache = &peerCache{
+		storage: opts.storage,
+		peerIPs: map[string]bool{"127.0.0.1": true},
+		maxBytes: 1 << 20,
+		entries: map[string]*list.Element{},
+		lru: list.New(),
+	}
+
+	// peers have no credentials, and are let through by their address.
+	if status := getStatus(t, server, "/.gohttpd-peer/private/s.txt", "", ""); status != 200 {
+		t.Errorf("peer fetch got status %d, expected 200", status)
+	}
+
+	if !strings.Contains(log.String(), "/.gohttpd-peer/private/s.txt") {
+		t.Errorf("peer fetch missing from the access log: %q", log.String())
+	}
+
+	opts.bans = newBanList(1, time.Minute, time.Minute, nil)
+	getStatus(t, server, "/.gohttpd-peer/missing.txt", "", "")
+
+	if status := getStatus(t, server, "/.gohttpd-peer/public.txt", "", ""); status != 403 {
+		t.Errorf("peer fetch of a banned address got status %d, expected 403", status)
+	}
+
+	loopback, err := parseIPList("127.0.0.0/8,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.bans = nil
+	opts.access = &accessControl{deny: loopback, status: 403}
+
+	if status := getStatus(t, server, "/.gohttpd-peer/public.txt", "", ""); status != 403 {
+		t.Errorf("peer fetch of a denied address got status %d, expected 403", status)
+	}
+
+	// other clients need credentials as usual, and can't fetch either.
+	opts.access = nil
+	opts.peerCache.peerIPs = map[string]bool{"192.0.2.1": true}
+
+	if status := getStatus(t, server, "/.gohttpd-peer/public.txt", "", ""); status != 401 {
+		t.Errorf("fetch by another client without credentials got status %d, expected 401", status)
+	}
+
+	if status := getStatus(t, server, "/.gohttpd-peer/public.txt", "bob", "secret"); status != 404 {
+		t.Errorf("fetch by another client got status %d, expected 404", status)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 16x16 outline icons for directory listings, drawn in the text color.
+const iconPrefix = `<svg class="icon" width="16" height="16" viewBox="0 0 16 16" fill="none" stroke="currentColor" stroke-width="1.2" aria-hidden="true">`
+
+var listingIcons = map[string]template.HTML {
+	"folder": iconPrefix + `<path d="M1.5 3.5h5l1.5 1.5h6.5v8h-13z"/></svg>`,
+	"image": iconPrefix + `<rect x="1.5" y="2.5" width="13" height="11"/><circle cx="5.5" cy="6" r="1.2"/><path d="M1.5 12l4-4 3 3 2-2 4 4"/></svg>`,
+	"audio": iconPrefix + `<path d="M6 12V3.5l7-1.5v8.5"/><circle cx="4.5" cy="12" r="1.5"/><circle cx="11.5" cy="10.5" r="1.5"/></svg>`,
+	"video": iconPrefix + `<rect x="1.5" y="3.5" width="13" height="9"/><path d="M6.5 6v4l3.5-2z"/></svg>`,
+	"archive": iconPrefix + `<path d="M3.5 1.5h9v13h-9z"/><path d="M8 1.5v2m0 1v1m0 1v1m-1 1h2v2h-2z"/></svg>`,
+	"document": iconPrefix + `<path d="M3.5 1.5h6l3 3v10h-9z"/><path d="M5.5 7.5h5m-5 2h5m-5 2h3"/></svg>`,
+	"file": iconPrefix + `<path d="M3.5 1.5h6l3 3v10h-9z"/><path d="M9.5 1.5v3h3"/></svg>`,
+}
+
+// iconKind classifies a listing entry by its MIME type for its icon.
+func iconKind(file os.FileInfo) string {
+	if file.IsDir() {
+		return "folder"
+	}
+
+	mimeType := mimes[strings.ToLower(strings.TrimPrefix(filepath.Ext(file.Name()), "."))]
+
+	switch {
+	case mimeType == "":
+		return "file"
+	case strings.HasPrefix(mimeType, "image/"):
+		return "image"
+	case strings.HasPrefix(mimeType, "audio/"):
+		return "audio"
+	case strings.HasPrefix(mimeType, "video/"):
+		return "video"
+	}
+
+	for _, marker := range []string{"zip", "compressed", "tar", "bzip", "xz", "7z", "rar"} {
+		if strings.Contains(mimeType, marker) {
+			return "archive"
+		}
+	}
+
+	for _, marker := range []string{"text/", "pdf", "msword", "officedocument", "opendocument", "rtf", "epub", "json", "xml"} {
+		if strings.Contains(mimeType, marker) {
+			return "document"
+		}
+	}
+
+	return "file"
+}
+
+// icon returns the inline SVG icon of the given kind.
+func icon(kind string) template.HTML {
+	return listingIcons[kind]
+}
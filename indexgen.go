@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// marks index files written by index-gen, which may be regenerated;
+// index files without it were written by hand and are left alone.
+const generatedIndexMarker = "<!-- generated by httpd index-gen -->"
+
+// indexGenCommand implements "httpd index-gen", which writes the
+// directory listing of every directory without an index page to
+// index.html, so that the tree can be served by plain object storage.
+func indexGenCommand(args []string) int {
+	flags := flag.NewFlagSet("index-gen", flag.ExitOnError)
+	index := flags.String(
+		"index",
+		strings.Join(indexFiles, ","),
+		"comma-separated index files; directories with one of them are skipped",
+	)
+	dryRun := flags.Bool("n", false, "only print the files that would be written")
+	humanSizes := flags.Bool(
+		"human-sizes",
+		false,
+		"show file sizes in listings as KB, MB or GB instead of bytes",
+	)
+	noIcons := flags.Bool(
+		"no-icons",
+		false,
+		"leave out the file type icons in listings",
+	)
+	listTheme := flags.String(
+		"list-theme",
+		"auto",
+		"color scheme of listings: auto (following the browser), light or dark",
+	)
+	listStylesheet := flags.String(
+		"list-stylesheet",
+		"",
+		"URL of a stylesheet loaded by listings after the built-in styles",
+	)
+	listTemplatePath := flags.String(
+		"list-template",
+		"",
+		"html/template file used for directory listings instead of the built-in one",
+	)
+	flags.Usage = func() {
+		fmt.Println("usage: httpd index-gen [-n] [-index files] [directory]")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if !stringInSlice(*listTheme, listThemes) {
+		fmt.Println("invalid listing theme: ", *listTheme)
+		return 1
+	}
+
+	if *listTemplatePath != "" {
+		if err := loadListTemplate(*listTemplatePath); err != nil {
+			fmt.Println("unable to load listing template: ", err)
+			return 1
+		}
+	}
+
+	root := "."
+	if flags.NArg() > 0 {
+		root = flags.Arg(0)
+	}
+
+	var names []string
+	for _, name := range strings.Split(*index, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	storage, err := newFileStore(root, "all")
+	if err != nil {
+		fmt.Println("unable to open directory: ", err)
+		return 1
+	}
+
+	written := 0
+
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		if isHiddenPath(filepath.ToSlash(rel)) {
+			return filepath.SkipDir
+		}
+
+		if _, err := os.Stat(filepath.Join(path, noListMarker)); err == nil {
+			return nil
+		}
+
+		generated, err := needsGeneratedIndex(path, names)
+		if err != nil || !generated {
+			return err
+		}
+
+		indexPath := filepath.Join(path, "index.html")
+		fmt.Println(indexPath)
+		written++
+
+		if *dryRun {
+			return nil
+		}
+
+		return writeGeneratedIndex(
+			storage, path, rel, indexPath, *humanSizes, !*noIcons, *listTheme, *listStylesheet,
+		)
+	})
+
+	if err != nil {
+		fmt.Println("unable to generate indexes: ", err)
+		return 1
+	}
+
+	fmt.Println("*", written, "index files written")
+	return 0
+}
+
+// needsGeneratedIndex reports whether dir has no index file of its own,
+// that is none at all or only one written by index-gen.
+func needsGeneratedIndex(dir string, names []string) (bool, error) {
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		return name == "index.html" &&
+			bytes.Contains(data, []byte(generatedIndexMarker)), nil
+	}
+
+	return true, nil
+}
+
+func writeGeneratedIndex(
+	storage *fileStore,
+	dir string,
+	rel string,
+	indexPath string,
+	humanSizes bool,
+	icons bool,
+	theme string,
+	stylesheet string,
+) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var files []os.FileInfo
+	for _, entry := range entries {
+		if entry.Name() == "index.html" || isHiddenPath(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		files = append(files, info)
+	}
+
+	var buf bytes.Buffer
+	info := listTemplateInfo{
+		Path: rel,
+		Files: files,
+		Server: "gohttpd",
+		HumanSizes: humanSizes,
+		Icons: icons,
+		Theme: theme,
+		Stylesheet: stylesheet,
+		Sort: "name",
+		Order: "asc",
+		Page: 1,
+		Pages: 1,
+		Total: len(files),
+	}
+
+	info.Header, info.Readme = listingReadme(context.Background(), storage, rel)
+
+	err = renderListing(&buf, info)
+
+	if err != nil {
+		return err
+	}
+
+	buf.WriteString("\n" + generatedIndexMarker + "\n")
+
+	return os.WriteFile(indexPath, buf.Bytes(), 0644)
+}
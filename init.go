@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// default file written by "httpd init".
+const defaultConfigFile = "gohttpd.toml"
+
+// setupWizard asks questions on the terminal and collects the answers.
+type setupWizard struct {
+	in *bufio.Reader
+	out io.Writer
+}
+
+func (w *setupWizard) ask(question string, def string) string {
+	fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+
+	answer, err := w.in.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		if err != nil {
+			fmt.Fprintln(w.out)
+		}
+
+		return def
+	}
+
+	return answer
+}
+
+func (w *setupWizard) askYesNo(question string, def bool) bool {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+
+	for {
+		answer := w.ask(question, hint)
+		if answer == hint {
+			return def
+		}
+
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		}
+
+		fmt.Fprintln(w.out, "please answer yes or no")
+	}
+}
+
+// initCommand implements "httpd init", which interactively writes a
+// commented config file for use with -config.
+func initCommand(args []string) int {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	force := flags.Bool("force", false, "overwrite an existing config file")
+	flags.Usage = func() {
+		fmt.Println("usage: httpd init [-force] [config file]")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	configPath := defaultConfigFile
+	if flags.NArg() > 0 {
+		configPath = flags.Arg(0)
+	}
+
+	if _, err := os.Stat(configPath); err == nil && !*force {
+		fmt.Println(configPath, "already exists, use -force to overwrite it")
+		return 1
+	}
+
+	wizard := &setupWizard{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	var config bytes.Buffer
+
+	fmt.Fprintln(&config, "# gohttpd configuration, written by httpd init.")
+	fmt.Fprintln(&config, "# Options are named after the command line flags (see httpd -help);")
+	fmt.Fprintln(&config, "# flags given on the command line override the values here.")
+
+	var home string
+	for {
+		home = wizard.ask("Directory to serve", ".")
+		stat, err := os.Stat(home)
+		if err == nil && stat.IsDir() {
+			break
+		}
+
+		fmt.Println("not a directory: ", home)
+	}
+
+	// the server may be started from elsewhere, e.g. by a service manager.
+	if abs, err := filepath.Abs(home); err == nil {
+		home = abs
+	}
+
+	fmt.Fprintln(&config, "\n# directory to serve")
+	fmt.Fprintf(&config, "home = %s\n", strconv.Quote(home))
+
+	var port int
+	for {
+		var err error
+		port, err = strconv.Atoi(wizard.ask("Port to listen on", "8080"))
+		if err == nil && port >= 1 && port <= 65535 {
+			break
+		}
+
+		fmt.Println("the port must be a number from 1 to 65535")
+	}
+
+	fmt.Fprintln(&config, "\n# port to listen on")
+	fmt.Fprintf(&config, "port = %d\n", port)
+
+	listDir := wizard.askYesNo("List the contents of directories without an index page?", false)
+	fmt.Fprintln(&config, "\n# list directories that have no index page")
+	fmt.Fprintf(&config, "listdir = %v\n", listDir)
+
+	cleanURLs := wizard.askYesNo("Serve /name from name.html (clean URLs)?", false)
+	fmt.Fprintln(&config, "\n# serve /name from name.html")
+	fmt.Fprintf(&config, "clean-urls = %v\n", cleanURLs)
+
+	if wizard.askYesNo("Require a user name and password (from an htpasswd file)?", false) {
+		var authFile string
+		for {
+			authFile = wizard.ask("htpasswd file", ".htpasswd")
+			if abs, err := filepath.Abs(authFile); err == nil {
+				authFile = abs
+			}
+
+			_, err := loadHtpasswd(authFile)
+			if err == nil {
+				break
+			}
+
+			fmt.Println("unable to load credentials: ", err)
+		}
+
+		fmt.Fprintln(&config, "\n# users allowed in, created with htpasswd -B")
+		fmt.Fprintf(&config, "auth-file = %s\n", strconv.Quote(authFile))
+	}
+
+	if err := os.WriteFile(configPath, config.Bytes(), 0644); err != nil {
+		fmt.Println("unable to write config: ", err)
+		return 1
+	}
+
+	fmt.Println()
+	fmt.Println("Wrote", configPath + ", start the server with:")
+	fmt.Println("  httpd -config", configPath)
+	return 0
+}
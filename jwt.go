@@ -0,0 +1,448 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the JWKS is fetched again, and how soon at the earliest when
+// a token names a key that isn't in it, as when keys were rotated.
+const (
+	jwksRefreshInterval = 10 * time.Minute
+	jwksMissRefreshInterval = time.Minute
+)
+
+// tolerated difference between the server's clock and the issuer's.
+const jwtClockSkew = time.Minute
+
+var (
+	errTokenInvalid = errors.New("malformed token")
+	errTokenSignature = errors.New("invalid signature")
+	errTokenExpired = errors.New("token expired")
+)
+
+// jwtVerifier checks JSON Web Tokens signed with an HMAC secret (HS256,
+// HS384, HS512) or with one of the RSA or ECDSA keys of a JWKS (RS*, PS*,
+// ES*). Tokens must expire, and must come from issuer and be meant for
+// audience if those are set.
+type jwtVerifier struct {
+	secret []byte
+	jwksURL string
+	issuer string
+	audience string
+	client *http.Client
+
+	mu sync.Mutex
+	keys map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID string `json:"kid"`
+}
+
+// jwtStrings is a claim that may be a string or an array of strings.
+type jwtStrings []string
+
+func (s *jwtStrings) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = jwtStrings{one}
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]string)(s))
+}
+
+// jwtClaims are the claims a token is checked against. Paths, when
+// present, are the URL prefixes or globs the token gives access to.
+type jwtClaims struct {
+	Issuer string `json:"iss"`
+	Subject string `json:"sub"`
+	Audience jwtStrings `json:"aud"`
+	Expires *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+	Paths jwtStrings `json:"paths"`
+}
+
+func newJWTVerifier(
+	secret []byte,
+	jwksURL string,
+	issuer string,
+	audience string,
+) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		secret: secret,
+		jwksURL: jwksURL,
+		issuer: issuer,
+		audience: audience,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if jwksURL != "" {
+		if err := v.refreshKeys(); err != nil {
+			return nil, err
+		}
+
+		subsystems.start("JWKS refresh", func() error {
+			for {
+				time.Sleep(jwksRefreshInterval)
+				if err := v.refreshKeys(); err != nil {
+					return err
+				}
+			}
+		})
+	}
+
+	return v, nil
+}
+
+// refreshKeys fetches the JWKS, keeping the keys it has if that fails.
+func (v *jwtVerifier) refreshKeys() error {
+	v.mu.Lock()
+	v.fetched = time.Now()
+	v.mu.Unlock()
+
+	response, err := v.client.Get(v.jwksURL)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return fmt.Errorf("fetching %s: %s", v.jwksURL, response.Status)
+	}
+
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1 << 20)).Decode(&jwks); err != nil {
+		return fmt.Errorf("reading %s: %v", v.jwksURL, err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, raw := range jwks.Keys {
+		kid, key, err := parseJWK(raw)
+		if err != nil {
+			fmt.Println("skipping key", kid, "of", v.jwksURL + ":", err)
+			continue
+		}
+
+		if key != nil {
+			keys[kid] = key
+		}
+	}
+
+	if len(keys) == 0 {
+		return fmt.Errorf("no usable keys in %s", v.jwksURL)
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+	return nil
+}
+
+// parseJWK returns the RSA or ECDSA public key of a JWK, or a nil key for
+// other kinds of keys and keys not meant for signatures.
+func parseJWK(raw []byte) (string, crypto.PublicKey, error) {
+	var jwk struct {
+		Type string `json:"kty"`
+		KeyID string `json:"kid"`
+		Use string `json:"use"`
+		N string `json:"n"`
+		E string `json:"e"`
+		Curve string `json:"crv"`
+		X string `json:"x"`
+		Y string `json:"y"`
+	}
+
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return "", nil, err
+	}
+
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return jwk.KeyID, nil, nil
+	}
+
+	decode := func(s string) []byte {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return b
+	}
+
+	switch jwk.Type {
+	case "RSA":
+		n, e := decode(jwk.N), new(big.Int).SetBytes(decode(jwk.E))
+		if len(n) < 256 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1 << 31 - 1 {
+			return jwk.KeyID, nil, errors.New("invalid or too short RSA key")
+		}
+
+		return jwk.KeyID, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		var check ecdh.Curve
+
+		switch jwk.Curve {
+		case "P-256":
+			curve, check = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, check = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, check = elliptic.P521(), ecdh.P521()
+		default:
+			return jwk.KeyID, nil, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+
+		size := (curve.Params().BitSize + 7) / 8
+		x, y := decode(jwk.X), decode(jwk.Y)
+		if len(x) != size || len(y) != size {
+			return jwk.KeyID, nil, errors.New("invalid EC key")
+		}
+
+		// rejects points that aren't on the curve.
+		if _, err := check.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return jwk.KeyID, nil, err
+		}
+
+		return jwk.KeyID, &ecdsa.PublicKey{
+			Curve: curve,
+			X: new(big.Int).SetBytes(x),
+			Y: new(big.Int).SetBytes(y),
+		}, nil
+	}
+
+	return jwk.KeyID, nil, nil
+}
+
+// key returns the JWKS key named kid, or the only key if kid is empty,
+// fetching the JWKS again if it is missing and wasn't fetched recently.
+func (v *jwtVerifier) key(kid string) crypto.PublicKey {
+	for attempt := 0; attempt < 2; attempt++ {
+		v.mu.Lock()
+		key, ok := v.keys[kid]
+		if kid == "" && len(v.keys) == 1 {
+			for _, only := range v.keys {
+				key, ok = only, true
+			}
+		}
+
+		recent := time.Since(v.fetched) < jwksMissRefreshInterval
+		v.mu.Unlock()
+
+		if ok {
+			return key
+		}
+
+		if recent || attempt > 0 {
+			break
+		}
+
+		if err := v.refreshKeys(); err != nil {
+			fmt.Println("unable to refresh JWKS: ", err)
+			break
+		}
+	}
+
+	return nil
+}
+
+// the curve each ECDSA algorithm signs with.
+var jwtCurves = map[string]string {
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+func jwtHash(algorithm string) (func() hash.Hash, crypto.Hash) {
+	switch algorithm[2:] {
+	case "256":
+		return sha256.New, crypto.SHA256
+	case "384":
+		return sha512.New384, crypto.SHA384
+	case "512":
+		return sha512.New, crypto.SHA512
+	}
+
+	return nil, 0
+}
+
+// verifySignature checks the signature of the signed part of a token.
+// HMAC tokens are only accepted with a secret and the others only with a
+// JWKS, so that a public key can't be passed off as an HMAC secret.
+func (v *jwtVerifier) verifySignature(header jwtHeader, signed string, signature []byte) error {
+	alg := header.Algorithm
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	newHash, cryptoHash := jwtHash(alg)
+	if newHash == nil {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	if v.secret != nil {
+		if alg[:2] != "HS" {
+			return fmt.Errorf("unsupported algorithm %q", alg)
+		}
+
+		mac := hmac.New(newHash, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errTokenSignature
+		}
+
+		return nil
+	}
+
+	h := newHash()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	key := v.key(header.KeyID)
+	if key == nil {
+		return fmt.Errorf("unknown key %q", header.KeyID)
+	}
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(pub, cryptoHash, digest, signature)
+		case "PS":
+			err = rsa.VerifyPSS(pub, cryptoHash, digest, signature, nil)
+		default:
+			return fmt.Errorf("algorithm %q doesn't match the key", alg)
+		}
+
+		if err != nil {
+			return errTokenSignature
+		}
+
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if jwtCurves[alg] != pub.Curve.Params().Name {
+			return fmt.Errorf("algorithm %q doesn't match the key", alg)
+		}
+
+		if len(signature) != size * 2 {
+			return errTokenSignature
+		}
+
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errTokenSignature
+		}
+	}
+
+	return nil
+}
+
+// verify checks token and returns its claims.
+func (v *jwtVerifier) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenInvalid
+	}
+
+	var decoded [3][]byte
+	for i, part := range parts {
+		var err error
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(part); err != nil {
+			return nil, errTokenInvalid
+		}
+	}
+
+	var header jwtHeader
+	if err := json.Unmarshal(decoded[0], &header); err != nil {
+		return nil, errTokenInvalid
+	}
+
+	if err := v.verifySignature(header, parts[0] + "." + parts[1], decoded[2]); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := json.Unmarshal(decoded[1], &claims); err != nil {
+		return nil, errTokenInvalid
+	}
+
+	now := time.Now()
+	if claims.Expires == nil {
+		return nil, errors.New("token doesn't expire")
+	}
+
+	if now.After(time.Unix(int64(*claims.Expires), 0).Add(jwtClockSkew)) {
+		return nil, errTokenExpired
+	}
+
+	if claims.NotBefore != nil && now.Before(time.Unix(int64(*claims.NotBefore), 0).Add(-jwtClockSkew)) {
+		return nil, errors.New("token not valid yet")
+	}
+
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, errors.New("wrong issuer")
+	}
+
+	if v.audience != "" && !stringInSlice(v.audience, claims.Audience) {
+		return nil, errors.New("wrong audience")
+	}
+
+	return &claims, nil
+}
+
+// checkBearer lets request through if it has a valid token for its path,
+// and otherwise answers it with a 401, or a 403 for a token restricted to
+// other paths.
+func (a *auth) checkBearer(writer http.ResponseWriter, request *http.Request, opts *serverOptions) bool {
+	trace := requestTraceFrom(request.Context())
+	challenge := `Bearer realm="` + strings.ReplaceAll(a.realm, `"`, `'`) + `"`
+
+	scheme, token, _ := strings.Cut(request.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		trace.note("auth", "token required, 401")
+		writer.Header().Set("WWW-Authenticate", challenge)
+		http.Error(writer, "Unauthorized", 401)
+		return false
+	}
+
+	claims, err := a.tokens.verify(strings.TrimSpace(token))
+	if err != nil {
+		trace.note("auth", "invalid token: %v, 401", err)
+		writer.Header().Set("WWW-Authenticate", challenge + `, error="invalid_token"`)
+		http.Error(writer, "Unauthorized", 401)
+		return false
+	}
+
+	if claims.Paths != nil && !pathMatchesAny(claims.Paths, request.URL.Path, opts) {
+		trace.note("auth", "token of %s not valid for this path, 403", claims.Subject)
+		writer.Header().Set("WWW-Authenticate", challenge + `, error="insufficient_scope"`)
+		http.Error(writer, "Forbidden", 403)
+		return false
+	}
+
+	logFieldsFrom(request.Context()).setAuthenticated(claims.Subject, claims.Paths)
+	trace.note("auth", "valid token of %s", claims.Subject)
+	return true
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var jwtTestSecret = []byte("a secret of at least thirty-two bytes")
+
+// jwtTestKeys are the private keys of the test JWKS.
+type jwtTestKeys struct {
+	rsa *rsa.PrivateKey
+	ec *ecdsa.PrivateKey
+	ec2 *ecdsa.PrivateKey
+}
+
+func newJWTTestKeys(t *testing.T) *jwtTestKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey2, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &jwtTestKeys{rsa: rsaKey, ec: ecKey, ec2: ecKey2}
+}
+
+func jwkFor(kid string, key crypto.PublicKey) map[string]string {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return map[string]string {
+			"kty": "RSA",
+			"kid": kid,
+			"n": encode(pub.N.Bytes()),
+			"e": encode(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		return map[string]string {
+			"kty": "EC",
+			"kid": kid,
+			"crv": "P-256",
+			"x": encode(pub.X.FillBytes(make([]byte, 32))),
+			"y": encode(pub.Y.FillBytes(make([]byte, 32))),
+		}
+	}
+
+	return nil
+}
+
+// newJWKSVerifier returns a verifier for a JWKS with the public keys of
+// keys, and the keys the JWKS is served with, which may be replaced.
+func newJWKSVerifier(t *testing.T, keys *jwtTestKeys) (*jwtVerifier, *[]map[string]string) {
+	jwks := []map[string]string {
+		jwkFor("rsa", &keys.rsa.PublicKey),
+		jwkFor("ec", &keys.ec.PublicKey),
+		jwkFor("ec2", &keys.ec2.PublicKey),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(writer).Encode(map[string]any{"keys": jwks})
+	}))
+	t.Cleanup(server.Close)
+
+	v := &jwtVerifier{
+		jwksURL: server.URL,
+		issuer: "https://issuer.example",
+		audience: "gohttpd",
+		client: server.Client(),
+	}
+
+	if err := v.refreshKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	return v, &jwks
+}
+
+// validClaims are claims the test verifiers accept.
+func validClaims() map[string]any {
+	return map[string]any {
+		"iss": "https://issuer.example",
+		"aud": "gohttpd",
+		"sub": "bob",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+// signJWT returns a token with header and claims, signed by sign.
+func signJWT(
+	t *testing.T,
+	header map[string]string,
+	claims map[string]any,
+	sign func(signed []byte) []byte,
+) string {
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signed := encode(header) + "." + encode(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hmacSigner(secret []byte) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func rsaSigner(t *testing.T, key *rsa.PrivateKey, pss bool) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+
+		var signature []byte
+		var err error
+		if pss {
+			signature, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], nil)
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return signature
+	}
+}
+
+func ecSigner(t *testing.T, key *ecdsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+}
+
+// corrupt flips a bit of the signature made by sign.
+func corrupt(sign func([]byte) []byte) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		signature := sign(signed)
+		signature[len(signature) / 2] ^= 1
+		return signature
+	}
+}
+
+func TestJWTSignatures(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	jwks, _ := newJWKSVerifier(t, keys)
+	hs := &jwtVerifier{secret: jwtTestSecret, issuer: jwks.issuer, audience: jwks.audience}
+
+	tests := []struct {
+		name string
+		verifier *jwtVerifier
+		header map[string]string
+		sign func([]byte) []byte
+	}{
+		{"HS256", hs, map[string]string{"alg": "HS256"}, hmacSigner(jwtTestSecret)},
+		{"RS256", jwks, map[string]string{"alg": "RS256", "kid": "rsa"}, rsaSigner(t, keys.rsa, false)},
+		{"PS256", jwks, map[string]string{"alg": "PS256", "kid": "rsa"}, rsaSigner(t, keys.rsa, true)},
+		{"ES256", jwks, map[string]string{"alg": "ES256", "kid": "ec"}, ecSigner(t, keys.ec)},
+	}
+
+	for _, test := range tests {
+		token := signJWT(t, test.header, validClaims(), test.sign)
+		if claims, err := test.verifier.verify(token); err != nil || claims.Subject != "bob" {
+			t.Errorf("%s: valid token refused: %v", test.name, err)
+		}
+
+		token = signJWT(t, test.header, validClaims(), corrupt(test.sign))
+		if _, err := test.verifier.verify(token); err != errTokenSignature {
+			t.Errorf("%s: got %v for a bad signature, expected %v", test.name, err, errTokenSignature)
+		}
+	}
+}
+
+func TestJWTRejectsUnsignedTokens(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	jwks, _ := newJWKSVerifier(t, keys)
+	hs := &jwtVerifier{secret: jwtTestSecret}
+
+	none := func([]byte) []byte { return nil }
+
+	for _, alg := range []string{"none", "None", "NONE"} {
+		for _, v := range []*jwtVerifier{hs, jwks} {
+			token := signJWT(t, map[string]string{"alg": alg}, validClaims(), none)
+			if _, err := v.verify(token); err == nil {
+				t.Errorf("token with alg %q accepted", alg)
+			}
+		}
+	}
+}
+
+func TestJWTRejectsAlgorithmConfusion(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	jwks, _ := newJWKSVerifier(t, keys)
+
+	// HMAC tokens "signed" with the public keys, which are no secret.
+	rsaJWK, _ := json.Marshal(jwkFor("rsa", &keys.rsa.PublicKey))
+	ecJWK, _ := json.Marshal(jwkFor("ec", &keys.ec.PublicKey))
+
+	tests := []struct {
+		kid string
+		secret []byte
+	}{
+		{"rsa", keys.rsa.PublicKey.N.Bytes()},
+		{"rsa", rsaJWK},
+		{"ec", ecJWK},
+		{"", rsaJWK},
+	}
+
+	for _, test := range tests {
+		header := map[string]string{"alg": "HS256", "kid": test.kid}
+		token := signJWT(t, header, validClaims(), hmacSigner(test.secret))
+		if _, err := jwks.verify(token); err == nil {
+			t.Errorf("HS256 token for key %q accepted", test.kid)
+		}
+	}
+
+	// tokens for a key of another kind or curve.
+	mismatched := []struct {
+		header map[string]string
+		sign func([]byte) []byte
+	}{
+		{map[string]string{"alg": "ES256", "kid": "rsa"}, ecSigner(t, keys.ec)},
+		{map[string]string{"alg": "RS256", "kid": "ec"}, rsaSigner(t, keys.rsa, false)},
+		{map[string]string{"alg": "ES384", "kid": "ec"}, ecSigner(t, keys.ec)},
+	}
+
+	for _, test := range mismatched {
+		if _, err := jwks.verify(signJWT(t, test.header, validClaims(), test.sign)); err == nil {
+			t.Errorf("%s token for key %q accepted", test.header["alg"], test.header["kid"])
+		}
+	}
+
+	// and the other way round, a verifier with a secret takes no JWKS tokens.
+	hs := &jwtVerifier{secret: jwtTestSecret}
+	token := signJWT(t, map[string]string{"alg": "RS256", "kid": "rsa"}, validClaims(), rsaSigner(t, keys.rsa, false))
+	if _, err := hs.verify(token); err == nil {
+		t.Errorf("RS256 token accepted by an HMAC verifier")
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	v := &jwtVerifier{secret: jwtTestSecret, issuer: "https://issuer.example", audience: "gohttpd"}
+	header := map[string]string{"alg": "HS256"}
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		change func(claims map[string]any)
+		valid bool
+	}{
+		{"valid", func(claims map[string]any) {}, true},
+		{"expired", func(claims map[string]any) {
+			claims["exp"] = now.Add(-time.Hour).Unix()
+		}, false},
+		{"expired within the clock skew", func(claims map[string]any) {
+			claims["exp"] = now.Add(-jwtClockSkew / 2).Unix()
+		}, true},
+		{"without exp", func(claims map[string]any) {
+			delete(claims, "exp")
+		}, false},
+		{"not yet valid", func(claims map[string]any) {
+			claims["nbf"] = now.Add(time.Hour).Unix()
+		}, false},
+		{"valid from now", func(claims map[string]any) {
+			claims["nbf"] = now.Unix()
+		}, true},
+		{"wrong issuer", func(claims map[string]any) {
+			claims["iss"] = "https://other.example"
+		}, false},
+		{"without issuer", func(claims map[string]any) {
+			delete(claims, "iss")
+		}, false},
+		{"wrong audience", func(claims map[string]any) {
+			claims["aud"] = "other"
+		}, false},
+		{"audience among others", func(claims map[string]any) {
+			claims["aud"] = []string{"other", "gohttpd"}
+		}, true},
+		{"wrong audiences", func(claims map[string]any) {
+			claims["aud"] = []string{"other", "gohttpd2"}
+		}, false},
+	}
+
+	for _, test := range tests {
+		claims := validClaims()
+		test.change(claims)
+
+		_, err := v.verify(signJWT(t, header, claims, hmacSigner(jwtTestSecret)))
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got error %v, expected valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestJWKSKeySelection(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	v, jwks := newJWKSVerifier(t, keys)
+
+	tests := []struct {
+		kid string
+		key *ecdsa.PrivateKey
+		valid bool
+	}{
+		{"ec", keys.ec, true},
+		{"ec2", keys.ec2, true},
+		{"ec", keys.ec2, false},
+		{"ec2", keys.ec, false},
+		{"unknown", keys.ec, false},
+
+		// with several keys, tokens must name theirs.
+		{"", keys.ec, false},
+	}
+
+	for _, test := range tests {
+		header := map[string]string{"alg": "ES256"}
+		if test.kid != "" {
+			header["kid"] = test.kid
+		}
+
+		_, err := v.verify(signJWT(t, header, validClaims(), ecSigner(t, test.key)))
+		if (err == nil) != test.valid {
+			t.Errorf("kid %q: got error %v, expected valid %v", test.kid, err, test.valid)
+		}
+	}
+
+	// a key added to the JWKS, as when keys are rotated, is fetched
+	// once the JWKS is no longer recent.
+	rotated, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	*jwks = []map[string]string{jwkFor("rotated", &rotated.PublicKey)}
+	token := signJWT(t, map[string]string{"alg": "ES256", "kid": "rotated"}, validClaims(), ecSigner(t, rotated))
+
+	if _, err := v.verify(token); err == nil {
+		t.Errorf("token for a new key accepted before the JWKS was fetched again")
+	}
+
+	v.mu.Lock()
+	v.fetched = time.Now().Add(-jwksMissRefreshInterval)
+	v.mu.Unlock()
+
+	if _, err := v.verify(token); err != nil {
+		t.Errorf("token for a rotated key refused: %v", err)
+	}
+
+	// a single key is used for tokens that name none.
+	token = signJWT(t, map[string]string{"alg": "ES256"}, validClaims(), ecSigner(t, rotated))
+	if _, err := v.verify(token); err != nil {
+		t.Errorf("token without kid refused with a single key: %v", err)
+	}
+}
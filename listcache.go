@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limits of the listing cache; larger listings are rendered every time.
+const (
+	listingCacheMaxEntries = 256
+	listingCacheMaxSize = 1 << 20
+)
+
+// listingCache keeps rendered listings for a short time, as long as the
+// directory's modification time, which changes when entries are added,
+// removed or renamed, stays the same. Changes to the files themselves
+// show up once the entry expires.
+type listingCache struct {
+	ttl time.Duration
+
+	mu sync.Mutex
+	entries map[string]listingCacheEntry
+}
+
+type listingCacheEntry struct {
+	body []byte
+	etag string
+	lastModified time.Time
+
+	modTime time.Time
+	expires time.Time
+}
+
+func newListingCache(ttl time.Duration) *listingCache {
+	return &listingCache{ttl: ttl, entries: map[string]listingCacheEntry{}}
+}
+
+// listingCacheKey identifies a rendering of the listing of path.
+func listingCacheKey(request *http.Request, path string, baseHref string, json bool) string {
+	query := request.URL.Query()
+	values := url.Values{}
+	for _, key := range []string{"sort", "order", "page", "per_page", "q"} {
+		if value := query.Get(key); value != "" {
+			values.Set(key, value)
+		}
+	}
+
+	format := "html"
+	if json {
+		format = "json"
+	}
+
+	return strings.Join([]string{path, baseHref, request.Host, format, values.Encode()}, "\x00")
+}
+
+func (c *listingCache) get(key string, modTime time.Time) (listingCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !entry.modTime.Equal(modTime) || time.Now().After(entry.expires) {
+		return listingCacheEntry{}, false
+	}
+
+	return entry, true
+}
+
+// put caches a rendered listing, with the directory's modification time
+// and the listing's validators.
+func (c *listingCache) put(key string, modTime time.Time, entry listingCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	if len(c.entries) >= listingCacheMaxEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+
+	// still full of live entries, so make room at random.
+	for k := range c.entries {
+		if len(c.entries) < listingCacheMaxEntries {
+			break
+		}
+
+		delete(c.entries, k)
+	}
+
+	entry.modTime, entry.expires = modTime, now.Add(c.ttl)
+	c.entries[key] = entry
+}
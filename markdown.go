@@ -0,0 +1,175 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+var (
+	markdownHeading = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	markdownRule = regexp.MustCompile(`^ {0,3}((\*\s*){3,}|(-\s*){3,}|(_\s*){3,})$`)
+	markdownBullet = regexp.MustCompile(`^ {0,3}[-*+]\s+`)
+	markdownNumber = regexp.MustCompile(`^ {0,3}\d{1,9}[.)]\s+`)
+	markdownImage = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)`)
+	markdownLink = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	markdownAutolink = regexp.MustCompile(`&lt;((?:https?|mailto):[^\s&]+)&gt;`)
+	markdownStrong = regexp.MustCompile(`\*\*(\S(?:.*?\S)?)\*\*|__(\S(?:.*?\S)?)__`)
+	markdownEm = regexp.MustCompile(`\*(\S(?:.*?\S)?)\*|\b_(\S(?:.*?\S)?)_\b`)
+)
+
+// renderMarkdown converts a README to HTML. It handles the commonly used
+// part of Markdown: headings, paragraphs, emphasis, code spans and
+// blocks, lists, block quotes, rules, links and images. HTML in the
+// source is shown as text rather than passed through.
+func renderMarkdown(src string) template.HTML {
+	var out strings.Builder
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + markdownInline(strings.Join(paragraph, "\n")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "":
+			flush()
+
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			flush()
+			fence := trimmed[:3]
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code = append(code, lines[i])
+			}
+
+			out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+
+		case len(paragraph) == 0 && (strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t")):
+			var code []string
+			for ; i < len(lines); i++ {
+				if strings.TrimSpace(lines[i]) != "" && !strings.HasPrefix(lines[i], "    ") &&
+				   !strings.HasPrefix(lines[i], "\t") {
+					break
+				}
+
+				code = append(code, strings.TrimPrefix(strings.TrimPrefix(lines[i], "\t"), "    "))
+			}
+
+			i--
+			out.WriteString("<pre><code>" + html.EscapeString(strings.TrimRight(strings.Join(code, "\n"), "\n")) + "</code></pre>\n")
+
+		case markdownHeading.MatchString(trimmed):
+			flush()
+			m := markdownHeading.FindStringSubmatch(trimmed)
+			level := string(rune('0' + len(m[1])))
+			out.WriteString("<h" + level + ">" + markdownInline(m[2]) + "</h" + level + ">\n")
+
+		case markdownRule.MatchString(line):
+			flush()
+			out.WriteString("<hr>\n")
+
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quoted := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quote = append(quote, strings.TrimPrefix(quoted, " "))
+			}
+
+			i--
+			out.WriteString("<blockquote>\n" + string(renderMarkdown(strings.Join(quote, "\n"))) + "</blockquote>\n")
+
+		case markdownBullet.MatchString(line) || markdownNumber.MatchString(line):
+			flush()
+			marker, tag := markdownBullet, "ul"
+			if !markdownBullet.MatchString(line) {
+				marker, tag = markdownNumber, "ol"
+			}
+
+			out.WriteString("<" + tag + ">\n")
+
+			// an item runs on over indented and lazy continuation
+			// lines, up to a blank line or the next item.
+			for i < len(lines) && marker.MatchString(lines[i]) {
+				item := []string{marker.ReplaceAllString(lines[i], "")}
+				for i++; i < len(lines) && strings.TrimSpace(lines[i]) != "" &&
+				    !markdownBullet.MatchString(lines[i]) && !markdownNumber.MatchString(lines[i]); i++ {
+					item = append(item, strings.TrimSpace(lines[i]))
+				}
+
+				out.WriteString("<li>" + markdownInline(strings.Join(item, "\n")) + "</li>\n")
+
+				// items may be separated by blank lines.
+				if i + 1 < len(lines) && strings.TrimSpace(lines[i]) == "" && marker.MatchString(lines[i + 1]) {
+					i++
+				}
+			}
+
+			i--
+			out.WriteString("</" + tag + ">\n")
+
+		default:
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+
+	flush()
+	return template.HTML(out.String())
+}
+
+// markdownInline converts code spans, links, images and emphasis in a
+// span of text.
+func markdownInline(text string) string {
+	var out strings.Builder
+
+	// odd parts are code spans.
+	for i, part := range strings.Split(text, "`") {
+		part = html.EscapeString(part)
+		if i % 2 == 1 {
+			out.WriteString("<code>" + part + "</code>")
+			continue
+		}
+
+		part = markdownImage.ReplaceAllStringFunc(part, func(s string) string {
+			m := markdownImage.FindStringSubmatch(s)
+			return `<img src="` + markdownURL(m[2]) + `" alt="` + m[1] + `">`
+		})
+
+		part = markdownLink.ReplaceAllStringFunc(part, func(s string) string {
+			m := markdownLink.FindStringSubmatch(s)
+			return `<a href="` + markdownURL(m[2]) + `">` + m[1] + `</a>`
+		})
+
+		part = markdownAutolink.ReplaceAllString(part, `<a href="$1">$1</a>`)
+		part = markdownStrong.ReplaceAllString(part, "<strong>$1$2</strong>")
+		part = markdownEm.ReplaceAllString(part, "<em>$1$2</em>")
+		out.WriteString(part)
+	}
+
+	return out.String()
+}
+
+// markdownURL passes through relative, http(s) and mailto URLs, which are
+// already HTML-escaped, and drops anything else, like javascript: URLs.
+func markdownURL(u string) string {
+	scheme, _, found := strings.Cut(u, ":")
+	if !found || strings.ContainsAny(scheme, "/?#") {
+		return u
+	}
+
+	switch strings.ToLower(scheme) {
+	case "http", "https", "mailto":
+		return u
+	}
+
+	return "#"
+}
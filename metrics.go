@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds of the buckets of the request duration histogram, in
+// seconds, as Prometheus client libraries have them by default.
+var durationBuckets = []float64 {0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// serverMetrics counts what the server does, for Prometheus to scrape
+// from the admin listener. Servers without one have nil metrics, which
+// count nothing.
+type serverMetrics struct {
+	inFlight atomic.Int64
+	bytes atomic.Int64
+	aborted atomic.Int64
+	compressionIn atomic.Int64
+	compressionOut atomic.Int64
+
+	mu sync.Mutex
+
+	// requests by status class, 1xx to 5xx, and the duration histogram
+	// with a count per bucket and one past the last.
+	requests [5]int64
+	buckets []int64
+	durationSum float64
+	durationCount int64
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{buckets: make([]int64, len(durationBuckets) + 1)}
+}
+
+// started and finished count the requests being served.
+func (m *serverMetrics) started() {
+	if m != nil {
+		m.inFlight.Add(1)
+	}
+}
+
+func (m *serverMetrics) finished() {
+	if m != nil {
+		m.inFlight.Add(-1)
+	}
+}
+
+// record counts a served request.
+func (m *serverMetrics) record(status int, written int64, duration time.Duration, aborted bool) {
+	if m == nil {
+		return
+	}
+
+	m.bytes.Add(written)
+	if aborted {
+		m.aborted.Add(1)
+	}
+
+	seconds := duration.Seconds()
+	bucket := len(durationBuckets)
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if class := status / 100; class >= 1 && class <= 5 {
+		m.requests[class - 1]++
+	}
+
+	m.buckets[bucket]++
+	m.durationSum += seconds
+	m.durationCount++
+}
+
+// compressed counts a response compressed from in bytes to out.
+func (m *serverMetrics) compressed(in int64, out int64) {
+	if m != nil {
+		m.compressionIn.Add(in)
+		m.compressionOut.Add(out)
+	}
+}
+
+// promLabel escapes a label value for the Prometheus text format.
+func promLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// serveMetrics writes the metrics in the Prometheus text format.
+func (m *serverMetrics) serveMetrics(writer http.ResponseWriter, request *http.Request) {
+	var b strings.Builder
+
+	metric := func(name string, kind string, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	m.mu.Lock()
+	requests := m.requests
+	buckets := append([]int64(nil), m.buckets...)
+	durationSum, durationCount := m.durationSum, m.durationCount
+	m.mu.Unlock()
+
+	metric("httpd_requests_total", "counter", "Requests served, by status class.")
+	for i, count := range requests {
+		fmt.Fprintf(&b, "httpd_requests_total{class=\"%dxx\"} %d\n", i + 1, count)
+	}
+
+	metric("httpd_request_duration_seconds", "histogram", "Time taken to serve requests, including the transfer.")
+	cumulative := int64(0)
+	for i, count := range buckets {
+		cumulative += count
+		bound := "+Inf"
+		if i < len(durationBuckets) {
+			bound = strconv.FormatFloat(durationBuckets[i], 'g', -1, 64)
+		}
+
+		fmt.Fprintf(&b, "httpd_request_duration_seconds_bucket{le=\"%s\"} %d\n", bound, cumulative)
+	}
+
+	fmt.Fprintf(&b, "httpd_request_duration_seconds_sum %g\n", durationSum)
+	fmt.Fprintf(&b, "httpd_request_duration_seconds_count %d\n", durationCount)
+
+	metric("httpd_requests_in_flight", "gauge", "Requests being served.")
+	fmt.Fprintf(&b, "httpd_requests_in_flight %d\n", m.inFlight.Load())
+
+	metric("httpd_response_bytes_total", "counter", "Bytes of response bodies sent.")
+	fmt.Fprintf(&b, "httpd_response_bytes_total %d\n", m.bytes.Load())
+
+	metric("httpd_requests_aborted_total", "counter", "Transfers that ended before the whole response was sent.")
+	fmt.Fprintf(&b, "httpd_requests_aborted_total %d\n", m.aborted.Load())
+
+	metric("httpd_compression_input_bytes_total", "counter", "Bytes of files sent compressed, before compression.")
+	fmt.Fprintf(&b, "httpd_compression_input_bytes_total %d\n", m.compressionIn.Load())
+
+	metric("httpd_compression_output_bytes_total", "counter", "Bytes of files sent compressed, after compression.")
+	fmt.Fprintf(&b, "httpd_compression_output_bytes_total %d\n", m.compressionOut.Load())
+
+	statuses := subsystems.status()
+
+	metric("httpd_subsystem_up", "gauge", "Whether a background job is running, by name.")
+	for _, status := range statuses {
+		up := 0
+		if status.Running {
+			up = 1
+		}
+
+		fmt.Fprintf(&b, "httpd_subsystem_up{name=\"%s\"} %d\n", promLabel(status.Name), up)
+	}
+
+	metric("httpd_subsystem_restarts_total", "counter", "Times a background job was restarted after failing, by name.")
+	for _, status := range statuses {
+		fmt.Fprintf(&b, "httpd_subsystem_restarts_total{name=\"%s\"} %d\n", promLabel(status.Name), status.Restarts)
+	}
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Write([]byte(b.String()))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"unicode/utf8"
+)
+
+// Hangul syllables are composed from their jamo arithmetically.
+const (
+	hangulBase = 0xAC00
+	hangulLBase = 0x1100
+	hangulVBase = 0x1161
+	hangulTBase = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+	hangulSCount = hangulLCount * hangulNCount
+)
+
+var canonicalCompositions = map[[2]rune]rune{}
+
+func init() {
+	for composed, pair := range canonicalPairs {
+		canonicalCompositions[pair] = composed
+	}
+}
+
+// normalizeName converts s to the Unicode normalization form "nfc" or
+// "nfd", so that names written by macOS (which uses NFD) and by most
+// everything else (NFC) compare equal; s is returned as is for any other
+// form. Only precomposed Latin, Greek and Cyrillic letters and Hangul
+// syllables are handled, and combining marks aren't reordered, which
+// covers names as they are typed but not every string Unicode allows.
+func normalizeName(s string, form string) string {
+	if form != "nfc" && form != "nfd" || isASCII(s) {
+		return s
+	}
+
+	var decomposed []rune
+	for _, r := range s {
+		decomposed = decomposeRune(decomposed, r)
+	}
+
+	if form == "nfd" {
+		return string(decomposed)
+	}
+
+	composed := decomposed[:0]
+	for _, r := range decomposed {
+		if n := len(composed); n > 0 {
+			if c, ok := composeRunes(composed[n - 1], r); ok {
+				composed[n - 1] = c
+				continue
+			}
+		}
+
+		composed = append(composed, r)
+	}
+
+	return string(composed)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+func decomposeRune(out []rune, r rune) []rune {
+	if s := r - hangulBase; s >= 0 && s < hangulSCount {
+		out = append(out, hangulLBase + s / hangulNCount, hangulVBase + s % hangulNCount / hangulTCount)
+		if t := s % hangulTCount; t != 0 {
+			out = append(out, hangulTBase + t)
+		}
+
+		return out
+	}
+
+	if pair, ok := canonicalPairs[r]; ok {
+		return append(decomposeRune(out, pair[0]), pair[1])
+	}
+
+	return append(out, r)
+}
+
+func composeRunes(a rune, b rune) (rune, bool) {
+	l, v := a - hangulLBase, b - hangulVBase
+	if l >= 0 && l < hangulLCount && v >= 0 && v < hangulVCount {
+		return hangulBase + (l * hangulVCount + v) * hangulTCount, true
+	}
+
+	s, t := a - hangulBase, b - hangulTBase
+	if s >= 0 && s < hangulSCount && s % hangulTCount == 0 && t > 0 && t < hangulTCount {
+		return a + t, true
+	}
+
+	c, ok := canonicalCompositions[[2]rune{a, b}]
+	return c, ok
+}
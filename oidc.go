@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the cookies holding a login session, and the state of a login in
+// progress until the identity provider redirects back.
+const (
+	oidcSessionCookie = "httpd_session"
+	oidcStateCookie = "httpd_oidc_state"
+)
+
+// how long a login may take at the identity provider.
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidcClient logs users in with an OpenID Connect provider, with the
+// authorization code flow and PKCE, and keeps them logged in with a
+// session cookie signed with a key made at startup, so that sessions end
+// when the server restarts. Users must have claims, when there are any,
+// with one of the values given for each name, such as a group.
+type oidcClient struct {
+	clientID string
+	clientSecret string
+	redirectURL string
+	callbackPath string
+	scopes string
+	claims map[string][]string
+	sessionTTL time.Duration
+
+	authEndpoint string
+	tokenEndpoint string
+	idTokens *jwtVerifier
+	key []byte
+	client *http.Client
+}
+
+// oidcSession is the content of the session cookie.
+type oidcSession struct {
+	Subject string `json:"sub"`
+	User string `json:"user"`
+	Expires int64 `json:"exp"`
+}
+
+// oidcLogin is the content of the state cookie.
+type oidcLogin struct {
+	State string `json:"state"`
+	Nonce string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return string `json:"return"`
+	Expires int64 `json:"exp"`
+}
+
+// newOIDCClient fetches the configuration of the provider at issuer.
+// redirectURL is the callback URL registered with it, on this server and
+// under secretPrefix if there is one; claims are required claims as
+// name=value.
+func newOIDCClient(
+	issuer string,
+	clientID string,
+	clientSecret string,
+	redirectURL string,
+	scopes string,
+	claims []string,
+	sessionTTL time.Duration,
+	secretPrefix string,
+) (*oidcClient, error) {
+	callback, err := url.Parse(redirectURL)
+	if err != nil || !callback.IsAbs() || !strings.HasPrefix(callback.Path, secretPrefix + "/") {
+		return nil, fmt.Errorf("invalid redirect URL %q", redirectURL)
+	}
+
+	c := &oidcClient{
+		clientID: clientID,
+		clientSecret: clientSecret,
+		redirectURL: redirectURL,
+		callbackPath: strings.TrimPrefix(callback.Path, secretPrefix),
+		scopes: scopes,
+		claims: map[string][]string{},
+		sessionTTL: sessionTTL,
+		key: make([]byte, 32),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	for _, claim := range claims {
+		name, value, ok := strings.Cut(claim, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected name=value, got %q", claim)
+		}
+
+		c.claims[name] = append(c.claims[name], value)
+	}
+
+	if _, err := rand.Read(c.key); err != nil {
+		return nil, err
+	}
+
+	issuer = strings.TrimSuffix(issuer, "/")
+	response, err := c.client.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("fetching the configuration of %s: %s", issuer, response.Status)
+	}
+
+	var config struct {
+		Issuer string `json:"issuer"`
+		AuthEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint string `json:"token_endpoint"`
+		JWKSURL string `json:"jwks_uri"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1 << 20)).Decode(&config); err != nil {
+		return nil, fmt.Errorf("reading the configuration of %s: %v", issuer, err)
+	}
+
+	if strings.TrimSuffix(config.Issuer, "/") != issuer ||
+	   config.AuthEndpoint == "" || config.TokenEndpoint == "" || config.JWKSURL == "" {
+		return nil, fmt.Errorf("incomplete configuration or wrong issuer at %s", issuer)
+	}
+
+	c.authEndpoint, c.tokenEndpoint = config.AuthEndpoint, config.TokenEndpoint
+	c.idTokens, err = newJWTVerifier(nil, config.JWKSURL, config.Issuer, clientID)
+	return c, err
+}
+
+// signCookie returns value as a cookie signed for purpose, so that one
+// kind of cookie can't be passed off as the other.
+func (c *oidcClient) signCookie(purpose string, value any) string {
+	payload, _ := json.Marshal(value)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(purpose + "\n" + encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// openCookie reads the cookie named name of request into value, and
+// reports whether it was there and signed for purpose.
+func (c *oidcClient) openCookie(request *http.Request, name string, purpose string, value any) bool {
+	cookie, err := request.Cookie(name)
+	if err != nil {
+		return false
+	}
+
+	encoded, signature, _ := strings.Cut(cookie.Value, ".")
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(purpose + "\n" + encoded))
+	expected := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	return err == nil && json.Unmarshal(payload, value) == nil
+}
+
+func (c *oidcClient) setCookie(writer http.ResponseWriter, name string, value string, path string, maxAge int) {
+	http.SetCookie(writer, &http.Cookie{
+		Name: name,
+		Value: value,
+		Path: path,
+		MaxAge: maxAge,
+		HttpOnly: true,
+		Secure: strings.HasPrefix(c.redirectURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// checkSession lets request through if it has a valid session, and
+// otherwise sends browsers to log in and answers others with a 401.
+func (c *oidcClient) checkSession(writer http.ResponseWriter, request *http.Request, opts *serverOptions) bool {
+	trace := requestTraceFrom(request.Context())
+
+	var session oidcSession
+	if c.openCookie(request, oidcSessionCookie, "session", &session) && time.Now().Unix() < session.Expires {
+		logFieldsFrom(request.Context()).setAuthenticated(session.User, nil)
+		trace.note("auth", "valid session of %s", session.User)
+		return true
+	}
+
+	// only page loads can be sent through a login.
+	if request.Method != "GET" && request.Method != "HEAD" || wantsJSON(request) {
+		trace.note("auth", "login required, 401")
+		http.Error(writer, "Unauthorized", 401)
+		return false
+	}
+
+	login := oidcLogin{
+		State: randomToken(),
+		Nonce: randomToken(),
+		Verifier: randomToken(),
+		Return: opts.secretPrefix + request.URL.RequestURI(),
+		Expires: time.Now().Add(oidcLoginTimeout).Unix(),
+	}
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", c.clientID)
+	query.Set("redirect_uri", c.redirectURL)
+	query.Set("scope", c.scopes)
+	query.Set("state", login.State)
+	query.Set("nonce", login.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	location := c.authEndpoint + "?" + query.Encode()
+	if strings.Contains(c.authEndpoint, "?") {
+		location = c.authEndpoint + "&" + query.Encode()
+	}
+
+	trace.note("auth", "login required, redirect to the identity provider")
+	c.setCookie(
+		writer, oidcStateCookie, c.signCookie("state", login),
+		opts.secretPrefix + c.callbackPath, int(oidcLoginTimeout.Seconds()),
+	)
+
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Set("Location", location)
+	writer.WriteHeader(302)
+	return false
+}
+
+// callback finishes a login when the identity provider redirects back
+// with a code, exchanging it for an ID token and starting a session if
+// the user has the required claims.
+func (c *oidcClient) callback(writer http.ResponseWriter, request *http.Request, opts *serverOptions) {
+	trace := requestTraceFrom(request.Context())
+	query := request.URL.Query()
+
+	var login oidcLogin
+	if !c.openCookie(request, oidcStateCookie, "state", &login) || time.Now().Unix() > login.Expires ||
+	   !hmac.Equal([]byte(query.Get("state")), []byte(login.State)) {
+		trace.note("auth", "login callback with a missing or wrong state, 400")
+		http.Error(writer, "Login expired or invalid, try again", 400)
+		return
+	}
+
+	c.setCookie(writer, oidcStateCookie, "", opts.secretPrefix + c.callbackPath, -1)
+
+	if e := query.Get("error"); e != "" {
+		trace.note("auth", "login refused by the identity provider: %s, 403", e)
+		http.Error(writer, "Login failed: " + e, 403)
+		return
+	}
+
+	claims, err := c.exchange(query.Get("code"), login)
+	if err != nil {
+		trace.note("auth", "login failed: %v, 502", err)
+		http.Error(writer, "Login failed", 502)
+		return
+	}
+
+	subject, _ := claims["sub"].(string)
+	user := subject
+	for _, name := range []string{"email", "preferred_username"} {
+		if value, _ := claims[name].(string); value != "" {
+			user = value
+			break
+		}
+	}
+
+	if name, ok := c.missingClaim(claims); !ok {
+		trace.note("auth", "%s lacks the %s claim, 403", user, name)
+		http.Error(writer, "Forbidden", 403)
+		return
+	}
+
+	session := oidcSession{Subject: subject, User: user, Expires: time.Now().Add(c.sessionTTL).Unix()}
+	c.setCookie(
+		writer, oidcSessionCookie, c.signCookie("session", session),
+		opts.secretPrefix + "/", int(c.sessionTTL.Seconds()),
+	)
+
+	trace.note("auth", "logged in %s", user)
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Set("Location", login.Return)
+	writer.WriteHeader(302)
+}
+
+// exchange trades code for an ID token at the token endpoint, and returns
+// its claims once it is verified.
+func (c *oidcClient) exchange(code string, login oidcLogin) (map[string]any, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", c.redirectURL)
+	form.Set("code_verifier", login.Verifier)
+
+	request, err := http.NewRequest("POST", c.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error string `json:"error"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1 << 20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("reading the token response: %v", err)
+	}
+
+	if response.StatusCode != 200 || tokens.IDToken == "" {
+		return nil, fmt.Errorf("token endpoint: %s %s", response.Status, tokens.Error)
+	}
+
+	if _, err := c.idTokens.verify(tokens.IDToken); err != nil {
+		return nil, fmt.Errorf("ID token: %v", err)
+	}
+
+	// the signature is good, so the claims can be read as they are.
+	parts := strings.Split(tokens.IDToken, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errTokenInvalid
+	}
+
+	if nonce, _ := claims["nonce"].(string); !hmac.Equal([]byte(nonce), []byte(login.Nonce)) {
+		return nil, errors.New("ID token: wrong nonce")
+	}
+
+	return claims, nil
+}
+
+// missingClaim reports whether claims has one of the required values of
+// every required claim, and if not, the first one missing. A claim that
+// is a list, such as groups, needs to contain one of them.
+func (c *oidcClient) missingClaim(claims map[string]any) (string, bool) {
+	for name, allowed := range c.claims {
+		var values []string
+		switch value := claims[name].(type) {
+		case []any:
+			for _, v := range value {
+				values = append(values, fmt.Sprint(v))
+			}
+		case nil:
+		default:
+			values = append(values, fmt.Sprint(value))
+		}
+
+		found := false
+		for _, value := range values {
+			found = found || stringInSlice(value, allowed)
+		}
+
+		if !found {
+			return name, false
+		}
+	}
+
+	return "", true
+}
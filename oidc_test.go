@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// oidcTestProvider is the token endpoint of an identity provider, which
+// hands out an ID token for the code of the last login it was sent.
+type oidcTestProvider struct {
+	t *testing.T
+	keys *jwtTestKeys
+	challenge string
+	nonce string
+	verifiers []string
+}
+
+func (p *oidcTestProvider) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	verifier := request.PostFormValue("code_verifier")
+	p.verifiers = append(p.verifiers, verifier)
+
+	challenge := sha256.Sum256([]byte(verifier))
+	if request.PostFormValue("code") != "code" ||
+	   base64.RawURLEncoding.EncodeToString(challenge[:]) != p.challenge {
+		writer.WriteHeader(400)
+		json.NewEncoder(writer).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims := validClaims()
+	claims["nonce"] = p.nonce
+	claims["email"] = "bob@example.org"
+
+	token := signJWT(p.t, map[string]string{"alg": "ES256", "kid": "ec"}, claims, ecSigner(p.t, p.keys.ec))
+	json.NewEncoder(writer).Encode(map[string]string{"id_token": token})
+}
+
+// newOIDCTestClient returns a client for the provider, with the ID tokens
+// it issues checked against the JWKS of newJWKSVerifier.
+func newOIDCTestClient(t *testing.T, provider *oidcTestProvider) *oidcClient {
+	provider.t, provider.keys = t, newJWTTestKeys(t)
+	idTokens, _ := newJWKSVerifier(t, provider.keys)
+
+	server := httptest.NewServer(provider)
+	t.Cleanup(server.Close)
+
+	return &oidcClient{
+		clientID: "gohttpd",
+		redirectURL: "https://site.example/.oidc/callback",
+		callbackPath: "/.oidc/callback",
+		scopes: "openid email",
+		claims: map[string][]string{},
+		sessionTTL: time.Hour,
+		authEndpoint: "https://issuer.example/authorize",
+		tokenEndpoint: server.URL,
+		idTokens: idTokens,
+		key: make([]byte, 32),
+		client: server.Client(),
+	}
+}
+
+// startLogin requests a protected page, and returns the state cookie and
+// the query of the redirect to the identity provider.
+func startLogin(t *testing.T, client *oidcClient) (*http.Cookie, url.Values) {
+	recorder := httptest.NewRecorder()
+	if client.checkSession(recorder, httptest.NewRequest("GET", "/private/page?a=1", nil), &serverOptions{}) {
+		t.Fatal("request without a session let through")
+	}
+
+	response := recorder.Result()
+	if response.StatusCode != 302 {
+		t.Fatalf("got status %d, expected a redirect to log in", response.StatusCode)
+	}
+
+	location, err := url.Parse(response.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cookie := range response.Cookies() {
+		if cookie.Name == oidcStateCookie {
+			return cookie, location.Query()
+		}
+	}
+
+	t.Fatal("no state cookie")
+	return nil, nil
+}
+
+// finishLogin sends the identity provider's redirect back with state, and
+// returns the response.
+func finishLogin(client *oidcClient, state string, cookie *http.Cookie) *http.Response {
+	request := httptest.NewRequest("GET", "/.oidc/callback?code=code&state=" + url.QueryEscape(state), nil)
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+
+	recorder := httptest.NewRecorder()
+	client.callback(recorder, request, &serverOptions{})
+	return recorder.Result()
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := &oidcTestProvider{}
+	client := newOIDCTestClient(t, provider)
+
+	cookie, query := startLogin(t, client)
+	if query.Get("code_challenge_method") != "S256" || query.Get("state") == "" {
+		t.Fatalf("login redirect without state or PKCE: %v", query)
+	}
+
+	provider.challenge, provider.nonce = query.Get("code_challenge"), query.Get("nonce")
+
+	response := finishLogin(client, query.Get("state"), cookie)
+	if response.StatusCode != 302 || response.Header.Get("Location") != "/private/page?a=1" {
+		t.Fatalf("got status %d to %q, expected a redirect back to the page",
+			response.StatusCode, response.Header.Get("Location"))
+	}
+
+	// the verifier sent is the one the challenge was made from, and
+	// isn't the state or anything else in the redirect.
+	verifier := provider.verifiers[len(provider.verifiers) - 1]
+	for _, values := range query {
+		if strings.Contains(values[0], verifier) {
+			t.Errorf("the PKCE verifier is in the login redirect")
+		}
+	}
+
+	var session *http.Cookie
+	for _, c := range response.Cookies() {
+		if c.Name == oidcSessionCookie {
+			session = c
+		}
+	}
+
+	if session == nil {
+		t.Fatal("no session cookie after logging in")
+	}
+
+	request := httptest.NewRequest("GET", "/private/page", nil)
+	request.AddCookie(session)
+	if !client.checkSession(httptest.NewRecorder(), request, &serverOptions{}) {
+		t.Errorf("request with the new session refused")
+	}
+}
+
+func TestOIDCCallbackRefusesWrongState(t *testing.T) {
+	provider := &oidcTestProvider{}
+	client := newOIDCTestClient(t, provider)
+
+	cookie, query := startLogin(t, client)
+	other, otherQuery := startLogin(t, client)
+	provider.challenge, provider.nonce = query.Get("code_challenge"), query.Get("nonce")
+
+	expired := &http.Cookie{Name: oidcStateCookie, Value: client.signCookie("state", oidcLogin{
+		State: query.Get("state"),
+		Expires: time.Now().Add(-time.Minute).Unix(),
+	})}
+
+	tests := []struct {
+		name string
+		state string
+		cookie *http.Cookie
+	}{
+		{"no state cookie", query.Get("state"), nil},
+		{"the state of another login", otherQuery.Get("state"), cookie},
+		{"the state cookie of another login", query.Get("state"), other},
+		{"no state", "", cookie},
+		{"an expired login", query.Get("state"), expired},
+		{"a session cookie as the state", query.Get("state"), &http.Cookie{
+			Name: oidcStateCookie,
+			Value: client.signCookie("session", oidcSession{User: "bob", Expires: time.Now().Add(time.Hour).Unix()}),
+		}},
+	}
+
+	for _, test := range tests {
+		response := finishLogin(client, test.state, test.cookie)
+		if response.StatusCode != 400 {
+			t.Errorf("%s: got status %d, expected 400", test.name, response.StatusCode)
+		}
+	}
+
+	if len(provider.verifiers) != 0 {
+		t.Errorf("codes were exchanged for logins with a wrong state")
+	}
+}
+
+func TestOIDCExchangeSendsTheLoginVerifier(t *testing.T) {
+	provider := &oidcTestProvider{}
+	client := newOIDCTestClient(t, provider)
+
+	cookie, query := startLogin(t, client)
+	_, other := startLogin(t, client)
+
+	// the provider saw the challenge of another login, so the verifier
+	// of this one doesn't match it.
+	provider.challenge, provider.nonce = other.Get("code_challenge"), query.Get("nonce")
+
+	if response := finishLogin(client, query.Get("state"), cookie); response.StatusCode != 502 {
+		t.Errorf("got status %d for a verifier not matching the challenge, expected 502", response.StatusCode)
+	}
+
+	// and an ID token for another login's nonce is refused.
+	provider.challenge, provider.nonce = query.Get("code_challenge"), other.Get("nonce")
+
+	if response := finishLogin(client, query.Get("state"), cookie); response.StatusCode != 502 {
+		t.Errorf("got status %d for an ID token with the wrong nonce, expected 502", response.StatusCode)
+	}
+}
+
+func TestOIDCSessionCookies(t *testing.T) {
+	client := newOIDCTestClient(t, &oidcTestProvider{})
+	valid := oidcSession{User: "bob", Expires: time.Now().Add(time.Hour).Unix()}
+	signed := client.signCookie("session", valid)
+
+	encoded, signature, _ := strings.Cut(signed, ".")
+	payload, _ := json.Marshal(oidcSession{User: "admin", Expires: valid.Expires})
+	flipped := []byte(signature)
+	flipped[0] ^= 1
+
+	other := &oidcClient{key: []byte("another key of thirty-two bytes!")}
+
+	tests := []struct {
+		name string
+		value string
+		valid bool
+	}{
+		{"valid", signed, true},
+		{"other payload", base64.RawURLEncoding.EncodeToString(payload) + "." + signature, false},
+		{"tampered signature", encoded + "." + string(flipped), false},
+		{"no signature", encoded, false},
+		{"expired", client.signCookie("session", oidcSession{
+			User: "bob",
+			Expires: time.Now().Add(-time.Second).Unix(),
+		}), false},
+		{"signed as the state", client.signCookie("state", valid), false},
+		{"signed with another key", other.signCookie("session", valid), false},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/private/page", nil)
+		request.Header.Set("Accept", "application/json")
+		request.AddCookie(&http.Cookie{Name: oidcSessionCookie, Value: test.value})
+
+		recorder := httptest.NewRecorder()
+		if client.checkSession(recorder, request, &serverOptions{}) != test.valid {
+			t.Errorf("%s: got %v, expected %v", test.name, !test.valid, test.valid)
+		}
+
+		if !test.valid && recorder.Code != 401 {
+			t.Errorf("%s: got status %d, expected 401", test.name, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spans are sent in batches of up to this many, or whatever has been
+// collected every otlpFlushInterval; past otlpQueueSize waiting spans,
+// new ones are dropped rather than holding up requests.
+const (
+	otlpBatchSize = 512
+	otlpQueueSize = 8192
+	otlpFlushInterval = 5 * time.Second
+)
+
+// spanContext identifies a span of a trace, as in a W3C traceparent
+// header: "00-<trace ID>-<span ID>-<flags>".
+type spanContext struct {
+	traceID [16]byte
+	spanID [8]byte
+	sampled bool
+}
+
+// parseTraceparent parses a traceparent header, returning false if it
+// is missing or malformed.
+func parseTraceparent(header string) (spanContext, bool) {
+	var sc spanContext
+
+	fields := strings.Split(strings.TrimSpace(header), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" ||
+	   fields[0] == "00" && len(fields) != 4 {
+		return sc, false
+	}
+
+	traceID, err1 := hex.DecodeString(fields[1])
+	spanID, err2 := hex.DecodeString(fields[2])
+	flags, err3 := hex.DecodeString(fields[3])
+	if err1 != nil || err2 != nil || err3 != nil ||
+	   len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 {
+		return sc, false
+	}
+
+	copy(sc.traceID[:], traceID)
+	copy(sc.spanID[:], spanID)
+	sc.sampled = flags[0] & 1 == 1
+
+	// all-zero IDs are invalid.
+	if sc.traceID == [16]byte{} || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+
+	return sc, true
+}
+
+// otlpExporter sends a span per request to an OpenTelemetry collector,
+// with OTLP over HTTP in its JSON encoding. Requests that come with a
+// traceparent header join that trace, and are sampled as it was; others
+// start a trace of their own, a sampleRatio of which are sent.
+type otlpExporter struct {
+	url string
+	headers http.Header
+	serviceName string
+	sampleRatio float64
+	client *http.Client
+
+	mu sync.Mutex
+	queue []otlpSpan
+	dropped int
+	ready chan struct{}
+}
+
+func newOTLPExporter(
+	endpoint string,
+	headers []string,
+	serviceName string,
+	sampleRatio float64,
+) (*otlpExporter, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("invalid endpoint %q, expected an http:// or https:// URL", endpoint)
+	}
+
+	if sampleRatio < 0 || sampleRatio > 1 {
+		return nil, fmt.Errorf("invalid sample ratio %v, expected 0 to 1", sampleRatio)
+	}
+
+	e := &otlpExporter{
+		url: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers: http.Header{},
+		serviceName: serviceName,
+		sampleRatio: sampleRatio,
+		client: &http.Client{Timeout: 10 * time.Second},
+		ready: make(chan struct{}, 1),
+	}
+
+	for _, header := range headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header %q, expected Name: value", header)
+		}
+
+		e.headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	return e, nil
+}
+
+// start returns the span context of request's span, which is only sent
+// if it is sampled, and that of its parent, if any.
+func (e *otlpExporter) start(request *http.Request) (spanContext, spanContext) {
+	parent, ok := parseTraceparent(request.Header.Get("traceparent"))
+
+	sc := spanContext{traceID: parent.traceID}
+	if ok {
+		sc.sampled = parent.sampled
+	} else {
+		parent = spanContext{}
+		rand.Read(sc.traceID[:])
+
+		// the trace ID is random, so its low bits sample as well as any.
+		n := uint64(0)
+		for _, b := range sc.traceID[8:] {
+			n = n << 8 | uint64(b)
+		}
+
+		sc.sampled = float64(n) < e.sampleRatio * math.MaxUint64 || e.sampleRatio == 1
+	}
+
+	rand.Read(sc.spanID[:])
+	return sc, parent
+}
+
+// otlpSpan and the types below are the parts of the OTLP JSON encoding
+// that are used, in which IDs are hex and 64-bit integers strings.
+type otlpSpan struct {
+	TraceID string `json:"traceId"`
+	SpanID string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId,omitempty"`
+	Name string `json:"name"`
+	Kind int `json:"kind"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	EndTimeUnixNano string `json:"endTimeUnixNano"`
+	Attributes []otlpAttribute `json:"attributes"`
+	Status otlpStatus `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key string `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue *string `json:"intValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code,omitempty"`
+}
+
+func stringAttribute(key string, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int64) otlpAttribute {
+	s := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+// spanRecord is what a request's span says about it.
+type spanRecord struct {
+	sc spanContext
+	parent spanContext
+	start time.Time
+	end time.Time
+	method string
+	path string
+	host string
+	client string
+	userAgent string
+	status int
+	bytes int64
+	uncompressed int64
+	encoding string
+	cache string
+	requestID string
+}
+
+// record queues the span of a finished request to be sent.
+func (e *otlpExporter) record(r spanRecord) {
+	span := otlpSpan{
+		TraceID: hex.EncodeToString(r.sc.traceID[:]),
+		SpanID: hex.EncodeToString(r.sc.spanID[:]),
+		Name: r.method,
+		Kind: 2,
+		StartTimeUnixNano: strconv.FormatInt(r.start.UnixNano(), 10),
+		EndTimeUnixNano: strconv.FormatInt(r.end.UnixNano(), 10),
+		Attributes: []otlpAttribute{
+			stringAttribute("http.request.method", r.method),
+			stringAttribute("url.path", r.path),
+			stringAttribute("server.address", r.host),
+			stringAttribute("client.address", r.client),
+			intAttribute("http.response.status_code", int64(r.status)),
+			intAttribute("http.response.body.size", r.bytes),
+			stringAttribute("httpd.request_id", r.requestID),
+		},
+	}
+
+	if r.parent.spanID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(r.parent.spanID[:])
+	}
+
+	if r.userAgent != "" {
+		span.Attributes = append(span.Attributes, stringAttribute("user_agent.original", r.userAgent))
+	}
+
+	if r.encoding != "" {
+		span.Attributes = append(
+			span.Attributes,
+			stringAttribute("httpd.compression", r.encoding),
+			intAttribute("httpd.uncompressed_size", r.uncompressed),
+		)
+	}
+
+	if r.cache != "" {
+		span.Attributes = append(span.Attributes, stringAttribute("httpd.cache", r.cache))
+	}
+
+	// server spans are errors only for 5xx, which are the server's fault.
+	if r.status >= 500 {
+		span.Status.Code = 2
+	}
+
+	e.mu.Lock()
+	if len(e.queue) >= otlpQueueSize {
+		e.dropped++
+		e.mu.Unlock()
+		return
+	}
+
+	e.queue = append(e.queue, span)
+	full := len(e.queue) >= otlpBatchSize
+	e.mu.Unlock()
+
+	if full {
+		select {
+		case e.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run sends the queued spans in batches, until the server stops and the
+// rest are flushed on the way out.
+func (e *otlpExporter) run() error {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.ready:
+		case <-stopServer:
+			return nil
+		}
+
+		if err := e.flush(); err != nil {
+			fmt.Println("unable to export spans: ", err)
+		}
+	}
+}
+
+// flush sends everything queued.
+func (e *otlpExporter) flush() error {
+	for {
+		e.mu.Lock()
+		batch := e.queue[:min(len(e.queue), otlpBatchSize)]
+		e.queue = e.queue[len(batch):]
+		dropped := e.dropped
+		e.dropped = 0
+		e.mu.Unlock()
+
+		if dropped > 0 {
+			fmt.Println("dropped", dropped, "spans, the collector isn't keeping up")
+		}
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := e.send(batch); err != nil {
+			return err
+		}
+	}
+}
+
+func (e *otlpExporter) send(spans []otlpSpan) error {
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{stringAttribute("service.name", e.serviceName)},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "gohttpd"},
+				"spans": spans,
+			}},
+		}},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	for name, values := range e.headers {
+		request.Header[name] = values
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := e.client.Do(request)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64 << 10))
+
+	if response.StatusCode / 100 != 2 {
+		return errors.New("collector answered " + response.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the key client addresses are hashed with changes every day and is never
+// stored, so hashes can only be linked within a day and can't be reversed
+// by hashing every possible address.
+var logHashKey struct {
+	sync.Mutex
+	key []byte
+	day string
+}
+
+// anonymizeIP returns the client address as it is logged: "full" keeps
+// it, "truncate" zeroes the host part (the last octet of IPv4 addresses
+// and all but the /48 prefix of IPv6 ones) and "hash" replaces it with a
+// keyed hash.
+func anonymizeIP(addr string, mode string) string {
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"))
+	if ip == nil {
+		return addr
+	}
+
+	switch mode {
+	case "truncate":
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+
+	case "hash":
+		day := time.Now().UTC().Format("2006-01-02")
+
+		logHashKey.Lock()
+		if logHashKey.day != day {
+			logHashKey.key = make([]byte, 32)
+			rand.Read(logHashKey.key)
+			logHashKey.day = day
+		}
+
+		mac := hmac.New(sha256.New, logHashKey.key)
+		logHashKey.Unlock()
+
+		mac.Write(ip)
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+
+	return addr
+}
+
+// sent with every response in strict privacy mode, turning off browser
+// features a static site has no use for, including interest tracking.
+const strictPermissionsPolicy = "accelerometer=(), ambient-light-sensor=(), browsing-topics=(), " +
+	"camera=(), display-capture=(), geolocation=(), gyroscope=(), hid=(), " +
+	"interest-cohort=(), magnetometer=(), microphone=(), midi=(), payment=(), " +
+	"serial=(), usb=()"
+
+// sent with generated pages in strict privacy mode, so that they can't
+// load anything from other sites, even through a HEADER.html or README.
+const strictContentSecurityPolicy = "default-src 'self'; img-src 'self' data:; " +
+	"style-src 'self' 'unsafe-inline'; script-src 'self' 'unsafe-inline'; " +
+	"form-action 'self'; base-uri 'self'; frame-ancestors 'self'"
+
+var thirdPartyReference = regexp.MustCompile(
+	`(?i)(src|href|action|srcset)\s*=\s*["']?\s*(https?:)?//|url\(\s*["']?\s*(https?:)?//|@import\s+["']\s*(https?:)?//`,
+)
+
+// checkStrictPrivacy verifies at startup that nothing configured would
+// set cookies or make generated pages refer to other sites.
+func checkStrictPrivacy(headers pathHeaders, stylesheet string) error {
+	for _, header := range headers {
+		if strings.EqualFold(header.name, "Set-Cookie") {
+			return fmt.Errorf("-header sets a cookie for %s", header.pattern)
+		}
+	}
+
+	if thirdPartyReference.MatchString("href=" + stylesheet) {
+		return fmt.Errorf("-list-stylesheet refers to another site: %s", stylesheet)
+	}
+
+	if ref := thirdPartyReference.FindString(listingTemplateSource); ref != "" {
+		return fmt.Errorf("the listing template refers to another site: %s", ref)
+	}
+
+	return nil
+}
+
+// pruneLogs deletes the files matching pattern, such as rotated access
+// logs, that were last written to longer than retention ago, once at
+// startup and then every hour.
+func pruneLogs(pattern string, retention time.Duration) {
+	for {
+		paths, _ := filepath.Glob(pattern)
+
+		for _, path := range paths {
+			stat, err := os.Stat(path)
+			if err != nil || !stat.Mode().IsRegular() ||
+			   time.Since(stat.ModTime()) < retention {
+				continue
+			}
+
+			if err := os.Remove(path); err != nil {
+				fmt.Println("unable to prune log: ", err)
+			}
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
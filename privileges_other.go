@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func lookupCredentials(userName string, groupName string) (int, int, error) {
+	return 0, 0, errors.New("switching users is only supported on Unix systems")
+}
+
+func dropPrivileges(uid int, gid int) error {
+	return errors.New("switching users is only supported on Unix systems")
+}
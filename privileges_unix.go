@@ -0,0 +1,79 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// lookupCredentials returns the IDs of the given user and group, by name
+// or number, or -1 for a user that isn't given. Without a group, the
+// user's primary group is used.
+func lookupCredentials(userName string, groupName string) (int, int, error) {
+	uid, gid := -1, -1
+
+	// numbers are taken as they are when no account has them.
+	if userName != "" {
+		account, err := user.Lookup(userName)
+		if err != nil {
+			account, err = user.LookupId(userName)
+		}
+
+		if err == nil {
+			uid, _ = strconv.Atoi(account.Uid)
+			gid, _ = strconv.Atoi(account.Gid)
+		} else if uid, err = strconv.Atoi(userName); err != nil || uid < 0 {
+			return 0, 0, fmt.Errorf("unknown user %s", userName)
+		}
+	}
+
+	if groupName != "" {
+		group, err := user.LookupGroup(groupName)
+		if err != nil {
+			group, err = user.LookupGroupId(groupName)
+		}
+
+		if err == nil {
+			gid, _ = strconv.Atoi(group.Gid)
+		} else if gid, err = strconv.Atoi(groupName); err != nil || gid < 0 {
+			return 0, 0, fmt.Errorf("unknown group %s", groupName)
+		}
+	}
+
+	if gid == -1 {
+		return 0, 0, fmt.Errorf("user %s has no account, so -group is needed", userName)
+	}
+
+	return uid, gid, nil
+}
+
+// dropPrivileges switches the process to the given user, unless it is -1,
+// and group, so that it can bind low ports as root and serve as someone
+// else. The supplementary groups are dropped either way.
+func dropPrivileges(uid int, gid int) error {
+	// the group has to change first, while the process may still do so.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+
+	if uid == -1 {
+		return nil
+	}
+
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("able to regain root after switching to user %d", uid)
+	}
+
+	return nil
+}
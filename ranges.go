@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errRangeUnsatisfiable = errors.New("range not satisfiable")
+
+// parseRange parses a Range header asking for a single range of bytes of
+// a file of the given size, returning its start and length. Headers it
+// doesn't handle, such as ones with several ranges, are an error other
+// than errRangeUnsatisfiable, and the whole file is sent instead.
+func parseRange(header string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, errors.New("unsupported range")
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, errors.New("invalid range")
+	}
+
+	// "-n" asks for the last n bytes.
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("invalid range")
+		}
+
+		if n == 0 || size == 0 {
+			return 0, 0, errRangeUnsatisfiable
+		}
+
+		n = min(n, size)
+		return size - n, n, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errors.New("invalid range")
+	}
+
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, errors.New("invalid range")
+		}
+
+		end = min(end, size - 1)
+	}
+
+	if start >= size {
+		return 0, 0, errRangeUnsatisfiable
+	}
+
+	return start, end - start + 1, nil
+}
+
+// ifRangeMatches reports whether a Range header applies to the current
+// file, given its If-Range header, which holds a strong ETag or the
+// exact Last-Modified date of the copy the client has.
+func ifRangeMatches(ifRange string, etag string, lastModified time.Time) bool {
+	if ifRange == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == etag
+	}
+
+	if strings.HasPrefix(ifRange, "W/") {
+		return false
+	}
+
+	since, err := time.Parse(http.TimeFormat, ifRange)
+	return err == nil && since.Equal(lastModified)
+}
+
+// fileConnections counts the requests each client has open for each file,
+// so that download accelerators splitting a file into many ranges can't
+// take more than their share of the server.
+type fileConnections struct {
+	limit int
+
+	mu sync.Mutex
+	open map[string]int
+}
+
+func newFileConnections(limit int) *fileConnections {
+	return &fileConnections{limit: limit, open: map[string]int{}}
+}
+
+// fileConnectionKey identifies the file at path as requested by the
+// client of request.
+func fileConnectionKey(request *http.Request, path string) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+
+	return host + "\x00" + filepath.Clean(path)
+}
+
+// acquire counts a request for key, unless the limit has been reached.
+func (c *fileConnections) acquire(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.open[key] >= c.limit {
+		return false
+	}
+
+	c.open[key]++
+	return true
+}
+
+func (c *fileConnections) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.open[key]--; c.open[key] <= 0 {
+		delete(c.open, key)
+	}
+}
+
+// limits of the digest cache: the most digests kept and the most files
+// hashed at once.
+const (
+	digestCacheMaxEntries = 4096
+	digestMaxPending = 2
+)
+
+// digestCache provides the SHA-256 digests of files for Repr-Digest and
+// Content-Digest headers. Digests from the checksum index are used as
+// they are; others are computed in the background the first time a file
+// is requested and sent from then on, as long as the file is unchanged.
+type digestCache struct {
+	storage *fileStore
+	mu sync.Mutex
+	entries map[string]digestEntry
+	pending map[string]bool
+}
+
+type digestEntry struct {
+	value string
+	size int64
+	modTime time.Time
+}
+
+func newDigestCache(storage *fileStore) *digestCache {
+	return &digestCache{
+		storage: storage,
+		entries: map[string]digestEntry{},
+		pending: map[string]bool{},
+	}
+}
+
+// formatDigest formats a digest as a structured field, like
+// "sha-256=:base64:".
+func formatDigest(algorithm string, sum []byte) string {
+	return algorithm + "=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// lookup returns the digest of the file at path, or false when it is not
+// known yet.
+func (c *digestCache) lookup(path string, stat os.FileInfo) (string, bool) {
+	path = filepath.Clean(path)
+
+	if checksum, ok := c.storage.checksums[path]; ok && !c.storage.inUserDir(path) {
+		switch len(checksum.sum) {
+		case sha256.Size:
+			return formatDigest("sha-256", checksum.sum), true
+		case sha512.Size:
+			return formatDigest("sha-512", checksum.sum), true
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[path]
+	if ok && entry.size == stat.Size() && entry.modTime.Equal(stat.ModTime()) {
+		return entry.value, true
+	}
+
+	if !c.pending[path] && len(c.pending) < digestMaxPending {
+		c.pending[path] = true
+		go c.compute(path, stat)
+	}
+
+	return "", false
+}
+
+func (c *digestCache) compute(path string, stat os.FileInfo) {
+	sum, err := hashFile(c.storage, path, sha256.New)
+	if err != nil {
+		errorLog.print(nil, "unable to compute digest of %s: %v", path, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, path)
+	if err != nil {
+		return
+	}
+
+	// full of digests, so make room at random.
+	for k := range c.entries {
+		if len(c.entries) < digestCacheMaxEntries {
+			break
+		}
+
+		delete(c.entries, k)
+	}
+
+	c.entries[path] = digestEntry{
+		value: formatDigest("sha-256", sum),
+		size: stat.Size(),
+		modTime: stat.ModTime(),
+	}
+}
+
+// hashFile returns the hash of the contents of the file at path.
+func hashFile(
+	storage *fileStore,
+	path string,
+	newHash func() hash.Hash,
+) ([]byte, error) {
+	file, err := storage.Open(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	h := newHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// most clients tracked at once; past that, random ones are forgotten,
+// which only hands them a full bucket again.
+const rateLimitMaxClients = 100000
+
+// rateLimiter gives each client a token bucket of burst requests, filled
+// at rate requests per second, keyed by clientKey. Buckets that have
+// filled up again are the same as new ones, so they are dropped once a
+// minute.
+type rateLimiter struct {
+	rate float64
+	burst float64
+
+	mu sync.Mutex
+	clients map[netip.Addr]*rateBucket
+	swept time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	updated time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate: rate,
+		burst: float64(max(burst, 1)),
+		clients: map[netip.Addr]*rateBucket{},
+		swept: time.Now(),
+	}
+}
+
+// clientKey identifies the client at addr for per-client limits: IPv6
+// clients are counted by their /64, as one host usually has all of it.
+func clientKey(addr netip.Addr) netip.Addr {
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return prefix.Addr()
+	}
+
+	return addr
+}
+
+// allow takes a token from the bucket of addr, or returns how long until
+// there is one.
+func (l *rateLimiter) allow(addr netip.Addr) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.swept) >= time.Minute {
+		l.sweep(now)
+	}
+
+	key := clientKey(addr)
+	bucket, ok := l.clients[key]
+	if !ok {
+		for k := range l.clients {
+			if len(l.clients) < rateLimitMaxClients {
+				break
+			}
+
+			delete(l.clients, k)
+		}
+
+		bucket = &rateBucket{tokens: l.burst, updated: now}
+		l.clients[key] = bucket
+	}
+
+	bucket.tokens = min(l.burst, bucket.tokens + now.Sub(bucket.updated).Seconds() * l.rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+
+	bucket.tokens--
+	return true, 0
+}
+
+// peek reports what allow would, without taking a token.
+func (l *rateLimiter) peek(addr netip.Addr) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tokens := l.burst
+	if bucket, ok := l.clients[clientKey(addr)]; ok {
+		tokens = min(l.burst, bucket.tokens + time.Since(bucket.updated).Seconds() * l.rate)
+	}
+
+	if tokens < 1 {
+		return false, time.Duration((1 - tokens) / l.rate * float64(time.Second))
+	}
+
+	return true, 0
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	l.swept = now
+
+	for key, bucket := range l.clients {
+		if bucket.tokens + now.Sub(bucket.updated).Seconds() * l.rate >= l.burst {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// check lets request through if its client has requests left, and
+// otherwise answers it with a 429.
+func (l *rateLimiter) check(writer http.ResponseWriter, request *http.Request) bool {
+	trace := requestTraceFrom(request.Context())
+
+	allow := l.allow
+	if trace != nil && trace.dryRun {
+		allow = l.peek
+	}
+
+	ok, wait := allow(remoteAddr(request))
+	if ok {
+		if trace != nil && trace.dryRun {
+			trace.note("rate limit", "within the limit, no token taken")
+		}
+
+		return true
+	}
+
+	retry := int(math.Ceil(wait.Seconds()))
+	trace.note("rate limit", "exceeded, retry in %ds, 429", retry)
+
+	writer.Header().Set("Retry-After", strconv.Itoa(retry))
+	http.Error(writer, "Too many requests", 429)
+	return false
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// allowed returns how many of n requests from addr are let through.
+func allowed(l *rateLimiter, addr netip.Addr, n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if ok, _ := l.allow(addr); ok {
+			count++
+		}
+	}
+
+	return count
+}
+
+// age moves the last update of the bucket of addr back by d, as if d had
+// passed since.
+func age(l *rateLimiter, addr netip.Addr, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.clients[clientKey(addr)].updated = l.clients[clientKey(addr)].updated.Add(-d)
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	l := newRateLimiter(1, 3)
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	if n := allowed(l, addr, 5); n != 3 {
+		t.Errorf("%d of 5 requests allowed, expected the burst of 3", n)
+	}
+
+	ok, wait := l.allow(addr)
+	if ok || wait <= 0 || wait > time.Second {
+		t.Errorf("got (%v, %v) with an empty bucket, expected a wait of up to 1s", ok, wait)
+	}
+
+	if n := allowed(l, netip.MustParseAddr("192.0.2.2"), 3); n != 3 {
+		t.Errorf("another client got %d of 3 requests, expected all of them", n)
+	}
+
+	// the addresses of an IPv6 /64 share a bucket.
+	allowed(l, netip.MustParseAddr("2001:db8::1"), 3)
+	if ok, _ := l.allow(netip.MustParseAddr("2001:db8::2")); ok {
+		t.Errorf("another address of the same /64 has its own bucket")
+	}
+
+	if ok, _ := l.allow(netip.MustParseAddr("2001:db8:0:1::1")); !ok {
+		t.Errorf("an address of another /64 shares the bucket")
+	}
+}
+
+func TestRateLimitRefill(t *testing.T) {
+	l := newRateLimiter(2, 5)
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	allowed(l, addr, 5)
+
+	// at 2 requests a second, a second and a half brings 3 tokens.
+	age(l, addr, 1500 * time.Millisecond)
+	if n := allowed(l, addr, 5); n != 3 {
+		t.Errorf("%d requests allowed after 1.5s, expected 3", n)
+	}
+
+	// and an hour doesn't bring more than the burst.
+	age(l, addr, time.Hour)
+	if n := allowed(l, addr, 10); n != 5 {
+		t.Errorf("%d requests allowed after an hour, expected the burst of 5", n)
+	}
+}
+
+func TestRateLimitDryRun(t *testing.T) {
+	l := newRateLimiter(0.001, 2)
+
+	check := func(dryRun bool) int {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = "192.0.2.1:1234"
+		if dryRun {
+			request = request.WithContext(withRequestTrace(request.Context(), &requestTrace{dryRun: true}))
+		}
+
+		recorder := httptest.NewRecorder()
+		l.check(recorder, request)
+		return recorder.Code
+	}
+
+	for i := 0; i < 5; i++ {
+		if status := check(true); status != 200 {
+			t.Fatalf("dry run %d got status %d, expected 200", i, status)
+		}
+	}
+
+	// the dry runs left the bucket full.
+	if check(false) != 200 || check(false) != 200 {
+		t.Errorf("requests refused after dry runs")
+	}
+
+	// a dry run still reports the limit once it is reached.
+	if status := check(true); status != 429 {
+		t.Errorf("dry run with an empty bucket got status %d, expected 429", status)
+	}
+}
+
+func TestRateLimitBehindProxy(t *testing.T) {
+	server, opts := newArchiveTestServer(t)
+
+	var err error
+	if opts.trustedProxies, err = parseIPList("127.0.0.0/8,::1"); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.rateLimit = newRateLimiter(0.001, 2)
+
+	get := func(forwardedFor string) int {
+		request, err := http.NewRequest("GET", server.URL + "/public.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request.Header.Set("X-Forwarded-For", forwardedFor)
+
+		response, err := server.Client().Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	// the client makes up a new leading entry each time, which the proxy
+	// passes on before the address it saw.
+	for i, spoofed := range []string{"198.51.100.1", "198.51.100.2"} {
+		if status := get(spoofed + ", 203.0.113.5"); status != 200 {
+			t.Fatalf("request %d got status %d, expected 200", i, status)
+		}
+	}
+
+	if status := get("198.51.100.3, 203.0.113.5"); status != 429 {
+		t.Errorf("third request with a spoofed entry got status %d, expected 429", status)
+	}
+
+	// entries of other trusted proxies are skipped as well.
+	if status := get("198.51.100.4, 203.0.113.5, 127.0.0.2"); status != 429 {
+		t.Errorf("request through two proxies got status %d, expected 429", status)
+	}
+
+	if status := get("203.0.113.6"); status != 200 {
+		t.Errorf("another client got status %d, expected 200", status)
+	}
+}
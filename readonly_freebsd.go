@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// MNT_RDONLY from <sys/mount.h>.
+const mntRdonly = 0x1
+
+const openNoFollow = syscall.O_NOFOLLOW
+
+// checkReadOnly returns an error unless dir is on a read-only mount. It
+// only uses the descriptor, so it keeps working in capability mode.
+func checkReadOnly(dir *os.File) error {
+	var st syscall.Statfs_t
+	if err := syscall.Fstatfs(int(dir.Fd()), &st); err != nil {
+		return err
+	}
+
+	if st.Flags & mntRdonly == 0 {
+		return fmt.Errorf("%s is on a writable filesystem", dir.Name())
+	}
+
+	return nil
+}
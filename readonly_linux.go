@@ -0,0 +1,28 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// ST_RDONLY from statvfs(3), which statfs(2) also reports in f_flags.
+const stRdonly = 0x1
+
+const openNoFollow = syscall.O_NOFOLLOW
+
+// checkReadOnly returns an error unless dir is on a read-only mount.
+func checkReadOnly(dir *os.File) error {
+	var st syscall.Statfs_t
+	if err := syscall.Fstatfs(int(dir.Fd()), &st); err != nil {
+		return err
+	}
+
+	if st.Flags & stRdonly == 0 {
+		return fmt.Errorf("%s is on a writable filesystem", dir.Name())
+	}
+
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+const openNoFollow = 0
+
+func checkReadOnly(dir *os.File) error {
+	return errors.New("read-only assertions are not supported on this platform")
+}
@@ -0,0 +1,28 @@
+//go:build unix && !linux && !freebsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+const openNoFollow = syscall.O_NOFOLLOW
+
+// checkReadOnly returns an error unless dir is on a read-only mount.
+// statfs(2) flags differ between the BSDs, so this relies on access(2)
+// failing with EROFS for a write check on a read-only filesystem.
+func checkReadOnly(dir *os.File) error {
+	path := dir.Name()
+	err := syscall.Access(path, 2) // W_OK
+	if err == syscall.EROFS {
+		return nil
+	}
+
+	if err == nil {
+		return fmt.Errorf("%s is on a writable filesystem", path)
+	}
+
+	return fmt.Errorf("unable to verify that %s is read-only: %v", path, err)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// responseRecorder passes a response on to the writer it wraps, noting
+// its status, how many bytes of body went out and when the response
+// started, which is what gets logged, counted and audited. Unlike digging them out of net/http's own
+// writer, this works the same under HTTP/2 and whatever else wraps it.
+// Nothing is counted for HEAD requests, whose bodies net/http drops.
+type responseRecorder struct {
+	http.ResponseWriter
+	head bool
+	status int
+	written int64
+	firstByte time.Time
+}
+
+// started notes the time the response started going out.
+func (r *responseRecorder) started() {
+	if r.firstByte.IsZero() {
+		r.firstByte = time.Now()
+	}
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.started()
+
+	// informational responses, like 103 Early Hints, come before the
+	// real one.
+	if r.status == 0 && status >= 200 {
+		r.status = status
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.started()
+	if r.status == 0 {
+		r.status = 200
+	}
+
+	n, err := r.ResponseWriter.Write(p)
+	if !r.head {
+		r.written += int64(n)
+	}
+
+	return n, err
+}
+
+// ReadFrom keeps files going out with sendfile when the wrapped writer
+// can do that.
+func (r *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.started()
+	if r.status == 0 {
+		r.status = 200
+	}
+
+	var n int64
+	var err error
+	if readerFrom, ok := r.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = readerFrom.ReadFrom(src)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{r.ResponseWriter}, src)
+	}
+
+	if !r.head {
+		r.written += n
+	}
+
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	r.started()
+	if r.status == 0 {
+		r.status = 200
+	}
+
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the wrapped writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// result returns the status and body size of the response; handlers that
+// return without writing anything have sent an empty 200.
+func (r *responseRecorder) result() (int, int64) {
+	if r.status == 0 {
+		return 200, r.written
+	}
+
+	return r.status, r.written
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// the longest request ID taken from a proxy.
+const maxRequestIDLength = 128
+
+// newRequestID returns a random request ID of 32 hex digits.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether id can be used as is, without breaking
+// log lines: it must be short and of printable ASCII without spaces or
+// quotes.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' || id[i] == '"' || id[i] == '\\' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestID returns the ID of request: the X-Request-ID set by a trusted
+// proxy in front, which ties the lines of both logs together, or else a
+// new one.
+func requestID(request *http.Request, opts *serverOptions) string {
+	id := request.Header.Get("X-Request-ID")
+	if validRequestID(id) && ipListContains(opts.trustedProxies, remoteAddr(request)) {
+		return id
+	}
+
+	return newRequestID()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// crawlers that collect content for training AI models, which are kept
+// out of -no-ai paths in the generated robots.txt.
+var aiCrawlers = []string {
+	"GPTBot",
+	"ChatGPT-User",
+	"CCBot",
+	"Google-Extended",
+	"Applebot-Extended",
+	"anthropic-ai",
+	"ClaudeBot",
+	"PerplexityBot",
+	"Bytespider",
+	"meta-externalagent",
+	"cohere-ai",
+	"Diffbot",
+}
+
+// applyRobots adds the X-Robots-Tag directives of the -robots patterns
+// matching urlPath, and the AI opt-out headers for -no-ai paths.
+func applyRobots(header http.Header, urlPath string, opts *serverOptions) {
+	for _, rule := range opts.robots {
+		if pathMatches(rule.prefix, urlPath) {
+			header.Add("X-Robots-Tag", rule.value)
+		}
+	}
+
+	for _, pattern := range opts.noAI {
+		if pathMatches(pattern, urlPath) {
+			header.Add("X-Robots-Tag", "noai, noimageai")
+			header.Set("TDM-Reservation", "1")
+			break
+		}
+	}
+}
+
+// serveRobotsTxt answers for a robots.txt the site doesn't have with one
+// keeping crawlers out of noindex paths and AI crawlers out of -no-ai
+// paths, and asking all of them to wait -crawl-delay between requests.
+func serveRobotsTxt(writer http.ResponseWriter, opts *serverOptions) {
+	var noIndex []string
+	for _, rule := range opts.robots {
+		for _, directive := range strings.Split(rule.value, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "noindex" || directive == "none" {
+				noIndex = append(noIndex, robotsPattern(rule.prefix))
+				break
+			}
+		}
+	}
+
+	var b strings.Builder
+
+	// crawlers follow only the group naming them, so the AI crawlers'
+	// group repeats the paths kept out of search.
+	if len(opts.noAI) > 0 {
+		for _, crawler := range aiCrawlers {
+			fmt.Fprintf(&b, "User-agent: %s\n", crawler)
+		}
+
+		for _, pattern := range opts.noAI {
+			fmt.Fprintf(&b, "Disallow: %s\n", robotsPattern(pattern))
+		}
+
+		for _, pattern := range noIndex {
+			fmt.Fprintf(&b, "Disallow: %s\n", pattern)
+		}
+
+		writeCrawlDelay(&b, opts)
+		b.WriteString("\n")
+	}
+
+	b.WriteString("User-agent: *\n")
+	for _, pattern := range noIndex {
+		fmt.Fprintf(&b, "Disallow: %s\n", pattern)
+	}
+
+	if len(noIndex) == 0 {
+		b.WriteString("Disallow:\n")
+	}
+
+	writeCrawlDelay(&b, opts)
+
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writer.Header().Set("Content-Length", fmt.Sprint(b.Len()))
+	writer.Write([]byte(b.String()))
+}
+
+func writeCrawlDelay(b *strings.Builder, opts *serverOptions) {
+	if opts.crawlDelay > 0 {
+		fmt.Fprintf(b, "Crawl-delay: %d\n", opts.crawlDelay)
+	}
+}
+
+// robotsPattern converts a path pattern to a robots.txt path, which is
+// matched by prefix and only knows the '*' wildcard.
+func robotsPattern(pattern string) string {
+	if i := strings.IndexAny(pattern, "?["); i >= 0 {
+		pattern = pattern[:i] + "*"
+	}
+
+	return pattern
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// applySandbox enters Capsicum capability mode, after which the process
+// can only use descriptors it already holds. storage already serves its
+// home directory from a root, unless it follows every symlink, in which
+// case it is switched to one opened on the first path beforehand; any
+// further paths are not reachable in capability mode.
+func applySandbox(storage *fileStore, paths []string) error {
+	root := storage.root
+	if root == nil {
+		var err error
+		if root, err = os.OpenRoot(paths[0]); err != nil {
+			return err
+		}
+	}
+
+	// the local time zone is loaded lazily and would fail to load once
+	// the filesystem namespace is gone.
+	time.Now().Zone()
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_CAP_ENTER, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("cap_enter: %v", errno)
+	}
+
+	storage.root = root
+	return nil
+}
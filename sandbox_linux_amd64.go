@@ -0,0 +1,40 @@
+package main
+
+import "syscall"
+
+// AUDIT_ARCH_X86_64
+const seccompAuditArch = 0xc000003e
+
+const sysSeccomp = 317
+
+var seccompDeniedSyscalls = []uint32 {
+	syscall.SYS_FORK,
+	syscall.SYS_VFORK,
+	syscall.SYS_EXECVE,
+	322, // execveat
+	syscall.SYS_PTRACE,
+	310, // process_vm_readv
+	311, // process_vm_writev
+	syscall.SYS_PERSONALITY,
+	syscall.SYS_MOUNT,
+	syscall.SYS_UMOUNT2,
+	syscall.SYS_PIVOT_ROOT,
+	syscall.SYS_UNSHARE,
+	308, // setns
+	syscall.SYS_SWAPON,
+	syscall.SYS_SWAPOFF,
+	syscall.SYS_REBOOT,
+	syscall.SYS_ACCT,
+	syscall.SYS_KEXEC_LOAD,
+	320, // kexec_file_load
+	syscall.SYS_INIT_MODULE,
+	313, // finit_module
+	syscall.SYS_DELETE_MODULE,
+	321, // bpf
+	syscall.SYS_PERF_EVENT_OPEN,
+	323, // userfaultfd
+	304, // open_by_handle_at
+	syscall.SYS_ADD_KEY,
+	syscall.SYS_REQUEST_KEY,
+	syscall.SYS_KEYCTL,
+}
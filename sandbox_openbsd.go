@@ -0,0 +1,104 @@
+//go:build openbsd && (amd64 || arm64)
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// OpenBSD only allows system calls through libc, so pledge(2) and
+// unveil(2) are reached through the runtime's libc call mechanism and the
+// trampolines in sandbox_openbsd_*.s, the same way golang.org/x/sys does.
+
+//go:linkname syscall_syscall syscall.syscall
+func syscall_syscall(fn, a1, a2, a3 uintptr) (r1, r2 uintptr, err syscall.Errno)
+
+var libc_pledge_trampoline_addr uintptr
+var libc_unveil_trampoline_addr uintptr
+
+//go:cgo_import_dynamic libc_pledge pledge "libc.so"
+//go:cgo_import_dynamic libc_unveil unveil "libc.so"
+
+// the promises needed to serve files: reading them, and accepting and
+// making (peer cache) network connections.
+const pledgePromises = "stdio rpath inet dns"
+
+func unveil(path string, permissions string) error {
+	var pathPtr, permissionsPtr *byte
+
+	if path != "" {
+		p, err := syscall.BytePtrFromString(path)
+		if err != nil {
+			return err
+		}
+
+		q, err := syscall.BytePtrFromString(permissions)
+		if err != nil {
+			return err
+		}
+
+		pathPtr, permissionsPtr = p, q
+	}
+
+	_, _, errno := syscall_syscall(
+		libc_unveil_trampoline_addr,
+		uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(unsafe.Pointer(permissionsPtr)),
+		0,
+	)
+
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func pledge(promises string) error {
+	p, err := syscall.BytePtrFromString(promises)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall_syscall(
+		libc_pledge_trampoline_addr,
+		uintptr(unsafe.Pointer(p)),
+		0,
+		0,
+	)
+
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// applySandbox unveils the given paths read-only, hides the rest of the
+// filesystem and pledges the process to the promises a file server needs.
+func applySandbox(storage *fileStore, paths []string) error {
+	for _, path := range paths {
+		if err := unveil(path, "r"); err != nil {
+			return fmt.Errorf("unveil %s: %v", path, err)
+		}
+	}
+
+	// DNS resolution needs these in addition to the "dns" promise.
+	for _, path := range []string{"/etc/resolv.conf", "/etc/hosts"} {
+		if err := unveil(path, "r"); err != nil {
+			return fmt.Errorf("unveil %s: %v", path, err)
+		}
+	}
+
+	if err := unveil("", ""); err != nil {
+		return fmt.Errorf("unveil: %v", err)
+	}
+
+	if err := pledge(pledgePromises); err != nil {
+		return fmt.Errorf("pledge: %v", err)
+	}
+
+	return nil
+}
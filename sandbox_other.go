@@ -0,0 +1,9 @@
+//go:build !((linux || openbsd) && (amd64 || arm64)) && !freebsd
+
+package main
+
+import "errors"
+
+func applySandbox(storage *fileStore, paths []string) error {
+	return errors.New("sandboxing is only supported on Linux and OpenBSD (amd64, arm64) and FreeBSD")
+}
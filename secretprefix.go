@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// newSecretPrefix returns the path prefix that -secret-prefix asks for:
+// a random one for "random", or the given one if it is long enough not to
+// be guessed.
+func newSecretPrefix(value string) (string, error) {
+	if value == "random" {
+		b := make([]byte, 18)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+
+		return "/" + base64.RawURLEncoding.EncodeToString(b), nil
+	}
+
+	if len(value) < 16 || strings.Trim(value, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_") != "" {
+		return "", errors.New("the secret prefix must be at least 16 letters, digits, - or _")
+	}
+
+	return "/" + value, nil
+}
+
+// stripSecretPrefix returns request with prefix taken off its path, so
+// that it is served as if it was for the root. Requests outside of it
+// get a 404, as if nothing was there, and the prefix itself a redirect
+// to the directory URL.
+func stripSecretPrefix(
+	writer http.ResponseWriter,
+	request *http.Request,
+	prefix string,
+) (*http.Request, bool) {
+	trace := requestTraceFrom(request.Context())
+	urlPath := request.URL.Path
+
+	// compared in constant time, so that it can't be found out bit by bit.
+	if len(urlPath) < len(prefix) ||
+	   subtle.ConstantTimeCompare([]byte(urlPath[:len(prefix)]), []byte(prefix)) != 1 ||
+	   len(urlPath) > len(prefix) && urlPath[len(prefix)] != '/' {
+		trace.note("secret prefix", "outside of it, 404")
+		http.Error(writer, "File not found", 404)
+		return request, false
+	}
+
+	if urlPath == prefix {
+		location := prefix + "/"
+		if request.URL.RawQuery != "" {
+			location += "?" + request.URL.RawQuery
+		}
+
+		trace.note("secret prefix", "redirect to %s/", prefix)
+		writer.Header().Set("Location", location)
+		writer.WriteHeader(301)
+		return request, false
+	}
+
+	stripped := request.WithContext(request.Context())
+	u := *request.URL
+	u.Path = urlPath[len(prefix):]
+	u.RawPath = strings.TrimPrefix(u.RawPath, prefix)
+	stripped.URL = &u
+
+	return stripped, true
+}
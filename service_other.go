@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "fmt"
+
+func serviceCommand(args []string) int {
+	fmt.Println("the service command is only supported on Windows")
+	return 1
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The service control manager and event log are driven directly through
+// advapi32, to keep the build free of external dependencies.
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procOpenSCManagerW = advapi32.NewProc("OpenSCManagerW")
+	procCreateServiceW = advapi32.NewProc("CreateServiceW")
+	procOpenServiceW = advapi32.NewProc("OpenServiceW")
+	procDeleteService = advapi32.NewProc("DeleteService")
+	procStartServiceW = advapi32.NewProc("StartServiceW")
+	procControlService = advapi32.NewProc("ControlService")
+	procCloseServiceHandle = advapi32.NewProc("CloseServiceHandle")
+	procStartServiceCtrlDispatcherW = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerExW = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSourceW = advapi32.NewProc("RegisterEventSourceW")
+	procReportEventW = advapi32.NewProc("ReportEventW")
+	procRegCreateKeyExW = advapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueExW = advapi32.NewProc("RegSetValueExW")
+	procRegDeleteKeyW = advapi32.NewProc("RegDeleteKeyW")
+)
+
+const (
+	scManagerAllAccess = 0xf003f
+	serviceAllAccess = 0xf01ff
+
+	serviceWin32OwnProcess = 0x10
+	serviceAutoStart = 2
+	serviceErrorNormal = 1
+
+	serviceStopped = 1
+	serviceStartPending = 2
+	serviceStopPending = 3
+	serviceRunning = 4
+
+	serviceAcceptStop = 1
+	serviceAcceptShutdown = 4
+
+	serviceControlStop = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown = 5
+
+	eventlogErrorType = 1
+	eventlogInformationType = 4
+
+	hkeyLocalMachine = 0x80000002
+	keyWrite = 0x20006
+	regExpandSz = 2
+	regDword = 4
+
+	eventLogKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+)
+
+type serviceStatus struct {
+	serviceType uint32
+	currentState uint32
+	controlsAccepted uint32
+	win32ExitCode uint32
+	serviceSpecificExitCode uint32
+	checkPoint uint32
+	waitHint uint32
+}
+
+type serviceTableEntry struct {
+	serviceName *uint16
+	serviceProc uintptr
+}
+
+// windowsService holds the state of the service while it is run by the
+// service control manager.
+type windowsService struct {
+	name string
+	args []string
+	statusHandle uintptr
+	eventLog uintptr
+	exitCode chan int
+}
+
+var runningService *windowsService
+
+func serviceCommand(args []string) int {
+	usage := func() {
+		fmt.Println("usage: httpd service install|uninstall|start|stop|run [-name name] [-- server flags]")
+	}
+
+	if len(args) == 0 {
+		usage()
+		return 1
+	}
+
+	flags := flag.NewFlagSet("service", flag.ExitOnError)
+	name := flags.String("name", "gohttpd", "service name")
+	flags.Parse(args[1:])
+
+	var err error
+
+	switch args[0] {
+	case "install":
+		err = installService(*name, flags.Args())
+	case "uninstall":
+		err = uninstallService(*name)
+	case "start":
+		err = startService(*name)
+	case "stop":
+		err = stopService(*name)
+	case "run":
+		return runService(*name, flags.Args())
+	default:
+		usage()
+		return 1
+	}
+
+	if err != nil {
+		fmt.Println("service", args[0], "failed: ", err)
+		return 1
+	}
+
+	return 0
+}
+
+func openSCManager() (uintptr, error) {
+	h, _, err := procOpenSCManagerW.Call(0, 0, scManagerAllAccess)
+	if h == 0 {
+		return 0, err
+	}
+
+	return h, nil
+}
+
+func openService(scm uintptr, name string) (uintptr, error) {
+	h, _, err := procOpenServiceW.Call(
+		scm,
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(name))),
+		serviceAllAccess,
+	)
+
+	if h == 0 {
+		return 0, err
+	}
+
+	return h, nil
+}
+
+func installService(name string, serverArgs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmdLine := []string{
+		syscall.EscapeArg(exe), "service", "run",
+		"-name", syscall.EscapeArg(name), "--",
+	}
+
+	for _, arg := range serverArgs {
+		cmdLine = append(cmdLine, syscall.EscapeArg(arg))
+	}
+
+	scm, err := openSCManager()
+	if err != nil {
+		return err
+	}
+
+	defer procCloseServiceHandle.Call(scm)
+
+	h, _, err := procCreateServiceW.Call(
+		scm,
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(name))),
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(name + " web server"))),
+		serviceAllAccess,
+		serviceWin32OwnProcess,
+		serviceAutoStart,
+		serviceErrorNormal,
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(strings.Join(cmdLine, " ")))),
+		0, 0, 0, 0, 0,
+	)
+
+	if h == 0 {
+		return err
+	}
+
+	procCloseServiceHandle.Call(h)
+
+	if err := installEventSource(name); err != nil {
+		return fmt.Errorf("installed, but unable to register event source: %v", err)
+	}
+
+	fmt.Println("* Installed service", name)
+	return nil
+}
+
+// installEventSource registers the service as an event log source, using
+// EventCreate.exe's generic message table so that the logged text shows
+// up in the Event Viewer without a custom message DLL.
+func installEventSource(name string) error {
+	var key syscall.Handle
+	var disposition uint32
+
+	r, _, _ := procRegCreateKeyExW.Call(
+		hkeyLocalMachine,
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(eventLogKey + name))),
+		0, 0, 0,
+		keyWrite,
+		0,
+		uintptr(unsafe.Pointer(&key)),
+		uintptr(unsafe.Pointer(&disposition)),
+	)
+
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+
+	defer syscall.RegCloseKey(key)
+
+	messageFile := syscall.StringToUTF16(`%SystemRoot%\System32\EventCreate.exe`)
+	r, _, _ = procRegSetValueExW.Call(
+		uintptr(key),
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr("EventMessageFile"))),
+		0,
+		regExpandSz,
+		uintptr(unsafe.Pointer(&messageFile[0])),
+		uintptr(len(messageFile) * 2),
+	)
+
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+
+	typesSupported := uint32(eventlogErrorType | eventlogInformationType)
+	r, _, _ = procRegSetValueExW.Call(
+		uintptr(key),
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr("TypesSupported"))),
+		0,
+		regDword,
+		uintptr(unsafe.Pointer(&typesSupported)),
+		4,
+	)
+
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+
+	return nil
+}
+
+func uninstallService(name string) error {
+	scm, err := openSCManager()
+	if err != nil {
+		return err
+	}
+
+	defer procCloseServiceHandle.Call(scm)
+
+	h, err := openService(scm, name)
+	if err != nil {
+		return err
+	}
+
+	defer procCloseServiceHandle.Call(h)
+
+	var status serviceStatus
+	procControlService.Call(h, serviceControlStop, uintptr(unsafe.Pointer(&status)))
+
+	if r, _, err := procDeleteService.Call(h); r == 0 {
+		return err
+	}
+
+	procRegDeleteKeyW.Call(
+		hkeyLocalMachine,
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(eventLogKey + name))),
+	)
+
+	fmt.Println("* Uninstalled service", name)
+	return nil
+}
+
+func startService(name string) error {
+	scm, err := openSCManager()
+	if err != nil {
+		return err
+	}
+
+	defer procCloseServiceHandle.Call(scm)
+
+	h, err := openService(scm, name)
+	if err != nil {
+		return err
+	}
+
+	defer procCloseServiceHandle.Call(h)
+
+	if r, _, err := procStartServiceW.Call(h, 0, 0); r == 0 {
+		return err
+	}
+
+	return nil
+}
+
+func stopService(name string) error {
+	scm, err := openSCManager()
+	if err != nil {
+		return err
+	}
+
+	defer procCloseServiceHandle.Call(scm)
+
+	h, err := openService(scm, name)
+	if err != nil {
+		return err
+	}
+
+	defer procCloseServiceHandle.Call(h)
+
+	var status serviceStatus
+	r, _, err := procControlService.Call(
+		h,
+		serviceControlStop,
+		uintptr(unsafe.Pointer(&status)),
+	)
+
+	if r == 0 {
+		return err
+	}
+
+	return nil
+}
+
+// runService is the entry point when started by the service control
+// manager. It blocks until the service has stopped.
+func runService(name string, serverArgs []string) int {
+	runningService = &windowsService{
+		name: name,
+		args: serverArgs,
+		exitCode: make(chan int, 1),
+	}
+
+	h, _, _ := procRegisterEventSourceW.Call(
+		0,
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(name))),
+	)
+
+	runningService.eventLog = h
+
+	table := []serviceTableEntry{
+		{
+			serviceName: syscall.StringToUTF16Ptr(name),
+			serviceProc: syscall.NewCallback(serviceMain),
+		},
+		{},
+	}
+
+	r, _, err := procStartServiceCtrlDispatcherW.Call(
+		uintptr(unsafe.Pointer(&table[0])),
+	)
+
+	if r == 0 {
+		fmt.Println("unable to start service dispatcher (not run by the service manager?): ", err)
+		return 1
+	}
+
+	select {
+	case code := <-runningService.exitCode:
+		return code
+	default:
+		return 0
+	}
+}
+
+func serviceMain(argc uint32, argv **uint16) uintptr {
+	s := runningService
+
+	s.statusHandle, _, _ = procRegisterServiceCtrlHandlerExW.Call(
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(s.name))),
+		syscall.NewCallback(serviceControlHandler),
+		0,
+	)
+
+	s.setStatus(serviceStartPending, 0)
+
+	// there is no console for a service; send whatever the server prints
+	// to the event log instead.
+	if r, w, err := os.Pipe(); err == nil {
+		os.Stdout = w
+		go s.logOutput(r)
+	}
+
+	done := make(chan int, 1)
+	go func() {
+		done <- serveWithExitCode(s.args)
+	}()
+
+	s.setStatus(serviceRunning, 0)
+
+	code := <-done
+	if code != 0 {
+		s.logEvent(eventlogErrorType, fmt.Sprintf("%s exited with status %d", s.name, code))
+	}
+
+	// give the event log a moment to drain the last lines of output.
+	time.Sleep(100 * time.Millisecond)
+
+	s.exitCode <- code
+	s.setStatus(serviceStopped, uint32(code))
+	return 0
+}
+
+func serviceControlHandler(control, eventType, eventData, context uintptr) uintptr {
+	s := runningService
+
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		s.setStatus(serviceStopPending, 0)
+
+		select {
+		case <-stopServer:
+		default:
+			close(stopServer)
+		}
+	case serviceControlInterrogate:
+	default:
+		return 120 // ERROR_CALL_NOT_IMPLEMENTED
+	}
+
+	return 0
+}
+
+func (s *windowsService) setStatus(state uint32, exitCode uint32) {
+	status := serviceStatus{
+		serviceType: serviceWin32OwnProcess,
+		currentState: state,
+		win32ExitCode: exitCode,
+	}
+
+	if state == serviceRunning {
+		status.controlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	}
+
+	if state == serviceStartPending || state == serviceStopPending {
+		status.waitHint = uint32((shutdownTimeout + 5 * time.Second) / time.Millisecond)
+	}
+
+	procSetServiceStatus.Call(s.statusHandle, uintptr(unsafe.Pointer(&status)))
+}
+
+func (s *windowsService) logOutput(r *os.File) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		s.logEvent(eventlogInformationType, scanner.Text())
+	}
+}
+
+func (s *windowsService) logEvent(eventType uint16, message string) {
+	if s.eventLog == 0 {
+		return
+	}
+
+	strs := []*uint16{syscall.StringToUTF16Ptr(message)}
+
+	procReportEventW.Call(
+		s.eventLog,
+		uintptr(eventType),
+		0,
+		1, // EventCreate.exe's message ids 1-1000 all print "%1"
+		0,
+		1,
+		0,
+		uintptr(unsafe.Pointer(&strs[0])),
+		0,
+	)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the query parameters of a signed URL.
+const (
+	signedExpiresParam = "expires"
+	signedSignatureParam = "signature"
+)
+
+// signedURLs checks URLs signed with "httpd sign", which carry their
+// expiry as a Unix time and an HMAC-SHA256 of the path and expiry. A
+// valid signature stands in for credentials, so that links to protected
+// files can be handed out for a while; paths matching paths are only
+// served with one.
+type signedURLs struct {
+	key []byte
+	paths []string
+}
+
+// loadSigningKey reads the key URLs are signed with from the file at
+// path.
+func loadSigningKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	key = bytes.TrimSpace(key)
+	if err == nil && len(key) < 32 {
+		err = errors.New("the URL signing key must be at least 32 bytes")
+	}
+
+	return key, err
+}
+
+func urlSignature(key []byte, urlPath string, expires string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(urlPath + "\n" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signURL returns the query string that signs urlPath until expires.
+func signURL(key []byte, urlPath string, expires time.Time) string {
+	expiresStr := strconv.FormatInt(expires.Unix(), 10)
+
+	query := url.Values{}
+	query.Set(signedExpiresParam, expiresStr)
+	query.Set(signedSignatureParam, urlSignature(key, urlPath, expiresStr))
+	return query.Encode()
+}
+
+// verify reports whether request carries a signature, and returns why it
+// isn't valid if it is wrong or has expired.
+func (s *signedURLs) verify(request *http.Request) (bool, error) {
+	query := request.URL.Query()
+
+	signature := query.Get(signedSignatureParam)
+	if signature == "" {
+		return false, nil
+	}
+
+	expiresStr := query.Get(signedExpiresParam)
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil {
+		return true, errors.New("invalid expiry")
+	}
+
+	expected := urlSignature(s.key, request.URL.Path, expiresStr)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return true, errors.New("invalid signature")
+	}
+
+	if time.Now().Unix() > expires {
+		return true, fmt.Errorf("expired at %s", time.Unix(expires, 0).UTC().Format(time.RFC3339))
+	}
+
+	return true, nil
+}
+
+// valid reports whether request has a valid signature.
+func (s *signedURLs) valid(request *http.Request) bool {
+	if s == nil {
+		return false
+	}
+
+	signed, err := s.verify(request)
+	return signed && err == nil
+}
+
+// check answers requests with a wrong or expired signature, or without
+// one for a path that needs it, with a 403, and lets the rest through.
+func (s *signedURLs) check(writer http.ResponseWriter, request *http.Request, opts *serverOptions) bool {
+	trace := requestTraceFrom(request.Context())
+
+	signed, err := s.verify(request)
+	switch {
+	case err != nil:
+		trace.note("signed URL", "%v, 403", err)
+	case signed:
+		trace.note("signed URL", "valid")
+		return true
+	case pathMatchesAny(s.paths, request.URL.Path, opts):
+		trace.note("signed URL", "signature required, 403")
+	default:
+		return true
+	}
+
+	http.Error(writer, "Forbidden", 403)
+	return false
+}
+
+// signCommand implements "httpd sign", which prints signed URLs for the
+// given paths.
+func signCommand(args []string) int {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyFile := flags.String("key-file", "", "file holding the key, as given to -url-signing-key-file")
+	expires := flags.Duration("expires", 24 * time.Hour, "how long the URLs are valid for")
+	base := flags.String("base", "", "URL of the server to prefix the paths with, e.g. https://example.com")
+	flags.Usage = func() {
+		fmt.Println("usage: httpd sign -key-file file [-expires 24h] [-base url] /path...")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if *keyFile == "" || flags.NArg() == 0 || *expires <= 0 {
+		flags.Usage()
+		return 1
+	}
+
+	key, err := loadSigningKey(*keyFile)
+	if err != nil {
+		fmt.Println("unable to load key: ", err)
+		return 1
+	}
+
+	until := time.Now().Add(*expires)
+
+	for _, urlPath := range flags.Args() {
+		if !strings.HasPrefix(urlPath, "/") {
+			fmt.Println("not a URL path: ", urlPath)
+			return 1
+		}
+
+		u := &url.URL{Path: urlPath, RawQuery: signURL(key, urlPath, until)}
+		fmt.Println(strings.TrimSuffix(*base, "/") + u.String())
+	}
+
+	return 0
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// signedRequest returns a request for urlPath with the query string q.
+func signedRequest(t *testing.T, urlPath string, q string) *http.Request {
+	request, err := http.NewRequest("GET", "http://localhost" + urlPath + "?" + q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return request
+}
+
+func TestSignedURLs(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	s := &signedURLs{key: key}
+
+	valid := signURL(key, "/private/report.pdf", time.Now().Add(time.Hour))
+	if !s.valid(signedRequest(t, "/private/report.pdf", valid)) {
+		t.Fatal("a fresh signature was refused")
+	}
+
+	query, _ := url.ParseQuery(valid)
+	signature := query.Get(signedSignatureParam)
+	expires := query.Get(signedExpiresParam)
+
+	later, _ := strconv.ParseInt(expires, 10, 64)
+	tamperedExpiry := url.Values{
+		signedExpiresParam: {strconv.FormatInt(later + 3600, 10)},
+		signedSignatureParam: {signature},
+	}
+
+	flipped := []byte(signature)
+	flipped[len(flipped) - 1] ^= 1
+
+	tests := []struct {
+		name string
+		urlPath string
+		query string
+	}{
+		{"expired", "/private/report.pdf", signURL(key, "/private/report.pdf", time.Now().Add(-time.Minute))},
+		{"other path", "/private/other.pdf", valid},
+		{"parent directory", "/private/", valid},
+		{"tampered expiry", "/private/report.pdf", tamperedExpiry.Encode()},
+		{"changed signature", "/private/report.pdf", url.Values{
+			signedExpiresParam: {expires},
+			signedSignatureParam: {string(flipped)},
+		}.Encode()},
+		{"truncated signature", "/private/report.pdf", url.Values{
+			signedExpiresParam: {expires},
+			signedSignatureParam: {signature[:len(signature) - 1]},
+		}.Encode()},
+		{"other key", "/private/report.pdf", signURL(make([]byte, 32), "/private/report.pdf", time.Now().Add(time.Hour))},
+		{"invalid expiry", "/private/report.pdf", url.Values{
+			signedExpiresParam: {"tomorrow"},
+			signedSignatureParam: {signature},
+		}.Encode()},
+	}
+
+	for _, test := range tests {
+		request := signedRequest(t, test.urlPath, test.query)
+
+		signed, err := s.verify(request)
+		if !signed || err == nil {
+			t.Errorf("%s: got signed %v, error %v, expected a refused signature", test.name, signed, err)
+		}
+
+		if s.valid(request) {
+			t.Errorf("%s: signature accepted", test.name)
+		}
+	}
+}
+
+func TestUnsignedRequests(t *testing.T) {
+	s := &signedURLs{key: make([]byte, 32), paths: []string{"/downloads"}}
+
+	request := signedRequest(t, "/downloads/a.iso", "")
+	if signed, err := s.verify(request); signed || err != nil {
+		t.Errorf("unsigned request: got signed %v, error %v", signed, err)
+	}
+
+	recorder := httptest.NewRecorder()
+	if s.check(recorder, request, &serverOptions{}) || recorder.Code != 403 {
+		t.Errorf("unsigned request for a signed path got status %d, expected 403", recorder.Code)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// how much longer than the minimum send rate allows any write may take,
+// and the most sent with a single deadline.
+const (
+	minSendRateGrace = 10 * time.Second
+	minSendRateChunk = 256 << 10
+)
+
+// minRateListener hands out connections that are aborted when their
+// client reads responses slower than rate bytes per second.
+type minRateListener struct {
+	net.Listener
+	rate int64
+}
+
+func (l *minRateListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &minRateConn{Conn: conn, rate: l.rate}, nil
+}
+
+// minRateConn gives every write a deadline of the time its size takes at
+// the minimum rate, plus some grace, so that a client that stops reading
+// or reads a few bytes at a time is cut off instead of holding on to a
+// socket and goroutine for as long as it likes.
+type minRateConn struct {
+	net.Conn
+	rate int64
+}
+
+func (c *minRateConn) setDeadline(size int64) {
+	c.Conn.SetWriteDeadline(time.Now().Add(
+		minSendRateGrace + time.Duration(size * int64(time.Second) / c.rate),
+	))
+}
+
+func (c *minRateConn) Write(p []byte) (int, error) {
+	c.setDeadline(int64(len(p)))
+	return c.Conn.Write(p)
+}
+
+// ReadFrom sends r in chunks with a deadline each, which keeps files
+// going out with sendfile.
+func (c *minRateConn) ReadFrom(r io.Reader) (int64, error) {
+	var sent int64
+
+	for {
+		c.setDeadline(minSendRateChunk)
+		n, err := io.Copy(c.Conn, io.LimitReader(r, minSendRateChunk))
+		sent += n
+
+		if err != nil || n < minSendRateChunk {
+			return sent, err
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// number of recent requests kept for display.
+const statsRecentRequests = 20
+
+// upper bound on distinct paths and clients tracked for the top paths and
+// clients tables; when it is reached the least requested half is dropped.
+const statsMaxKeys = 10000
+
+type requestRecord struct {
+	time time.Time
+	client string
+	method string
+	path string
+	status int
+	bytes int64
+	aborted bool
+}
+
+type statsBucket struct {
+	second int64
+	requests int64
+	bytes int64
+}
+
+// keyCount is the number of requests for a path or from a client.
+type keyCount struct {
+	key string
+	count int64
+}
+
+// requestStats keeps in-memory counters about served requests: totals,
+// per-second rates over the last minute, status classes, the most
+// requested paths, the clients making the most requests and the last few
+// requests.
+type requestStats struct {
+	mu sync.Mutex
+	started time.Time
+	requests int64
+	bytes int64
+	statusClasses [6]int64
+	aborted int64
+	buckets [60]statsBucket
+	paths map[string]int64
+	clients map[string]int64
+	recent []requestRecord
+}
+
+type statsSnapshot struct {
+	uptime time.Duration
+	requests int64
+	bytes int64
+	statusClasses [6]int64
+	aborted int64
+	lastRequestRate float64
+	lastByteRate float64
+	avgRequestRate float64
+	avgByteRate float64
+	topPaths []keyCount
+	topClients []keyCount
+	recent []requestRecord
+}
+
+func newRequestStats() *requestStats {
+	return &requestStats{
+		started: time.Now(),
+		paths: map[string]int64{},
+		clients: map[string]int64{},
+	}
+}
+
+func (s *requestStats) record(r requestRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	s.bytes += r.bytes
+
+	if class := r.status / 100; class >= 1 && class <= 5 {
+		s.statusClasses[class]++
+	}
+
+	if r.aborted {
+		s.aborted++
+	}
+
+	second := r.time.Unix()
+	bucket := &s.buckets[second % int64(len(s.buckets))]
+	if bucket.second != second {
+		*bucket = statsBucket{second: second}
+	}
+
+	bucket.requests++
+	bucket.bytes += r.bytes
+
+	countKey(s.paths, r.path)
+	countKey(s.clients, r.client)
+
+	s.recent = append(s.recent, r)
+	if len(s.recent) > statsRecentRequests {
+		s.recent = s.recent[1:]
+	}
+}
+
+// countKey counts a request for key in counts, first dropping the less
+// requested half of the keys when there are too many.
+func countKey(counts map[string]int64, key string) {
+	if _, ok := counts[key]; !ok && len(counts) >= statsMaxKeys {
+		values := make([]int64, 0, len(counts))
+		for _, count := range counts {
+			values = append(values, count)
+		}
+
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+		median := values[len(values) / 2]
+
+		for k, count := range counts {
+			if count <= median {
+				delete(counts, k)
+			}
+		}
+	}
+
+	counts[key]++
+}
+
+// topKeys returns the n keys of counts with the most requests.
+func topKeys(counts map[string]int64, n int) []keyCount {
+	var top []keyCount
+	for key, count := range counts {
+		top = append(top, keyCount{key: key, count: count})
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].count != top[j].count {
+			return top[i].count > top[j].count
+		}
+
+		return top[i].key < top[j].key
+	})
+
+	if len(top) > n {
+		top = top[:n]
+	}
+
+	return top
+}
+
+func (s *requestStats) snapshot(topN int) statsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	snap := statsSnapshot{
+		uptime: now.Sub(s.started).Truncate(time.Second),
+		requests: s.requests,
+		bytes: s.bytes,
+		statusClasses: s.statusClasses,
+		aborted: s.aborted,
+		recent: append([]requestRecord(nil), s.recent...),
+	}
+
+	// the current second is still filling up, so rates are computed from
+	// the complete seconds before it.
+	current := now.Unix()
+	for _, bucket := range s.buckets {
+		if bucket.second >= current || bucket.second < current - int64(len(s.buckets)) {
+			continue
+		}
+
+		if bucket.second == current - 1 {
+			snap.lastRequestRate = float64(bucket.requests)
+			snap.lastByteRate = float64(bucket.bytes)
+		}
+
+		snap.avgRequestRate += float64(bucket.requests)
+		snap.avgByteRate += float64(bucket.bytes)
+	}
+
+	snap.avgRequestRate /= float64(len(s.buckets))
+	snap.avgByteRate /= float64(len(s.buckets))
+
+	snap.topPaths = topKeys(s.paths, topN)
+	snap.topClients = topKeys(s.clients, topN)
+
+	return snap
+}
+
+// formatBytes formats a byte count with a binary unit, e.g. "1.5 MB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(n) / float64(div), "KMGTPE"[exp])
+}
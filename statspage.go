@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// how many paths and clients the stats page lists, and how often it
+// reloads itself, in seconds.
+const (
+	statsPageTop = 10
+	statsPageRefresh = 2
+)
+
+type statsPageInfo struct {
+	Refresh int
+	Uptime time.Duration
+	Requests int64
+	Bytes int64
+	RequestRate float64
+	RequestRateAvg float64
+	ByteRate int64
+	ByteRateAvg int64
+	Statuses []statsPageCount
+	Aborted int64
+	TopPaths []statsPageCount
+	TopClients []statsPageCount
+	Recent []statsPageRequest
+}
+
+type statsPageCount struct {
+	Key string
+	Count int64
+}
+
+type statsPageRequest struct {
+	Time time.Time
+	Client string
+	Method string
+	Status int
+	Bytes int64
+	Path string
+}
+
+func statsPageCounts(top []keyCount) []statsPageCount {
+	counts := make([]statsPageCount, 0, len(top))
+	for _, entry := range top {
+		counts = append(counts, statsPageCount{Key: entry.key, Count: entry.count})
+	}
+
+	return counts
+}
+
+var statsPageTemplate = template.Must(template.New("stats").Funcs(template.FuncMap{
+	"formatBytes": formatBytes,
+	"clock": func(t time.Time) string { return t.Format("15:04:05") },
+}).Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+  <title>Server statistics</title>
+  <meta http-equiv="refresh" content="{{ .Refresh }}">
+  <meta name="viewport" content="width=device-width, initial-scale=1.0">
+  <meta name="color-scheme" content="light dark">
+  <style>
+    .main {
+      max-width: 992px;
+      margin: 0 auto;
+      font-family: sans-serif;
+    }
+    table {
+      border-collapse: collapse;
+      margin-bottom: 1.5em;
+    }
+    th, td {
+      text-align: left;
+      padding: 0.2em 1em 0.2em 0;
+    }
+    td.n {
+      text-align: right;
+      font-variant-numeric: tabular-nums;
+    }
+    .columns {
+      display: flex;
+      flex-wrap: wrap;
+      gap: 2em;
+    }
+    .muted {
+      opacity: 0.6;
+    }
+  </style>
+</head>
+<body>
+  <div class="main">
+    <h2>Server statistics</h2>
+    <p class="muted">Up {{ .Uptime }}, reloading every {{ .Refresh }} seconds.</p>
+    <table>
+      <tr><th></th><th>total</th><th>last second</th><th>last minute</th></tr>
+      <tr><td>requests</td><td class="n">{{ .Requests }}</td><td class="n">{{ printf "%.1f" .RequestRate }}/s</td><td class="n">{{ printf "%.1f" .RequestRateAvg }}/s</td></tr>
+      <tr><td>bandwidth</td><td class="n">{{ formatBytes .Bytes }}</td><td class="n">{{ formatBytes .ByteRate }}/s</td><td class="n">{{ formatBytes .ByteRateAvg }}/s</td></tr>
+    </table>
+    <table>
+      <tr>{{ range .Statuses }}<th>{{ .Key }}</th>{{ end }}<th>aborted</th></tr>
+      <tr>{{ range .Statuses }}<td class="n">{{ .Count }}</td>{{ end }}<td class="n">{{ .Aborted }}</td></tr>
+    </table>
+    <div class="columns">
+      <table>
+        <tr><th>top paths</th><th></th></tr>
+        {{ range .TopPaths }}<tr><td class="n">{{ .Count }}</td><td>{{ .Key }}</td></tr>
+        {{ end }}
+      </table>
+      <table>
+        <tr><th>top clients</th><th></th></tr>
+        {{ range .TopClients }}<tr><td class="n">{{ .Count }}</td><td>{{ .Key }}</td></tr>
+        {{ end }}
+      </table>
+    </div>
+    <table>
+      <tr><th>recent requests</th><th></th><th></th><th></th><th></th><th></th></tr>
+      {{ range .Recent }}<tr><td>{{ clock .Time }}</td><td>{{ .Client }}</td><td>{{ .Method }}</td><td class="n">{{ .Status }}</td><td class="n">{{ formatBytes .Bytes }}</td><td>{{ .Path }}</td></tr>
+      {{ end }}
+    </table>
+  </div>
+</body>
+</html>`))
+
+// serveStatsPage answers the admin endpoint /stats with a page of what
+// the server is busy with, from the same counters as the status screen,
+// which reloads itself; with ?format=json, the same as JSON.
+func serveStatsPage(writer http.ResponseWriter, request *http.Request, stats *requestStats) {
+	snap := stats.snapshot(statsPageTop)
+
+	writer.Header().Set("Cache-Control", "no-store")
+
+	if wantsJSON(request) {
+		// top lists stay in order, most requests first.
+		counts := func(top []keyCount, name string) []map[string]any {
+			list := []map[string]any{}
+			for _, entry := range top {
+				list = append(list, map[string]any{name: entry.key, "requests": entry.count})
+			}
+
+			return list
+		}
+
+		statuses := map[string]int64{}
+		for class := 1; class <= 5; class++ {
+			statuses[fmt.Sprintf("%dxx", class)] = snap.statusClasses[class]
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(map[string]any{
+			"uptime_seconds": int64(snap.uptime.Seconds()),
+			"requests": snap.requests,
+			"bytes": snap.bytes,
+			"requests_per_second": snap.lastRequestRate,
+			"requests_per_second_1m": snap.avgRequestRate,
+			"bytes_per_second": int64(snap.lastByteRate),
+			"bytes_per_second_1m": int64(snap.avgByteRate),
+			"statuses": statuses,
+			"aborted": snap.aborted,
+			"top_paths": counts(snap.topPaths, "path"),
+			"top_clients": counts(snap.topClients, "client"),
+		})
+
+		return
+	}
+
+	info := statsPageInfo{
+		Refresh: statsPageRefresh,
+		Uptime: snap.uptime,
+		Requests: snap.requests,
+		Bytes: snap.bytes,
+		RequestRate: snap.lastRequestRate,
+		RequestRateAvg: snap.avgRequestRate,
+		ByteRate: int64(snap.lastByteRate),
+		ByteRateAvg: int64(snap.avgByteRate),
+		Aborted: snap.aborted,
+		TopPaths: statsPageCounts(snap.topPaths),
+		TopClients: statsPageCounts(snap.topClients),
+	}
+
+	for class := 1; class <= 5; class++ {
+		info.Statuses = append(info.Statuses, statsPageCount{
+			Key: fmt.Sprintf("%dxx", class),
+			Count: snap.statusClasses[class],
+		})
+	}
+
+	// newest first
+	for i := len(snap.recent) - 1; i >= 0; i-- {
+		r := snap.recent[i]
+		info.Recent = append(info.Recent, statsPageRequest{
+			Time: r.time,
+			Client: r.client,
+			Method: r.method,
+			Status: r.status,
+			Bytes: r.bytes,
+			Path: r.path,
+		})
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statsPageTemplate.Execute(writer, info); err != nil {
+		errorLog.print(request, "unable to render stats page: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// bounds of the delay before a failed subsystem is restarted, which
+// doubles with every failure in a row.
+const (
+	restartMinDelay = time.Second
+	restartMaxDelay = time.Minute
+)
+
+// subsystems runs the server's background jobs.
+var subsystems = &supervisor{}
+
+// supervisor runs background jobs, such as log pruning, that would
+// otherwise stop silently when they panic or fail, and restarts them
+// with a growing delay. A job that runs for restartMaxDelay without
+// failing starts over with the shortest delay.
+type supervisor struct {
+	mu sync.Mutex
+	jobs []*subsystemStatus
+}
+
+// subsystemStatus is the health of a supervised job.
+type subsystemStatus struct {
+	Name string `json:"name"`
+	Running bool `json:"running"`
+	Restarts int `json:"restarts"`
+	LastError string `json:"last_error,omitempty"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+}
+
+// start runs fn as a supervised job named name. It is restarted whenever
+// it panics or returns an error, and left stopped when it returns nil.
+func (s *supervisor) start(name string, fn func() error) {
+	status := &subsystemStatus{Name: name, Running: true}
+
+	s.mu.Lock()
+	s.jobs = append(s.jobs, status)
+	s.mu.Unlock()
+
+	go func() {
+		delay := restartMinDelay
+
+		for {
+			started := time.Now()
+			err := runRecovered(fn)
+
+			s.mu.Lock()
+			if err == nil {
+				status.Running = false
+				s.mu.Unlock()
+				return
+			}
+
+			if time.Since(started) >= restartMaxDelay {
+				delay = restartMinDelay
+			}
+
+			status.Restarts++
+			status.LastError = err.Error()
+			status.LastFailure = time.Now()
+			s.mu.Unlock()
+
+			fmt.Printf("%s failed, restarting in %v: %v\n", name, delay, err)
+			time.Sleep(delay)
+
+			delay = min(delay * 2, restartMaxDelay)
+		}
+	}()
+}
+
+// status returns the health of every supervised job.
+func (s *supervisor) status() []subsystemStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]subsystemStatus, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		statuses = append(statuses, *job)
+	}
+
+	return statuses
+}
+
+// runRecovered calls fn, turning a panic into an error.
+func runRecovered(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+
+	return fn()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// the -follow-symlinks policies: follow every symlink, only those that
+// stay inside the home directory, or none.
+var symlinkPolicies = []string {"all", "safe", "off"}
+
+// checkSymlinks applies the symlink policy to rel, a path in root,
+// returning a not-exist error if it goes through a symlink the policy
+// doesn't follow. Roots keep symlinks inside themselves already, which is
+// all that safe asks for, so only off needs checking.
+func (s *fileStore) checkSymlinks(root *os.Root, rel string) error {
+	if s.symlinks != "off" || root == nil {
+		return nil
+	}
+
+	for p := filepath.Clean(rel); p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+		stat, err := root.Lstat(p)
+
+		// what doesn't exist is left for the caller to find out.
+		if err != nil {
+			return nil
+		}
+
+		if stat.Mode() & fs.ModeSymlink != 0 {
+			return &fs.PathError{Op: "open", Path: rel, Err: fs.ErrNotExist}
+		}
+	}
+
+	return nil
+}
+
+// refuseEscapes turns the error of a root refusing to follow a symlink out
+// of itself, which os has no exported error for, into a not-exist error,
+// so that such links are treated like any other refused one.
+func refuseEscapes(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) && pathErr.Err.Error() == "path escapes from parent" {
+		return &fs.PathError{Op: pathErr.Op, Path: pathErr.Path, Err: fs.ErrNotExist}
+	}
+
+	return err
+}
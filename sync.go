@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errNotListed is returned for upstream directories that can't be listed,
+// such as ones with a .nolist file.
+var errNotListed = errors.New("directory not listed")
+
+// syncer keeps a local tree updated from another gohttpd's JSON listings,
+// which the upstream serves with -listdir.
+type syncer struct {
+	client *http.Client
+	upstream *url.URL
+	delete bool
+	dryRun bool
+
+	fetched int
+	deleted int
+	failed int
+}
+
+// fetchListing returns every entry of the upstream directory at urlPath,
+// following the listing's pages.
+func (s *syncer) fetchListing(urlPath string) ([]jsonListingEntry, error) {
+	var entries []jsonListingEntry
+
+	for page := 1; ; page++ {
+		u := *s.upstream
+		u.Path = strings.TrimSuffix(u.Path, "/") + urlPath
+		u.RawQuery = "format=json&per_page=" + strconv.Itoa(maxListPageSize) +
+			"&page=" + strconv.Itoa(page)
+
+		response, err := s.client.Get(u.String())
+		if err != nil {
+			return nil, err
+		}
+
+		var listing jsonListing
+		if response.StatusCode == 200 {
+			err = json.NewDecoder(response.Body).Decode(&listing)
+		} else if response.StatusCode == 403 || response.StatusCode == 404 {
+			err = errNotListed
+		} else {
+			err = fmt.Errorf("%s: %s", u.String(), response.Status)
+		}
+
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, listing.Entries...)
+
+		if listing.PerPage == 0 || len(listing.Entries) == 0 ||
+		   page * listing.PerPage >= listing.Total {
+			return entries, nil
+		}
+	}
+}
+
+// syncDir brings the local directory dir up to date with the upstream
+// directory at urlPath, and then its subdirectories.
+func (s *syncer) syncDir(urlPath string, dir string) error {
+	entries, err := s.fetchListing(urlPath)
+	if err != nil {
+		return err
+	}
+
+	if !s.dryRun {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	upstream := map[string]bool{}
+
+	for _, entry := range entries {
+		// names come from another server, so they must not lead outside
+		// of dir.
+		if entry.Name == "" || entry.Name == ".." || strings.ContainsAny(entry.Name, "/\\") ||
+		   isHiddenPath(entry.Name) {
+			fmt.Println("skipping invalid name in", urlPath + ":", entry.Name)
+			continue
+		}
+
+		upstream[entry.Name] = true
+		path := filepath.Join(dir, entry.Name)
+		entryURL := urlPath + entry.Name
+
+		if entry.Type == "directory" {
+			err := s.syncDir(entryURL + "/", path)
+			if err == errNotListed {
+				fmt.Println("skipping unlisted directory", entryURL + "/")
+			} else if err != nil {
+				fmt.Println("unable to sync", entryURL + "/:", err)
+				s.failed++
+			}
+
+			continue
+		}
+
+		stat, err := os.Stat(path)
+		if err == nil && stat.Mode().IsRegular() && stat.Size() == entry.Size &&
+		   stat.ModTime().Truncate(time.Second).Equal(entry.ModTime) {
+			continue
+		}
+
+		fmt.Println(path)
+		if s.dryRun {
+			s.fetched++
+			continue
+		}
+
+		if err := s.fetchFile(entryURL, path, entry); err != nil {
+			fmt.Println("unable to fetch", entryURL + ":", err)
+			s.failed++
+			continue
+		}
+
+		s.fetched++
+	}
+
+	if s.delete {
+		return s.deleteExtra(dir, upstream)
+	}
+
+	return nil
+}
+
+// fetchFile downloads the upstream file at urlPath next to path and then
+// renames it into place, so that the file being served is never partial.
+func (s *syncer) fetchFile(urlPath string, path string, entry jsonListingEntry) error {
+	u := *s.upstream
+	u.Path = strings.TrimSuffix(u.Path, "/") + urlPath
+
+	response, err := s.client.Get(u.String())
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return fmt.Errorf("%s", response.Status)
+	}
+
+	// the temporary file is hidden, so that it isn't served meanwhile.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".sync-*")
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(tmp, response.Body)
+	if err == nil && response.ContentLength >= 0 && n != response.ContentLength {
+		err = fmt.Errorf("expected %d bytes, got %d", response.ContentLength, n)
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), time.Now(), entry.ModTime)
+	}
+
+	if err == nil {
+		// a directory in the way is replaced by the file, as upstream.
+		if stat, statErr := os.Lstat(path); statErr == nil && stat.IsDir() {
+			err = os.RemoveAll(path)
+		}
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// deleteExtra removes the entries of dir that upstream doesn't have,
+// except hidden ones, which upstream doesn't list.
+func (s *syncer) deleteExtra(dir string, upstream map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) && s.dryRun {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if upstream[entry.Name()] || isHiddenPath(entry.Name()) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		fmt.Println("deleting", path)
+		s.deleted++
+
+		if !s.dryRun {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// syncCommand implements "httpd sync", which mirrors the tree served by
+// another gohttpd with -listdir into a local directory, once or at an
+// interval, so that the local server can act as its replica.
+func syncCommand(args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	interval := flags.Duration(
+		"interval",
+		0,
+		"keep syncing at this interval instead of syncing once",
+	)
+	deleteExtra := flags.Bool(
+		"delete",
+		false,
+		"delete local files and directories that upstream doesn't have",
+	)
+	dryRun := flags.Bool("n", false, "only print the files that would be fetched or deleted")
+	timeout := flags.Duration(
+		"timeout",
+		time.Hour,
+		"time limit for fetching a single listing or file",
+	)
+	flags.Usage = func() {
+		fmt.Println("usage: httpd sync [flags] upstream-url directory")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 1
+	}
+
+	upstream, err := url.Parse(flags.Arg(0))
+	if err != nil || (upstream.Scheme != "http" && upstream.Scheme != "https") {
+		fmt.Println("invalid upstream URL: ", flags.Arg(0))
+		return 1
+	}
+
+	s := &syncer{
+		client: &http.Client{Timeout: *timeout},
+		upstream: upstream,
+		delete: *deleteExtra,
+		dryRun: *dryRun,
+	}
+
+	for {
+		s.fetched, s.deleted, s.failed = 0, 0, 0
+		err := s.syncDir("/", flags.Arg(1))
+
+		if err != nil {
+			fmt.Println("unable to sync: ", err)
+		}
+
+		fmt.Printf("%d fetched, %d deleted, %d failed\n", s.fetched, s.deleted, s.failed)
+
+		if *interval <= 0 {
+			if err != nil || s.failed > 0 {
+				return 1
+			}
+
+			return 0
+		}
+
+		time.Sleep(*interval)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// the syslog facilities of RFC 5424 by name.
+var syslogFacilities = map[string]int {
+	"kern": 0,
+	"user": 1,
+	"mail": 2,
+	"daemon": 3,
+	"auth": 4,
+	"syslog": 5,
+	"lpr": 6,
+	"news": 7,
+	"uucp": 8,
+	"cron": 9,
+	"authpriv": 10,
+	"ftp": 11,
+	"local0": 16,
+	"local1": 17,
+	"local2": 18,
+	"local3": 19,
+	"local4": 20,
+	"local5": 21,
+	"local6": 22,
+	"local7": 23,
+}
+
+// parseSyslogAddress splits an address given to -syslog, which is "local"
+// for the local daemon or a URL like udp://host:514, tcp://host:514 or
+// unix:///dev/log, into the network and address to dial.
+func parseSyslogAddress(address string) (string, string, error) {
+	if address == "local" {
+		return "", "", nil
+	}
+
+	network, addr, ok := strings.Cut(address, "://")
+	switch {
+	case !ok || addr == "":
+	case network == "udp" || network == "tcp":
+		if !strings.Contains(addr, ":") {
+			addr += ":514"
+		}
+
+		return network, addr, nil
+	case network == "unix":
+		// the daemon's socket is a datagram socket, though some listen
+		// on a stream socket instead.
+		return "unixgram", addr, nil
+	}
+
+	return "", "", fmt.Errorf("expected local, udp://host:port, tcp://host:port or unix:///path, got %q", address)
+}
+
+// syslogLineWriter sends what is written to it to syslog with send, as a
+// message per line.
+type syslogLineWriter struct {
+	mu sync.Mutex
+	send func(string) error
+	partial []byte
+}
+
+func (w *syslogLineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+
+		if line := string(bytes.TrimRight(w.partial[:i], "\r")); line != "" {
+			w.send(line)
+		}
+
+		w.partial = w.partial[i + 1:]
+	}
+}
+
+// redirectOutput points *file, which is os.Stdout or os.Stderr, to a pipe
+// that copies what the server prints to w, the way the Windows service
+// sends it to the event log.
+func redirectOutput(file **os.File, w io.Writer) error {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	*file = pw
+	go io.Copy(w, r)
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// syslogLog can't be opened where there is no syslog; the Windows
+// service logs to the event log instead.
+type syslogLog struct{}
+
+func openSyslog(address string, facility string, tag string) (*syslogLog, error) {
+	return nil, errors.New("syslog is only supported on Unix")
+}
+
+func (l *syslogLog) info() io.Writer {
+	return io.Discard
+}
+
+func (l *syslogLog) notice() io.Writer {
+	return io.Discard
+}
+
+func (l *syslogLog) err() io.Writer {
+	return io.Discard
+}
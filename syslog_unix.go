@@ -0,0 +1,47 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+)
+
+// syslogLog sends logs to a syslog daemon with the facility and tag given
+// to -syslog-facility and -syslog-tag.
+type syslogLog struct {
+	w *syslog.Writer
+}
+
+func openSyslog(address string, facility string, tag string) (*syslogLog, error) {
+	network, addr, err := parseSyslogAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	f, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown facility %q", facility)
+	}
+
+	w, err := syslog.Dial(network, addr, syslog.Priority(f << 3) | syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogLog{w}, nil
+}
+
+// info, notice and err return writers that send lines with that severity.
+func (l *syslogLog) info() io.Writer {
+	return &syslogLineWriter{send: l.w.Info}
+}
+
+func (l *syslogLog) notice() io.Writer {
+	return &syslogLineWriter{send: l.w.Notice}
+}
+
+func (l *syslogLog) err() io.Writer {
+	return &syslogLineWriter{send: l.w.Err}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type requestTraceKey struct{}
+
+// requestTrace collects the decisions made while serving a request, for
+// /_debug/trace. Requests that aren't traced have a nil trace, which
+// ignores notes. A dry run is a traced request that isn't really served,
+// which must not change what happens to real ones, such as by taking
+// rate limit tokens.
+type requestTrace struct {
+	mu sync.Mutex
+	steps []traceStep
+	dryRun bool
+}
+
+type traceStep struct {
+	Stage string `json:"stage"`
+	Decision string `json:"decision"`
+}
+
+func withRequestTrace(ctx context.Context, trace *requestTrace) context.Context {
+	return context.WithValue(ctx, requestTraceKey{}, trace)
+}
+
+func requestTraceFrom(ctx context.Context) *requestTrace {
+	trace, _ := ctx.Value(requestTraceKey{}).(*requestTrace)
+	return trace
+}
+
+func (t *requestTrace) note(stage string, format string, args ...any) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.steps = append(t.steps, traceStep{Stage: stage, Decision: fmt.Sprintf(format, args...)})
+}
+
+// last returns the most recent decision, or an empty step if there is
+// none.
+func (t *requestTrace) last() traceStep {
+	if t == nil {
+		return traceStep{}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.steps) == 0 {
+		return traceStep{}
+	}
+
+	return t.steps[len(t.steps) - 1]
+}
+
+// traceRecorder is the response writer of a traced request. It keeps the
+// status and headers, and as soon as the body starts, which is when every
+// decision has been made, it cancels the request so that e.g. a large
+// file isn't read to the end.
+type traceRecorder struct {
+	header http.Header
+	status int
+	cancel context.CancelFunc
+}
+
+func (r *traceRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *traceRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *traceRecorder) Write(p []byte) (int, error) {
+	r.WriteHeader(200)
+	r.cancel()
+	return len(p), nil
+}
+
+type traceResult struct {
+	Method string `json:"method"`
+	URL string `json:"url"`
+	Host string `json:"host"`
+	Steps []traceStep `json:"steps"`
+	Status int `json:"status"`
+	Headers http.Header `json:"headers"`
+}
+
+// serveTrace answers /_debug/trace?path=/some/url by running a request for
+// that URL through the server, without sending the response anywhere,
+// and returning the decisions made and the resulting status and headers
+// as JSON. method=, host=, client= (an IP address) and repeated
+// header=Name:Value parameters describe the rest of the request.
+func serveTrace(writer http.ResponseWriter, request *http.Request, opts *serverOptions) {
+	query := request.URL.Query()
+
+	target := query.Get("path")
+	if !strings.HasPrefix(target, "/") {
+		http.Error(writer, "path must be a URL path, like /docs/", 400)
+		return
+	}
+
+	method := strings.ToUpper(query.Get("method"))
+	if method == "" {
+		method = "GET"
+	}
+
+	host := query.Get("host")
+	if host == "" {
+		host = "localhost"
+		if len(opts.allowedHosts) > 0 {
+			host = strings.TrimPrefix(opts.allowedHosts[0], "*.")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+
+	trace := &requestTrace{dryRun: true}
+	traced, err := http.NewRequestWithContext(withRequestTrace(ctx, trace), method, target, nil)
+	if err != nil {
+		http.Error(writer, "Invalid path: " + err.Error(), 400)
+		return
+	}
+
+	for _, header := range query["header"] {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			http.Error(writer, "header must be Name:Value", 400)
+			return
+		}
+
+		traced.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	traced.Host = host
+	traced.RequestURI = target
+	traced.RemoteAddr = request.RemoteAddr
+	if client := query.Get("client"); client != "" {
+		traced.RemoteAddr = net.JoinHostPort(client, "0")
+	}
+
+	recorder := &traceRecorder{header: http.Header{}, cancel: cancel}
+
+	if urlWithinLimits(recorder, traced, opts) && admitRequest(recorder, traced, opts) {
+		requestHandler(recorder, traced, opts)
+	}
+
+	// a handler that wrote nothing sends an empty 200.
+	if recorder.status == 0 {
+		recorder.status = 200
+	}
+
+	result := traceResult{
+		Method: method,
+		URL: target,
+		Host: host,
+		Steps: trace.steps,
+		Status: recorder.status,
+		Headers: recorder.header,
+	}
+
+	if result.Steps == nil {
+		result.Steps = []traceStep{}
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+}
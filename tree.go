@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the suffix of URLs asking for a plain-text list of a directory's
+// subtree, such as /releases/..tree.
+const treeSuffix = "/..tree"
+
+// the most entries a tree view shows, whatever its depth.
+const maxTreeEntries = 100000
+
+var errTreeFull = errors.New("tree is full")
+
+// treeNode is an entry in a tree view.
+type treeNode struct {
+	Name string
+	URL string
+	Size int64
+	ModTime time.Time
+	IsDir bool
+	Children []*treeNode
+}
+
+type treeTemplateInfo struct {
+	Path string
+	BaseHref string
+	Theme string
+	Nodes []*treeNode
+	Truncated bool
+	Limit int
+}
+
+type jsonTree struct {
+	Path string `json:"path"`
+	Truncated bool `json:"truncated"`
+	Entries []jsonListingEntry `json:"entries"`
+}
+
+var treeTemplate = template.Must(template.New("tree").Funcs(listTemplateFuncs).Parse(`
+<!DOCTYPE html>
+<html{{ if ne .Theme "auto" }} data-theme="{{ .Theme }}"{{ end }}>
+<head>
+  <title>Tree of {{ .Path }}</title>
+  {{ if .BaseHref }}<base href="{{ .BaseHref }}">{{ end }}
+  <meta name="viewport" content="width=device-width, initial-scale=1.0">
+  <meta name="color-scheme" content="{{ if eq .Theme "auto" }}light dark{{ else }}{{ .Theme }}{{ end }}">
+  <style>
+    .main {
+      max-width: 992px;
+      margin: 0 auto;
+    }
+    ul {
+      list-style: none;
+      padding-left: 1.5em;
+    }
+    a {
+      text-decoration: none;
+    }
+    a:hover {
+      text-decoration: underline;
+    }
+    .size {
+      opacity: 0.6;
+      margin-left: 1em;
+    }
+  </style>
+</head>
+<body>
+  <div class="main">
+    <h2>Tree of {{ .Path }}</h2>
+    {{ template "nodes" .Nodes }}
+    {{ if .Truncated }}<p>Only the first {{ .Limit }} entries are shown.</p>{{ end }}
+  </div>
+</body>
+</html>
+{{ define "nodes" }}<ul>
+{{ range . }}<li>{{ if .IsDir }}<details open><summary><a href="{{ .URL }}">{{ .Name }}/</a></summary>{{ if .Children }}{{ template "nodes" .Children }}{{ end }}</details>{{ else }}<a href="{{ .URL }}">{{ .Name }}</a><span class="size">{{ formatBytes .Size }}</span>{{ end }}</li>
+{{ end }}</ul>{{ end }}`))
+
+// showTree answers ?recursive=1 with the subtree of the directory at
+// path, down to -tree-depth levels or the ?depth= given, as a collapsible
+// tree or JSON, or, when asText is set, as a plain list of relative paths.
+// Like archives, it leaves out hidden files, unlisted directories, what
+// the client couldn't request by itself and symlinks to directories.
+func showTree(
+	writer http.ResponseWriter,
+	request *http.Request,
+	path string,
+	baseHref string,
+	asText bool,
+	opts *serverOptions,
+) {
+	depth := opts.treeDepth
+	if n, err := strconv.Atoi(request.URL.Query().Get("depth")); err == nil && n > 0 {
+		depth = min(n, depth)
+	}
+
+	dirPath := "/" + strings.TrimPrefix(filepath.ToSlash(path) + "/", "./")
+	root := &treeNode{IsDir: true}
+	nodes := map[string]*treeNode{"": root}
+	var entries []jsonListingEntry
+
+	dir := archiveDir{
+		ctx: request.Context(),
+		path: path,
+		urlPath: request.URL.Path,
+		opts: opts,
+		access: newArchiveAccess(request, opts),
+	}
+
+	err := walkArchive(dir, "", func(_ string, name string, info os.FileInfo) error {
+		if len(entries) >= maxTreeEntries {
+			return errTreeFull
+		}
+
+		name = strings.TrimPrefix(name, "/")
+		parentName, baseName := "", name
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			parentName, baseName = name[:i], name[i + 1:]
+		}
+
+		escaped := (&url.URL{Path: name}).EscapedPath()
+		node := &treeNode{
+			Name: baseName,
+			URL: "./" + escaped,
+			Size: listingSize(info),
+			ModTime: info.ModTime(),
+			IsDir: info.IsDir(),
+		}
+
+		entry := jsonListingEntry{
+			Name: name,
+			Type: "file",
+			Size: node.Size,
+			ModTime: info.ModTime().UTC().Truncate(time.Second),
+		}
+
+		if info.IsDir() {
+			node.URL += "/"
+			entry.Type = "directory"
+			nodes[name] = node
+		}
+
+		parent := nodes[parentName]
+		parent.Children = append(parent.Children, node)
+		entries = append(entries, entry)
+
+		if info.IsDir() && strings.Count(name, "/") + 1 >= depth {
+			return fs.SkipDir
+		}
+
+		return nil
+	})
+
+	truncated := err == errTreeFull
+	if err != nil && !truncated {
+		fileError(writer, request, err)
+		return
+	}
+
+	if asText {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		var b strings.Builder
+		for _, entry := range entries {
+			b.WriteString(entry.Name)
+			if entry.Type == "directory" {
+				b.WriteString("/")
+			}
+
+			b.WriteString("\n")
+		}
+
+		fmt.Fprint(writer, b.String())
+		return
+	}
+
+	addVary(writer.Header(), "Accept")
+
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(jsonTree{
+			Path: dirPath,
+			Truncated: truncated,
+			Entries: append([]jsonListingEntry{}, entries...),
+		})
+
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if opts.strictPrivacy {
+		writer.Header().Set("Content-Security-Policy", strictContentSecurityPolicy)
+	}
+
+	opts.securityHeaders.applyHTML(writer.Header())
+
+	info := treeTemplateInfo{
+		Path: dirPath,
+		BaseHref: baseHref,
+		Theme: opts.listTheme,
+		Nodes: root.Children,
+		Truncated: truncated,
+		Limit: maxTreeEntries,
+	}
+
+	if err := treeTemplate.Execute(writer, info); err != nil {
+		errorLog.print(request, "unable to render tree of %s: %v", path, err)
+	}
+}
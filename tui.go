@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// the status screen is laid out for a standard 80x24 terminal.
+const (
+	statusScreenWidth = 80
+	statusScreenTopPaths = 5
+	statusScreenRecent = 10
+)
+
+// runStatusScreen redraws a live status screen on stdout every second,
+// using the terminal's alternate screen so that the previous contents are
+// restored on exit.
+func runStatusScreen(stats *requestStats, serving string) {
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		drawStatusScreen(stats, serving)
+
+		select {
+		case <-ticker.C:
+		case <-signals:
+			os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+			os.Exit(0)
+		}
+	}
+}
+
+func drawStatusScreen(stats *requestStats, serving string) {
+	snap := stats.snapshot(statusScreenTopPaths)
+	var buf bytes.Buffer
+
+	buf.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&buf, "gohttpd serving %s, up %v\r\n\r\n", serving, snap.uptime)
+
+	fmt.Fprintf(
+		&buf,
+		"requests   %10d total  %8.1f/s now  %8.1f/s 1m avg\r\n",
+		snap.requests,
+		snap.lastRequestRate,
+		snap.avgRequestRate,
+	)
+
+	fmt.Fprintf(
+		&buf,
+		"bandwidth  %10s total  %8s/s now  %8s/s 1m avg\r\n",
+		formatBytes(snap.bytes),
+		formatBytes(int64(snap.lastByteRate)),
+		formatBytes(int64(snap.avgByteRate)),
+	)
+
+	fmt.Fprintf(
+		&buf,
+		"status     2xx %d  3xx %d  4xx %d  5xx %d  errors %d  aborted %d\r\n\r\n",
+		snap.statusClasses[2],
+		snap.statusClasses[3],
+		snap.statusClasses[4],
+		snap.statusClasses[5],
+		snap.statusClasses[4] + snap.statusClasses[5],
+		snap.aborted,
+	)
+
+	buf.WriteString("top paths\r\n")
+	for _, entry := range snap.topPaths {
+		fmt.Fprintf(&buf, "  %8d  %s\r\n", entry.count, truncateText(entry.key, statusScreenWidth - 12))
+	}
+
+	buf.WriteString("\r\nrecent requests\r\n")
+
+	recent := snap.recent
+	if len(recent) > statusScreenRecent {
+		recent = recent[len(recent) - statusScreenRecent:]
+	}
+
+	// newest first
+	for i := len(recent) - 1; i >= 0; i-- {
+		r := recent[i]
+		line := fmt.Sprintf(
+			"  %s %-15s %-4s %3d %9s ",
+			r.time.Format("15:04:05"),
+			truncateText(r.client, 15),
+			truncateText(r.method, 4),
+			r.status,
+			formatBytes(r.bytes),
+		)
+
+		buf.WriteString(line)
+		buf.WriteString(truncateText(r.path, statusScreenWidth - len(line)))
+		buf.WriteString("\r\n")
+	}
+
+	os.Stdout.Write(buf.Bytes())
+}
+
+// truncateText shortens s to at most width runes, marking the cut.
+func truncateText(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+
+	if width < 1 {
+		return ""
+	}
+
+	return string(runes[:width - 1]) + "…"
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// userAgentFilter refuses requests from clients whose User-Agent matches
+// one of patterns, which are case-insensitive regular expressions, so
+// that known bad bots and scrapers can be kept out without a WAF in front
+// of the server. Requests without a User-Agent are refused if denyEmpty
+// is set, as browsers always send one.
+type userAgentFilter struct {
+	patterns []*regexp.Regexp
+	denyEmpty bool
+}
+
+func newUserAgentFilter(patterns []string, denyEmpty bool) (*userAgentFilter, error) {
+	f := &userAgentFilter{denyEmpty: denyEmpty}
+
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		f.patterns = append(f.patterns, re)
+	}
+
+	return f, nil
+}
+
+// check lets request through unless its User-Agent is denied, and
+// otherwise answers it with a 403.
+func (f *userAgentFilter) check(writer http.ResponseWriter, request *http.Request) bool {
+	trace := requestTraceFrom(request.Context())
+	userAgent := request.UserAgent()
+
+	if userAgent == "" {
+		if !f.denyEmpty {
+			return true
+		}
+
+		trace.note("user agent", "no User-Agent, 403")
+		http.Error(writer, "Forbidden", 403)
+		return false
+	}
+
+	for _, re := range f.patterns {
+		if re.MatchString(userAgent) {
+			trace.note("user agent", "matches %s, 403", re.String()[len("(?i)"):])
+			http.Error(writer, "Forbidden", 403)
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the file in a user directory with that user's own listing settings.
+const userDirSettings = ".gohttpd.toml"
+
+// userDirs serves /~name/ URLs from per-user public directories, as
+// Apache's UserDir does. The pattern is either a directory inside each
+// user's home, like "public_html", an absolute path in which "*" stands
+// for the user name, like "/srv/www/*/htdocs", or an absolute directory
+// holding one directory per user.
+type userDirs struct {
+	pattern string
+
+	// for absolute patterns, the directory above the user directories,
+	// opened up front so that they can be reached when sandboxed, and
+	// the rest of the pattern relative to it.
+	base *os.Root
+	rest string
+
+	// daily transfer quota in bytes of every user, 0 for none, and
+	// quotas of particular users.
+	quota int64
+	quotas map[string]int64
+
+	mu sync.Mutex
+	roots map[string]*os.Root
+	day string
+	used map[string]int64
+}
+
+func newUserDirs(pattern string, quotaMB int, quotas []string) (*userDirs, error) {
+	u := &userDirs{
+		pattern: pattern,
+		quota: int64(quotaMB) << 20,
+		quotas: map[string]int64{},
+		roots: map[string]*os.Root{},
+		used: map[string]int64{},
+	}
+
+	for _, quota := range quotas {
+		name, value, ok := strings.Cut(quota, "=")
+		mb, err := strconv.Atoi(value)
+		if !ok || name == "" || err != nil || mb < 0 {
+			return nil, fmt.Errorf("expected name=MiB, got %q", quota)
+		}
+
+		u.quotas[name] = int64(mb) << 20
+	}
+
+	if !filepath.IsAbs(pattern) {
+		if strings.Contains(pattern, "*") {
+			return nil, errors.New("a pattern with * must be an absolute path")
+		}
+
+		return u, nil
+	}
+
+	// the base is the part of the pattern before the user name.
+	pattern = filepath.Clean(pattern)
+	baseDir, rest := pattern, "*"
+	if i := strings.Index(pattern, "*"); i >= 0 {
+		baseDir = filepath.Dir(pattern[:i + 1])
+		rest, _ = filepath.Rel(baseDir, pattern)
+	}
+
+	base, err := os.OpenRoot(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	u.base, u.rest = base, rest
+	return u, nil
+}
+
+// baseDir returns the directory holding the user directories, or "" when
+// they are in the users' homes.
+func (u *userDirs) baseDir() string {
+	if u.base == nil {
+		return ""
+	}
+
+	return u.base.Name()
+}
+
+// userDirName returns the user name of a URL path in a user directory,
+// "/~name/...", or "".
+func userDirName(urlPath string) string {
+	name, _, _ := strings.Cut(strings.TrimPrefix(path.Clean(urlPath), "/"), "/")
+	if !strings.HasPrefix(name, "~") {
+		return ""
+	}
+
+	return name[1:]
+}
+
+// root returns the opened directory of the named user.
+func (u *userDirs) root(name string) (*os.Root, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\*") {
+		return nil, os.ErrNotExist
+	}
+
+	u.mu.Lock()
+	root, ok := u.roots[name]
+	u.mu.Unlock()
+
+	if ok {
+		return root, nil
+	}
+
+	var err error
+
+	if u.base != nil {
+		root, err = u.base.OpenRoot(strings.ReplaceAll(u.rest, "*", name))
+	} else {
+		var account *user.User
+		account, err = user.Lookup(name)
+		if err == nil {
+			root, err = os.OpenRoot(filepath.Join(account.HomeDir, u.pattern))
+		}
+	}
+
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// another request may have opened it meanwhile.
+	if existing, ok := u.roots[name]; ok {
+		root.Close()
+		return existing, nil
+	}
+
+	u.roots[name] = root
+	return root, nil
+}
+
+// options returns the server options for a request in the named user's
+// directory, with the listing settings from the user's settings file.
+func (u *userDirs) options(name string, opts *serverOptions) (*serverOptions, error) {
+	root, err := u.root(name)
+	if err != nil {
+		return opts, nil
+	}
+
+	file, err := root.Open(userDirSettings)
+	if os.IsNotExist(err) {
+		return opts, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	settingsPath := "~" + name + "/" + userDirSettings
+	entries, err := readConfig(io.LimitReader(file, 64 << 10), settingsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	userOpts := *opts
+
+	flags := flag.NewFlagSet("userdir", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.BoolVar(&userOpts.listDir, "listdir", opts.listDir, "")
+	flags.BoolVar(&userOpts.humanSizes, "human-sizes", opts.humanSizes, "")
+	flags.BoolVar(&userOpts.noIcons, "no-icons", opts.noIcons, "")
+	flags.IntVar(&userOpts.listPageSize, "list-page-size", opts.listPageSize, "")
+	flags.StringVar(&userOpts.listTheme, "list-theme", opts.listTheme, "")
+
+	if err := applyConfig(entries, settingsPath, flags); err != nil {
+		return nil, err
+	}
+
+	if !stringInSlice(userOpts.listTheme, listThemes) {
+		return nil, fmt.Errorf("%s: invalid listing theme %q", settingsPath, userOpts.listTheme)
+	}
+
+	userOpts.listPageSize = max(userOpts.listPageSize, 0)
+	return &userOpts, nil
+}
+
+// overQuota reports whether the named user has used up today's transfer
+// quota, and if so, how long it is until it is renewed.
+func (u *userDirs) overQuota(name string) (bool, time.Duration) {
+	quota, ok := u.quotas[name]
+	if !ok {
+		quota = u.quota
+	}
+
+	if quota == 0 {
+		return false, 0
+	}
+
+	now := time.Now()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.resetDay(now)
+	if u.used[name] < quota {
+		return false, 0
+	}
+
+	year, month, day := now.Date()
+	return true, time.Date(year, month, day + 1, 0, 0, 0, 0, now.Location()).Sub(now)
+}
+
+// account adds bytes sent from the named user's directory to today's
+// transfer.
+func (u *userDirs) account(name string, bytes int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.resetDay(time.Now())
+	u.used[name] += bytes
+}
+
+func (u *userDirs) resetDay(now time.Time) {
+	if day := now.Format("2006-01-02"); day != u.day {
+		u.day = day
+		u.used = map[string]int64{}
+	}
+}